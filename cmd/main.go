@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -13,11 +14,17 @@ import (
 	"github.com/packetcap/go-pcap"
 )
 
+const (
+	// envFilter the filter to use when none is passed as arguments
+	envFilter = "PCAP_FILTER"
+	// envInterface the interface to use when none is passed with --interface
+	envInterface = "PCAP_INTERFACE"
+)
+
 var (
 	useGopacket bool
 	useSyscalls bool
 	debug       bool
-	iface       string
 	timeout     int
 )
 
@@ -28,17 +35,16 @@ func main() {
 var rootCmd = &cobra.Command{
 	Use:   "pcap",
 	Short: "Capture packets for all interfaces (default) or a given interface, when passed as first argument",
-	Long:  `Capture packets for all interfaces (default) or a given interface, when passed as first argument`,
+	Long: `Capture packets for all interfaces (default) or a given interface, when passed as first argument.
+The filter is the remaining arguments or, if there are none, $` + envFilter + `; the interface is --interface or,
+if it is not given, $` + envInterface + `.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			err    error
 			handle *pcap.Handle
 			count  int
-			filter string
 		)
-		if len(args) >= 1 {
-			filter = strings.Join(args, " ")
-		}
+		iface, filter := captureSettings(cmd, args)
 		if debug {
 			log.SetLevel(log.DebugLevel)
 		}
@@ -75,10 +81,24 @@ func init() {
 	rootCmd.Flags().BoolVar(&useGopacket, "gopacket", false, "use gopacket interface instead of simple pcap.Listen")
 	rootCmd.Flags().BoolVar(&useSyscalls, "syscalls", pcap.DefaultSyscalls, "use syscalls instead of mmap when mmap is available; the default varies by platform")
 	rootCmd.Flags().BoolVar(&debug, "debug", false, "print lots of debugging messages")
-	rootCmd.Flags().StringVarP(&iface, "interface", "i", "", "interface from which to capture, default to all")
+	rootCmd.Flags().StringP("interface", "i", "", "interface from which to capture, default to $"+envInterface+" or, if not set, all")
 	rootCmd.Flags().IntVar(&timeout, "timeout", 0, "close the listener after given number of seconds, 0 to never close")
 }
 
+// captureSettings the interface and filter to capture with: those on the command line, which take
+// precedence, else those in the environment
+func captureSettings(cmd *cobra.Command, args []string) (iface, filter string) {
+	iface, _ = cmd.Flags().GetString("interface")
+	if env, ok := os.LookupEnv(envInterface); ok && !cmd.Flags().Changed("interface") {
+		iface = env
+	}
+	filter = strings.Join(args, " ")
+	if len(args) == 0 {
+		filter = os.Getenv(envFilter)
+	}
+	return iface, filter
+}
+
 func processPacket(packet gopacket.Packet, count int) {
 	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 		fmt.Printf("%d: IP packet ", count)
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCaptureSettings(t *testing.T) {
+	t.Setenv(envInterface, "eth7")
+	t.Setenv(envFilter, "udp port 53")
+
+	// nothing on the command line, so the environment is used
+	if err := rootCmd.ParseFlags(nil); err != nil {
+		t.Fatalf("unexpected error parsing flags: %v", err)
+	}
+	iface, filter := captureSettings(rootCmd, nil)
+	if iface != "eth7" {
+		t.Errorf("mismatched interface, actual %q, expected %q", iface, "eth7")
+	}
+	if filter != "udp port 53" {
+		t.Errorf("mismatched filter, actual %q, expected %q", filter, "udp port 53")
+	}
+
+	// the command line takes precedence
+	if err := rootCmd.ParseFlags([]string{"--interface", "eth8"}); err != nil {
+		t.Fatalf("unexpected error parsing flags: %v", err)
+	}
+	iface, filter = captureSettings(rootCmd, []string{"tcp", "port", "80"})
+	if iface != "eth8" {
+		t.Errorf("mismatched interface, actual %q, expected %q", iface, "eth8")
+	}
+	if filter != "tcp port 80" {
+		t.Errorf("mismatched filter, actual %q, expected %q", filter, "tcp port 80")
+	}
+}
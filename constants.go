@@ -2,5 +2,9 @@ package pcap
 
 // constants, see compliant with pcap-linktype(7) and http://www.tcpdump.org/linktypes.html.
 const (
-	LinkTypeEthernet uint8 = 0x01
+	LinkTypeNull      uint32 = 0x00
+	LinkTypeEthernet  uint32 = 0x01
+	LinkTypeRaw       uint32 = 0x65
+	LinkTypeLinuxSLL  uint32 = 0x71
+	LinkTypeLinuxSLL2 uint32 = 0x114
 )
@@ -0,0 +1,42 @@
+package pcap
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// WithDeduplication drop any packet that is identical to the immediately preceding
+// packet, if it was captured within window of it. This is useful when the same packet
+// is seen twice, e.g. when capturing on a bridge or a span port.
+func WithDeduplication(window time.Duration) Option {
+	return func(h *Handle) {
+		if window <= 0 {
+			h.dedup = nil
+			return
+		}
+		h.dedup = &deduplicator{window: window}
+	}
+}
+
+// deduplicator tracks the last packet seen, so that exact duplicates can be dropped
+type deduplicator struct {
+	window   time.Duration
+	lastHash uint64
+	lastLen  int
+	lastSeen time.Time
+}
+
+// duplicate whether the packet is a duplicate of the previous one within the window.
+// If ts is zero, the current time is used.
+func (d *deduplicator) duplicate(data []byte, ts time.Time) bool {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	sum := h.Sum64()
+
+	dup := sum == d.lastHash && len(data) == d.lastLen && !d.lastSeen.IsZero() && ts.Sub(d.lastSeen) <= d.window
+	d.lastHash, d.lastLen, d.lastSeen = sum, len(data), ts
+	return dup
+}
@@ -0,0 +1,30 @@
+package pcap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	base := time.Unix(1000, 0)
+	a, b := []byte("packet a"), []byte("packet b")
+	tests := []struct {
+		data     []byte
+		ts       time.Time
+		expected bool
+	}{
+		{a, base, false},
+		{a, base.Add(time.Millisecond), true},
+		{a, base.Add(2 * time.Millisecond), true},
+		{b, base.Add(3 * time.Millisecond), false},
+		{a, base.Add(4 * time.Millisecond), false},
+		// outside of the window
+		{a, base.Add(time.Second), false},
+	}
+	d := deduplicator{window: 10 * time.Millisecond}
+	for i, tt := range tests {
+		if dup := d.duplicate(tt.data, tt.ts); dup != tt.expected {
+			t.Errorf("%d: mismatched duplicate, actual %v, expected %v", i, dup, tt.expected)
+		}
+	}
+}
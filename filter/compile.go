@@ -3,16 +3,15 @@ package filter
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/bpf"
 )
 
-// Compile take a filter string compatible with tcpdump at
-// https://www.tcpdump.org/manpages/pcap-filter.7.html and return
-// bpf instructions
-
 var (
 	ip4MaskFull                  = net.CIDRMask(32, 32)   //[]byte{0xff, 0xff, 0xff, 0xff}
 	ip6MaskFull                  = net.CIDRMask(128, 128) //[]byte{0xff, 0xff, 0xff, 0xff,0xff, 0xff, 0xff, 0xff,0xff, 0xff, 0xff, 0xff,0xff, 0xff, 0xff, 0xff}
@@ -22,13 +21,22 @@ var (
 	loadIPv4DestinationPort      = bpf.LoadIndirect{Off: ip4DestinationPort, Size: lengthHalf}
 	loadIPv6SourcePort           = bpf.LoadAbsolute{Off: ip6SourcePort, Size: lengthHalf}
 	loadIPv6DestinationPort      = bpf.LoadAbsolute{Off: ip6DestinationPort, Size: lengthHalf}
-	loadEtherKind                = bpf.LoadAbsolute{Off: 12, Size: lengthHalf}
+	loadEtherKind                = bpf.LoadAbsolute{Off: ethernetTypeOffset, Size: lengthHalf}
+	loadIPv4GreProtocolType      = bpf.LoadIndirect{Off: ip4GreProtocolType, Size: lengthHalf}
+	loadVlanTCI                  = bpf.LoadAbsolute{Off: 14, Size: lengthHalf}
 	loadIPv4SourceAddress        = bpf.LoadAbsolute{Off: 26, Size: lengthWord}
 	loadIPv4DestinationAddress   = bpf.LoadAbsolute{Off: 30, Size: lengthWord}
 	loadArpSenderAddress         = bpf.LoadAbsolute{Off: 28, Size: lengthWord}
 	loadArpTargetAddress         = bpf.LoadAbsolute{Off: 38, Size: lengthWord}
 	loadIPv4Protocol             = bpf.LoadAbsolute{Off: 23, Size: lengthByte}
 	loadIPv6Protocol             = bpf.LoadAbsolute{Off: 20, Size: lengthByte}
+	loadIPv4Flags                = bpf.LoadAbsolute{Off: ip4HeaderFlags, Size: lengthByte}
+	loadIPv4FlagsAndOffset       = bpf.LoadAbsolute{Off: ip4HeaderFlags, Size: lengthHalf}
+	loadIPv4VersionIHL           = bpf.LoadAbsolute{Off: ethernetHeaderSize, Size: lengthByte}
+	loadLlcDsap                  = bpf.LoadAbsolute{Off: ethernetHeaderSize, Size: lengthByte}
+	loadIPv4TypeOfService        = bpf.LoadAbsolute{Off: ip4TypeOfService, Size: lengthByte}
+	loadIPv6VersionClass         = bpf.LoadAbsolute{Off: ip6VersionClass, Size: lengthHalf}
+	loadIPv6PayloadLength        = bpf.LoadAbsolute{Off: ip6PayloadLength, Size: lengthHalf}
 	loadIPv6ContinuationProtocol = bpf.LoadAbsolute{Off: 54, Size: lengthByte}
 	loadEthernetSourceFirst      = bpf.LoadAbsolute{Off: 6, Size: lengthHalf}
 	loadEthernetSourceLast       = bpf.LoadAbsolute{Off: 8, Size: lengthWord}
@@ -36,6 +44,61 @@ var (
 	loadEthernetDestinationLast  = bpf.LoadAbsolute{Off: 2, Size: lengthWord}
 )
 
+// Compile take a filter string compatible with tcpdump at
+// https://www.tcpdump.org/manpages/pcap-filter.7.html and return
+// bpf instructions that match packets of linkType, e.g. LinkTypeEthernet, in one go, as a handle
+// does for SetBPFFilter, without needing one. An empty expression matches every packet. inbound and
+// outbound are not in the packet, so they cannot be compiled; use SplitPacketDirection for those.
+// Errors about a clause of the expression are a *CompileError.
+func Compile(expr string, linkType uint32) ([]bpf.Instruction, error) {
+	// check the link type first, rather than resolving any hostnames only to fail
+	if _, err := linkTypeOffset(linkType); err != nil {
+		return nil, err
+	}
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return []bpf.Instruction{returnKeep}, nil
+	}
+	f, direction, err := SplitPacketDirection(NewExpression(expr).Parse())
+	if err != nil {
+		return nil, err
+	}
+	if direction != PacketDirectionAny {
+		return nil, errors.New("inbound and outbound are not in the packet, so cannot be compiled")
+	}
+	inst, err := f.Compile()
+	if err != nil {
+		return nil, err
+	}
+	// the primitives compile for Ethernet, so move the offsets to the link type
+	return ForLinkType(inst, linkType)
+}
+
+// shiftOffsets move the loads of everything from offset from on by shift bytes, as when the packet
+// has that many bytes of vlan tags from the EtherType on, or of an ip-in-ip header from the ip header
+// on. The Ethernet addresses come before either, so stay.
+func shiftOffsets(inst []bpf.Instruction, from, shift uint32) []bpf.Instruction {
+	if shift == 0 {
+		return inst
+	}
+	for n, in := range inst {
+		switch i := in.(type) {
+		case bpf.LoadAbsolute:
+			if i.Off >= from {
+				i.Off += shift
+			}
+			inst[n] = i
+		case bpf.LoadIndirect:
+			i.Off += shift
+			inst[n] = i
+		case bpf.LoadMemShift:
+			i.Off += shift
+			inst[n] = i
+		}
+	}
+	return inst
+}
+
 func loadIPv4HeaderOffset(skipFail uint8) []bpf.Instruction {
 	return []bpf.Instruction{
 		bpf.LoadAbsolute{Off: ip4HeaderFlags, Size: lengthHalf},                  // flags+fragment offset, since we need to calc where the src/dst port is
@@ -44,6 +107,17 @@ func loadIPv4HeaderOffset(skipFail uint8) []bpf.Instruction {
 	}
 }
 
+// compareEther8023 an 802.3 frame, whose EtherType is its length instead
+func compareEther8023(skipTrue, skipFalse uint8) bpf.Instruction {
+	return bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: ether8023MaxLength, SkipFalse: skipFalse, SkipTrue: skipTrue}
+}
+
+// compareLlcDsap an 802.2 LLC header, loaded with loadLlcDsap, to the sap, by its DSAP, as tcpdump does.
+// It only is one if the frame is 802.3, so check that first.
+func compareLlcDsap(sap uint32, skipTrue, skipFalse uint8) bpf.Instruction {
+	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: sap, SkipFalse: skipFalse, SkipTrue: skipTrue}
+}
+
 func compareProtocolIP4(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv4, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
@@ -52,6 +126,15 @@ func compareProtocolIP6(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv6, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
 
+// maskDscp the steps to mask the dscp out of the value loaded, the ToS byte of ipv4 or the version and traffic
+// class of ipv6, and shift it down to compare
+func maskDscp(mask, shift uint32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: shift},
+	}
+}
+
 func compareProtocolArp(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeArp, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
@@ -60,6 +143,18 @@ func compareProtocolRarp(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeRarp, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
 
+// compareProtocolMpls add the 2 steps to check for either mpls EtherType, unicast or multicast
+func compareProtocolMpls(skipTrue, skipFalse uint8) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeMplsUnicast, SkipTrue: skipTrue + 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeMplsMulticast, SkipFalse: skipFalse - 1, SkipTrue: skipTrue},
+	}
+}
+
+func compareProtocolVlan(skipTrue, skipFalse uint8) bpf.Instruction {
+	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeVlan, SkipFalse: skipFalse, SkipTrue: skipTrue}
+}
+
 func compareSubProtocolTCP(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolTCP, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
@@ -72,6 +167,17 @@ func compareSubProtocolSctp(skipTrue, skipFalse uint8) bpf.Instruction {
 	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolSctp, SkipFalse: skipFalse, SkipTrue: skipTrue}
 }
 
+func compareSubProtocolGre(skipTrue, skipFalse uint8) bpf.Instruction {
+	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolGre, SkipFalse: skipFalse, SkipTrue: skipTrue}
+}
+
+func compareSubProtocolHopByHop(skipTrue, skipFalse uint8) bpf.Instruction {
+	return bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolHopByHop, SkipFalse: skipFalse, SkipTrue: skipTrue}
+}
+
+// compareIPv6Protocol add the 5 steps to check the ip protocol of an IPv6 packet. Like tcpdump, it looks past
+// at most one extension header, and only a fragment header, e.g. so that fragments of tcp still match "tcp";
+// a protocol after a hop-by-hop options header, or after more than one extension header, does not match.
 func compareIPv6Protocol(proto uint32, skipTrue, skipFalse uint8) []bpf.Instruction {
 	st, sf := skipTrue, skipFalse
 	if st == 0 {
@@ -89,6 +195,56 @@ func compareIPv6Protocol(proto uint32, skipTrue, skipFalse uint8) []bpf.Instruct
 	}
 }
 
+// checkIPv6Protochain add the steps to check whether the ip protocol of an IPv6 packet is proto, after at
+// most depth extension headers, for "protochain". There are no loops in bpf, so the walk is unrolled: each
+// step compares the next header, and, if it is an extension header, adds its length to X and loads the next
+// header from it. skipTrue and skipFalse count from the first step, as for compareIPv6Protocol, with 0
+// the step after the last one.
+func checkIPv6Protochain(proto uint32, depth int, skipTrue, skipFalse uint8) []bpf.Instruction {
+	size := 3 + 19*depth
+	st, sf := int(skipTrue), int(skipFalse)
+	if st == 0 {
+		st = size - 1
+	}
+	if sf == 0 {
+		sf = size - 1
+	}
+	inst := []bpf.Instruction{
+		loadIPv6Protocol,
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 0}, // the offset of the next extension header
+	}
+	for i := 0; i < depth; i++ {
+		n := len(inst)
+		inst = append(inst,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: proto, SkipTrue: uint8(st - n)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ip6ContinuationPacket, SkipTrue: 12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolAh, SkipTrue: 7},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolHopByHop, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolIP6Routing, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: ipProtocolIP6DestOpts, SkipFalse: uint8(sf - n - 5)},
+			// options and routing headers are 8 bytes longer than their length in 8 byte units
+			bpf.LoadIndirect{Off: ip6ExtensionHeader + 1, Size: lengthByte},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.Jump{Skip: 5},
+			// authentication headers are 8 bytes longer than their length in 4 byte units
+			bpf.LoadIndirect{Off: ip6ExtensionHeader + 1, Size: lengthByte},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.Jump{Skip: 1},
+			// fragment headers always are 8 bytes
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 8},
+			// move X past the header, after loading the next header from it
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: ip6ExtensionHeader, Size: lengthByte},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+		)
+	}
+	n := len(inst)
+	return append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: proto, SkipTrue: uint8(st - n), SkipFalse: uint8(sf - n)})
+}
+
 func compareIPv4Protocol(proto uint32, skipTrue, skipFalse uint8) []bpf.Instruction {
 	st, sf := skipTrue, skipFalse
 	if st == 0 {
@@ -272,9 +428,29 @@ func checkIP6Addresses(direction filterDirection, addr []byte, mask net.IPMask,
 	return inst
 }
 
+// portRange the ports from low to high, inclusive, which is a single port if they are the same
+type portRange struct {
+	low, high uint32
+}
+
+// portCompareSteps how many steps it takes to compare a loaded port to the ports
+func portCompareSteps(ports []portRange) uint8 {
+	var count uint8
+	for _, r := range ports {
+		// a single port needs one comparison, a range needs two
+		count++
+		if r.low != r.high {
+			count++
+		}
+	}
+	return count
+}
+
+// checkPorts add steps to check that the src and/or dst port is in any of the ports. As with tcpdump, each
+// port is loaded once and compared to all of them, e.g. for "port 53 or port 67".
 // fail and succeed are the number of steps to skip the succeed or fail instructions.
 // For example, if the next one is succeed, then succeed will be 0
-func checkPorts(direction filterDirection, port uint32, fail, succeed uint8, ip6 bool) []bpf.Instruction {
+func checkPorts(direction filterDirection, ports []portRange, fail, succeed uint8, ip6 bool) []bpf.Instruction {
 	inst := make([]bpf.Instruction, 0)
 
 	var (
@@ -296,29 +472,88 @@ func checkPorts(direction filterDirection, port uint32, fail, succeed uint8, ip6
 		succeed -= diff
 	}
 
+	// the steps after loading the source port, to where the destination port is loaded
+	compare := portCompareSteps(ports)
 	switch direction {
 	case filterDirectionSrc:
 		inst = append(inst, loadSource)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: succeed - 1, SkipFalse: fail - 1})
+		inst = append(inst, comparePorts(ports, 1, succeed, fail)...)
 	case filterDirectionDst:
 		inst = append(inst, loadDestination)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: succeed - 1, SkipFalse: fail - 1})
+		inst = append(inst, comparePorts(ports, 1, succeed, fail)...)
 	case filterDirectionSrcOrDst:
 		inst = append(inst, loadSource)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: succeed - 1})
+		inst = append(inst, comparePorts(ports, 1, succeed, compare)...)
 		inst = append(inst, loadDestination)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: succeed - 3, SkipFalse: fail - 3})
+		inst = append(inst, comparePorts(ports, compare+2, succeed, fail)...)
 	case filterDirectionSrcAndDst:
+		// as with tcpdump, a source port that does not match fails, rather than going on to the destination port
 		inst = append(inst, loadSource)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipFalse: fail - 1})
+		inst = append(inst, comparePorts(ports, 1, compare, fail)...)
 		inst = append(inst, loadDestination)
-		inst = append(inst, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: succeed - 3, SkipFalse: fail - 3})
+		inst = append(inst, comparePorts(ports, compare+2, succeed, fail)...)
+	}
+	return inst
+}
+
+// comparePorts add steps to compare the loaded port to each of the ports, which go to match if it is any
+// of them, else to miss. The steps start at step start, counting from the load of the first port, as do
+// match and miss, which are the number of steps to skip from it, as are fail and succeed of checkPorts.
+func comparePorts(ports []portRange, start, match, miss uint8) []bpf.Instruction {
+	inst := make([]bpf.Instruction, 0)
+	for i, r := range ports {
+		last := i == len(ports)-1
+		step := start + uint8(len(inst))
+		if r.low == r.high {
+			// a match of any one is a match, and a miss of the last is a miss
+			jump := bpf.JumpIf{Cond: bpf.JumpEqual, Val: r.low, SkipTrue: match - step}
+			if last {
+				jump.SkipFalse = miss - step
+			}
+			inst = append(inst, jump)
+			continue
+		}
+		// below the range skips its upper check, so both below and above it go on to the next
+		lower := bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: r.low, SkipFalse: 1}
+		upper := bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: r.high, SkipFalse: match - step - 1}
+		if last {
+			lower.SkipFalse = miss - step
+			upper.SkipTrue = miss - step - 1
+		}
+		inst = append(inst, lower, upper)
 	}
 	return inst
 }
 
+// stripZone remove the zone from a scoped IPv6 address, e.g. fe80::1%eth0, since packets do not carry
+// it; anything else is returned as is
+func stripZone(id string) string {
+	addr, zone, ok := strings.Cut(id, "%")
+	if !ok || zone == "" {
+		return id
+	}
+	if ip := net.ParseIP(addr); ip == nil || ip.To4() != nil {
+		return id
+	}
+	return addr
+}
+
+// getEtherType the ethertype of the id of "ether proto", by name in etherProtocols or by number,
+// e.g. "lldp" or "0x88cc"
+func getEtherType(id string) (uint32, error) {
+	if etherType, ok := etherProtocols[id]; ok {
+		return etherType, nil
+	}
+	etherType, err := strconv.ParseUint(id, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %s", id)
+	}
+	return uint32(etherType), nil
+}
+
 // getNetAndMask get the address and the network with mask for an IP address.
 // If it is *not* CIDR, will return full mask, i.e. 0xffffffff
+// Anything that is neither, such as a hostname, is an error, as a name is of a host, not of a network.
 func getNetAndMask(id string) (net.IP, *net.IPNet, error) {
 	var (
 		addr    net.IP
@@ -339,7 +574,7 @@ func getNetAndMask(id string) (net.IP, *net.IPNet, error) {
 	}
 	addr, network, err := net.ParseCIDR(id)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid net: %s", id)
+		return nil, nil, fmt.Errorf("net requires an IP or CIDR, got %q", id)
 	}
 	return addr, network, nil
 }
@@ -353,6 +588,7 @@ func calculateIP6MaskSteps(mask net.IPMask) uint8 {
 	// if it does not split evenly, we need another word and a bitmask line
 	if partWords > 0 {
 		wholeWords++
+		count++
 	}
 	count += 2 * uint8(wholeWords)
 	return count
@@ -19,7 +19,7 @@ type testCaseExpressions struct {
 	filter       Filter
 	err          error
 	instructions []bpf.Instruction
-	_            string // output from "tcpdump -d <expression>"
+	tcpdump      string // output from "tcpdump -d <expression>", if any
 }
 
 var (
@@ -28,6 +28,16 @@ var (
 			"A":    "216.58.207.36",
 			"AAAA": "2a00:1450:4001:824::2004",
 		},
+		// more addresses than are checked by default
+		"many.example.com": {
+			"A":    manyAddresses("198.51.100.%d", 20),
+			"AAAA": manyAddresses("2001:db8:100::%x", 20),
+		},
+		// more than one address of each family
+		"multi.example.com": {
+			"A":    "192.0.2.1,192.0.2.2",
+			"AAAA": "2001:db8::1,2001:db8::2",
+		},
 	}
 )
 
@@ -88,7 +98,46 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			direction: filterDirectionSrcOrDst,
 			protocol:  filterProtocolUnset,
 			id:        "10.100.100.100/24",
-		}, fmt.Errorf("invalid host address with CIDR: %s", "10.100.100.100/24"), nil, ""},
+		}, nil, []bpf.Instruction{
+			// the same as net 10.100.100.0/24
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 26, Size: 4},                   // ip4 src address
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffffff00}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646400, SkipTrue: 11},
+			bpf.LoadAbsolute{Off: 30, Size: 4},                   // ip4 dst address
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffffff00}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646400, SkipTrue: 8, SkipFalse: 9},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0806, SkipTrue: 1},  // arp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 7}, // rarp
+			bpf.LoadAbsolute{Off: 28, Size: 4},                         // arp src address
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffffff00},       // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646400, SkipTrue: 3},
+			bpf.LoadAbsolute{Off: 38, Size: 4},                   // arp dst address
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffffff00}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646400, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 8
+		(002) ld       [26]
+		(003) and      #0xffffff00
+		(004) jeq      #0xa646400       jt 16	jf 5
+		(005) ld       [30]
+		(006) and      #0xffffff00
+		(007) jeq      #0xa646400       jt 16	jf 17
+		(008) jeq      #0x806           jt 10	jf 9
+		(009) jeq      #0x8035          jt 10	jf 17
+		(010) ld       [28]
+		(011) and      #0xffffff00
+		(012) jeq      #0xa646400       jt 16	jf 13
+		(013) ld       [38]
+		(014) and      #0xffffff00
+		(015) jeq      #0xa646400       jt 16	jf 17
+		(016) ret      #262144
+		(017) ret      #0
+		`},
 		{"ip host 10.100.100.100", primitive{
 			kind:      filterKindHost,
 			direction: filterDirectionSrcOrDst,
@@ -263,7 +312,75 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			direction: filterDirectionSrcOrDst,
 			protocol:  filterProtocolUnset,
 			id:        "2a00:1450:4001:824::2004/48",
-		}, fmt.Errorf("invalid host address with CIDR: %s", "2a00:1450:4001:824::2004/48"), nil, ""},
+		}, nil, []bpf.Instruction{
+			// the same as net 2a00:1450:4001::/48
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2a001450, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 26, Size: 4},                   // ip6 src address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40010000, SkipTrue: 5},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2a001450, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 42, Size: 4},                   // ip6 dst address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40010000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 13
+		(002) ld       [22]
+		(003) jeq      #0x2a001450      jt 4	jf 7
+		(004) ld       [26]
+		(005) and      #0xffff0000
+		(006) jeq      #0x40010000      jt 12	jf 7
+		(007) ld       [38]
+		(008) jeq      #0x2a001450      jt 9	jf 13
+		(009) ld       [42]
+		(010) and      #0xffff0000
+		(011) jeq      #0x40010000      jt 12	jf 13
+		(012) ret      #262144
+		(013) ret      #0
+		`},
+		{"ip6 host 2a00::/48", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "2a00::/48",
+		}, nil, []bpf.Instruction{
+			// the same as ip6 net 2a00::/48
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2a000000, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 26, Size: 4},                   // ip6 src address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipTrue: 5},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2a000000, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 42, Size: 4},                   // ip6 dst address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 13
+		(002) ld       [22]
+		(003) jeq      #0x2a000000      jt 4	jf 7
+		(004) ld       [26]
+		(005) and      #0xffff0000
+		(006) jeq      #0x0             jt 12	jf 7
+		(007) ld       [38]
+		(008) jeq      #0x2a000000      jt 9	jf 13
+		(009) ld       [42]
+		(010) and      #0xffff0000
+		(011) jeq      #0x0             jt 12	jf 13
+		(012) ret      #262144
+		(013) ret      #0
+		`},
 		{"ip6 host 2a00:1450:4001:824::2004", primitive{
 			kind:      filterKindHost,
 			direction: filterDirectionSrcOrDst,
@@ -761,6 +878,112 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(029) ret      #262144
 		(030) ret      #0
 		`},
+		// a hostname with more than one address of each family checks each of them in turn
+		{"host multi.example.com", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolUnset,
+			id:        "multi.example.com",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000201, SkipTrue: 49},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000201, SkipTrue: 47},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000202, SkipTrue: 45},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000202, SkipTrue: 43, SkipFalse: 44},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x806, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000201, SkipTrue: 39},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000201, SkipTrue: 37},
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000202, SkipTrue: 35},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0000202, SkipTrue: 33, SkipFalse: 34},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 33},
+			bpf.LoadAbsolute{Off: 22, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1, SkipTrue: 24},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 42, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 46, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 50, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1, SkipTrue: 16},
+			bpf.LoadAbsolute{Off: 22, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2, SkipTrue: 8},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 42, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 46, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 50, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip6 host multi.example.com", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "multi.example.com",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 33},
+			bpf.LoadAbsolute{Off: 22, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1, SkipTrue: 24},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 42, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 46, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 50, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1, SkipTrue: 16},
+			bpf.LoadAbsolute{Off: 22, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2, SkipTrue: 8},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 42, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 46, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 50, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
 	},
 	"port": {
 		{"port foo", primitive{
@@ -899,7 +1122,7 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(004) jeq      #0x6             jt 6	jf 5
 		(005) jeq      #0x11            jt 6	jf 19
 		(006) ldh      [54]
-		(007) jeq      #0x35            jt 18	jf 19
+		(007) jeq      #0x16            jt 18	jf 19
 		(008) jeq      #0x800           jt 9	jf 19
 		(009) ldb      [23]
 		(010) jeq      #0x84            jt 13	jf 11
@@ -909,7 +1132,7 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(014) jset     #0x1fff          jt 19	jf 15
 		(015) ldxb     4*([14]&0xf)
 		(016) ldh      [x + 14]
-		(017) jeq      #0x35            jt 18	jf 19
+		(017) jeq      #0x16            jt 18	jf 19
 		(018) ret      #262144
 		(019) ret      #0
 		`},
@@ -950,7 +1173,7 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(004) jeq      #0x6             jt 6	jf 5
 		(005) jeq      #0x11            jt 6	jf 19
 		(006) ldh      [56]
-		(007) jeq      #0x35            jt 18	jf 19
+		(007) jeq      #0x16            jt 18	jf 19
 		(008) jeq      #0x800           jt 9	jf 19
 		(009) ldb      [23]
 		(010) jeq      #0x84            jt 13	jf 11
@@ -960,7 +1183,7 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(014) jset     #0x1fff          jt 19	jf 15
 		(015) ldxb     4*([14]&0xf)
 		(016) ldh      [x + 16]
-		(017) jeq      #0x35            jt 18	jf 19
+		(017) jeq      #0x16            jt 18	jf 19
 		(018) ret      #262144
 		(019) ret      #0
 		`},
@@ -997,7 +1220,33 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x16, SkipFalse: 1},
 			bpf.RetConstant{Val: 262144},
 			bpf.RetConstant{Val: 0},
-		}, ""},
+		}, `
+		// as "port 22", but for a source port that does not match failing rather than going on to the destination port
+		(000) ldh      [12]													load half-word at byte 12 (EtherType)
+		(001) jeq      #0x86dd          jt 2	jf 10 if 0x86dd (IPv6), go to 2, else 10
+		(002) ldb      [20]													load byte at byte 20 (next header, i.e. ip protocol)
+		(003) jeq      #0x84            jt 6	jf 4	if 0x84 (sctp) go to 6, else go to 4
+		(004) jeq      #0x6             jt 6	jf 5  if 0x06 (tcp) go to 6, else go to 5
+		(005) jeq      #0x11            jt 6	jf 23 if 0x11 (udp) go to 6, else go to 23
+		(006) ldh      [54]													load half-word at byte 54 (L4 header source port)
+		(007) jeq      #0x16            jt 8	jf 23	if 0x16 (22) go to 8, else go to 23, as the source port must match too
+		(008) ldh      [56]													load half-word at byte 56 (L4 header destination port)
+		(009) jeq      #0x16            jt 22	jf 23	if 0x16 (22) go to 22, else go to 23
+		(010) jeq      #0x800           jt 11	jf 23 if 0x800 (ipv4), go to 11, else 23
+		(011) ldb      [23]													load byte at byte 23 (ip protocol)
+		(012) jeq      #0x84            jt 15	jf 13	if 0x84 (sctp) go to 15, else go to 13
+		(013) jeq      #0x6             jt 15	jf 14	if 0x06 (tcp) go to 15, else go to 14
+		(014) jeq      #0x11            jt 15	jf 23	if 0x11 (udp) go to 15, else go to 23
+		(015) ldh      [20]													load half-word at byte 20 (flags+fragment offset)
+		(016) jset     #0x1fff          jt 23	jf 17	if 0x1fff mask (fragment 0), we do not have an L4 header, go to 23, else go to 17
+		(017) ldxb     4*([14]&0xf)									load index register with byte size of IP header
+		(018) ldh      [x + 14]											load half-word at position [index + 14], i.e. ethernet header (14) + IP header (x) - this gives first half-word in L4 header
+		(019) jeq      #0x16            jt 20	jf 23	if 0x16 (22) go to 20, else go to 23, as the source port must match too
+		(020) ldh      [x + 16]											load half-word at position [index + 16], L4 destination port
+		(021) jeq      #0x16            jt 22	jf 23	if 0x16 (22) go to 22, else go to 23
+		(022) ret      #262144											return 0x40000, i.e. the entire packet
+		(023) ret      #0														return constant 0 (drop packet)
+		`},
 		// next one is interesting. It could be a composite "udp and port 23" or primitive "udp port 23".
 		// so we test it with both.
 		{"udp port 23", primitive{
@@ -1059,7 +1308,14 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			direction: filterDirectionSrcOrDst,
 			protocol:  filterProtocolUnset,
 			id:        "abc",
-		}, fmt.Errorf("invalid net: %s", "abc"), nil, ""},
+		}, fmt.Errorf("net requires an IP or CIDR, got %q", "abc"), nil, ""},
+		// a hostname is not a network, even if it resolves, so it is not looked up
+		{"net www.google.com", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolUnset,
+			id:        "www.google.com",
+		}, fmt.Errorf("net requires an IP or CIDR, got %q", "www.google.com"), nil, ""},
 		{"net 192.168.0.0", primitive{
 			kind:      filterKindNet,
 			direction: filterDirectionSrcOrDst,
@@ -1481,6 +1737,31 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(012) ret      #262144
 		(013) ret      #0
 		`},
+		{"net 2001:db8::/32", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolUnset,
+			id:        "2001:db8::/32",
+		}, nil, []bpf.Instruction{
+			// a mask on a word boundary needs no netmask step
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 7
+		(002) ld       [22]
+		(003) jeq      #0x20010db8      jt 6	jf 4
+		(004) ld       [38]
+		(005) jeq      #0x20010db8      jt 6	jf 7
+		(006) ret      #262144
+		(007) ret      #0
+		`},
 		{"src net 2a00:1450:4001:824::/62", primitive{
 			kind:      filterKindNet,
 			direction: filterDirectionSrc,
@@ -1606,6 +1887,107 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(012) ret      #262144
 		(013) ret      #0
 		`},
+		// prefixes that end part way through the second, third and fourth words
+		{"src and dst net 2001:db8:8000::/33", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcAndDst,
+			protocol:  filterProtocolUnset,
+			id:        "2001:db8:8000::/33",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 9},
+			bpf.LoadAbsolute{Off: 26, Size: 4},                   // ip6 src address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 42, Size: 4},                   // ip6 dst address part2
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"src and dst net 2001:db8:aaaa:bbbb:8000::/65", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcAndDst,
+			protocol:  filterProtocolUnset,
+			id:        "2001:db8:aaaa:bbbb:8000::/65",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 13},
+			bpf.LoadAbsolute{Off: 26, Size: 4}, // ip6 src address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 30, Size: 4},                   // ip6 src address part3
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 42, Size: 4}, // ip6 dst address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 46, Size: 4},                   // ip6 dst address part3
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"src and dst net 2001:db8:aaaa:bbbb:cccc:dddd:8000:0/97", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcAndDst,
+			protocol:  filterProtocolUnset,
+			id:        "2001:db8:aaaa:bbbb:cccc:dddd:8000:0/97",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 19},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 17},
+			bpf.LoadAbsolute{Off: 26, Size: 4}, // ip6 src address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 30, Size: 4}, // ip6 src address part3
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xccccdddd, SkipFalse: 13},
+			bpf.LoadAbsolute{Off: 34, Size: 4},                   // ip6 src address part4
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 42, Size: 4}, // ip6 dst address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 46, Size: 4}, // ip6 dst address part3
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xccccdddd, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 50, Size: 4},                   // ip6 dst address part4
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip6 host 2001:db8:aaaa:bbbb:8000::/65", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "2001:db8:aaaa:bbbb:8000::/65",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 22, Size: 4}, // ip6 src address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4}, // ip6 src address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 30, Size: 4},                   // ip6 src address part3
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipTrue: 7},
+			bpf.LoadAbsolute{Off: 38, Size: 4}, // ip6 dst address part1
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x20010db8, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 42, Size: 4}, // ip6 dst address part2
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xaaaabbbb, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 46, Size: 4},                   // ip6 dst address part3
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x80000000}, // netmask
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x80000000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
 	},
 	"ether_address": {
 		{"ether abc", primitive{
@@ -1850,22 +2232,73 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 		(002) ret      #262144
 		(003) ret      #0
 		`},
-	},
-	"ip_proto": {
-		{"ip proto abc", primitive{
-			kind:        filterKindUnset,
-			direction:   filterDirectionSrcOrDst,
-			protocol:    filterProtocolIP,
-			subProtocol: filterSubProtocolUnknown,
-			id:          "abc",
-		}, fmt.Errorf("unknown protocol %s", "abc"), nil, ""},
-		// valid protocol
-		{"ip proto tcp", primitive{
+		{"ether proto 0x8100", primitive{
 			kind:        filterKindUnset,
 			direction:   filterDirectionSrcOrDst,
-			protocol:    filterProtocolIP,
-			subProtocol: filterSubProtocolTCP,
-			id:          "",
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolEtherType,
+			id:          "0x8100",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8100          jt 2	jf 3
+		(002) ret      #262144
+		(003) ret      #0
+		`},
+		{"ether proto lldp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolEtherType,
+			id:          "lldp",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x88cc, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ether proto 0x10000", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolUnknown,
+			id:          "0x10000",
+		}, fmt.Errorf("unknown protocol %s", "0x10000"), nil, ""},
+	},
+	"ip_proto": {
+		{"ip", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 3
+		(002) ret      #262144
+		(003) ret      #0
+		`},
+		{"ip proto abc", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolUnknown,
+			id:          "abc",
+		}, fmt.Errorf("unknown protocol %s", "abc"), nil, ""},
+		// valid protocol
+		{"ip proto tcp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolTCP,
+			id:          "",
 		}, nil, []bpf.Instruction{
 			// get ethernet protocol
 			bpf.LoadAbsolute{Off: 12, Size: 2},
@@ -1877,65 +2310,1384 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			bpf.RetConstant{Val: 0},
 		}, `
 		(000) ldh      [12]
-		(001) jeq      #0x800           jt 2	jf 5
-		(002) ldb      [23]
-		(003) jeq      #0x6             jt 4	jf 5
+		(001) jeq      #0x800           jt 2	jf 5
+		(002) ldb      [23]
+		(003) jeq      #0x6             jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"ip proto udp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolUDP,
+			id:          "",
+		}, nil, []bpf.Instruction{
+			// get ethernet protocol
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			// ipv4? next several steps, else fail
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 23, Size: 1},                       // ip protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1}, // tcp
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+
+		{"udp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolUnset,
+			subProtocol: filterSubProtocolUDP,
+			id:          "",
+		}, nil, []bpf.Instruction{
+			// get ethernet protocol
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			// ipv6: next several steps
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ip6 protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 6},               // udp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipFalse: 6},              // is a continuation packet
+			bpf.LoadAbsolute{Off: 54, Size: 1},                                    // ip6 protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 3, SkipFalse: 4}, // udp
+			// ipv4: next several steps
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 23, Size: 1},                       // ip6 protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1}, // udp
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 7
+		(002) ldb      [20]
+		(003) jeq      #0x11            jt 10	jf 4
+		(004) jeq      #0x2c            jt 5	jf 11
+		(005) ldb      [54]
+		(006) jeq      #0x11            jt 10	jf 11
+		(007) jeq      #0x800           jt 8	jf 11
+		(008) ldb      [23]
+		(009) jeq      #0x11            jt 10	jf 11
+		(010) ret      #262144
+		(011) ret      #0
+		`},
+	},
+	"hbh": {
+		{"ip6 hbh", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP6,
+			subProtocol: filterSubProtocolHbh,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 5
+		(002) ldb      [20]
+		(003) jeq      #0x0             jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"ip hbh", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolHbh,
+		}, fmt.Errorf("hbh only is valid for ip6"), nil, ""},
+	},
+	"llc": {
+		{"llc", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolLlc,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 0x5dc, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jgt      #0x5dc           jt 3	jf 2
+		(002) ret      #262144
+		(003) ret      #0
+		`},
+		{"802.3", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolLlc,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 0x5dc, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"llc host 10.100.100.100", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolLlc,
+			id:        "10.100.100.100",
+		}, fmt.Errorf("llc takes no qualifiers"), nil, ""},
+		// spanning tree is 802.2, with the DSAP of the bridge protocol
+		{"stp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolStp,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 0x5dc, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 14, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x42, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ether proto stp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolStp,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 0x5dc, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 14, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x42, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"stp host 10.100.100.100", primitive{
+			kind:        filterKindHost,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolStp,
+			id:          "10.100.100.100",
+		}, fmt.Errorf("stp takes no qualifiers"), nil, ""},
+		{"ip proto stp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolStp,
+		}, fmt.Errorf("stp only is valid for ether"), nil, ""},
+	},
+	// parsed, as tcpdump has them, but not compiled, rather than compiled to something that does not match them
+	"unsupported": {
+		{"decnet", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolDecnet,
+		}, fmt.Errorf("unsupported protocol %s", "decnet"), nil, ""},
+		{"decnet host 10.100.100.100", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolDecnet,
+			id:        "10.100.100.100",
+		}, fmt.Errorf("unsupported protocol %s", "decnet"), nil, ""},
+		{"fddi host aa:bb:cc:dd:ee:ff", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolFddi,
+			id:        "aa:bb:cc:dd:ee:ff",
+		}, fmt.Errorf("unsupported protocol %s", "fddi"), nil, ""},
+		{"iso", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolIso,
+		}, fmt.Errorf("unsupported protocol %s", "iso"), nil, ""},
+		{"ether proto atalk", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolAtalk,
+		}, fmt.Errorf("unsupported protocol %s", "atalk"), nil, ""},
+		{"ether proto mopdl", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolMopdl,
+		}, fmt.Errorf("unsupported protocol %s", "mopdl"), nil, ""},
+		{"ether proto tcp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolEther,
+			subProtocol: filterSubProtocolTCP,
+		}, fmt.Errorf("unsupported protocol %s", "tcp"), nil, ""},
+	},
+	"jumbo": {
+		// the output is that of the equivalent "ip6 and ip6[4:2] == 0", as tcpdump has no jumbo
+		{"ip6 jumbo", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "jumbo",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 18, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 5
+		(002) ldh      [18]
+		(003) jeq      #0x0             jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"ip6 hbh jumbo", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP6,
+			subProtocol: filterSubProtocolHbh,
+			id:          "jumbo",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 18, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip jumbo", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "jumbo",
+		}, fmt.Errorf("jumbo only is valid for ip6"), nil, ""},
+		{"ip6 large", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "large",
+		}, fmt.Errorf("unknown ip6 qualifier: large"), nil, ""},
+	},
+	"df": {
+		// the output is that of the equivalent "ip[6] & 0x40 != 0", as tcpdump has no df
+		{"ip df", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "df",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x40, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 5
+		(002) ldb      [20]
+		(003) jset     #0x40            jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"ip df and udp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolUDP,
+			id:          "df",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x40, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip6 df", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "df",
+		}, fmt.Errorf("unknown ip6 qualifier: df"), nil, ""},
+		{"ip lf", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "lf",
+		}, fmt.Errorf("unknown ip qualifier: lf"), nil, ""},
+	},
+	"fragment": {
+		// the output is that of the equivalent "ip[6:2] & 0x1fff != 0", for all fragments but the first
+		{"ip fragment", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "fragment",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 5
+		(002) ldh      [20]
+		(003) jset     #0x1fff          jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		// and that of "ip[6] & 0x20 != 0", for all fragments but the last
+		{"ip mf", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "mf",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x20, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 5
+		(002) ldb      [20]
+		(003) jset     #0x20            jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"ip mf and udp", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolUDP,
+			id:          "mf",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x20, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip6 fragment", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "fragment",
+		}, fmt.Errorf("unknown ip6 qualifier: fragment"), nil, ""},
+		{"ip fragment and gre", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindUnset,
+					direction: filterDirectionSrcOrDst,
+					protocol:  filterProtocolIP,
+					id:        "fragment",
+				},
+				primitive{
+					kind:        filterKindUnset,
+					direction:   filterDirectionSrcOrDst,
+					subProtocol: filterSubProtocolGre,
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 5},
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2f, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+	},
+	"dscp": {
+		// the output is that of the equivalent "ip[1] & 0xfc >> 2 == 46", for expedited forwarding
+		{"ip dscp 46", primitive{
+			kind:      filterKindDscp,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			id:        "46",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 15, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfc},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 46, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 7
+		(002) ldb      [15]
+		(003) and      #0xfc
+		(004) rsh      #2
+		(005) jeq      #0x2e            jt 6	jf 7
+		(006) ret      #262144
+		(007) ret      #0
+		`},
+		// and of "ip6[0:2] & 0xfc0 >> 6 == 46", as the traffic class spans the nibbles after the version
+		{"ip6 dscp 46", primitive{
+			kind:      filterKindDscp,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP6,
+			id:        "46",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfc0},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 6},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 46, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x86dd          jt 2	jf 7
+		(002) ldh      [14]
+		(003) and      #0xfc0
+		(004) rsh      #6
+		(005) jeq      #0x2e            jt 6	jf 7
+		(006) ret      #262144
+		(007) ret      #0
+		`},
+		// either of them
+		{"dscp 46", primitive{
+			kind:      filterKindDscp,
+			direction: filterDirectionSrcOrDst,
+			id:        "46",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 15, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfc},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 46, SkipTrue: 5, SkipFalse: 6},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfc0},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 6},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 46, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x800           jt 2	jf 6
+		(002) ldb      [15]
+		(003) and      #0xfc
+		(004) rsh      #2
+		(005) jeq      #0x2e            jt 11	jf 12
+		(006) jeq      #0x86dd          jt 7	jf 12
+		(007) ldh      [14]
+		(008) and      #0xfc0
+		(009) rsh      #6
+		(010) jeq      #0x2e            jt 11	jf 12
+		(011) ret      #262144
+		(012) ret      #0
+		`},
+		{"dscp 64", primitive{
+			kind:      filterKindDscp,
+			direction: filterDirectionSrcOrDst,
+			id:        "64",
+		}, fmt.Errorf("invalid dscp, must be from 0 to 63: 64"), nil, ""},
+		{"ether dscp 46", primitive{
+			kind:      filterKindDscp,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolEther,
+			id:        "46",
+		}, fmt.Errorf("dscp only is valid for ip and ip6"), nil, ""},
+	},
+	"gre": {
+		{"gre", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolGre,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2f, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"gre proto 0x0800", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolGre,
+			id:          "0x0800",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2f, SkipFalse: 6},
+			// find the gre header after the ip header, then its protocol type at gre[2:2]
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"gre proto ipx", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolGre,
+			id:          "ipx",
+		}, fmt.Errorf("invalid gre protocol type: %s", "ipx"), nil, ""},
+		{"ip6 gre", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP6,
+			subProtocol: filterSubProtocolGre,
+		}, fmt.Errorf("gre only is valid for ip"), nil, ""},
+	},
+	"protochain": {
+		{"ip protochain udp", primitive{
+			kind:        filterKindProtochain,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP,
+			subProtocol: filterSubProtocolUDP,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ip6 protochain tcp", primitive{
+			kind:        filterKindProtochain,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolIP6,
+			subProtocol: filterSubProtocolTCP,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 61},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.LoadConstant{Dst: bpf.RegX, Val: 0},
+			// the protocol, or the first extension header
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 57},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipTrue: 12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x33, SkipTrue: 7},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2b, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x3c, SkipFalse: 53},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.Jump{Skip: 5},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.Jump{Skip: 1},
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 8},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: 54, Size: 1},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+			// extension header 2, or the protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 38},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipTrue: 12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x33, SkipTrue: 7},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2b, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x3c, SkipFalse: 34},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.Jump{Skip: 5},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.Jump{Skip: 1},
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 8},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: 54, Size: 1},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+			// extension header 3, or the protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 19},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipTrue: 12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x33, SkipTrue: 7},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2b, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x3c, SkipFalse: 15},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.Jump{Skip: 5},
+			bpf.LoadIndirect{Off: 55, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.Jump{Skip: 1},
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 8},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: 54, Size: 1},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+			// the protocol after the third extension header
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"protochain foo", primitive{
+			kind:      filterKindProtochain,
+			direction: filterDirectionSrcOrDst,
+			id:        "foo",
+		}, fmt.Errorf("unsupported protochain protocol: %s", "foo"), nil, ""},
+		{"arp protochain tcp", primitive{
+			kind:        filterKindProtochain,
+			direction:   filterDirectionSrcOrDst,
+			protocol:    filterProtocolArp,
+			subProtocol: filterSubProtocolTCP,
+		}, fmt.Errorf("protochain only is valid for ip and ip6"), nil, ""},
+	},
+	"ipip": {
+		{"ipip", primitive{
+			kind:      filterKindIPIP,
+			direction: filterDirectionSrcOrDst,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x4, SkipFalse: 3},
+			// the outer header must be the 20 bytes without options
+			bpf.LoadAbsolute{Off: 14, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x45, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ipip and ip host 10.0.0.1", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindIPIP,
+					direction: filterDirectionSrcOrDst,
+				},
+				primitive{
+					kind:      filterKindHost,
+					direction: filterDirectionSrcOrDst,
+					protocol:  filterProtocolIP,
+					id:        "10.0.0.1",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x4, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 14, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x45, SkipFalse: 1},
+			// and: matches go on to the next, failures go to the end
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 7},
+			// the EtherType stays, as the inner packet is ip too, but the addresses are past the outer header
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 46, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 50, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"ipip 5", primitive{
+			kind:      filterKindIPIP,
+			direction: filterDirectionSrcOrDst,
+			id:        "5",
+		}, fmt.Errorf("ipip takes no qualifiers"), nil, ""},
+	},
+	"mpls": {
+		{"mpls", primitive{
+			kind:      filterKindMpls,
+			direction: filterDirectionSrcOrDst,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8847, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8848, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"mpls 18 and ip host 10.0.0.1", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindMpls,
+					direction: filterDirectionSrcOrDst,
+					id:        "18",
+				},
+				primitive{
+					kind:      filterKindHost,
+					direction: filterDirectionSrcOrDst,
+					protocol:  filterProtocolIP,
+					id:        "10.0.0.1",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8847, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8848, SkipFalse: 4},
+			// the label is the top 20 bits of the header
+			bpf.LoadAbsolute{Off: 14, Size: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfffff000},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x12000, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 8},
+			// there is no EtherType after the label, so the ip version stands in for it, and the addresses are past the label
+			bpf.LoadAbsolute{Off: 18, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0a000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"mpls 100 mpls 200", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindMpls,
+					direction: filterDirectionSrcOrDst,
+					id:        "100",
+				},
+				primitive{
+					kind:      filterKindMpls,
+					direction: filterDirectionSrcOrDst,
+					id:        "200",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8847, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8848, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 14, Size: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfffff000},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x64000, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 9},
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8847, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8848, SkipFalse: 6},
+			// the first label must not have been the bottom of the stack
+			bpf.LoadAbsolute{Off: 16, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1, SkipTrue: 4},
+			bpf.LoadAbsolute{Off: 18, Size: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfffff000},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc8000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"mpls 1048576", primitive{
+			kind:      filterKindMpls,
+			direction: filterDirectionSrcOrDst,
+			id:        "1048576",
+		}, fmt.Errorf("invalid mpls label: 1048576"), nil, ""},
+	},
+	"tcpflags": {
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			id:          "0xff==0x12",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 27, Size: 1},
+			// the flags ORed together into one value
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x12, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"tcp[tcpflags] == tcp-synack", primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			id:          "0xff==0x12",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 27, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x12, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) != 0", primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			id:          "0x12!=0x0",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 9},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 5},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 27, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0, SkipTrue: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"udp[tcpflags] == 1", primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolUDP,
+			id:          "1",
+		}, fmt.Errorf("only tcp[tcpflags] can be accessed"), nil, ""},
+		{"tcp[tcpflags] == tcp-bogus", primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+		}, fmt.Errorf("invalid tcp flags \"tcp-bogus\""), nil, ""},
+	},
+	"portrange": {
+		{"tcp src portrange 1024-65535", primitive{
+			kind:        filterKindPortRange,
+			direction:   filterDirectionSrc,
+			subProtocol: filterSubProtocolTCP,
+			id:          "1024-65535",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			// ipv6
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 13},
+			bpf.LoadAbsolute{Off: 54, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x400, SkipFalse: 11},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0xffff, SkipTrue: 10, SkipFalse: 9},
+			// ipv4
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 9},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 5},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x400, SkipFalse: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0xffff, SkipTrue: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		// a range of a single port is just a port
+		{"udp dst portrange 53-53", primitive{
+			kind:        filterKindPortRange,
+			direction:   filterDirectionDst,
+			subProtocol: filterSubProtocolUDP,
+			id:          "53-53",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 56, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 8, SkipFalse: 9},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"portrange 1024", primitive{
+			kind:      filterKindPortRange,
+			direction: filterDirectionSrcOrDst,
+			id:        "1024",
+		}, fmt.Errorf("invalid port range: %s", "1024"), nil, ""},
+		{"portrange 1024-70000", primitive{
+			kind:      filterKindPortRange,
+			direction: filterDirectionSrcOrDst,
+			id:        "1024-70000",
+		}, fmt.Errorf("invalid port range: %s", "1024-70000"), nil, ""},
+		{"src portrange 1024-65535 and dst port 443", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindPortRange,
+					direction: filterDirectionSrc,
+					id:        "1024-65535",
+				},
+				primitive{
+					kind:      filterKindPort,
+					direction: filterDirectionDst,
+					id:        "443",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			// src portrange 1024-65535, ipv6
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 54, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x400, SkipFalse: 13},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0xffff, SkipTrue: 12, SkipFalse: 11},
+			// src portrange 1024-65535, ipv4
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 11},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 5},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x400, SkipFalse: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0xffff, SkipTrue: 1},
+			// and: matches go on to the next, failures go to the end
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 19},
+			// dst port 443, ipv6
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 13},
+			bpf.LoadAbsolute{Off: 56, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1bb, SkipTrue: 10, SkipFalse: 11},
+			// dst port 443, ipv4
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x1bb, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"port ssh or portrange 8000-8010", composite{
+			filters: []Filter{
+				primitive{
+					kind:      filterKindPort,
+					direction: filterDirectionSrcOrDst,
+					id:        "ssh",
+				},
+				primitive{
+					kind:      filterKindPortRange,
+					direction: filterDirectionSrcOrDst,
+					id:        "8000-8010",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			// port ssh, ipv6
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 17},
+			bpf.LoadAbsolute{Off: 54, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x16, SkipTrue: 14},
+			bpf.LoadAbsolute{Off: 56, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x16, SkipTrue: 12, SkipFalse: 13},
+			// port ssh, ipv4
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 12},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x16, SkipTrue: 2},
+			bpf.LoadIndirect{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x16, SkipFalse: 1},
+			// or: matches go to the end, failures go on to the next
+			bpf.Jump{Skip: 27},
+			bpf.Jump{Skip: 0},
+			// portrange 8000-8010, ipv6
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 20, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 21},
+			bpf.LoadAbsolute{Off: 54, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x1f40, SkipFalse: 1},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0x1f4a, SkipFalse: 17},
+			bpf.LoadAbsolute{Off: 56, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x1f40, SkipFalse: 16},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0x1f4a, SkipTrue: 15, SkipFalse: 14},
+			// portrange 8000-8010, ipv4
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 14},
+			bpf.LoadAbsolute{Off: 23, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 8},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x1f40, SkipFalse: 1},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0x1f4a, SkipFalse: 3},
+			bpf.LoadIndirect{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 0x1f40, SkipFalse: 2},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0x1f4a, SkipTrue: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+	},
+	"rarp": {
+		{"rarp", primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolRarp,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8035          jt 2	jf 3
+		(002) ret      #262144
+		(003) ret      #0
+		`},
+		{"rarp host 10.100.100.100", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolRarp,
+			id:        "10.100.100.100",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 5},
+			// sender protocol address
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			// target protocol address
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8035          jt 2	jf 7
+		(002) ld       [28]
+		(003) jeq      #0xa646464       jt 6	jf 4
+		(004) ld       [38]
+		(005) jeq      #0xa646464       jt 6	jf 7
+		(006) ret      #262144
+		(007) ret      #0
+		`},
+		{"rarp src host 10.100.100.100", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrc,
+			protocol:  filterProtocolRarp,
+			id:        "10.100.100.100",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8035          jt 2	jf 5
+		(002) ld       [28]
+		(003) jeq      #0xa646464       jt 4	jf 5
+		(004) ret      #262144
+		(005) ret      #0
+		`},
+		{"rarp dst host 10.100.100.100", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionDst,
+			protocol:  filterProtocolRarp,
+			id:        "10.100.100.100",
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8035          jt 2	jf 5
+		(002) ld       [38]
+		(003) jeq      #0xa646464       jt 4	jf 5
 		(004) ret      #262144
 		(005) ret      #0
 		`},
-		{"ip proto udp", primitive{
-			kind:        filterKindUnset,
-			direction:   filterDirectionSrcOrDst,
-			protocol:    filterProtocolIP,
-			subProtocol: filterSubProtocolUDP,
-			id:          "",
+		{"rarp net 192.168.0.0/16", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolRarp,
+			id:        "192.168.0.0/16",
 		}, nil, []bpf.Instruction{
-			// get ethernet protocol
 			bpf.LoadAbsolute{Off: 12, Size: 2},
-			// ipv4? next several steps, else fail
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
-			bpf.LoadAbsolute{Off: 23, Size: 1},                       // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1}, // tcp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8035, SkipFalse: 7},
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0a80000, SkipTrue: 3},
+			bpf.LoadAbsolute{Off: 38, Size: 4},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xffff0000},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc0a80000, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, `
+		(000) ldh      [12]
+		(001) jeq      #0x8035          jt 2	jf 9
+		(002) ld       [28]
+		(003) and      #0xffff0000
+		(004) jeq      #0xc0a80000      jt 8	jf 5
+		(005) ld       [38]
+		(006) and      #0xffff0000
+		(007) jeq      #0xc0a80000      jt 8	jf 9
+		(008) ret      #262144
+		(009) ret      #0
+		`},
+		{"rarp host 2001:db8::1", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolRarp,
+			id:        "2001:db8::1",
+		}, fmt.Errorf("arp and rarp only are valid for IPv4 addresses: %s", "2001:db8::1"), nil, ""},
+		{"rarp net 2001:db8::/32", primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolRarp,
+			id:        "2001:db8::/32",
+		}, fmt.Errorf("arp and rarp only are valid for IPv4 addresses: %s", "2001:db8::/32"), nil, ""},
+	},
+	"vlan": {
+		{"vlan", primitive{
+			kind:      filterKindVlan,
+			direction: filterDirectionSrcOrDst,
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
 			bpf.RetConstant{Val: 262144},
 			bpf.RetConstant{Val: 0},
 		}, ""},
-
-		{"udp", primitive{
-			kind:        filterKindUnset,
-			direction:   filterDirectionSrcOrDst,
-			protocol:    filterProtocolUnset,
-			subProtocol: filterSubProtocolUDP,
-			id:          "",
+		{"vlan 100", primitive{
+			kind:      filterKindVlan,
+			direction: filterDirectionSrcOrDst,
+			id:        "100",
 		}, nil, []bpf.Instruction{
-			// get ethernet protocol
 			bpf.LoadAbsolute{Off: 12, Size: 2},
-			// ipv6: next several steps
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
-			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 6},               // udp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipFalse: 6},              // is a continuation packet
-			bpf.LoadAbsolute{Off: 54, Size: 1},                                    // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 3, SkipFalse: 4}, // udp
-			// ipv4: next several steps
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
-			bpf.LoadAbsolute{Off: 23, Size: 1},                       // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1}, // udp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x64, SkipFalse: 1},
 			bpf.RetConstant{Val: 262144},
 			bpf.RetConstant{Val: 0},
 		}, `
 		(000) ldh      [12]
-		(001) jeq      #0x86dd          jt 2	jf 7
-		(002) ldb      [20]
-		(003) jeq      #0x11            jt 10	jf 4
-		(004) jeq      #0x2c            jt 5	jf 11
-		(005) ldb      [54]
-		(006) jeq      #0x11            jt 10	jf 11
-		(007) jeq      #0x800           jt 8	jf 11
-		(008) ldb      [23]
-		(009) jeq      #0x11            jt 10	jf 11
-		(010) ret      #262144
-		(011) ret      #0
+		(001) jeq      #0x8100          jt 2	jf 6
+		(002) ldh      [14]
+		(003) and      #0xfff
+		(004) jeq      #0x64            jt 5	jf 6
+		(005) ret      #262144
+		(006) ret      #0
 		`},
+		{"vlan 5000", primitive{
+			kind:      filterKindVlan,
+			direction: filterDirectionSrcOrDst,
+			id:        "5000",
+		}, fmt.Errorf("invalid vlan id: %s", "5000"), nil, ""},
+		{"not vlan and ip host 10.100.100.100", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+					negator:   true,
+				},
+				primitive{
+					kind:      filterKindHost,
+					direction: filterDirectionSrcOrDst,
+					protocol:  filterProtocolIP,
+					id:        "10.100.100.100",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			// not vlan: tagged frames fail, untagged go on to the next
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.Jump{Skip: 8},
+			bpf.Jump{Skip: 0},
+			// ip host 10.100.100.100, at the unshifted offsets
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"vlan and tcp port 80", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+				},
+				primitive{
+					kind:        filterKindPort,
+					direction:   filterDirectionSrcOrDst,
+					subProtocol: filterSubProtocolTCP,
+					id:          "80",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 19},
+			// tcp port 80, 4 bytes further on, past the tag
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 24, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 58, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 12},
+			bpf.LoadAbsolute{Off: 60, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 10, SkipFalse: 11},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 27, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 24, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6},
+			bpf.LoadMemShift{Off: 18},
+			bpf.LoadIndirect{Off: 18, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 2},
+			bpf.LoadIndirect{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		{"vlan 100 and tcp port 80", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+					id:        "100",
+				},
+				primitive{
+					kind:        filterKindPort,
+					direction:   filterDirectionSrcOrDst,
+					subProtocol: filterSubProtocolTCP,
+					id:          "80",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x64, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 19},
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 24, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 15},
+			bpf.LoadAbsolute{Off: 58, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 12},
+			bpf.LoadAbsolute{Off: 60, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 10, SkipFalse: 11},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 10},
+			bpf.LoadAbsolute{Off: 27, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 24, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6},
+			bpf.LoadMemShift{Off: 18},
+			bpf.LoadIndirect{Off: 18, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipTrue: 2},
+			bpf.LoadIndirect{Off: 20, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x50, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		// stacked, as with QinQ: the second tag is past the first
+		{"vlan and vlan 200", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+				},
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+					id:        "200",
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 6},
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 18, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xc8, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
+		// the inner EtherType, past the tag
+		{"vlan and arp", composite{
+			and: true,
+			filters: []Filter{
+				primitive{
+					kind:      filterKindVlan,
+					direction: filterDirectionSrcOrDst,
+				},
+				primitive{
+					kind:      filterKindUnset,
+					direction: filterDirectionSrcOrDst,
+					protocol:  filterProtocolArp,
+				},
+			},
+		}, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 3},
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x806, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}, ""},
 	},
 	"composite": {
 		// simple case that should combine down
@@ -1971,8 +3723,6 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			bpf.RetConstant{Val: 0},
 		}, `
 		// This is the real one given by "tcpdump -d udp and port 23".
-		// However, we are not doing it for now; just some interim steps
-		// we can optimize later
 			(000) ldh      [12]
 			(001) jeq      #0x86dd          jt 2	jf 8
 			(002) ldb      [20]
@@ -2156,94 +3906,30 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 				},
 			},
 		}, nil, []bpf.Instruction{
-			// first: tcp dst port ftp
-			bpf.LoadAbsolute{Off: 12, Size: 2},
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},            // check ipv6
-			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ipv6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 11},              // tcp
-			bpf.LoadAbsolute{Off: 56, Size: 2},                                    // ipv6 dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipTrue: 8, SkipFalse: 9}, // ftp
-			// ipv4
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 8}, // ipv4
-			bpf.LoadAbsolute{Off: 23, Size: 1},                         // ipv4 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 6},    // tcp
-			bpf.LoadAbsolute{Off: 20, Size: 2},                         // next few steps calculate location of ipv4 port
-			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
-			bpf.LoadMemShift{Off: 14},
-			bpf.LoadIndirect{Off: 16, Size: 2},                       // ipv4 dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipFalse: 1}, // ftp
-
-			// OR - jump to next
-			bpf.Jump{Skip: 31},
-			bpf.Jump{Skip: 0},
-
-			// second: tcp dst port ftp-data
-			bpf.LoadAbsolute{Off: 12, Size: 2},
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},            // check ipv6
-			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ipv6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 11},              // tcp
-			bpf.LoadAbsolute{Off: 56, Size: 2},                                    // ipv6 dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x14, SkipTrue: 8, SkipFalse: 9}, // ftp-data
-			// ipv4
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 8}, // ipv4
-			bpf.LoadAbsolute{Off: 23, Size: 1},                         // ipv4 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 6},    // tcp
-			bpf.LoadAbsolute{Off: 20, Size: 2},                         // next few steps calculate location of ipv4 port
-			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
-			bpf.LoadMemShift{Off: 14},
-			bpf.LoadIndirect{Off: 16, Size: 2},                       // ipv4 dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x14, SkipFalse: 1}, // ftp-data
-
-			// OR - jump to next
-			bpf.Jump{Skip: 15},
-			bpf.Jump{Skip: 0},
-
-			// third: tcp dst port domain
+			// as with tcpdump, the protocols are checked once, and the dst port loaded once for all of the ports
 			bpf.LoadAbsolute{Off: 12, Size: 2},
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},            // check ipv6
-			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ipv6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 11},              // tcp
-			bpf.LoadAbsolute{Off: 56, Size: 2},                                    // ipv6 dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 8, SkipFalse: 9}, // domain
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 6},              // check ipv6
+			bpf.LoadAbsolute{Off: 20, Size: 1},                                      // ipv6 protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 15},                // tcp
+			bpf.LoadAbsolute{Off: 56, Size: 2},                                      // ipv6 dst port
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipTrue: 12},                // ftp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x14, SkipTrue: 11},                // ftp-data
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 10, SkipFalse: 11}, // domain
 			// ipv4
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 8}, // ipv4
-			bpf.LoadAbsolute{Off: 23, Size: 1},                         // ipv4 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 6},    // tcp
-			bpf.LoadAbsolute{Off: 20, Size: 2},                         // next few steps calculate location of ipv4 port
-			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 10}, // ipv4
+			bpf.LoadAbsolute{Off: 23, Size: 1},                          // ipv4 protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 8},     // tcp
+			bpf.LoadAbsolute{Off: 20, Size: 2},                          // next few steps calculate location of ipv4 port
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6},
 			bpf.LoadMemShift{Off: 14},
 			bpf.LoadIndirect{Off: 16, Size: 2},                       // ipv4 dst port
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipTrue: 2},  // ftp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x14, SkipTrue: 1},  // ftp-data
 			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipFalse: 1}, // domain
-
-			// end
-			bpf.RetConstant{Val: 262144},
-			bpf.RetConstant{Val: 0},
-			/*
-				Here is the real one; we may optimize for it later
-				bpf.LoadAbsolute{Off: 12, Size: 2},
-				// ipv6
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4}, // check ipv6
-				bpf.LoadAbsolute{Off: 20, Size: 1},  												// ipv6 protocol
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 13},		// tcp
-				bpf.LoadAbsolute{Off: 56, Size: 2},													// ipv6 dst port
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipTrue: 10, SkipFalse: 8},	// ftp
-				// ipv4
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 10}, // ipv4
-				bpf.LoadAbsolute{Off: 23, Size: 1}, 												 // ipv4 protocol
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x6, SkipFalse: 8},		 // tcp
-				bpf.LoadAbsolute{Off: 20, Size: 2},													 // next few steps calculate location of ipv4 port
-				bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 21},
-				bpf.LoadMemShift{Off: 14},
-				bpf.LoadIndirect{Off: 16, Size: 2},														// ipv4 dst port
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x15, SkipTrue: 2},			// ftp
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x14, SkipTrue: 1},			// ftp-data
-				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipFalse: 1},			// domain/dns
-				bpf.RetConstant{Val: 262144},
-				bpf.RetConstant{Val: 0},
-
-			*/
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
 		}, `
-		// this is the true one given by "tcpdump -d"; we may optimize towards it later
+		// this is the true one given by "tcpdump -d"; its optimizer has ipv6 share the comparisons of ipv4
 		(000) ldh      [12]
 		(001) jeq      #0x86dd          jt 2	jf 6
 		(002) ldb      [20]
@@ -2292,99 +3978,23 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 				},
 			},
 		}, nil, []bpf.Instruction{
-			// our interim one
-
-			// the first primitive: udp
-			// get ethernet protocol
-			bpf.LoadAbsolute{Off: 12, Size: 2},
-			// ipv6: next several steps
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},
-			bpf.LoadAbsolute{Off: 20, Size: 1},                                    // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 6},               // udp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2c, SkipFalse: 6},              // is a continuation packet
-			bpf.LoadAbsolute{Off: 54, Size: 1},                                    // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipTrue: 3, SkipFalse: 4}, // udp
-			// ipv4: next several steps
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 3},
-			bpf.LoadAbsolute{Off: 23, Size: 1},                       // ip6 protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 1}, // udp
-			bpf.Jump{Skip: 1},
-			bpf.Jump{Skip: 47},
-
-			// the second primitive: port 53
-			// get ethernet protocol
-			bpf.LoadAbsolute{Off: 12, Size: 2},
-			// ipv6? next several steps; else check ipv6
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 8},
-			bpf.LoadAbsolute{Off: 20, Size: 1},                        // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},   // sctp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipTrue: 1},   // tcp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 17}, // udp
-			bpf.LoadAbsolute{Off: 54, Size: 2},                        // src port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipTrue: 14},
-			bpf.LoadAbsolute{Off: 56, Size: 2}, // dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipTrue: 12, SkipFalse: 13},
-			// ipv4? next several steps, else fail
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 12},
-			bpf.LoadAbsolute{Off: 23, Size: 1},                          // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},     // sctp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipTrue: 1},     // tcp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 8},    // udp
-			bpf.LoadAbsolute{Off: 20, Size: 2},                          // flags+fragment offset, since we need to calc where the src/dst port is
-			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6}, // do we have an L4 header?
-			bpf.LoadMemShift{Off: 14},                                   // calculate size of IP header
-			bpf.LoadIndirect{Off: 14, Size: 2},                          // src port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipTrue: 2},
-			bpf.LoadIndirect{Off: 16, Size: 2}, // dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
-			bpf.Jump{Skip: 23},
-			bpf.Jump{Skip: 0},
-
-			// the second primitive: port 67
-			// get ethernet protocol
-			bpf.LoadAbsolute{Off: 12, Size: 2},
-			// ipv6? next several steps; else check ipv6
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 8},
-			bpf.LoadAbsolute{Off: 20, Size: 1},                        // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},   // sctp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipTrue: 1},   // tcp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 17}, // udp
-			bpf.LoadAbsolute{Off: 54, Size: 2},                        // src port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipTrue: 14},
-			bpf.LoadAbsolute{Off: 56, Size: 2}, // dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipTrue: 12, SkipFalse: 13},
-			// ipv4? next several steps, else fail
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 12},
-			bpf.LoadAbsolute{Off: 23, Size: 1},                          // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x84, SkipTrue: 2},     // sctp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipTrue: 1},     // tcp
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 8},    // udp
-			bpf.LoadAbsolute{Off: 20, Size: 2},                          // flags+fragment offset, since we need to calc where the src/dst port is
-			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 6}, // do we have an L4 header?
-			bpf.LoadMemShift{Off: 14},                                   // calculate size of IP header
-			bpf.LoadIndirect{Off: 14, Size: 2},                          // src port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipTrue: 2},
-			bpf.LoadIndirect{Off: 16, Size: 2}, // dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipFalse: 1},
-
-			bpf.RetConstant{Val: 262144},
-			bpf.RetConstant{Val: 0},
-			/* the real steps
+			// as with tcpdump, udp is checked once, and each of the src and dst port loaded once for both ports
 			// get ethernet protocol
 			bpf.LoadAbsolute{Off: 12, Size: 2},
 			// ipv6? next several steps
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 7},
-			bpf.LoadAbsolute{Off: 20, Size: 1},                        // protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 18}, // udp
-			bpf.LoadAbsolute{Off: 54, Size: 2},                        // src port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 15},  // port 53
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipTrue: 14},  // port 67
-			bpf.LoadAbsolute{Off: 56, Size: 2},                        // dst port
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 12, JumpFalse: 11},  // port 53
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 20, Size: 1},                                      // protocol
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 19},               // udp
+			bpf.LoadAbsolute{Off: 54, Size: 2},                                      // src port
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 16},                // port 53
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipTrue: 15},                // port 67
+			bpf.LoadAbsolute{Off: 56, Size: 2},                                      // dst port
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 13},                // port 53
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipTrue: 12, SkipFalse: 13}, // port 67
 			// ipv4? next several steps
 			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 12},
 			bpf.LoadAbsolute{Off: 23, Size: 1},                          // ip protocol
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 9},    // udp
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x11, SkipFalse: 10},   // udp
 			bpf.LoadAbsolute{Off: 20, Size: 2},                          // flags+fragment offset, since we need to calc where the src/dst port is
 			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 8}, // do we have an L4 header?
 			bpf.LoadMemShift{Off: 14},                                   // calculate size of IP header
@@ -2393,14 +4003,12 @@ var testCasesExpressionFilterInstructions = map[string][]testCaseExpressions{
 			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipTrue: 3},     // port 67
 			bpf.LoadIndirect{Off: 16, Size: 2},                          // dst port
 			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x35, SkipTrue: 1},     // port 53
-			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipFalse: 1},     // port 67
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x43, SkipFalse: 1},    // port 67
 			bpf.RetConstant{Val: 262144},
 			bpf.RetConstant{Val: 0},
-			*/
 		}, `
-		// This is the real one given by "tcpdump -d".
-		// However, we are not doing it for now; just some interim steps
-		// we can optimize later
+		// This is the real one given by "tcpdump -d", which is the same
+		// but for its optimizer having ipv6 share the last comparison of ipv4
 		(000) ldh      [12]
 		(001) jeq      #0x86dd          jt 2	jf 9
 		(002) ldb      [20]
@@ -2,8 +2,11 @@ package filter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/bpf"
@@ -12,7 +15,7 @@ import (
 func setup() {
 	dns := NewDNSServer(0, dnsRecords)
 	addr := dns.StartAndServe()
-	resolver = net.Resolver{
+	resolver = &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{}
@@ -152,6 +155,21 @@ func TestExpressionNextPrimitive(t *testing.T) {
 			subProtocol: filterSubProtocolTCP,
 			id:          "",
 		}},
+		// not is of the whole primitive, with its direction
+		{"not src or dst host abc", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolUnset,
+			negator:   true,
+			id:        "abc",
+		}},
+		{"not src and dst host abc", primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcAndDst,
+			protocol:  filterProtocolUnset,
+			negator:   true,
+			id:        "abc",
+		}},
 	}
 	for _, tt := range tests {
 		e := NewExpression(tt.expression)
@@ -187,7 +205,7 @@ func TestFilterSize(t *testing.T) {
 					continue
 				}
 				size := filter.Size()
-				if size != uint8(len(tt.instructions)) {
+				if size != uint32(len(tt.instructions)) {
 					t.Errorf("%d '%s': mismatched size actual %d, expected %d", i, tt.expression, size, len(tt.instructions))
 				}
 			}
@@ -195,6 +213,40 @@ func TestFilterSize(t *testing.T) {
 	}
 }
 
+func TestFilterJumps(t *testing.T) {
+	for k, v := range testCasesExpressionFilterInstructions {
+		t.Run(k, func(t *testing.T) {
+			for i, tt := range v {
+				inst, err := NewExpression(tt.expression).Compile().Compile()
+				if err != nil {
+					continue
+				}
+				if err := checkJumps(inst); err != nil {
+					t.Errorf("%d '%s': %v", i, tt.expression, err)
+				}
+			}
+		})
+	}
+	tests := []struct {
+		inst []bpf.Instruction
+		err  bool
+	}{
+		{[]bpf.Instruction{bpf.Jump{Skip: 1}, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1}}, false},
+		{[]bpf.Instruction{bpf.Jump{Skip: 2}, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1}}, true},
+		{[]bpf.Instruction{bpf.JumpIf{SkipTrue: 1}, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1}}, false},
+		{[]bpf.Instruction{bpf.JumpIf{SkipFalse: 2}, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1}}, true},
+		{[]bpf.Instruction{bpf.JumpIfX{SkipTrue: 5}, bpf.RetConstant{Val: 0}}, true},
+		// a jump that wrapped around, as when the size is too small
+		{[]bpf.Instruction{bpf.Jump{Skip: 0xffffffff}, bpf.RetConstant{Val: 0}}, true},
+		{[]bpf.Instruction{bpf.RetConstant{Val: 0}}, false},
+	}
+	for i, tt := range tests {
+		if err := checkJumps(tt.inst); (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error, actual %v, expected error %v", i, err, tt.err)
+		}
+	}
+}
+
 func TestFilterCompile(t *testing.T) {
 	for k, v := range testCasesExpressionFilterInstructions {
 		t.Run(k, func(t *testing.T) {
@@ -213,6 +265,79 @@ func TestFilterCompile(t *testing.T) {
 	}
 }
 
+func TestFilterCompileStrict(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"porrt 80", `unrecognized token "porrt" at position 1`},
+		{"hostt 1.2.3.4", `unrecognized token "hostt" at position 1`},
+		{"udp and porrt 80", `unrecognized token "porrt" at position 9`},
+		{"tcp or (udp and  dstt port 53)", `unrecognized token "dstt" at position 18`},
+		{"host www.google.com", ""},
+	}
+	for _, tt := range tests {
+		_, err := NewStrictExpression(tt.expression).Compile().Compile()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("'%s': unexpected error: %v", tt.expression, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("'%s': mismatched errors\nActual  : %v\nExpected: %s", tt.expression, err, tt.err)
+		}
+		// the lenient mode takes the typo as an id
+		if _, err := NewExpression(tt.expression).Compile().Compile(); err != nil && strings.Contains(err.Error(), "unrecognized token") {
+			t.Errorf("'%s': lenient mode returned strict error: %v", tt.expression, err)
+		}
+	}
+	// strict mode does not change anything that is valid
+	for k, v := range testCasesExpressionFilterInstructions {
+		for i, tt := range v {
+			inst, err := NewStrictExpression(tt.expression).Compile().Compile()
+			if (err == nil) != (tt.err == nil) || !compareInstructions(inst, tt.instructions) {
+				t.Errorf("%s %d '%s': strict mode changed the result: %v", k, i, tt.expression, err)
+			}
+		}
+	}
+}
+
+func TestCompileErrorPosition(t *testing.T) {
+	tests := []struct {
+		expression string
+		strict     bool
+		token      string
+		position   int
+		err        string
+	}{
+		{"port 80 or port foo", false, "foo", 17, "invalid port: foo"},
+		// with the qualifiers of the one before
+		{"port 80 or foo", false, "foo", 12, "invalid port: foo"},
+		// combined with the protocol before it
+		{"tcp and port foo", false, "foo", 14, "invalid port: foo"},
+		{"host 10.0.0.1 and (udp or ip proto abc)", false, "abc", 36, "unknown protocol abc"},
+		{"ip and ether dscp 46", false, "46", 19, "dscp only is valid for ip and ip6"},
+		{"porrt 80", true, "porrt", 1, `unrecognized token "porrt" at position 1`},
+	}
+	for i, tt := range tests {
+		e := NewExpression(tt.expression)
+		if tt.strict {
+			e = NewStrictExpression(tt.expression)
+		}
+		_, err := e.Compile().Compile()
+		var compileErr *CompileError
+		if !errors.As(err, &compileErr) {
+			t.Errorf("%d '%s': not a CompileError: %#v", i, tt.expression, err)
+			continue
+		}
+		if compileErr.Token != tt.token || compileErr.Position != tt.position || err.Error() != tt.err {
+			t.Errorf("%d '%s': mismatched error, actual %q at %d: %v, expected %q at %d: %s", i, tt.expression,
+				compileErr.Token, compileErr.Position, err, tt.token, tt.position, tt.err)
+		}
+		if compileErr.Position > 0 && !strings.HasPrefix(tt.expression[compileErr.Position-1:], compileErr.Token) {
+			t.Errorf("%d '%s': %q is not at position %d", i, tt.expression, compileErr.Token, compileErr.Position)
+		}
+	}
+}
+
 // compare slices of bpf instruction
 func compareInstructions(a, b []bpf.Instruction) bool {
 	if len(a) != len(b) {
@@ -227,3 +352,273 @@ func compareInstructions(a, b []bpf.Instruction) bool {
 
 	return true
 }
+
+func TestFilterCompileLinkType(t *testing.T) {
+	tests := []struct {
+		expression   string
+		linkType     uint32
+		err          error
+		instructions []bpf.Instruction
+	}{
+		{"ip host 10.100.100.100", LinkTypeEthernet, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// tcpdump -y LINUX_SLL -d ip host 10.100.100.100
+		{"ip host 10.100.100.100", LinkTypeLinuxSLL, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 28, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 32, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// the gre header is found via the ip header length, so this covers indirect loads
+		{"gre proto 0x0800", LinkTypeLinuxSLL, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+			bpf.LoadAbsolute{Off: 25, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x2f, SkipFalse: 6},
+			bpf.LoadAbsolute{Off: 22, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+			bpf.LoadMemShift{Off: 16},
+			bpf.LoadIndirect{Off: 18, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		{"ip host 127.0.0.1", LinkTypeEthernet, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// the null header is just the address family, in host byte order
+		{"ip host 127.0.0.1", LinkTypeNull, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: nullFamily(etherTypeIPv4), SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 16, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 20, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// arp and rarp never are carried, but the comparisons after the ip addresses still are against the family
+		{"src host 127.0.0.1", LinkTypeNull, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: nullFamily(etherTypeIPv4), SkipFalse: 2},
+			bpf.LoadAbsolute{Off: 16, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipTrue: 4, SkipFalse: 5},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: afUnspec, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: afUnspec, SkipFalse: 3},
+			bpf.LoadAbsolute{Off: 18, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x7f000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// tcpdump -y LINUX_SLL2 -d ip host 10.100.100.100
+		{"ip host 10.100.100.100", LinkTypeLinuxSLL2, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 32, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 36, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// raw packets compare the ip version instead, which takes one more instruction, so the jump over the second grows
+		{"ip6 or ip", LinkTypeRaw, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x60, SkipFalse: 1},
+			bpf.Jump{Skip: 4},
+			bpf.Jump{Skip: 0},
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		{"ether host 00:11:22:33:44:55", LinkTypeRaw, fmt.Errorf("ether addresses are not available for link type %d", LinkTypeRaw), nil},
+		{"ether host 00:11:22:33:44:55", LinkTypeNull, fmt.Errorf("ether addresses are not available for link type %d", LinkTypeNull), nil},
+		{"ether host 00:11:22:33:44:55", LinkTypeLinuxSLL, fmt.Errorf("ether addresses are not available for link type %d", LinkTypeLinuxSLL), nil},
+		{"ip host 10.100.100.100", 105, fmt.Errorf("filters only are supported for Ethernet, Linux SLL, Linux SLL2, null and raw, not link type %d", 105), nil},
+	}
+	for i, tt := range tests {
+		inst, err := NewExpression(tt.expression).Compile().Compile()
+		if err != nil {
+			t.Fatalf("%d '%s': unexpected error compiling: %v", i, tt.expression, err)
+		}
+		inst, err = ForLinkType(inst, tt.linkType)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && err.Error() != tt.err.Error()):
+			t.Errorf("%d '%s': mismatched errors \nActual  : %v\nExpected: %v", i, tt.expression, err, tt.err)
+		case !compareInstructions(inst, tt.instructions):
+			t.Errorf("%d '%s': mismatched instructions \nActual  : %#v\nExpected: %#v", i, tt.expression, inst, tt.instructions)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		expression   string
+		linkType     uint32
+		err          error
+		instructions []bpf.Instruction
+	}{
+		{"ip host 10.0.0.1", LinkTypeEthernet, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		{"ip host 10.0.0.1", LinkTypeNull, nil, []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: nullFamily(etherTypeIPv4), SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 16, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa000001, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 20, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa000001, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// as with tcpdump, nothing to match is everything
+		{" ", LinkTypeNull, nil, []bpf.Instruction{
+			bpf.RetConstant{Val: 262144},
+		}},
+		{"ether host 00:11:22:33:44:55", LinkTypeNull, fmt.Errorf("ether addresses are not available for link type %d", LinkTypeNull), nil},
+		{"inbound and ip host 10.0.0.1", LinkTypeEthernet, fmt.Errorf("inbound and outbound are not in the packet, so cannot be compiled"), nil},
+		{"ip host 10.0.0.1", 105, fmt.Errorf("filters only are supported for Ethernet, Linux SLL, Linux SLL2, null and raw, not link type %d", 105), nil},
+		{"port 80 or port foo", LinkTypeEthernet, fmt.Errorf("invalid port: foo"), nil},
+	}
+	for i, tt := range tests {
+		inst, err := Compile(tt.expression, tt.linkType)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && err.Error() != tt.err.Error()):
+			t.Errorf("%d '%s': mismatched errors \nActual  : %v\nExpected: %v", i, tt.expression, err, tt.err)
+		case !compareInstructions(inst, tt.instructions):
+			t.Errorf("%d '%s': mismatched instructions \nActual  : %#v\nExpected: %#v", i, tt.expression, inst, tt.instructions)
+		}
+	}
+	// errors about a clause say where it is
+	var compileErr *CompileError
+	if _, err := Compile("port 80 or port foo", LinkTypeEthernet); !errors.As(err, &compileErr) || compileErr.Token != "foo" {
+		t.Errorf("mismatched error %#v, expected a CompileError of foo", err)
+	}
+}
+
+func TestExpressionZone(t *testing.T) {
+	tests := []struct {
+		scoped, bare string
+	}{
+		{"host fe80::1%eth0", "host fe80::1"},
+		{"ip6 src host fe80::1%en0", "ip6 src host fe80::1"},
+		{"host fe80::1%eth0 and port 80", "host fe80::1 and port 80"},
+	}
+	for i, tt := range tests {
+		scoped, bare := NewExpression(tt.scoped).Compile(), NewExpression(tt.bare).Compile()
+		if !scoped.Equal(bare) {
+			t.Errorf("%d '%s': mismatched value\nactual   %#v\nexpected %#v", i, tt.scoped, scoped, bare)
+			continue
+		}
+		scopedInst, err := scoped.Compile()
+		if err != nil {
+			t.Fatalf("%d '%s': unexpected error: %v", i, tt.scoped, err)
+		}
+		bareInst, err := bare.Compile()
+		if err != nil {
+			t.Fatalf("%d '%s': unexpected error: %v", i, tt.bare, err)
+		}
+		if !compareInstructions(scopedInst, bareInst) {
+			t.Errorf("%d '%s': mismatched instructions \nActual  : %#v\nExpected: %#v", i, tt.scoped, scopedInst, bareInst)
+		}
+	}
+}
+
+// describeFilter walk a parsed filter with its accessors, writing each node as
+// "[not] <protocol>/<subprotocol>/<direction>/<kind>/<id>", and composites as "(a and b)"
+func describeFilter(t *testing.T, f Filter) string {
+	switch v := f.(type) {
+	case PrimitiveFilter:
+		s := fmt.Sprintf("%s/%s/%s/%s/%s", v.Protocol(), v.SubProtocol(), v.Direction(), v.Kind(), v.ID())
+		if v.Negated() {
+			s = "not " + s
+		}
+		return s
+	case CompositeFilter:
+		joiner := " or "
+		if v.And() {
+			joiner = " and "
+		}
+		children := make([]string, 0, len(v.Children()))
+		for _, c := range v.Children() {
+			children = append(children, describeFilter(t, c))
+		}
+		return "(" + strings.Join(children, joiner) + ")"
+	default:
+		t.Fatalf("parsed filter %#v is neither a primitive nor a composite", f)
+		return ""
+	}
+}
+
+func TestExpressionOperatorAliases(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"tcp && port 80", "tcp and port 80"},
+		{"tcp&&port 80", "tcp and port 80"},
+		{"udp || tcp", "udp or tcp"},
+		{"(udp||tcp) && host 10.0.0.1", "(udp or tcp) and host 10.0.0.1"},
+		{"! udp", "not udp"},
+		{"!udp", "not udp"},
+		{"tcp && !port 22", "tcp and not port 22"},
+		{"!src or dst host 10.0.0.1", "not src or dst host 10.0.0.1"},
+	}
+	for i, tt := range tests {
+		actual, expected := NewExpression(tt.expression).Parse(), NewExpression(tt.expected).Parse()
+		if !actual.Equal(expected) {
+			t.Errorf("%d '%s': mismatched tree\nactual   %#v\nexpected %#v", i, tt.expression, actual, expected)
+		}
+	}
+}
+
+func TestExpressionParse(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"tcp and (port 80 or port 443)", "(/tcp/src or dst// and (//src or dst/port/80 or //src or dst/port/443))"},
+		{"not ip6 src host fe80::1", "not ip6//src/host/fe80::1"},
+		{"udp and port 53", "/udp/src or dst/port/53"},
+		{"ether proto arp", "ether/arp/src or dst//"},
+		// not binds to the primitive that follows, direction and all, and no further
+		{"not src or dst host 10.0.0.1", "not //src or dst/host/10.0.0.1"},
+		{"not src and dst host 10.0.0.1", "not //src and dst/host/10.0.0.1"},
+		{"not src or dst host 10.0.0.1 and port 53", "(not //src or dst/host/10.0.0.1 and //src or dst/port/53)"},
+		{"not src host 10.0.0.1 or dst host 10.0.0.1", "(not //src/host/10.0.0.1 or //dst/host/10.0.0.1)"},
+	}
+	for i, tt := range tests {
+		if actual := describeFilter(t, NewExpression(tt.expression).Parse()); actual != tt.expected {
+			t.Errorf("%d '%s': mismatched tree\nactual   %s\nexpected %s", i, tt.expression, actual, tt.expected)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package filter
 
 import (
+	"fmt"
+
 	"golang.org/x/net/bpf"
 )
 
@@ -15,15 +17,36 @@ func (c composite) Compile() ([]bpf.Instruction, error) {
 	//   - if 'and', then a failure of any one is straight to fail
 	//   - if 'or', then a failure of any one means to move on to the next
 	// The simplest way to implement is to just have interim jump steps.
+	if p, ok := portSet(c); ok {
+		return p.Compile()
+	}
 	inst := []bpf.Instruction{}
-	size := uint32(c.Size())
+	size := c.Size()
+	// like tcpdump, once a vlan matched, everything after it looks past the tag; but, unlike
+	// tcpdump, only in the same "and", as each alternative of an "or" starts from the same place.
+	// The same goes for ipip and the outer ip header, which is inside of any tags, and for mpls labels.
+	var shift, ipShift, labels uint32
 	for i, f := range c.filters {
-		finst, err := f.Compile()
+		finst, err := compileAfterMpls(f, labels)
 		if err != nil {
 			return nil, err
 		}
+		finst = shiftOffsets(finst, ethernetHeaderSize, ipShift)
+		finst = shiftOffsets(finst, ethernetTypeOffset, shift)
+		if c.and {
+			shift += vlanShift(f)
+			ipShift += ipipShift(f)
+			labels += mplsLabels(f)
+		}
 		// remove the last two instructions, which are the returns, if we are not on the last one
 		if i == len(c.filters)-1 {
+			if isNegated(f) {
+				// a negated primitive reaches the second to last when it matched, which is where
+				// the jumps above go on success, so it gets a fail and a success of its own
+				inst = append(inst, finst[:len(finst)-2]...)
+				inst = append(inst, bpf.Jump{Skip: 1}, returnKeep, returnDrop)
+				continue
+			}
 			inst = append(inst, finst...)
 			continue
 		}
@@ -32,21 +55,78 @@ func (c composite) Compile() ([]bpf.Instruction, error) {
 		// now add the jump to the next steppf.
 		// the expectation of every primitive is that the second to last is success,
 		// and the last is fail. For that step.
-		if c.and {
+		// A negated primitive reaches the second to last when it did *not* match,
+		// so the success and fail jumps are swapped.
+		switch {
+		case c.and && isNegated(f):
+			// the primitive matched, so its negation failed
+			inst = append(inst, bpf.Jump{Skip: size - uint32(len(inst)) - 2})
+			inst = append(inst, bpf.Jump{Skip: 0})
+		case c.and:
 			// Each step is required, so if the previous step failed, it just fails.
 			// If it succeeded, go to the next one.
 			inst = append(inst, bpf.Jump{Skip: 1})
 			inst = append(inst, bpf.Jump{Skip: size - uint32(len(inst)) - 2})
-		} else {
+		case isNegated(f):
+			// the primitive did not match, so its negation succeeded
+			inst = append(inst, bpf.Jump{Skip: 1})
+			inst = append(inst, bpf.Jump{Skip: size - uint32(len(inst)) - 3})
+		default:
 			// Each step is not required, so if the previous step failed, go to next.
 			// If it succeeded, return success.
 			inst = append(inst, bpf.Jump{Skip: size - uint32(len(inst)) - 3})
 			inst = append(inst, bpf.Jump{Skip: 0})
 		}
 	}
+	// the jumps are only as good as Size, so if it is off, fail rather than have the kernel reject it, or worse
+	if err := checkJumps(inst); err != nil {
+		return nil, fmt.Errorf("invalid program: %v", err)
+	}
 	return inst, nil
 }
 
+// vlanShift how far a filter moves the offsets of the filters after it, by the vlan tags that it matches.
+// Not matching a vlan means that there is no tag, so it does not move them.
+func vlanShift(f Filter) uint32 {
+	return encapsulationShift(f, filterKindVlan, vlanTagSize)
+}
+
+// ipipShift how far a filter moves the offsets of the ip headers after it, by the outer ip headers of
+// the ip-in-ip packets that it matches
+func ipipShift(f Filter) uint32 {
+	return encapsulationShift(f, filterKindIPIP, ipipHeaderSize)
+}
+
+// encapsulationShift how far a filter moves offsets by matching primitives of kind, each size bytes
+func encapsulationShift(f Filter, kind filterKind, size uint32) uint32 {
+	switch v := f.(type) {
+	case primitive:
+		if v.kind == kind && !v.negator {
+			return size
+		}
+	case composite:
+		var shift uint32
+		for _, m := range v.filters {
+			s := encapsulationShift(m, kind, size)
+			switch {
+			case v.and:
+				shift += s
+			case s > shift:
+				// the alternatives of an "or" should agree; if they do not, take the most tags
+				shift = s
+			}
+		}
+		return shift
+	}
+	return 0
+}
+
+// isNegated whether the filter is a primitive with a negator
+func isNegated(f Filter) bool {
+	p, ok := f.(primitive)
+	return ok && p.negator
+}
+
 func (c composite) Equal(o Filter) bool {
 	if o == nil {
 		return false
@@ -58,15 +138,34 @@ func (c composite) Equal(o Filter) bool {
 	return c.and == oc.and && c.filters.Equal(oc.filters)
 }
 
-// Size how many elements do we expect
-func (c composite) Size() uint8 {
-	var size uint8
+// Size how many elements do we expect. It can be more than a primitive can jump, as a composite
+// joins its filters with jumps that are not limited to 8 bits.
+func (c composite) Size() uint32 {
+	if p, ok := portSet(c); ok {
+		return p.Size()
+	}
+	var size, labels uint32
 	for _, f := range c.filters {
-		size += f.Size()
+		size += sizeAfterMpls(f, labels)
+		if c.and {
+			labels += mplsLabels(f)
+		}
+	}
+	// a negated primitive at the end needs a jump to separate its returns from ours
+	if len(c.filters) > 0 && isNegated(c.filters[len(c.filters)-1]) {
+		size++
 	}
 	return size
 }
 
+func (c composite) Children() Filters {
+	return c.filters
+}
+
+func (c composite) And() bool {
+	return c.and
+}
+
 func (c composite) IsPrimitive() bool {
 	return false
 }
@@ -100,8 +199,8 @@ func (c composite) Distill() Filter {
 	if len(c.filters) == 1 {
 		return c.filters[0]
 	}
-	// only can distill with and
-	if !c.and {
+	// only can distill with and, and not with vlan, ipip or mpls, as the order of what comes after them matters
+	if !c.and || vlanShift(c) > 0 || ipipShift(c) > 0 || mplsLabels(c) > 0 {
 		return c
 	}
 	// we have "and" joiner, so perhaps we can combine overlapping elements
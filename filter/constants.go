@@ -9,21 +9,90 @@ const (
 	etherTypeIPv6              uint32 = 0x86dd
 	etherTypeArp               uint32 = 0x806
 	etherTypeRarp              uint32 = 0x8035
+	etherTypeVlan              uint32 = 0x8100
+	etherTypeMplsUnicast       uint32 = 0x8847
+	etherTypeMplsMulticast     uint32 = 0x8848
+	etherTypePppoeDiscovery    uint32 = 0x8863
+	etherTypePppoeSession      uint32 = 0x8864
+	etherTypeLldp              uint32 = 0x88cc
+	etherTypeLoopback          uint32 = 0x9000
+	ether8023MaxLength         uint32 = 0x05dc
+	llcSapStp                  uint32 = 0x42
+	vlanIDMask                 uint32 = 0x0fff
+	vlanTagSize                uint32 = 4
+	mplsLabelSize              uint32 = 4
+	mplsLabelMask              uint32 = 0xfffff000
+	mplsLabelShift             uint32 = 12
+	mplsMaxLabel               uint32 = 0xfffff
+	mplsBottomOfStack          uint32 = 0x01
 	jumpMask                   uint32 = 0x1fff
+	ip4DontFragment            uint32 = 0x40
+	ip4MoreFragments           uint32 = 0x20
+	ip4TypeOfService           uint32 = 15
+	ip4DscpMask                uint32 = 0xfc
+	ip4DscpShift               uint32 = 2
+	ip6VersionClass            uint32 = 14
+	ip6DscpMask                uint32 = 0x0fc0
+	ip6DscpShift               uint32 = 6
+	dscpMax                    uint32 = 0x3f
+	ipProtocolIcmp             uint32 = 0x01
+	ipProtocolIPIP             uint32 = 0x04
 	ipProtocolTCP              uint32 = 0x06
 	ipProtocolUDP              uint32 = 0x11
+	ipProtocolIcmp6            uint32 = 0x3a
 	ipProtocolSctp             uint32 = 0x84
+	ipProtocolHopByHop         uint32 = 0x00
+	ipProtocolIP6Routing       uint32 = 0x2b
+	ipProtocolAh               uint32 = 0x33
+	ipProtocolIP6DestOpts      uint32 = 0x3c
+	ipProtocolGre              uint32 = 0x2f
 	ip6SourcePort              uint32 = 54
 	ip6DestinationPort         uint32 = 56
 	ip4SourcePort              uint32 = 14
 	ip4DestinationPort         uint32 = 16
+	ip4GreProtocolType         uint32 = 16
 	ip4HeaderSize              uint32 = 14
 	ip4HeaderFlags             uint32 = 20
+	ip4VersionIHL              uint32 = 0x45
+	ipipHeaderSize             uint32 = 20
+	ip6PayloadLength           uint32 = 18
 	ip6SourceAddressStart      uint32 = 22
 	ip6DestinationAddressStart uint32 = 38
 	ip6ContinuationPacket      uint32 = 0x2c
+	ip6ExtensionHeader         uint32 = 54
+	ethernetTypeOffset         uint32 = 12
+	ethernetHeaderSize         uint32 = 14
+	linuxSLLHeaderSize         uint32 = 16
+	linuxSLL2HeaderSize        uint32 = 20
+	nullHeaderSize             uint32 = 4
 )
 
+// ip6Jumbo qualifier of ip6 for jumbograms, which carry their length in a hop-by-hop
+// option and leave the payload length 0
+const ip6Jumbo = "jumbo"
+
+// ProtochainDepth how many IPv6 extension headers "protochain" looks past for the protocol. As
+// there are no loops in bpf, each one adds 19 instructions to the filter. It must be from 1 to 10.
+var ProtochainDepth = 3
+
+// maxProtochainDepth the deepest protochain that still fits in the jumps of a primitive
+const maxProtochainDepth = 10
+
+// ip4DF qualifier of ip for packets with the Don't-Fragment flag set, e.g. for path MTU discovery
+const ip4DF = "df"
+
+// ip4Fragment qualifier of ip for fragments other than the first, whose offset is not 0, and which have no
+// header of the protocol that they carry
+const ip4Fragment = "fragment"
+
+// ip4MF qualifier of ip for packets with the More-Fragments flag set, which are all fragments but the last
+const ip4MF = "mf"
+
+// isIP4Flag whether id is a qualifier of ip for its flags or fragment offset
+func isIP4Flag(id string) bool {
+	return id == ip4DF || id == ip4Fragment || id == ip4MF
+}
+
 type filterKind int
 
 const (
@@ -32,20 +101,52 @@ const (
 	filterKindNet
 	filterKindPort
 	filterKindPortRange
+	filterKindVlan
+	filterKindProtochain
+	filterKindIPIP
+	filterKindMpls
+	filterKindTCPFlags
+	filterKindDscp
+	filterKindInbound
+	filterKindOutbound
 )
 
-//nolint:unused
 var kinds = map[string]filterKind{
-	"host":      filterKindHost,
-	"net":       filterKindNet,
-	"port":      filterKindPort,
-	"portrange": filterKindPortRange,
+	"host":       filterKindHost,
+	"net":        filterKindNet,
+	"port":       filterKindPort,
+	"portrange":  filterKindPortRange,
+	"vlan":       filterKindVlan,
+	"protochain": filterKindProtochain,
+	"ipip":       filterKindIPIP,
+	"mpls":       filterKindMpls,
+	"tcpflags":   filterKindTCPFlags,
+	"dscp":       filterKindDscp,
+	"inbound":    filterKindInbound,
+	"outbound":   filterKindOutbound,
 }
 var kinds2 = map[ExpressionToken]filterKind{
-	tokenHost:      filterKindHost,
-	tokenNet:       filterKindNet,
-	tokenPort:      filterKindPort,
-	tokenPortRange: filterKindPortRange,
+	tokenHost:       filterKindHost,
+	tokenNet:        filterKindNet,
+	tokenPort:       filterKindPort,
+	tokenPortRange:  filterKindPortRange,
+	tokenVlan:       filterKindVlan,
+	tokenProtochain: filterKindProtochain,
+	tokenIPIP:       filterKindIPIP,
+	tokenMpls:       filterKindMpls,
+	tokenDscp:       filterKindDscp,
+	tokenInbound:    filterKindInbound,
+	tokenOutbound:   filterKindOutbound,
+}
+
+// String the name of the kind, as in an expression
+func (k filterKind) String() string {
+	for name, kind := range kinds {
+		if kind == k {
+			return name
+		}
+	}
+	return ""
 }
 
 type filterDirection int
@@ -64,7 +165,6 @@ const (
 	filterDirectionAddr4
 )
 
-//nolint:unused
 var directions = map[string]filterDirection{
 	"src":         filterDirectionSrc,
 	"dst":         filterDirectionDst,
@@ -78,6 +178,16 @@ var directions = map[string]filterDirection{
 	"addr4":       filterDirectionAddr4,
 }
 
+// String the name of the direction, as in an expression
+func (d filterDirection) String() string {
+	for name, direction := range directions {
+		if direction == d {
+			return name
+		}
+	}
+	return ""
+}
+
 type filterProtocol int
 
 const (
@@ -91,18 +201,31 @@ const (
 	filterProtocolArp
 	filterProtocolRarp
 	filterProtocolDecnet
+	filterProtocolLlc
 )
 
 var protocols = map[string]filterProtocol{
-	"ether":   filterProtocolEther,
-	"fddi":    filterProtocolFddi,
-	"tr":      filterProtocolTr,
-	"wlan":    filterProtocolWlan,
-	"ip":      filterProtocolIP,
-	"ip6":     filterProtocolIP6,
-	"arp":     filterProtocolArp,
-	"rarp":    filterProtocolRarp,
-	"decnett": filterProtocolDecnet,
+	"ether":  filterProtocolEther,
+	"fddi":   filterProtocolFddi,
+	"tr":     filterProtocolTr,
+	"wlan":   filterProtocolWlan,
+	"ip":     filterProtocolIP,
+	"ip6":    filterProtocolIP6,
+	"arp":    filterProtocolArp,
+	"rarp":   filterProtocolRarp,
+	"decnet": filterProtocolDecnet,
+	"llc":    filterProtocolLlc,
+	"802.3":  filterProtocolLlc,
+}
+
+// String the name of the protocol, as in an expression
+func (p filterProtocol) String() string {
+	for name, protocol := range protocols {
+		if protocol == p {
+			return name
+		}
+	}
+	return ""
 }
 
 type filterSubProtocol int
@@ -134,6 +257,12 @@ const (
 	filterSubProtocolVrrp
 	filterSubProtocolUDP
 	filterSubProtocolTCP
+	filterSubProtocolHbh
+	filterSubProtocolGre
+	filterSubProtocolSctp
+	// filterSubProtocolEtherType an ethertype of "ether proto" that is not one of the others, by number
+	// or by a name in etherProtocols, which is the id of its primitive
+	filterSubProtocolEtherType
 	filterSubProtocolUnknown
 )
 
@@ -147,8 +276,8 @@ var subProtocols = map[string]filterSubProtocol{
 	"decnet":  filterSubProtocolDecnet,
 	"sca":     filterSubProtocolSca,
 	"lat":     filterSubProtocolLat,
-	"modpl":   filterSubProtocolMopdl,
-	"morpc":   filterSubProtocolMoprc,
+	"mopdl":   filterSubProtocolMopdl,
+	"moprc":   filterSubProtocolMoprc,
 	"iso":     filterSubProtocolIso,
 	"stp":     filterSubProtocolStp,
 	"ipx":     filterSubProtocolIPx,
@@ -163,4 +292,77 @@ var subProtocols = map[string]filterSubProtocol{
 	"vrrp":    filterSubProtocolVrrp,
 	"udp":     filterSubProtocolUDP,
 	"tcp":     filterSubProtocolTCP,
+	"hbh":     filterSubProtocolHbh,
+	"gre":     filterSubProtocolGre,
+	"sctp":    filterSubProtocolSctp,
+}
+
+// unsupportedProtocols the protocols that are parsed, as tcpdump has them, but cannot be compiled
+var unsupportedProtocols = map[filterProtocol]bool{
+	filterProtocolFddi:   true,
+	filterProtocolTr:     true,
+	filterProtocolWlan:   true,
+	filterProtocolDecnet: true,
+}
+
+// unsupportedSubProtocols the sub-protocols of the link layer that are parsed, as tcpdump has them,
+// but cannot be compiled
+var unsupportedSubProtocols = map[filterSubProtocol]bool{
+	filterSubProtocolAtalk:   true,
+	filterSubProtocolAarp:    true,
+	filterSubProtocolDecnet:  true,
+	filterSubProtocolSca:     true,
+	filterSubProtocolLat:     true,
+	filterSubProtocolMopdl:   true,
+	filterSubProtocolMoprc:   true,
+	filterSubProtocolIso:     true,
+	filterSubProtocolIPx:     true,
+	filterSubProtocolNetbeui: true,
+}
+
+// etherProtocols the names "ether proto" takes for ethertypes, beyond those of subProtocols
+var etherProtocols = map[string]uint32{
+	"loopback": etherTypeLoopback,
+	"loop":     etherTypeLoopback,
+	"lldp":     etherTypeLldp,
+	"pppoed":   etherTypePppoeDiscovery,
+	"pppoes":   etherTypePppoeSession,
+	"vlan":     etherTypeVlan,
+	"mpls":     etherTypeMplsUnicast,
+}
+
+// ipSubProtocol the ip protocol number of a sub-protocol that can be matched on its own, e.g. "tcp",
+// and over which versions of ip it runs
+type ipSubProtocol struct {
+	proto    uint32
+	ip4, ip6 bool
+}
+
+var ipSubProtocols = map[filterSubProtocol]ipSubProtocol{
+	filterSubProtocolTCP:   {proto: ipProtocolTCP, ip4: true, ip6: true},
+	filterSubProtocolUDP:   {proto: ipProtocolUDP, ip4: true, ip6: true},
+	filterSubProtocolSctp:  {proto: ipProtocolSctp, ip4: true, ip6: true},
+	filterSubProtocolIcmp:  {proto: ipProtocolIcmp, ip4: true},
+	filterSubProtocolIcmp6: {proto: ipProtocolIcmp6, ip6: true},
+}
+
+// ipProtocolNumbers the ip protocol numbers of the sub-protocols, beyond ipSubProtocols, that protochain can look for
+var ipProtocolNumbers = map[filterSubProtocol]uint32{
+	filterSubProtocolIgmp: 0x02,
+	filterSubProtocolGre:  ipProtocolGre,
+	filterSubProtocolEsp:  0x32,
+	filterSubProtocolAh:   ipProtocolAh,
+	filterSubProtocolPim:  0x67,
+	filterSubProtocolVrrp: 0x70,
+}
+
+// String the name of the sub-protocol, as in an expression. An unknown one, which has no name
+// of its own, is the id of its primitive.
+func (p filterSubProtocol) String() string {
+	for name, subProtocol := range subProtocols {
+		if subProtocol == p {
+			return name
+		}
+	}
+	return ""
 }
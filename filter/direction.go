@@ -0,0 +1,71 @@
+package filter
+
+import (
+	"errors"
+)
+
+// PacketDirection which way a packet went through the interface. It is not in the packet itself,
+// so filters cannot compile it into instructions; the capture has to check it.
+type PacketDirection int
+
+// packet directions, as the inbound and outbound primitives match them
+const (
+	PacketDirectionAny PacketDirection = iota
+	PacketDirectionInbound
+	PacketDirectionOutbound
+)
+
+// SplitPacketDirection take the inbound or outbound primitives out of a parsed filter, so that the
+// rest can be compiled, and the direction checked on capture. The direction only can be joined
+// to the rest with "and", e.g. "outbound and tcp port 80", and may be negated. If there is no rest,
+// it returns a nil Filter.
+func SplitPacketDirection(f Filter) (Filter, PacketDirection, error) {
+	switch v := f.(type) {
+	case primitive:
+		if !v.isPacketDirection() {
+			return f, PacketDirectionAny, nil
+		}
+		return nil, v.packetDirection(), nil
+	case composite:
+		var (
+			direction = PacketDirectionAny
+			rest      = make(Filters, 0, len(v.filters))
+		)
+		for _, m := range v.filters {
+			if p, ok := m.(primitive); ok && p.isPacketDirection() {
+				if !v.and {
+					return nil, direction, errors.New("inbound and outbound only can be joined to a filter with and")
+				}
+				d := p.packetDirection()
+				if direction != PacketDirectionAny && direction != d {
+					return nil, direction, errors.New("a filter cannot be both inbound and outbound")
+				}
+				direction = d
+				continue
+			}
+			// anywhere deeper, the direction would depend on the rest of the packet
+			if _, d, err := SplitPacketDirection(m); err != nil || d != PacketDirectionAny {
+				return nil, direction, errors.New("inbound and outbound only can be joined to a filter with and")
+			}
+			rest = append(rest, m)
+		}
+		switch len(rest) {
+		case 0:
+			return nil, direction, nil
+		case 1:
+			return rest[0], direction, nil
+		}
+		// what is left may combine now, e.g. "tcp and inbound and port 80"
+		v.filters = rest
+		return v.Distill(), direction, nil
+	}
+	return f, PacketDirectionAny, nil
+}
+
+// packetDirection the direction that an inbound or outbound primitive matches
+func (p primitive) packetDirection() PacketDirection {
+	if (p.kind == filterKindInbound) != p.negator {
+		return PacketDirectionInbound
+	}
+	return PacketDirectionOutbound
+}
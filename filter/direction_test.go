@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestSplitPacketDirection(t *testing.T) {
+	tests := []struct {
+		expression string
+		rest       string
+		direction  PacketDirection
+		err        bool
+	}{
+		{"outbound", "", PacketDirectionOutbound, false},
+		{"inbound", "", PacketDirectionInbound, false},
+		{"not inbound", "", PacketDirectionOutbound, false},
+		{"outbound and udp port 53", "udp port 53", PacketDirectionOutbound, false},
+		{"tcp and inbound and port 80", "tcp and port 80", PacketDirectionInbound, false},
+		{"inbound and inbound", "", PacketDirectionInbound, false},
+		{"udp port 53", "udp port 53", PacketDirectionAny, false},
+		{"outbound or udp", "", PacketDirectionAny, true},
+		{"inbound and outbound", "", PacketDirectionAny, true},
+		{"tcp and (port 80 or inbound)", "", PacketDirectionAny, true},
+	}
+	for i, tt := range tests {
+		rest, direction, err := SplitPacketDirection(NewExpression(tt.expression).Parse())
+		if (err != nil) != tt.err {
+			t.Errorf("%d '%s': mismatched error, actual %v, expected error %v", i, tt.expression, err, tt.err)
+		}
+		if tt.err {
+			continue
+		}
+		if direction != tt.direction {
+			t.Errorf("%d '%s': mismatched direction, actual %d, expected %d", i, tt.expression, direction, tt.direction)
+		}
+		var expected Filter
+		if tt.rest != "" {
+			expected = NewExpression(tt.rest).Parse()
+		}
+		if (rest == nil) != (expected == nil) || (rest != nil && !rest.Equal(expected)) {
+			t.Errorf("%d '%s': mismatched rest\nactual   %#v\nexpected %#v", i, tt.expression, rest, expected)
+		}
+	}
+	// on its own, the direction cannot be compiled
+	if _, err := NewExpression("outbound and udp").Parse().Compile(); err == nil {
+		t.Error("expected error compiling outbound")
+	}
+}
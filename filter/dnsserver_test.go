@@ -2,6 +2,7 @@ package filter
 
 import (
 	"net"
+	"strings"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
@@ -89,11 +90,15 @@ func (udp *udpConnection) Write(b []byte) error {
 	return nil
 }
 
-func respond(w *udpConnection, r *layers.DNS, answerType layers.DNSType, ip string) {
+// respond answer with ips, which may be several addresses, separated by commas
+func respond(w *udpConnection, r *layers.DNS, answerType layers.DNSType, ips string) {
 	replyMess := r
 	var err error
-	a := net.ParseIP(ip)
-	if a != nil {
+	for _, ip := range strings.Split(ips, ",") {
+		a := net.ParseIP(ip)
+		if a == nil {
+			continue
+		}
 		dnsAnswer := layers.DNSResourceRecord{
 			Type:  answerType,
 			IP:    a,
@@ -103,7 +108,7 @@ func respond(w *udpConnection, r *layers.DNS, answerType layers.DNSType, ip stri
 		replyMess.Answers = append(replyMess.Answers, dnsAnswer)
 	}
 	replyMess.QR = true
-	replyMess.ANCount = 1
+	replyMess.ANCount = uint16(len(replyMess.Answers))
 	replyMess.OpCode = layers.DNSOpCodeNotify
 	replyMess.AA = true
 	replyMess.ResponseCode = layers.DNSResponseCodeNoErr
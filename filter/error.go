@@ -0,0 +1,22 @@
+package filter
+
+// CompileError an error compiling an expression, with where in it the clause that caused it is, so
+// that the one that broke can be found in a long expression. Its message is that of the cause alone.
+type CompileError struct {
+	// Token the word of the expression that the error is about, usually the id of the primitive,
+	// e.g. "foo" in "port foo", or else its first word
+	Token string
+	// Position where Token starts in the expression, counting from 1, or 0 if the filter was not
+	// parsed from an expression
+	Position int
+	// Err the cause
+	Err error
+}
+
+func (e *CompileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,1360 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+/*
+ File contains tests that run compiled filters against real packets in a bpf.VM
+*/
+
+var (
+	testSrcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	testDstMAC = net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb}
+)
+
+// serializePacket serialize the layers into packet bytes, fixing lengths and checksums
+func serializePacket(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatalf("unable to serialize packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// udp4Packet build an Ethernet+IPv4+UDP packet, optionally tagged with vlan ids
+func udp4Packet(t *testing.T, src, dst string, srcPort, dstPort uint16, vlans ...uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	l := []gopacket.SerializableLayer{eth}
+	if len(vlans) > 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		for i, id := range vlans {
+			next := layers.EthernetTypeDot1Q
+			if i == len(vlans)-1 {
+				next = layers.EthernetTypeIPv4
+			}
+			l = append(l, &layers.Dot1Q{VLANIdentifier: id, Type: next})
+		}
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	l = append(l, ip, udp, gopacket.Payload("payload"))
+	return serializePacket(t, l...)
+}
+
+// udp6Packet build an Ethernet+IPv6+UDP packet, optionally with a hop-by-hop router alert option
+func udp6Packet(t *testing.T, src, dst string, srcPort, dstPort uint16, routerAlert bool) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	if routerAlert {
+		ip.HopByHop = &layers.IPv6HopByHop{}
+		// router alert, then PadN to fill out the 8 bytes
+		ip.HopByHop.Options = append(ip.HopByHop.Options,
+			&layers.IPv6HopByHopOption{OptionType: 0x05, OptionData: []byte{0, 0}},
+			&layers.IPv6HopByHopOption{OptionType: 0x01, OptionData: []byte{}},
+		)
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t, eth, ip, udp, gopacket.Payload("payload"))
+}
+
+// ip6ExtensionPacket build an Ethernet+IPv6 packet of the ip protocol proto, after the extension headers
+// of the given types, each the minimum 8 bytes, e.g. a fragment header
+func ip6ExtensionPacket(t *testing.T, proto layers.IPProtocol, extensions ...layers.IPProtocol) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: proto, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+	var payload []byte
+	for i, ext := range extensions {
+		if i == 0 {
+			ip.NextHeader = ext
+		}
+		next := proto
+		if i+1 < len(extensions) {
+			next = extensions[i+1]
+		}
+		// the next header, then a length of 0, i.e. 8 bytes, the rest left as zeroes
+		payload = append(payload, byte(next), 0, 0, 0, 0, 0, 0, 0)
+	}
+	// enough of a transport header for the filters, which only look at the protocol
+	payload = append(payload, make([]byte, 8)...)
+	return serializePacket(t, eth, ip, gopacket.Payload(payload))
+}
+
+// grePacket build an Ethernet+IPv4+GRE packet, encapsulating a packet of the given ethertype
+func grePacket(t *testing.T, protocol layers.EthernetType, inner ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("192.168.0.2")}
+	gre := &layers.GRE{Protocol: protocol}
+	return serializePacket(t, append([]gopacket.SerializableLayer{eth, ip, gre}, inner...)...)
+}
+
+// arpPacket build an Ethernet+ARP request with the given sender and target protocol addresses,
+// optionally tagged with vlan ids
+func arpPacket(t *testing.T, sender, target string, vlans ...uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeARP}
+	l := []gopacket.SerializableLayer{eth}
+	if len(vlans) > 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		for i, id := range vlans {
+			next := layers.EthernetTypeDot1Q
+			if i == len(vlans)-1 {
+				next = layers.EthernetTypeARP
+			}
+			l = append(l, &layers.Dot1Q{VLANIdentifier: id, Type: next})
+		}
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   testSrcMAC,
+		SourceProtAddress: net.ParseIP(sender).To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    net.ParseIP(target).To4(),
+	}
+	return serializePacket(t, append(l, arp)...)
+}
+
+// rarpPacket build an Ethernet+RARP packet with the given sender and target protocol addresses
+func rarpPacket(t *testing.T, sender, target string) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetType(etherTypeRarp)}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         4, // reverse reply
+		SourceHwAddress:   testSrcMAC,
+		SourceProtAddress: net.ParseIP(sender).To4(),
+		DstHwAddress:      testDstMAC,
+		DstProtAddress:    net.ParseIP(target).To4(),
+	}
+	return serializePacket(t, eth, arp)
+}
+
+// matchFilter compile the expression and run it against the Ethernet packet, returning if it matched
+func matchFilter(t *testing.T, expression string, data []byte) bool {
+	t.Helper()
+	return matchFilterLinkType(t, expression, LinkTypeEthernet, data)
+}
+
+// matchFilterLinkType compile the expression for the link type and run it against the packet, returning if it matched
+func matchFilterLinkType(t *testing.T, expression string, linkType uint32, data []byte) bool {
+	t.Helper()
+	return matchCompiled(t, expression, NewExpression(expression).Compile(), linkType, data)
+}
+
+// matchCompiled compile the filter for the link type and run it against the packet, returning if it matched
+func matchCompiled(t *testing.T, expression string, f Filter, linkType uint32, data []byte) bool {
+	t.Helper()
+	inst, err := f.Compile()
+	if err != nil {
+		t.Fatalf("'%s': unable to compile: %v", expression, err)
+	}
+	if inst, err = ForLinkType(inst, linkType); err != nil {
+		t.Fatalf("'%s': unable to compile for link type %d: %v", expression, linkType, err)
+	}
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		t.Fatalf("'%s': invalid program: %v", expression, err)
+	}
+	n, err := vm.Run(data)
+	if err != nil {
+		t.Fatalf("'%s': error running program: %v", expression, err)
+	}
+	return n > 0
+}
+
+func TestExecuteVlan(t *testing.T) {
+	untagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53, 100)
+	other := udp4Packet(t, "10.100.100.2", "10.100.100.1", 1234, 53)
+	qinq := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53, 100, 200)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"vlan", tagged, true},
+		{"vlan", untagged, false},
+		{"vlan 100", tagged, true},
+		{"vlan 200", tagged, false},
+		{"not vlan", tagged, false},
+		{"not vlan", untagged, true},
+		{"not vlan and ip host 10.100.100.100", untagged, true},
+		{"not vlan and ip host 10.100.100.100", tagged, false},
+		{"not vlan and ip host 10.100.100.100", other, false},
+		// what comes after a vlan looks past the tag
+		{"vlan and ip host 10.100.100.100", tagged, true},
+		{"vlan and ip host 10.100.100.100", untagged, false},
+		{"vlan 100 and udp dst port 53", tagged, true},
+		{"vlan 100 and udp dst port 54", tagged, false},
+		{"vlan and vlan", tagged, false},
+		// but only within the same "and"
+		{"vlan or ip host 10.100.100.100", untagged, true},
+		{"vlan and vlan 200 and udp dst port 53", qinq, true},
+		{"vlan 100 and vlan 200 and ip host 10.100.100.100", qinq, true},
+		{"vlan 100 and vlan 100", qinq, false},
+		{"vlan and udp dst port 53", qinq, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteVlanArp(t *testing.T) {
+	untagged := arpPacket(t, "10.100.100.100", "10.100.100.1")
+	tagged := arpPacket(t, "10.100.100.100", "10.100.100.1", 100)
+	qinq := arpPacket(t, "10.100.100.100", "10.100.100.1", 100, 200)
+	taggedIP := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53, 100)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"vlan and arp", tagged, true},
+		{"vlan and arp", untagged, false},
+		{"vlan and arp", taggedIP, false},
+		{"vlan and arp", qinq, false},
+		{"vlan and vlan and arp", qinq, true},
+		// without the vlan, the EtherType is the tag's
+		{"arp", tagged, false},
+		{"arp", untagged, true},
+		{"vlan 100 and arp", tagged, true},
+		{"vlan 200 and arp", tagged, false},
+		// the arp addresses are past the tag too
+		{"vlan and arp host 10.100.100.100", tagged, true},
+		{"vlan and arp dst host 10.100.100.1", tagged, true},
+		{"vlan and arp src host 10.100.100.1", tagged, false},
+		{"vlan and ether proto arp", tagged, true},
+		{"vlan and ip", tagged, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteEtherProto(t *testing.T) {
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetType(etherTypeLldp)}
+	lldp := serializePacket(t, eth, gopacket.Payload("lldp tlvs"))
+	tagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53, 100)
+	untagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ether proto lldp", lldp, true},
+		{"ether proto 0x88cc", lldp, true},
+		{"ether proto 35020", lldp, true},
+		{"ether proto lldp", untagged, false},
+		{"ether proto 0x8100", tagged, true},
+		{"ether proto 0x8100", untagged, false},
+		{"ether proto 0x800", untagged, true},
+		{"ether proto vlan", tagged, true},
+		{"not ether proto lldp", lldp, false},
+		{"ether proto lldp or ether proto 0x8100", tagged, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteNegation(t *testing.T) {
+	udp := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.100.100.100"), DstIP: net.ParseIP("10.100.100.1")}
+	tcpLayer := &layers.TCP{SrcPort: 1234, DstPort: 80}
+	_ = tcpLayer.SetNetworkLayerForChecksum(ip)
+	tcp := serializePacket(t, eth, ip, tcpLayer)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		// a negation last has its returns the other way around from the rest of the composite
+		{"udp or not tcp", udp, true},
+		{"udp or not tcp", tcp, false},
+		{"udp and not tcp", udp, true},
+		{"udp and not tcp", tcp, false},
+		{"not tcp and not udp", tcp, false},
+		{"ip and (udp or not tcp)", udp, true},
+		{"ip and (udp or not tcp)", tcp, false},
+		// not negates the whole primitive, including a direction of more than one word
+		{"not src or dst host 10.100.100.100", udp, false},
+		{"not src or dst host 10.100.100.1", udp, false},
+		{"not src or dst host 10.100.100.2", udp, true},
+		{"not src and dst host 10.100.100.100", udp, true},
+		{"not src or dst host 10.100.100.2 and udp", udp, true},
+		{"not src or dst host 10.100.100.2 and udp", tcp, false},
+		// and not what comes after it
+		{"not src host 10.100.100.100 or dst host 10.100.100.1", udp, true},
+		// the C-style operators
+		{"!udp", udp, false},
+		{"!udp", tcp, true},
+		{"ip && !udp", tcp, true},
+		{"udp || !tcp", tcp, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteGroups(t *testing.T) {
+	udp4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	udp6 := udp6Packet(t, "fe80::1", "fe80::2", 1234, 53, false)
+	tcp4 := tcp4Packet(t, &layers.TCP{})
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+	tcpLayer := &layers.TCP{SrcPort: 1234, DstPort: 53}
+	_ = tcpLayer.SetNetworkLayerForChecksum(ip6)
+	tcp6 := serializePacket(t, eth, ip6, tcpLayer)
+	tests := []struct {
+		expression string
+		// expected whether each of udp4, udp6, tcp4 to port 80 and tcp6 to port 53 matches
+		expected [4]bool
+	}{
+		{"(ip or ip6) and udp", [4]bool{true, true, false, false}},
+		{"udp and (ip or ip6)", [4]bool{true, true, false, false}},
+		{"((ip or ip6)) and udp", [4]bool{true, true, false, false}},
+		{"(ip and udp) or tcp", [4]bool{true, false, true, true}},
+		{"(tcp or udp) and port 53", [4]bool{true, true, false, true}},
+		{"(ip and udp) or (ip6 and tcp)", [4]bool{true, false, false, true}},
+		{"ip6 and (udp or tcp port 53)", [4]bool{false, true, false, true}},
+		// without them, and and or are of the same precedence, from left to right, as in tcpdump
+		{"ip and udp or tcp", [4]bool{true, false, true, true}},
+		{"tcp or udp and port 53", [4]bool{true, true, false, true}},
+	}
+	for i, tt := range tests {
+		for j, data := range [][]byte{udp4, udp6, tcp4, tcp6} {
+			if matched := matchFilter(t, tt.expression, data); matched != tt.expected[j] {
+				t.Errorf("%d '%s': mismatched result for packet %d, actual %v, expected %v", i, tt.expression, j, matched, tt.expected[j])
+			}
+		}
+	}
+}
+
+func TestExecutePortRange(t *testing.T) {
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"src portrange 1024-65535 and dst port 443", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1024, 443), true},
+		{"src portrange 1024-65535 and dst port 443", udp4Packet(t, "10.100.100.100", "10.100.100.1", 65535, 443), true},
+		{"src portrange 1024-65535 and dst port 443", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1023, 443), false},
+		{"src portrange 1024-65535 and dst port 443", udp4Packet(t, "10.100.100.100", "10.100.100.1", 50000, 80), false},
+		{"src portrange 1024-65535 and dst port 443", udp4Packet(t, "10.100.100.100", "10.100.100.1", 443, 50000), false},
+		{"portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 80, 1500), true},
+		{"portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1500, 80), true},
+		{"portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 80, 2001), false},
+		{"src and dst portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1000, 2000), true},
+		{"src and dst portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1000, 2001), false},
+		{"tcp portrange 1000-2000", udp4Packet(t, "10.100.100.100", "10.100.100.1", 1500, 1500), false},
+		{"port ssh or portrange 8000-8010", udp4Packet(t, "10.100.100.100", "10.100.100.1", 22, 50000), true},
+		{"port ssh or portrange 8000-8010", udp4Packet(t, "10.100.100.100", "10.100.100.1", 50000, 8010), true},
+		{"port ssh or portrange 8000-8010", udp6Packet(t, "2001:db8::1", "2001:db8::2", 8000, 50000, false), true},
+		{"port ssh or portrange 8000-8010", udp6Packet(t, "2001:db8::1", "2001:db8::2", 50000, 22, false), true},
+		{"port ssh or portrange 8000-8010", udp4Packet(t, "10.100.100.100", "10.100.100.1", 7999, 8011), false},
+		{"port ssh or portrange 8000-8010", udp6Packet(t, "2001:db8::1", "2001:db8::2", 23, 8011, false), false},
+		// the portrange has a kind, so it does not take the direction of the port before it
+		{"dst port ssh or portrange 8000-8010", udp4Packet(t, "10.100.100.100", "10.100.100.1", 22, 50000), false},
+		{"dst port ssh or portrange 8000-8010", udp4Packet(t, "10.100.100.100", "10.100.100.1", 8005, 50000), true},
+		// a bare id takes all of the qualifiers before it
+		{"dst port 8080 or ssh", udp4Packet(t, "10.100.100.100", "10.100.100.1", 50000, 22), true},
+		{"dst port 8080 or ssh", udp4Packet(t, "10.100.100.100", "10.100.100.1", 22, 50000), false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteSrcAndDstPort(t *testing.T) {
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2"), FragOffset: 100}
+	// a later fragment has no ports, whatever its payload looks like
+	fragment := serializePacket(t, eth, ip, gopacket.Payload{0x00, 0x16, 0x00, 0x16})
+	tests := []struct {
+		data     []byte
+		expected bool
+	}{
+		{udp4Packet(t, "10.0.0.1", "10.0.0.2", 22, 22), true},
+		{udp4Packet(t, "10.0.0.1", "10.0.0.2", 22, 80), false},
+		{udp4Packet(t, "10.0.0.1", "10.0.0.2", 80, 22), false},
+		{udp4Packet(t, "10.0.0.1", "10.0.0.2", 80, 80), false},
+		{udp6Packet(t, "2001:db8::1", "2001:db8::2", 22, 22, false), true},
+		{udp6Packet(t, "2001:db8::1", "2001:db8::2", 22, 80, false), false},
+		{udp6Packet(t, "2001:db8::1", "2001:db8::2", 80, 22, false), false},
+		{fragment, false},
+		{arpPacket(t, "10.0.0.1", "10.0.0.2"), false},
+	}
+	for i, tt := range tests {
+		// both ports must match, as with each checked on its own
+		for _, expression := range []string{"src and dst port 22", "src port 22 and dst port 22"} {
+			if matched := matchFilter(t, expression, tt.data); matched != tt.expected {
+				t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, expression, matched, tt.expected)
+			}
+		}
+	}
+}
+
+func TestExecuteHopByHop(t *testing.T) {
+	withHbh := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, true)
+	withoutHbh := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, false)
+	ip4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	// make sure the packet we built really does start with hop-by-hop options
+	if p := gopacket.NewPacket(withHbh, layers.LayerTypeEthernet, gopacket.Default); p.Layer(layers.LayerTypeIPv6HopByHop) == nil {
+		t.Fatal("test packet is missing the hop-by-hop header")
+	}
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip6 hbh", withHbh, true},
+		{"ip6 hbh", withoutHbh, false},
+		{"ip6 hbh", ip4, false},
+		{"not ip6 hbh", withoutHbh, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteJumbo(t *testing.T) {
+	// a jumbogram sets the payload length to 0 and carries the real one in a hop-by-hop option;
+	// only the payload length matters to the filter, so mark a packet with options as one
+	jumbo := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, true)
+	jumbo[ip6PayloadLength], jumbo[ip6PayloadLength+1] = 0, 0
+	normal := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, true)
+	ip4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip6 jumbo", jumbo, true},
+		{"ip6 jumbo", normal, false},
+		{"ip6 jumbo", ip4, false},
+		{"ip6 hbh jumbo", jumbo, true},
+		{"ip6 and ip6 jumbo", jumbo, true},
+		{"not ip6 jumbo", normal, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteLlc(t *testing.T) {
+	// spanning tree, which is carried in 802.3 frames with an llc header
+	llc := serializePacket(t,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeLLC},
+		&layers.LLC{DSAP: 0x42, SSAP: 0x42, Control: 0x03},
+		gopacket.Payload(make([]byte, 35)),
+	)
+	ip4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"llc", llc, true},
+		{"llc", ip4, false},
+		{"802.3", llc, true},
+		{"not llc", ip4, true},
+		{"ip", llc, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteStp(t *testing.T) {
+	stp := serializePacket(t,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeLLC},
+		&layers.LLC{DSAP: 0x42, SSAP: 0x42, Control: 0x03},
+		gopacket.Payload(make([]byte, 35)),
+	)
+	// an llc frame of another protocol, with a SNAP header
+	snap := serializePacket(t,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeLLC},
+		&layers.LLC{DSAP: 0xaa, SSAP: 0xaa, Control: 0x03},
+		gopacket.Payload(make([]byte, 35)),
+	)
+	// an ethernet frame whose payload starts with what would be the stp DSAP in an llc header
+	ip4 := serializePacket(t,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		gopacket.Payload(append([]byte{0x42}, make([]byte, 35)...)),
+	)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"stp", stp, true},
+		{"stp", snap, false},
+		{"stp", ip4, false},
+		{"ether proto stp", stp, true},
+		{"not stp", snap, true},
+		{"llc and stp", stp, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteDontFragment(t *testing.T) {
+	df := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	df[ip4HeaderFlags] |= byte(ip4DontFragment)
+	notDF := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	ip6 := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, false)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip df", df, true},
+		{"ip df", notDF, false},
+		{"ip df", ip6, false},
+		{"ip df and udp", df, true},
+		{"ip df and tcp", df, false},
+		{"ip df and gre", df, false},
+		{"not ip df", notDF, true},
+		{"not ip df", df, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+// fragmentPacket build an Ethernet+IPv4 fragment of a udp packet, at the offset in 8 bytes, maybe with more to come
+func fragmentPacket(t *testing.T, offset uint16, more bool) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2"), FragOffset: offset}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	return serializePacket(t, eth, ip, gopacket.Payload("fragment"))
+}
+
+func TestExecuteFragment(t *testing.T) {
+	first := fragmentPacket(t, 0, true)
+	middle := fragmentPacket(t, 100, true)
+	last := fragmentPacket(t, 100, false)
+	whole := udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 53)
+	ip6 := udp6Packet(t, "fe80::1", "ff02::16", 1234, 53, false)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip fragment", first, false},
+		{"ip fragment", middle, true},
+		{"ip fragment", last, true},
+		{"ip fragment", whole, false},
+		{"ip fragment", ip6, false},
+		{"ip mf", first, true},
+		{"ip mf", middle, true},
+		{"ip mf", last, false},
+		{"ip mf", whole, false},
+		// any fragment at all
+		{"ip fragment or ip mf", first, true},
+		{"ip fragment or ip mf", last, true},
+		{"ip fragment or ip mf", whole, false},
+		{"ip fragment and udp", middle, true},
+		{"ip fragment and tcp", middle, false},
+		// without the udp header, there are no ports to match
+		{"ip fragment and udp port 53", middle, false},
+		{"not ip fragment", whole, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+// dscpPacket build a udp packet over ipv4, or over ipv6 if ip6, whose ToS byte or traffic class is class
+func dscpPacket(t *testing.T, ip6 bool, class uint8) []byte {
+	t.Helper()
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5004}
+	if ip6 {
+		eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, TrafficClass: class, FlowLabel: 0xfffff, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, eth, ip, udp, gopacket.Payload("rtp"))
+	}
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, TOS: class, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t, eth, ip, udp, gopacket.Payload("rtp"))
+}
+
+func TestExecuteDscp(t *testing.T) {
+	// expedited forwarding is dscp 46, 0xb8 in the ToS byte or traffic class; the low 2 bits are ecn
+	ef4 := dscpPacket(t, false, 0xb8)
+	ef4ECN := dscpPacket(t, false, 0xbb)
+	af41 := dscpPacket(t, false, 0x88)
+	ef6 := dscpPacket(t, true, 0xb8)
+	ef6ECN := dscpPacket(t, true, 0xb9)
+	af6 := dscpPacket(t, true, 0x88)
+	// the dscp bits shifted down, which must not be taken for the dscp
+	low4 := dscpPacket(t, false, 46)
+	low6 := dscpPacket(t, true, 46)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip dscp 46", ef4, true},
+		{"ip dscp 46", ef4ECN, true},
+		{"ip dscp 46", af41, false},
+		{"ip dscp 46", low4, false},
+		{"ip dscp 46", ef6, false},
+		{"ip dscp 34", af41, true},
+		{"ip6 dscp 46", ef6, true},
+		{"ip6 dscp 46", ef6ECN, true},
+		{"ip6 dscp 46", af6, false},
+		{"ip6 dscp 46", low6, false},
+		{"ip6 dscp 46", ef4, false},
+		{"ip6 dscp 34", af6, true},
+		{"dscp 46", ef4, true},
+		{"dscp 46", ef6, true},
+		{"dscp 46", af41, false},
+		{"dscp 46", af6, false},
+		{"dscp 0", udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 53), true},
+		{"dscp 34 or 46", af6, true},
+		{"udp and dscp 46", ef4, true},
+		{"not dscp 46", af41, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteGre(t *testing.T) {
+	innerIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.100.100.100"), DstIP: net.ParseIP("10.100.100.1")}
+	greIP4 := grePacket(t, layers.EthernetTypeIPv4, innerIP, gopacket.Payload("payload"))
+	greEther := grePacket(t, layers.EthernetTypeTransparentEthernetBridging,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}, innerIP, gopacket.Payload("payload"))
+	plain := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"gre", greIP4, true},
+		{"gre", greEther, true},
+		{"gre", plain, false},
+		{"gre proto 0x0800", greIP4, true},
+		{"gre proto 0x0800", greEther, false},
+		{"gre proto 0x0800", plain, false},
+		{"gre proto 0x6558", greEther, true},
+		{"ip proto gre", greIP4, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteRarp(t *testing.T) {
+	rarp := rarpPacket(t, "10.100.100.1", "192.168.0.5")
+	plain := udp4Packet(t, "10.100.100.1", "192.168.0.5", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"rarp", rarp, true},
+		{"rarp", plain, false},
+		{"arp", rarp, false},
+		{"rarp host 10.100.100.1", rarp, true},
+		{"rarp host 192.168.0.5", rarp, true},
+		{"rarp host 10.100.100.2", rarp, false},
+		{"rarp host 10.100.100.1", plain, false},
+		{"rarp src host 10.100.100.1", rarp, true},
+		{"rarp src host 192.168.0.5", rarp, false},
+		{"rarp dst host 192.168.0.5", rarp, true},
+		{"rarp dst host 10.100.100.1", rarp, false},
+		{"rarp net 192.168.0.0/16", rarp, true},
+		{"rarp src net 192.168.0.0/16", rarp, false},
+		{"rarp net 172.16.0.0/12", rarp, false},
+		{"host 10.100.100.1", rarp, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteHostMultiAddress(t *testing.T) {
+	// multi.example.com resolves to two addresses of each family, each of which must match in its place
+	type packet struct {
+		name     string
+		data     []byte
+		ip6, arp bool
+		src, dst bool // whether the src or dst is an address of the host
+	}
+	var packets []packet
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		other := "192.0.2.99"
+		packets = append(packets,
+			packet{"udp4 src " + addr, udp4Packet(t, addr, other, 1234, 53), false, false, true, false},
+			packet{"udp4 dst " + addr, udp4Packet(t, other, addr, 1234, 53), false, false, false, true},
+			packet{"udp4 both " + addr, udp4Packet(t, addr, addr, 1234, 53), false, false, true, true},
+			packet{"arp sender " + addr, arpPacket(t, addr, other), false, true, true, false},
+			packet{"arp target " + addr, arpPacket(t, other, addr), false, true, false, true},
+			packet{"rarp sender " + addr, rarpPacket(t, addr, other), false, true, true, false},
+		)
+	}
+	for _, addr := range []string{"2001:db8::1", "2001:db8::2"} {
+		other := "2001:db8::99"
+		packets = append(packets,
+			packet{"udp6 src " + addr, udp6Packet(t, addr, other, 1234, 53, false), true, false, true, false},
+			packet{"udp6 dst " + addr, udp6Packet(t, other, addr, 1234, 53, false), true, false, false, true},
+			packet{"udp6 both " + addr, udp6Packet(t, addr, addr, 1234, 53, false), true, false, true, true},
+		)
+	}
+	packets = append(packets,
+		packet{"udp4 neither", udp4Packet(t, "192.0.2.98", "192.0.2.99", 1234, 53), false, false, false, false},
+		packet{"udp6 neither", udp6Packet(t, "2001:db8::98", "2001:db8::99", 1234, 53, false), true, false, false, false},
+		// one address of the host as the src, and another as the dst, which is not a match for
+		// "src and dst host", as that is of each address, as tcpdump has it
+		packet{"udp4 across", udp4Packet(t, "192.0.2.1", "192.0.2.2", 1234, 53), false, false, true, true},
+		packet{"udp6 across", udp6Packet(t, "2001:db8::1", "2001:db8::2", 1234, 53, false), true, false, true, true},
+	)
+	tests := []struct {
+		expression string
+		expected   func(p packet) bool
+	}{
+		{"host multi.example.com", func(p packet) bool { return p.src || p.dst }},
+		{"src host multi.example.com", func(p packet) bool { return p.src }},
+		{"dst host multi.example.com", func(p packet) bool { return p.dst }},
+		{"src and dst host multi.example.com", func(p packet) bool {
+			return p.src && p.dst && !strings.HasSuffix(p.name, "across")
+		}},
+		{"ip host multi.example.com", func(p packet) bool { return !p.ip6 && !p.arp && (p.src || p.dst) }},
+		{"ip6 host multi.example.com", func(p packet) bool { return p.ip6 && (p.src || p.dst) }},
+		{"arp host multi.example.com", func(p packet) bool {
+			return p.arp && !strings.HasPrefix(p.name, "rarp") && (p.src || p.dst)
+		}},
+		{"rarp src host multi.example.com", func(p packet) bool { return strings.HasPrefix(p.name, "rarp") && p.src }},
+	}
+	for _, tt := range tests {
+		for _, p := range packets {
+			if matched, expected := matchFilter(t, tt.expression, p.data), tt.expected(p); matched != expected {
+				t.Errorf("'%s' %s: mismatched result, actual %v, expected %v", tt.expression, p.name, matched, expected)
+			}
+		}
+	}
+}
+
+func TestExecuteHostDualStack(t *testing.T) {
+	// www.google.com resolves to an address of each family, either of which is the host
+	ip4, ip6 := "216.58.207.36", "2a00:1450:4001:824::2004"
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"host www.google.com", udp4Packet(t, "10.0.0.1", ip4, 1234, 443), true},
+		{"host www.google.com", udp6Packet(t, ip6, "2001:db8::1", 443, 1234, false), true},
+		{"host www.google.com", udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 443), false},
+		{"host www.google.com", udp6Packet(t, "2001:db8::1", "2001:db8::2", 1234, 443, false), false},
+		{"ip host www.google.com", udp4Packet(t, ip4, "10.0.0.1", 443, 1234), true},
+		{"ip host www.google.com", udp6Packet(t, ip6, "2001:db8::1", 443, 1234, false), false},
+		{"ip6 host www.google.com", udp4Packet(t, ip4, "10.0.0.1", 443, 1234), false},
+		{"ip6 host www.google.com", udp6Packet(t, "2001:db8::1", ip6, 1234, 443, false), true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteNull(t *testing.T) {
+	// gopacket always writes the family little-endian, while the filter expects host byte order
+	if !hostLittleEndian() {
+		t.Skip("null headers only can be built for little-endian hosts")
+	}
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("127.0.0.1"), DstIP: net.ParseIP("127.0.0.2")}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip4)
+	null4 := serializePacket(t, &layers.Loopback{Family: layers.ProtocolFamilyIPv4}, ip4, udp, gopacket.Payload("payload"))
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("::1"), DstIP: net.ParseIP("::1")}
+	_ = udp.SetNetworkLayerForChecksum(ip6)
+	null6 := serializePacket(t, &layers.Loopback{Family: layers.ProtocolFamily(afInet6())}, ip6, udp, gopacket.Payload("payload"))
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip host 127.0.0.1", null4, true},
+		{"ip host 127.0.0.3", null4, false},
+		{"src host 127.0.0.1", null4, true},
+		{"dst host 127.0.0.1", null4, false},
+		{"udp dst port 53", null4, true},
+		{"tcp dst port 53", null4, false},
+		{"ip6", null6, true},
+		{"ip6", null4, false},
+		{"ip", null6, false},
+		{"udp port 53", null6, true},
+		{"arp", null4, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilterLinkType(t, tt.expression, LinkTypeNull, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteRaw(t *testing.T) {
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.100.100.100"), DstIP: net.ParseIP("10.100.100.1")}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip4)
+	raw4 := serializePacket(t, ip4, udp, gopacket.Payload("payload"))
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	_ = udp.SetNetworkLayerForChecksum(ip6)
+	raw6 := serializePacket(t, ip6, udp, gopacket.Payload("payload"))
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip host 10.100.100.100", raw4, true},
+		{"ip host 10.100.100.2", raw4, false},
+		{"src host 10.100.100.100", raw4, true},
+		{"dst host 10.100.100.100", raw4, false},
+		{"udp dst port 53", raw4, true},
+		{"tcp dst port 53", raw4, false},
+		{"ip6", raw6, true},
+		{"ip6", raw4, false},
+		{"ip", raw6, false},
+		{"host 2001:db8::2", raw6, true},
+		{"udp port 53", raw6, true},
+		{"tcp port 80 or udp port 53", raw6, true},
+		{"not ip6 and udp port 53", raw4, true},
+		{"arp", raw4, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilterLinkType(t, tt.expression, LinkTypeRaw, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteLinuxSLL2(t *testing.T) {
+	// protocol, reserved, interface index, ARPHRD_ETHER, PACKET_HOST, address length and address
+	sll2 := func(etherType uint16, packet []byte) []byte {
+		hdr := []byte{byte(etherType >> 8), byte(etherType), 0, 0, 0, 0, 0, 2, 0, 1, 0, 6}
+		hdr = append(hdr, testSrcMAC...)
+		return append(append(hdr, 0, 0), packet[ethernetHeaderSize:]...)
+	}
+	udp4 := sll2(uint16(etherTypeIPv4), udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53))
+	udp6 := sll2(uint16(etherTypeIPv6), udp6Packet(t, "2001:db8::1", "2001:db8::2", 1234, 53, false))
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip host 10.100.100.100", udp4, true},
+		{"ip host 10.100.100.2", udp4, false},
+		{"udp dst port 53", udp4, true},
+		{"tcp dst port 53", udp4, false},
+		{"ip6", udp6, true},
+		{"ip6", udp4, false},
+		{"host 2001:db8::2", udp6, true},
+		{"udp port 53", udp6, true},
+	}
+	for i, tt := range tests {
+		if matched := matchFilterLinkType(t, tt.expression, LinkTypeLinuxSLL2, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+func TestExecuteIPv6ExtensionHeaders(t *testing.T) {
+	fragment, hopByHop := layers.IPProtocolIPv6Fragment, layers.IPProtocolIPv6HopByHop
+	tests := []struct {
+		expression string
+		proto      layers.IPProtocol
+		extensions []layers.IPProtocol
+		expected   bool
+	}{
+		// no extension headers
+		{"tcp", layers.IPProtocolTCP, nil, true},
+		{"udp", layers.IPProtocolUDP, nil, true},
+		{"sctp", layers.IPProtocolSCTP, nil, true},
+		{"icmp6", layers.IPProtocolICMPv6, nil, true},
+		{"ip6 tcp", layers.IPProtocolTCP, nil, true},
+		{"ip6 icmp6", layers.IPProtocolICMPv6, nil, true},
+		{"tcp", layers.IPProtocolUDP, nil, false},
+		{"icmp6", layers.IPProtocolTCP, nil, false},
+		{"icmp", layers.IPProtocolICMPv4, nil, false},
+		{"ip tcp", layers.IPProtocolTCP, nil, false},
+		// one extension header, which only is looked past if it is a fragment header
+		{"tcp", layers.IPProtocolTCP, []layers.IPProtocol{fragment}, true},
+		{"udp", layers.IPProtocolUDP, []layers.IPProtocol{fragment}, true},
+		{"sctp", layers.IPProtocolSCTP, []layers.IPProtocol{fragment}, true},
+		{"icmp6", layers.IPProtocolICMPv6, []layers.IPProtocol{fragment}, true},
+		{"ip6 udp", layers.IPProtocolUDP, []layers.IPProtocol{fragment}, true},
+		{"udp", layers.IPProtocolTCP, []layers.IPProtocol{fragment}, false},
+		{"tcp", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop}, false},
+		// two extension headers are past the maximum depth of one
+		{"tcp", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop, fragment}, false},
+		{"udp", layers.IPProtocolUDP, []layers.IPProtocol{fragment, fragment}, false},
+		{"icmp6", layers.IPProtocolICMPv6, []layers.IPProtocol{hopByHop, fragment}, false},
+	}
+	for i, tt := range tests {
+		data := ip6ExtensionPacket(t, tt.proto, tt.extensions...)
+		if matched := matchFilter(t, tt.expression, data); matched != tt.expected {
+			t.Errorf("%d '%s' %v after %v: mismatched result, actual %v, expected %v", i, tt.expression, tt.proto, tt.extensions, matched, tt.expected)
+		}
+	}
+	// the ip4 side of the bare protocols
+	ip4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	for _, expression := range []string{"udp", "ip udp"} {
+		if !matchFilter(t, expression, ip4) {
+			t.Errorf("'%s': did not match an ip4 udp packet", expression)
+		}
+	}
+	for _, expression := range []string{"tcp", "sctp", "icmp", "icmp6", "ip6 udp"} {
+		if matchFilter(t, expression, ip4) {
+			t.Errorf("'%s': matched an ip4 udp packet", expression)
+		}
+	}
+}
+
+func TestExecuteProtochain(t *testing.T) {
+	fragment, hopByHop, destination := layers.IPProtocolIPv6Fragment, layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Destination
+	tests := []struct {
+		expression string
+		proto      layers.IPProtocol
+		extensions []layers.IPProtocol
+		expected   bool
+	}{
+		// no extension headers
+		{"ip6 protochain tcp", layers.IPProtocolTCP, nil, true},
+		{"ip6 protochain tcp", layers.IPProtocolUDP, nil, false},
+		{"protochain 17", layers.IPProtocolUDP, nil, true},
+		// one extension header, of any kind
+		{"ip6 protochain tcp", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop}, true},
+		{"ip6 protochain tcp", layers.IPProtocolTCP, []layers.IPProtocol{fragment}, true},
+		{"ip6 protochain tcp", layers.IPProtocolTCP, []layers.IPProtocol{layers.IPProtocolAH}, true},
+		{"ip6 protochain tcp", layers.IPProtocolUDP, []layers.IPProtocol{hopByHop}, false},
+		{"protochain udp", layers.IPProtocolUDP, []layers.IPProtocol{destination}, true},
+		// the extension header itself can be looked for
+		{"ip6 protochain ah", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop, layers.IPProtocolAH}, true},
+		// up to the default depth of 3
+		{"ip6 protochain tcp", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop, destination, fragment}, true},
+		{"ip6 protochain tcp", layers.IPProtocolTCP, []layers.IPProtocol{hopByHop, destination, layers.IPProtocolIPv6Routing, fragment}, false},
+		// not ip6
+		{"ip protochain tcp", layers.IPProtocolTCP, nil, false},
+	}
+	for i, tt := range tests {
+		data := ip6ExtensionPacket(t, tt.proto, tt.extensions...)
+		if matched := matchFilter(t, tt.expression, data); matched != tt.expected {
+			t.Errorf("%d '%s' %v after %v: mismatched result, actual %v, expected %v", i, tt.expression, tt.proto, tt.extensions, matched, tt.expected)
+		}
+	}
+
+	// extension headers longer than the minimum, a 16 byte destination options header then a 16 byte
+	// authentication header, whose lengths are in 8 and 4 byte units, less 8 bytes
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 1, NextHeader: destination, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+	payload := append([]byte{byte(layers.IPProtocolAH), 1}, make([]byte, 14)...)
+	payload = append(payload, append([]byte{byte(layers.IPProtocolTCP), 2}, make([]byte, 14)...)...)
+	payload = append(payload, make([]byte, 8)...)
+	long := serializePacket(t, eth, ip, gopacket.Payload(payload))
+	if !matchFilter(t, "ip6 protochain tcp", long) {
+		t.Error("did not match tcp after long extension headers")
+	}
+	if matchFilter(t, "ip6 protochain udp", long) {
+		t.Error("matched udp after long extension headers")
+	}
+
+	// the ip4 side, which is the same as ip proto
+	ip4 := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	for expression, expected := range map[string]bool{"ip protochain udp": true, "protochain udp": true, "protochain tcp": false, "ip6 protochain udp": false} {
+		if matched := matchFilter(t, expression, ip4); matched != expected {
+			t.Errorf("'%s': mismatched result for an ip4 udp packet, actual %v, expected %v", expression, matched, expected)
+		}
+	}
+
+	// a shallower walk
+	defer func(depth int) { ProtochainDepth = depth }(ProtochainDepth)
+	ProtochainDepth = 1
+	if !matchFilter(t, "ip6 protochain tcp", ip6ExtensionPacket(t, layers.IPProtocolTCP, hopByHop)) {
+		t.Error("depth 1: did not match tcp after one extension header")
+	}
+	if matchFilter(t, "ip6 protochain tcp", ip6ExtensionPacket(t, layers.IPProtocolTCP, hopByHop, fragment)) {
+		t.Error("depth 1: matched tcp after two extension headers")
+	}
+	ProtochainDepth = 0
+	if _, err := NewExpression("ip6 protochain tcp").Compile().Compile(); err == nil {
+		t.Error("depth 0: did not error")
+	}
+}
+
+// ipipPacket build an Ethernet+IPv4 packet from outerSrc to outerDst, carrying an IPv4+UDP packet from src to dst,
+// optionally tagged with a vlan id
+func ipipPacket(t *testing.T, outerSrc, outerDst, src, dst string, vlans ...uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	l := []gopacket.SerializableLayer{eth}
+	for _, id := range vlans {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		l = append(l, &layers.Dot1Q{VLANIdentifier: id, Type: layers.EthernetTypeIPv4})
+	}
+	outer := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolIPv4, SrcIP: net.ParseIP(outerSrc), DstIP: net.ParseIP(outerDst)}
+	inner := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(inner)
+	l = append(l, outer, inner, udp, gopacket.Payload("payload"))
+	return serializePacket(t, l...)
+}
+
+func TestExecuteIPIP(t *testing.T) {
+	tunneled := ipipPacket(t, "192.168.0.1", "192.168.0.2", "10.0.0.1", "10.0.0.2")
+	plain := udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ipip", tunneled, true},
+		{"ipip", plain, false},
+		// the inner addresses, after ipip
+		{"ipip and ip host 10.0.0.1", tunneled, true},
+		{"ipip and ip dst host 10.0.0.2", tunneled, true},
+		{"ipip and ip host 192.168.0.1", tunneled, false},
+		{"ipip and ip host 10.0.0.1", plain, false},
+		{"ipip and udp port 53", tunneled, true},
+		{"ipip and tcp port 53", tunneled, false},
+		// the outer addresses, without it
+		{"ip host 192.168.0.1", tunneled, true},
+		{"ip host 10.0.0.1", tunneled, false},
+		// either
+		{"ip host 10.0.0.1 or (ipip and ip host 10.0.0.1)", tunneled, true},
+		{"ip host 10.0.0.1 or (ipip and ip host 10.0.0.1)", plain, true},
+		// not ipip means there is no outer header to look past
+		{"not ipip and ip host 10.0.0.1", plain, true},
+		{"not ipip and ip host 10.0.0.1", tunneled, false},
+		// inside a vlan tag
+		{"vlan 100 and ipip and ip host 10.0.0.1", ipipPacket(t, "192.168.0.1", "192.168.0.2", "10.0.0.1", "10.0.0.2", 100), true},
+		{"vlan 100 and ipip and ip host 192.168.0.1", ipipPacket(t, "192.168.0.1", "192.168.0.2", "10.0.0.1", "10.0.0.2", 100), false},
+		{"vlan and ipip and ip host 10.0.0.1", tunneled, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+// mplsPacket build an ipv4 udp packet under the given stack of mpls labels, the last of which is the bottom
+func mplsPacket(t *testing.T, src, dst string, labels ...uint32) []byte {
+	t.Helper()
+	l := []gopacket.SerializableLayer{&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeMPLSUnicast}}
+	for i, label := range labels {
+		l = append(l, &layers.MPLS{Label: label, StackBottom: i == len(labels)-1, TTL: 64})
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	l = append(l, ip, udp, gopacket.Payload("payload"))
+	return serializePacket(t, l...)
+}
+
+func TestExecuteMpls(t *testing.T) {
+	labeled := mplsPacket(t, "10.0.0.1", "10.0.0.2", 18)
+	stacked := mplsPacket(t, "10.0.0.1", "10.0.0.2", 100, 200)
+	plain := udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 53)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"mpls", labeled, true},
+		{"mpls", plain, false},
+		{"mpls 18", labeled, true},
+		{"mpls 19", labeled, false},
+		// after the label
+		{"mpls 18 and ip host 10.0.0.1", labeled, true},
+		{"mpls 18 and ip host 10.0.0.3", labeled, false},
+		{"mpls and udp port 53", labeled, true},
+		{"mpls and tcp port 53", labeled, false},
+		{"mpls and ip6", labeled, false},
+		{"mpls and ip host 10.0.0.1", plain, false},
+		// without it, there is no ip at all
+		{"ip host 10.0.0.1", labeled, false},
+		// stacked
+		{"mpls 100 mpls 200", stacked, true},
+		{"mpls 100 and mpls 200 and ip dst host 10.0.0.2", stacked, true},
+		{"mpls 200", stacked, false},
+		{"mpls 100 and mpls 300", stacked, false},
+		// the label after the bottom of the stack is not a label
+		{"mpls 18 and mpls", labeled, false},
+		{"mpls and ip host 10.0.0.1", stacked, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+// tcp4Packet build an Ethernet+IPv4 packet with the given tcp header, and maybe ip options, which move it along
+func tcp4Packet(t *testing.T, tcp *layers.TCP, options ...layers.IPv4Option) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2"), Options: options}
+	tcp.SrcPort, tcp.DstPort = 1234, 80
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t, eth, ip, tcp)
+}
+
+// ip6PrefixBounds the first and last addresses in the prefix of addr, and the ones just before and after it
+func ip6PrefixBounds(addr string, prefix int) (first, last, before, after string) {
+	mask := net.CIDRMask(prefix, 128)
+	ip := net.ParseIP(addr).To16()
+	lo, hi := make(net.IP, net.IPv6len), make(net.IP, net.IPv6len)
+	for i := range ip {
+		lo[i] = ip[i] & mask[i]
+		hi[i] = ip[i] | ^mask[i]
+	}
+	below, above := make(net.IP, net.IPv6len), make(net.IP, net.IPv6len)
+	copy(below, lo)
+	copy(above, hi)
+	// borrow and carry across the bytes
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		below[i]--
+		if below[i] != 0xff {
+			break
+		}
+	}
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		above[i]++
+		if above[i] != 0 {
+			break
+		}
+	}
+	return lo.String(), hi.String(), below.String(), above.String()
+}
+
+func TestExecuteIP6NetPrefix(t *testing.T) {
+	// prefixes that end part way through a word, each in a different one
+	for _, prefix := range []int{33, 65, 97, 127} {
+		first, last, before, after := ip6PrefixBounds("2001:db8:aaaa:bbbb:cccc:dddd:eeee:ffff", prefix)
+		network := fmt.Sprintf("%s/%d", first, prefix)
+		inside, outside := []string{first, last}, []string{before, after}
+		for _, expression := range []string{"net", "ip6 net", "host", "ip6 host"} {
+			for _, direction := range []string{"src", "dst", "src or dst", "src and dst"} {
+				expr := fmt.Sprintf("%s %s %s", direction, expression, network)
+				for _, src := range append(inside, outside...) {
+					for _, dst := range append(inside, outside...) {
+						srcIn, dstIn := src == first || src == last, dst == first || dst == last
+						var expected bool
+						switch direction {
+						case "src":
+							expected = srcIn
+						case "dst":
+							expected = dstIn
+						case "src or dst":
+							expected = srcIn || dstIn
+						case "src and dst":
+							expected = srcIn && dstIn
+						}
+						data := udp6Packet(t, src, dst, 1234, 53, false)
+						if matched := matchFilter(t, expr, data); matched != expected {
+							t.Errorf("'%s' %s > %s: mismatched result, actual %v, expected %v", expr, src, dst, matched, expected)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestExecuteTCPFlags(t *testing.T) {
+	syn := tcp4Packet(t, &layers.TCP{SYN: true})
+	synAck := tcp4Packet(t, &layers.TCP{SYN: true, ACK: true})
+	ack := tcp4Packet(t, &layers.TCP{ACK: true})
+	// a router alert option makes the ip header 24 bytes
+	synAckOptions := tcp4Packet(t, &layers.TCP{SYN: true, ACK: true}, layers.IPv4Option{OptionType: 0x94, OptionLength: 4, OptionData: []byte{0, 0}})
+	udp := udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 80)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", synAck, true},
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", syn, false},
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", ack, false},
+		{"tcp[tcpflags] == tcp-syn|tcp-ack", synAckOptions, true},
+		{"tcp[tcpflags] == tcp-syn", syn, true},
+		{"tcp[tcpflags] == tcp-syn", synAck, false},
+		{"tcp[tcpflags] == tcp-synack", synAck, true},
+		{"tcp[tcpflags] == 0x12", synAck, true},
+		{"tcp[13] == 2", syn, true},
+		{"tcp[tcpflags] != tcp-syn", synAck, true},
+		{"tcp[tcpflags] != tcp-syn", syn, false},
+		// the mask picks out the flags to compare
+		{"tcp[tcpflags] & tcp-syn != 0", synAck, true},
+		{"tcp[tcpflags] & tcp-syn != 0", ack, false},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", syn, true},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", synAck, false},
+		{"tcp[tcpflags] == tcp-syn|tcp-ack and port 80", synAck, true},
+		{"tcp[tcpflags] != tcp-syn", udp, false},
+	}
+	for i, tt := range tests {
+		if matched := matchFilter(t, tt.expression, tt.data); matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
+
+// TestExecutePortSet check that an "or" of ports, which is compiled to load each port once for all of them,
+// matches the same packets as each of the ports compiled on its own
+func TestExecutePortSet(t *testing.T) {
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2"), FragOffset: 100}
+	fragment := serializePacket(t, eth, ip, gopacket.Payload("53535353"))
+	corpus := [][]byte{
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 53, 1234),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 67),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 67, 53),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 53, 53),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 80),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 53, 100),
+		udp6Packet(t, "fe80::1", "fe80::2", 53, 1234, false),
+		udp6Packet(t, "fe80::1", "fe80::2", 1234, 67, false),
+		udp6Packet(t, "fe80::1", "fe80::2", 1234, 80, false),
+		tcp4Packet(t, &layers.TCP{SYN: true}),
+		fragment,
+	}
+	tests := []struct {
+		expression   string
+		alternatives []string
+	}{
+		{"port 53 or port 67", []string{"port 53", "port 67"}},
+		{"udp and (port 53 or port 67)", []string{"udp port 53", "udp port 67"}},
+		{"ip and (port 53 or port 67)", []string{"ip port 53", "ip port 67"}},
+		{"ip6 and (port 53 or port 67)", []string{"ip6 port 53", "ip6 port 67"}},
+		{"src port 53 or src port 1234 or src port 67", []string{"src port 53", "src port 1234", "src port 67"}},
+		{"tcp dst port 80 or tcp dst port 443", []string{"tcp dst port 80", "tcp dst port 443"}},
+		{"vlan 100 and (port 53 or port 67)", []string{"vlan 100 and port 53", "vlan 100 and port 67"}},
+		// not a set, as it would match a src of one and a dst of the other
+		{"src and dst port 53 or src and dst port 67", []string{"src and dst port 53", "src and dst port 67"}},
+		{"port 53 or portrange 60-70", []string{"port 53", "portrange 60-70"}},
+		{"port 53 or not port 67", []string{"port 53", "not port 67"}},
+	}
+	// the most there can be in a set, and too many, so each is on its own
+	for _, count := range []int{maxPortSet, 100} {
+		var ports []string
+		for port := 1; port <= count; port++ {
+			ports = append(ports, fmt.Sprintf("port %d", port+50))
+		}
+		tests = append(tests, struct {
+			expression   string
+			alternatives []string
+		}{strings.Join(ports, " or "), []string{fmt.Sprintf("portrange 51-%d", count+50)}})
+	}
+	for i, tt := range tests {
+		for j, data := range corpus {
+			var expected bool
+			for _, alternative := range tt.alternatives {
+				expected = expected || matchFilter(t, alternative, data)
+			}
+			if matched := matchFilter(t, tt.expression, data); matched != expected {
+				t.Errorf("%d '%s': packet %d mismatched result, actual %v, expected %v", i, tt.expression, j, matched, expected)
+			}
+		}
+	}
+}
+
+func TestExecuteRedundantProtocol(t *testing.T) {
+	corpus := [][]byte{
+		tcp4Packet(t, &layers.TCP{SYN: true}),
+		tcp4Packet(t, &layers.TCP{SYN: true, ACK: true}),
+		udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, 80),
+		udp4Packet(t, "10.0.0.3", "10.0.0.2", 1234, 80),
+		udp6Packet(t, "fe80::1", "fe80::2", 1234, 80, false),
+	}
+	tests := []struct {
+		parts   []string
+		smaller bool
+	}{
+		{[]string{"tcp", "port 80"}, true},
+		{[]string{"tcp", "host 10.0.0.1", "port 80"}, true},
+		{[]string{"tcp", "tcp[tcpflags] == tcp-syn"}, true},
+		{[]string{"udp", "host 10.0.0.1", "dst port 80"}, true},
+		// a host does not check the protocol in ip, so each is checked on its own
+		{[]string{"tcp", "host 10.0.0.1"}, false},
+		{[]string{"not ip", "not tcp"}, false},
+	}
+	for i, tt := range tests {
+		expression := strings.Join(tt.parts, " and ")
+		// each part compiled on its own, with nothing combined
+		before := composite{and: true}
+		for _, part := range tt.parts {
+			before.filters = append(before.filters, NewExpression(part).Compile())
+		}
+		after := NewExpression(expression).Compile()
+		if smaller := after.Size() < before.Size(); smaller != tt.smaller {
+			t.Errorf("%d '%s': size %d, was %d on its own", i, expression, after.Size(), before.Size())
+		}
+		for j, data := range corpus {
+			expected := matchCompiled(t, expression, before, LinkTypeEthernet, data)
+			if matched := matchCompiled(t, expression, after, LinkTypeEthernet, data); matched != expected {
+				t.Errorf("%d '%s': packet %d mismatched result, actual %v, expected %v", i, expression, j, matched, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// ExportC return inst as the C array of struct sock_filter that `tcpdump -dd` prints, one
+// `{ code, jt, jf, k },` line per instruction, for embedding the compiled filter in C programs
+// or eBPF loaders. It is headed by a comment line with the number of instructions, as the
+// array length is needed for the struct sock_fprog.
+func ExportC(inst []bpf.Instruction) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "/* %d instructions */\n", len(inst))
+	for n, in := range inst {
+		raw, err := in.Assemble()
+		if err != nil {
+			return "", fmt.Errorf("unable to assemble instruction %d %v: %v", n, in, err)
+		}
+		fmt.Fprintf(&b, "{ 0x%x, %d, %d, 0x%08x },\n", raw.Op, raw.Jt, raw.Jf, raw.K)
+	}
+	return b.String(), nil
+}
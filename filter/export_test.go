@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestExportC(t *testing.T) {
+	inst, err := NewExpression("ip host 10.100.100.100").Compile().Compile()
+	if err != nil {
+		t.Fatalf("unexpected error compiling: %v", err)
+	}
+	out, err := ExportC(inst)
+	if err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+	// tcpdump -dd ip host 10.100.100.100, after the count
+	expected := `/* 8 instructions */
+{ 0x28, 0, 0, 0x0000000c },
+{ 0x15, 0, 5, 0x00000800 },
+{ 0x20, 0, 0, 0x0000001a },
+{ 0x15, 2, 0, 0x0a646464 },
+{ 0x20, 0, 0, 0x0000001e },
+{ 0x15, 0, 1, 0x0a646464 },
+{ 0x6, 0, 0, 0x00040000 },
+{ 0x6, 0, 0, 0x00000000 },
+`
+	if out != expected {
+		t.Errorf("mismatched export, actual:\n%s\nexpected:\n%s", out, expected)
+	}
+}
+
+func TestExportCInvalid(t *testing.T) {
+	inst := []bpf.Instruction{bpf.LoadAbsolute{Off: 12, Size: 3}}
+	if _, err := ExportC(inst); err == nil {
+		t.Error("invalid instruction did not error")
+	}
+}
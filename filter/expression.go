@@ -3,6 +3,8 @@ package filter
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -35,42 +37,82 @@ const (
 	tokenPort
 	tokenPortRange
 	tokenEther
+	tokenVlan
+	tokenProtochain
+	tokenIPIP
+	tokenMpls
+	tokenDscp
+	tokenInbound
+	tokenOutbound
+	tokenLeftBracket
+	tokenRightBracket
+	tokenEqual
+	tokenNotEqual
+	tokenBitAnd
+	tokenBitOr
 )
 
 var lexerTokens = map[string]ExpressionToken{
-	"and":       tokenAnd,
-	"or":        tokenOr,
-	"not":       tokenNot,
-	"gateway":   tokenGateway,
-	"proto":     tokenProto,
-	"ether":     tokenEther,
-	"src":       tokenSrc,
-	"dst":       tokenDst,
-	"net":       tokenNet,
-	"port":      tokenPort,
-	"host":      tokenHost,
-	"portrange": tokenPortRange,
-	"ip":        tokenIP4,
-	"ip4":       tokenIP4,
-	"ip6":       tokenIP6,
-	"tcp":       tokenTCP,
-	"udp":       tokenUDP,
+	"and":        tokenAnd,
+	"or":         tokenOr,
+	"not":        tokenNot,
+	"gateway":    tokenGateway,
+	"proto":      tokenProto,
+	"ether":      tokenEther,
+	"src":        tokenSrc,
+	"dst":        tokenDst,
+	"net":        tokenNet,
+	"port":       tokenPort,
+	"host":       tokenHost,
+	"portrange":  tokenPortRange,
+	"ip":         tokenIP4,
+	"ip4":        tokenIP4,
+	"ip6":        tokenIP6,
+	"tcp":        tokenTCP,
+	"udp":        tokenUDP,
+	"vlan":       tokenVlan,
+	"protochain": tokenProtochain,
+	"ipip":       tokenIPIP,
+	"mpls":       tokenMpls,
+	"dscp":       tokenDscp,
+	"inbound":    tokenInbound,
+	"outbound":   tokenOutbound,
 }
 
 type buffer struct {
 	token ExpressionToken
 	word  string
+	// pos the position of the token in the expression, counting from 1
+	pos int
 }
 type Expression struct {
 	raw    string
 	lexer  expressionLexer
 	buffer buffer
+	// pos the position of the token last scanned
+	pos int
+	// strict whether only the last word of a primitive may be other than a keyword
+	strict bool
+	// err the first unrecognized token, in strict mode
+	err error
+	// impliedAnd whether to join the next element with "and", as between stacked labels, e.g. "mpls 100 mpls 200"
+	impliedAnd bool
+	// depth how many "( ... )" the token last scanned is in
+	depth int
+	// groupEnd whether the ")" of the current "( ... )" was scanned
+	groupEnd bool
 }
 
 type expressionLexer struct {
 	reader *bufio.Reader
+	// pos the number of runes read so far
+	pos int
+	// start the position of the token being scanned
+	start int
 }
 
+// NewExpression start parsing the expression. It is lenient, like tcpdump: any word that is not a
+// keyword is taken as the id of the primitive, e.g. a host name, even if it is a typo of a keyword.
 func NewExpression(s string) *Expression {
 	if s == "" {
 		return nil
@@ -86,6 +128,18 @@ func NewExpression(s string) *Expression {
 	return e
 }
 
+// NewStrictExpression start parsing the expression, like NewExpression, except that only the last word
+// of each primitive may be other than a keyword, so that a typo like "porrt 80" is reported as
+// `unrecognized token "porrt" at position 1` by Compile on the parsed filter, rather than taken as a
+// host. Host names still are accepted where the id goes, e.g. "host www.example.com".
+func NewStrictExpression(s string) *Expression {
+	e := NewExpression(s)
+	if e != nil {
+		e.strict = true
+	}
+	return e
+}
+
 // isWhitespace returns true if the rune is a space, tab, or newline.
 func isWhitespace(ch rune) bool {
 	return ch == ' ' || ch == '\t' || ch == '\n'
@@ -97,9 +151,9 @@ func isAlpha(ch rune) bool {
 }
 
 // isValidWord returns true if the rune is part of a valid word, which is broader
-// than just alphanumeric, e.g. 10.100.100.100/24 or fe200::
+// than just alphanumeric, e.g. 10.100.100.100/24, fe200:: or fe80::1%eth0
 func isValidWord(ch rune) bool {
-	return isAlpha(ch) || ch == '/' || ch == '.' || ch == ':' || ch == '-'
+	return isAlpha(ch) || ch == '/' || ch == '.' || ch == ':' || ch == '-' || ch == '%'
 }
 
 // scanWhitespace scan past all of the next whitespace
@@ -118,7 +172,9 @@ func (e *expressionLexer) scanWhitespace() ExpressionToken {
 }
 
 func (e *expressionLexer) unread() {
-	_ = e.reader.UnreadRune()
+	if e.reader.UnreadRune() == nil {
+		e.pos--
+	}
 }
 
 func (e *expressionLexer) read() rune {
@@ -126,6 +182,7 @@ func (e *expressionLexer) read() rune {
 	if err != nil {
 		return eof
 	}
+	e.pos++
 	return ch
 }
 
@@ -166,6 +223,7 @@ forloop:
 // Scan read the next element from the expression and convert it into a token
 // It might return a primitive, a composite or a joiner.
 func (e *expressionLexer) Scan() (ExpressionToken, string) {
+	e.start = e.pos + 1
 	ch := e.read()
 	if ch == eof {
 		return tokenEOF, ""
@@ -180,6 +238,36 @@ func (e *expressionLexer) Scan() (ExpressionToken, string) {
 		return tokenLeft, string(ch)
 	case ch == ')':
 		return tokenRight, string(ch)
+	case ch == '[':
+		return tokenLeftBracket, string(ch)
+	case ch == ']':
+		return tokenRightBracket, string(ch)
+	case ch == '=':
+		// = and == are the same
+		if e.read() != '=' {
+			e.unread()
+		}
+		return tokenEqual, "=="
+	case ch == '!':
+		// the C-style operators of tcpdump, which, like the braces, need no whitespace around them
+		if e.read() == '=' {
+			return tokenNotEqual, "!="
+		}
+		e.unread()
+		return tokenNot, string(ch)
+	case ch == '&' || ch == '|':
+		if next := e.read(); next != ch {
+			// a single one is of bits, as in tcp[tcpflags] & tcp-syn != 0
+			e.unread()
+			if ch == '&' {
+				return tokenBitAnd, string(ch)
+			}
+			return tokenBitOr, string(ch)
+		}
+		if ch == '&' {
+			return tokenAnd, "&&"
+		}
+		return tokenOr, "||"
 	case isAlpha(ch):
 		e.unread()
 		return e.scanWord()
@@ -188,11 +276,33 @@ func (e *expressionLexer) Scan() (ExpressionToken, string) {
 }
 
 // Compile build an abstract syntax tree of the expression, implemented in
-// a Filter.
+// a Filter. It is the same as Parse.
 func (e *Expression) Compile() Filter {
+	return e.Parse()
+}
+
+// Parse build an abstract syntax tree of the expression, without compiling it to instructions.
+// Each node is either a PrimitiveFilter or a CompositeFilter, so that it can be walked. Primitives
+// that qualify each other, e.g. "udp and port 53", are combined into one. In strict mode, an
+// expression with an unrecognized token parses to a single primitive, whose Compile returns the error.
+func (e *Expression) Parse() Filter {
+	f := e.parse()
+	if e.err != nil {
+		return primitive{err: e.err}
+	}
+	return f
+}
+
+// parse build the tree of the expression, up to the end of it or of the current "( ... )"
+func (e *Expression) parse() Filter {
 	// create a root element, which should be a composite. If it ends up having
 	// just one member, we will return just that at the end.
-	var combo composite
+	var (
+		combo  composite
+		joined bool
+		// last the primitive just before, whose qualifiers the next one may take
+		last *primitive
+	)
 
 	for {
 		var fe Element
@@ -202,26 +312,43 @@ func (e *Expression) Compile() Filter {
 		switch fe.Type() {
 		case Primitive:
 			p := fe.(primitive)
-			setPrimitiveDefaults(&p, combo.LastPrimitive())
+			setPrimitiveDefaults(&p, last)
 			combo.filters = append(combo.filters, p)
+			last = &p
 		case Composite:
 			c := fe.(composite)
 			combo.filters = append(combo.filters, c)
+			last = nil
 		case Joiner:
-			// it is not a primitive, so it is a joiner
-			isAnd := fe.(*and)
-			combo.and = bool(*isAnd)
+			// it is not a primitive, so it is a joiner. As in tcpdump, "and" and "or" are of the same
+			// precedence, from left to right, so a change of joiner groups all that came before it.
+			isAnd := bool(*fe.(*and))
+			if joined && isAnd != combo.and && len(combo.filters) > 1 {
+				combo = composite{filters: Filters{combo}}
+			}
+			combo.and, joined = isAnd, true
+		}
+		if e.groupEnd {
+			break
 		}
 	}
+	e.groupEnd = false
 	return combo.Distill()
 }
 
 func (e *Expression) scan() (ExpressionToken, string) {
 	tok, word := e.buffer.token, e.buffer.word
-	e.buffer.token, e.buffer.word = e.lexer.Scan()
+	e.pos = e.buffer.pos
+	e.fill()
 	return tok, word
 }
 
+// fill scan the next token into the buffer
+func (e *Expression) fill() {
+	e.buffer.token, e.buffer.word = e.lexer.Scan()
+	e.buffer.pos = e.lexer.start
+}
+
 func (e *Expression) scanPastWhitespace() (ExpressionToken, string) {
 	var (
 		tok  ExpressionToken
@@ -229,7 +356,8 @@ func (e *Expression) scanPastWhitespace() (ExpressionToken, string) {
 	)
 	for {
 		tok, word = e.buffer.token, e.buffer.word
-		e.buffer.token, e.buffer.word = e.lexer.Scan()
+		e.pos = e.buffer.pos
+		e.fill()
 		if tok != tokenWhitespace {
 			break
 		}
@@ -251,7 +379,7 @@ func (e *Expression) peekPastWhitespace() (ExpressionToken, string) {
 		if tok != tokenWhitespace {
 			break
 		}
-		e.buffer.token, e.buffer.word = e.lexer.Scan()
+		e.fill()
 	}
 
 	return tok, word
@@ -268,8 +396,18 @@ func (e *Expression) Next() Element {
 	if !e.HasNext() {
 		return nil
 	}
+	if e.impliedAnd {
+		e.impliedAnd = false
+		j := and(true)
+		return &j
+	}
 
-	var inElement bool
+	var (
+		inElement bool
+		// idWord and idPos the word last taken as the id, if it was not after a kind
+		idWord string
+		idPos  int
+	)
 
 	p := primitive{
 		direction: filterDirectionUnset,
@@ -287,6 +425,11 @@ tokens:
 			// We account for the special case of "src and dst" or "src or dst" below.
 			return p
 		}
+		// stacked labels need not be joined, as there is nothing else they could mean
+		if inElement && p.kind == filterKindMpls && tok == tokenMpls {
+			e.impliedAnd = true
+			return p
+		}
 
 		tok, word := e.scanPastWhitespace()
 
@@ -310,9 +453,26 @@ tokens:
 			// start a new sub-element
 			return e.tokenBrace()
 		case tokenRight:
-			// end a sub-element
+			// end a sub-element, and the "( ... )" it is in, if there is one; a stray ")" is ignored
+			if e.depth == 0 {
+				return p
+			}
+			e.groupEnd = true
+			if p.pos == 0 && !p.negator {
+				return nil
+			}
 			return p
+		case tokenLeftBracket:
+			// the only accessor there is: tcp[tcpflags]
+			if p.subProtocol == filterSubProtocolTCP && p.kind == filterKindUnset && p.id == "" {
+				e.tcpFlags(&p)
+			} else if p.err == nil {
+				p.err = errors.New("only tcp[tcpflags] can be accessed")
+			}
+			continue tokens
 		case tokenNot:
+			// as in tcpdump, it negates the whole primitive that follows, including a direction of more
+			// than one word, so "not src or dst host X" is "not (src or dst host X)"
 			p.negator = true
 			continue tokens
 		case tokenGateway:
@@ -326,10 +486,19 @@ tokens:
 			if tok == tokenEOF {
 				continue tokens
 			}
+			p.token, p.pos = word, e.pos
+			// "gre proto <ethertype>" is the protocol encapsulated by gre, rather than an ip protocol
+			if p.subProtocol == filterSubProtocolGre {
+				p.id = word
+				continue tokens
+			}
 			// we will accept the protocol as "name" or "\name", because some get escaped
 			protoName := strings.TrimLeft(word, "\\")
 			if sub, ok := subProtocols[protoName]; ok {
 				p.subProtocol = sub
+			} else if _, err := getEtherType(protoName); err == nil && p.protocol == filterProtocolEther {
+				p.subProtocol = filterSubProtocolEtherType
+				p.id = protoName
 			} else {
 				p.subProtocol = filterSubProtocolUnknown
 				p.id = protoName
@@ -356,6 +525,14 @@ tokens:
 		case tokenDst:
 			p.direction = filterDirectionDst
 		}
+		// in strict mode, only the last word can be the id, so one before this must have been a typo
+		if e.strict && idPos != 0 && e.err == nil {
+			e.err = &CompileError{Token: idWord, Position: idPos, Err: fmt.Errorf("unrecognized token %q at position %d", idWord, idPos)}
+		}
+		idPos = 0
+		if p.pos == 0 {
+			p.token, p.pos = word, e.pos
+		}
 		// it must be a primitive word, so find it
 		if kind, ok := kinds2[tok]; ok {
 			p.kind = kind
@@ -365,13 +542,25 @@ tokens:
 			p.subProtocol = subprotocol
 		} else {
 			p.id = word
+			p.token, p.pos = word, e.pos
+			if tok == tokenID && p.kind == filterKindUnset {
+				idWord, idPos = word, e.pos
+			}
 		}
 	}
 }
 
 // tokenBrace process the innards of a "( ... )"
 func (e *Expression) tokenBrace() Filter {
-	return e.Compile()
+	e.depth++
+	defer func() { e.depth-- }()
+	f := e.parse()
+	// it already has its defaults, so keep it from being taken as a primitive that needs them,
+	// until it is distilled with what it is in
+	if p, ok := f.(primitive); ok {
+		return composite{filters: Filters{p}}
+	}
+	return f
 }
 
 // setPrimitiveDefaults set defaults on expressions
@@ -405,4 +594,7 @@ func setPrimitiveDefaults(p, lastPrimitive *primitive) {
 	if p.kind == filterKindUnset && p.protocol == filterProtocolUnset && p.subProtocol == filterSubProtocolUnset {
 		p.kind = filterKindHost
 	}
+	if p.kind == filterKindHost {
+		p.id = stripZone(p.id)
+	}
 }
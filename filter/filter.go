@@ -10,12 +10,39 @@ import (
 type Filter interface {
 	Compile() ([]bpf.Instruction, error)
 	Equal(o Filter) bool
-	Size() uint8
+	Size() uint32
 	IsPrimitive() bool
 	Type() ElementType
 	Distill() Filter
 }
 
+// PrimitiveFilter a single primitive of a parsed expression, e.g. "tcp dst port 80". Each
+// qualifier is as in the tcpdump syntax, or empty if it was not given.
+type PrimitiveFilter interface {
+	Filter
+	// Kind what the id is, e.g. "host", "net", "port", "portrange" or "vlan"
+	Kind() string
+	// Direction e.g. "src", "dst" or "src or dst"
+	Direction() string
+	// Protocol e.g. "ether", "ip" or "ip6"
+	Protocol() string
+	// SubProtocol e.g. "tcp" or "udp"
+	SubProtocol() string
+	// ID the host, network, port or other value that is matched
+	ID() string
+	// Negated whether the primitive is preceded by "not"
+	Negated() bool
+}
+
+// CompositeFilter filters joined by "and" or "or" in a parsed expression
+type CompositeFilter interface {
+	Filter
+	// Children the joined filters, in order
+	Children() Filters
+	// And whether the children are joined by "and", rather than "or"
+	And() bool
+}
+
 type ElementType uint8
 
 const (
@@ -1,6 +1,9 @@
 package filter
 
 import (
+	"fmt"
+	"net"
+
 	"golang.org/x/net/bpf"
 )
 
@@ -23,3 +26,38 @@ func (i *instructions) skipToFail() uint8 {
 func (i *instructions) skipToSucceed() uint8 {
 	return i.size - uint8(len(i.inst)) - 3
 }
+
+// appendAddressChecks append a check of each of addrs, of steps each, as check makes them, so that a
+// packet that does not match one address goes on to the next, and fails after the last
+func (i *instructions) appendAddressChecks(direction filterDirection, addrs []net.IP, steps uint8, check func(direction filterDirection, addr net.IP, fail, succeed uint8) []bpf.Instruction) {
+	for n, addr := range addrs {
+		fail := i.skipToFail()
+		if n < len(addrs)-1 {
+			// skip the rest of this check, to the next
+			fail = steps - 1
+		}
+		i.append(check(direction, addr, fail, i.skipToSucceed())...)
+	}
+}
+
+// checkJumps make sure that every jump lands within the program, as the kernel requires, so that a step
+// that was sized wrong is an error, rather than a jump past the end, or to the wrong place
+func checkJumps(inst []bpf.Instruction) error {
+	for i, in := range inst {
+		var skips []uint32
+		switch j := in.(type) {
+		case bpf.Jump:
+			skips = []uint32{j.Skip}
+		case bpf.JumpIf:
+			skips = []uint32{uint32(j.SkipTrue), uint32(j.SkipFalse)}
+		case bpf.JumpIfX:
+			skips = []uint32{uint32(j.SkipTrue), uint32(j.SkipFalse)}
+		}
+		for _, skip := range skips {
+			if uint64(i)+1+uint64(skip) >= uint64(len(inst)) {
+				return fmt.Errorf("step %d skips %d, past the end of the %d steps", i, skip, len(inst))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+)
+
+// link types for which filters can be compiled, compliant with pcap-linktype(7)
+const (
+	LinkTypeNull      uint32 = 0x00
+	LinkTypeEthernet  uint32 = 0x01
+	LinkTypeRaw       uint32 = 0x65
+	LinkTypeLinuxSLL  uint32 = 0x71
+	LinkTypeLinuxSLL2 uint32 = 0x114
+)
+
+// address families in a null header, which are those of the capturing host
+const (
+	afUnspec uint32 = 0
+	afInet   uint32 = 2
+)
+
+// ip versions in the high nibble of the first byte of a raw packet; versionUnspec is what other
+// EtherTypes become, which never matches as the low nibble is masked off
+const (
+	versionMask   uint32 = 0xf0
+	versionIPv4   uint32 = 0x40
+	versionIPv6   uint32 = 0x60
+	versionUnspec uint32 = 0x01
+)
+
+// linkHeader how the header of a link type differs from Ethernet, which is what primitives compile for
+type linkHeader struct {
+	// shift bytes to add to every offset past the Ethernet header
+	shift int32
+	// typeOffset where the EtherType is, if the header has one
+	typeOffset uint32
+	// macs if the header has the Ethernet destination and source addresses before the EtherType
+	macs bool
+	// family if, instead of an EtherType, the header starts with a 4 byte address family in host byte order
+	family bool
+	// version if there is no header, so the ip version of the packet stands in for the EtherType
+	version bool
+}
+
+// linkTypeOffset get the header layout of a link type
+func linkTypeOffset(linkType uint32) (linkHeader, error) {
+	switch linkType {
+	case LinkTypeEthernet:
+		return linkHeader{typeOffset: ethernetTypeOffset, macs: true}, nil
+	case LinkTypeLinuxSLL:
+		// 16 byte cooked header, with the protocol in its last 2 bytes, at 14
+		return linkHeader{shift: int32(linuxSLLHeaderSize) - int32(ethernetHeaderSize), typeOffset: 14}, nil
+	case LinkTypeLinuxSLL2:
+		// 20 byte cooked header, with the protocol in its first 2 bytes
+		return linkHeader{shift: int32(linuxSLL2HeaderSize) - int32(ethernetHeaderSize), typeOffset: 0}, nil
+	case LinkTypeNull:
+		// 4 byte address family
+		return linkHeader{shift: int32(nullHeaderSize) - int32(ethernetHeaderSize), family: true}, nil
+	case LinkTypeRaw:
+		// straight into the ip header
+		return linkHeader{shift: -int32(ethernetHeaderSize), version: true}, nil
+	default:
+		return linkHeader{}, fmt.Errorf("filters only are supported for Ethernet, Linux SLL, Linux SLL2, null and raw, not link type %d", linkType)
+	}
+}
+
+// ForLinkType relocate instructions compiled by a Filter, which always are for Ethernet, to
+// match packets of another link type. Only the loads change, as well as, for link types without an
+// EtherType, the comparisons against it. For raw packets, the EtherType load becomes two instructions,
+// masking the ip version, so the jumps over it are lengthened to match.
+func ForLinkType(inst []bpf.Instruction, linkType uint32) ([]bpf.Instruction, error) {
+	hdr, err := linkTypeOffset(linkType)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.macs {
+		return inst, nil
+	}
+	// what the accumulator may hold on reaching each instruction, so that we know which
+	// comparisons are against the EtherType; the program starts with it 0
+	etherType, other := make([]bool, len(inst)+1), make([]bool, len(inst)+1)
+	other[0] = true
+	reach := func(to int, ether, notEther bool) {
+		if to < len(etherType) {
+			etherType[to] = etherType[to] || ether
+			other[to] = other[to] || notEther
+		}
+	}
+	out := make([]bpf.Instruction, 0, len(inst))
+	// where each instruction starts in out, for lengthening the jumps
+	pos := make([]int, len(inst)+1)
+	for n, in := range inst {
+		pos[n] = len(out)
+		ether, notEther := etherType[n], other[n]
+		switch i := in.(type) {
+		case bpf.LoadAbsolute:
+			loadsEther := i.Off == ethernetTypeOffset && i.Size == lengthHalf
+			switch {
+			case i.Off < ethernetTypeOffset:
+				return nil, fmt.Errorf("ether addresses are not available for link type %d", linkType)
+			case i.Off < ethernetHeaderSize && (hdr.family || hdr.version):
+				if !loadsEther {
+					return nil, fmt.Errorf("cannot load %d bytes at offset %d for link type %d", i.Size, i.Off, linkType)
+				}
+				in = bpf.LoadAbsolute{Off: 0, Size: lengthWord}
+				if hdr.version {
+					// the version is the high nibble of the first byte
+					out = append(out, bpf.LoadAbsolute{Off: 0, Size: lengthByte})
+					in = bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: versionMask}
+				}
+			case i.Off < ethernetHeaderSize:
+				i.Off = i.Off - ethernetTypeOffset + hdr.typeOffset
+				in = i
+			default:
+				i.Off = uint32(int32(i.Off) + hdr.shift)
+				in = i
+			}
+			ether, notEther = loadsEther, !loadsEther
+		case bpf.LoadIndirect:
+			if i.Off < ethernetHeaderSize {
+				return nil, fmt.Errorf("cannot load %d bytes at offset %d for link type %d", i.Size, i.Off, linkType)
+			}
+			i.Off = uint32(int32(i.Off) + hdr.shift)
+			in = i
+			ether, notEther = false, true
+		case bpf.LoadMemShift:
+			// only changes X
+			if i.Off < ethernetHeaderSize {
+				return nil, fmt.Errorf("cannot load offset %d for link type %d", i.Off, linkType)
+			}
+			i.Off = uint32(int32(i.Off) + hdr.shift)
+			in = i
+		case bpf.JumpIf:
+			if (hdr.family || hdr.version) && ether {
+				if notEther || (i.Cond != bpf.JumpEqual && i.Cond != bpf.JumpNotEqual) {
+					return nil, fmt.Errorf("cannot compare the EtherType for link type %d", linkType)
+				}
+				if hdr.family {
+					i.Val = nullFamily(i.Val)
+				} else {
+					i.Val = ipVersion(i.Val)
+				}
+				in = i
+			}
+			reach(n+1+int(i.SkipTrue), ether, notEther)
+			reach(n+1+int(i.SkipFalse), ether, notEther)
+			out = append(out, in)
+			continue
+		case bpf.Jump:
+			reach(n+1+int(i.Skip), ether, notEther)
+			out = append(out, in)
+			continue
+		case bpf.RetA, bpf.RetConstant:
+			out = append(out, in)
+			continue
+		case bpf.StoreScratch, bpf.TAX:
+			// only read the accumulator
+		case bpf.LoadConstant:
+			if i.Dst == bpf.RegA {
+				ether, notEther = false, true
+			}
+		case bpf.LoadScratch:
+			if i.Dst == bpf.RegA {
+				ether, notEther = false, true
+			}
+		default:
+			ether, notEther = false, true
+		}
+		out = append(out, in)
+		reach(n+1, ether, notEther)
+	}
+	pos[len(inst)] = len(out)
+	if len(out) == len(inst) {
+		return out, nil
+	}
+	return lengthenJumps(inst, out, pos, linkType)
+}
+
+// lengthenJumps fix the jumps in out, which are those of inst, for the instructions in between
+// that were expanded; the instruction at n in inst starts at pos[n] in out, and jumps are not expanded.
+func lengthenJumps(inst, out []bpf.Instruction, pos []int, linkType uint32) ([]bpf.Instruction, error) {
+	skip := func(n int, skip uint32) uint32 {
+		return uint32(pos[n+1+int(skip)] - pos[n] - 1)
+	}
+	for n := range inst {
+		switch i := out[pos[n]].(type) {
+		case bpf.JumpIf:
+			skipTrue, skipFalse := skip(n, uint32(i.SkipTrue)), skip(n, uint32(i.SkipFalse))
+			if skipTrue > math.MaxUint8 || skipFalse > math.MaxUint8 {
+				return nil, fmt.Errorf("filter is too long to jump over for link type %d", linkType)
+			}
+			i.SkipTrue, i.SkipFalse = uint8(skipTrue), uint8(skipFalse)
+			out[pos[n]] = i
+		case bpf.Jump:
+			i.Skip = skip(n, i.Skip)
+			out[pos[n]] = i
+		}
+	}
+	return out, nil
+}
+
+// ipVersion the masked version byte of a raw packet, for an EtherType; raw packets only carry ip
+func ipVersion(etherType uint32) uint32 {
+	switch etherType {
+	case etherTypeIPv4:
+		return versionIPv4
+	case etherTypeIPv6:
+		return versionIPv6
+	default:
+		return versionUnspec
+	}
+}
+
+// nullFamily the address family word of a null header, as a 4 byte load reads it, for an EtherType.
+// The header is in the byte order of the capturing host, which is assumed to be this one, and only
+// carries IP, so anything else becomes AF_UNSPEC, which never matches.
+func nullFamily(etherType uint32) uint32 {
+	family := afUnspec
+	switch etherType {
+	case etherTypeIPv4:
+		family = afInet
+	case etherTypeIPv6:
+		family = afInet6()
+	}
+	// loads are big-endian
+	if hostLittleEndian() {
+		family = family>>24 | (family>>8)&0xff00 | (family<<8)&0xff0000 | family<<24
+	}
+	return family
+}
+
+// afInet6 AF_INET6, which, unlike AF_INET, differs between operating systems
+func afInet6() uint32 {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return 10
+	case "darwin", "ios":
+		return 30
+	case "freebsd", "dragonfly":
+		return 28
+	default:
+		// netbsd, openbsd
+		return 24
+	}
+}
+
+// hostLittleEndian if this host is little-endian
+func hostLittleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// mplsLabels how many mpls labels a filter matches, which the filters after it in an "and" look past
+func mplsLabels(f Filter) uint32 {
+	return encapsulationShift(f, filterKindMpls, 1)
+}
+
+// atMplsDepth f as it is compiled after labels mpls labels. An mpls primitive is the next label in the stack.
+func atMplsDepth(f Filter, labels uint32) Filter {
+	if p, ok := f.(primitive); ok && p.kind == filterKindMpls {
+		p.labels = labels
+		return p
+	}
+	return f
+}
+
+// compileAfterMpls compile f to look at what follows labels mpls labels. That has no EtherType, so, as for
+// raw packets, the ip version takes its place; every load then moves past the Ethernet header and the labels.
+func compileAfterMpls(f Filter, labels uint32) ([]bpf.Instruction, error) {
+	f = atMplsDepth(f, labels)
+	inst, err := f.Compile()
+	if err != nil || labels == 0 {
+		return inst, err
+	}
+	if p, ok := f.(primitive); ok && p.kind == filterKindMpls {
+		// it already knows where its label is
+		return inst, nil
+	}
+	if mplsLabels(f) > 0 {
+		return nil, errors.New("stacked mpls labels only can be joined with and")
+	}
+	if inst, err = ForLinkType(inst, LinkTypeRaw); err != nil {
+		return nil, fmt.Errorf("after mpls: %v", err)
+	}
+	return shiftOffsets(inst, 0, ethernetHeaderSize+mplsLabelSize*labels), nil
+}
+
+// sizeAfterMpls the size of f, as compileAfterMpls compiles it, which, for all but an mpls primitive,
+// is longer by an instruction for every load of the EtherType, to mask the ip version instead
+func sizeAfterMpls(f Filter, labels uint32) uint32 {
+	f = atMplsDepth(f, labels)
+	if p, ok := f.(primitive); labels == 0 || (ok && p.kind == filterKindMpls) {
+		return f.Size()
+	}
+	inst, err := f.Compile()
+	if err != nil {
+		return f.Size()
+	}
+	size := uint32(len(inst))
+	for _, in := range inst {
+		if in == loadEtherKind {
+			size++
+		}
+	}
+	return size
+}
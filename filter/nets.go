@@ -0,0 +1,32 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Nets build a filter that matches packets to or from any of the networks in cidrs, e.g. all of the
+// prefixes of an ASN, the same as "net a or net b or ...". The networks can be ip4 or ip6, and there
+// can be as many as fit in a program; unlike the jumps within a primitive, those between them are
+// not limited to 8 bits.
+func Nets(cidrs []string) (Filter, error) {
+	if len(cidrs) == 0 {
+		return nil, errors.New("no networks")
+	}
+	filters := make(Filters, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p := primitive{
+			kind:      filterKindNet,
+			direction: filterDirectionSrcOrDst,
+			id:        cidr,
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid network %s: %v", cidr, err)
+		}
+		filters = append(filters, p)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return composite{filters: filters}, nil
+}
@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestNets(t *testing.T) {
+	// enough networks that the jumps across them go well past 8 bits
+	var cidrs []string
+	for i := 0; i < 40; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.0.0/16", i))
+	}
+	for i := 0; i < 10; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("2001:db8:%x::/48", i))
+	}
+	// it is the same as the expression
+	if actual, expected := netsFilter(t, cidrs[:2]), NewExpression("net "+cidrs[0]+" or net "+cidrs[1]).Parse(); !actual.Equal(expected) {
+		t.Errorf("mismatched filter for 2 networks, actual %#v, expected %#v", actual, expected)
+	}
+	f := netsFilter(t, cidrs)
+	inst, err := f.Compile()
+	if err != nil {
+		t.Fatalf("unexpected error compiling: %v", err)
+	}
+	if len(inst) != int(f.Size()) || len(inst) <= 255 {
+		t.Fatalf("mismatched program of %d instructions, size %d", len(inst), f.Size())
+	}
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		t.Fatalf("invalid program: %v", err)
+	}
+	tests := []struct {
+		data     []byte
+		expected bool
+	}{
+		{udp4Packet(t, "192.168.1.1", "10.37.5.5", 1234, 53), true},
+		{udp4Packet(t, "10.0.0.1", "192.168.1.1", 1234, 53), true},
+		{udp4Packet(t, "192.168.1.1", "10.40.0.1", 1234, 53), false},
+		{udp6Packet(t, "2001:db8:9::1", "fe80::1", 1234, 53, false), true},
+		{udp6Packet(t, "fe80::1", "2001:db8:a::1", 1234, 53, false), false},
+	}
+	for i, tt := range tests {
+		n, err := vm.Run(tt.data)
+		if err != nil {
+			t.Fatalf("%d: error running program: %v", i, err)
+		}
+		if matched := n > 0; matched != tt.expected {
+			t.Errorf("%d: mismatched result, actual %v, expected %v", i, matched, tt.expected)
+		}
+	}
+}
+
+func TestNetsInvalid(t *testing.T) {
+	tests := [][]string{
+		nil,
+		{"10.0.0.0/8", "10.0.0.0/33"},
+		{"10.1.2.3/8"},
+		{"example"},
+	}
+	for i, cidrs := range tests {
+		if _, err := Nets(cidrs); err == nil {
+			t.Errorf("%d %v: expected error", i, cidrs)
+		}
+	}
+}
+
+// netsFilter build the filter for cidrs, failing if it cannot
+func netsFilter(t *testing.T, cidrs []string) Filter {
+	t.Helper()
+	f, err := Nets(cidrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f
+}
@@ -0,0 +1,69 @@
+package filter
+
+// maxPortSet the most ports that are compiled as a set, as the jumps over all of them in a primitive only go 255 steps
+const maxPortSet = 32
+
+// portSet the primitive that compiles c as tcpdump does, when c is an "or" of single ports with the same
+// qualifiers, e.g. "port 53 or port 67", or one joined with "and" to a primitive that qualifies all of them,
+// e.g. "udp and (port 53 or port 67)". Rather than check the protocols for each port, it checks them once,
+// and loads each of the src and dst port once to compare to all of the ports.
+func portSet(c composite) (primitive, bool) {
+	if c.and {
+		return qualifiedPortSet(c)
+	}
+	if len(c.filters) < 2 || len(c.filters) > maxPortSet {
+		return primitive{}, false
+	}
+	var set primitive
+	for i, f := range c.filters {
+		p, ok := f.(primitive)
+		// src and dst port is not the same as src and dst in any of them, since they can be different ones
+		if !ok || p.kind != filterKindPort || p.negator || p.direction == filterDirectionSrcAndDst || len(p.ports) > 0 {
+			return primitive{}, false
+		}
+		if i == 0 {
+			set = p
+			continue
+		}
+		if p.direction != set.direction || p.protocol != set.protocol || p.subProtocol != set.subProtocol {
+			return primitive{}, false
+		}
+		port, _, err := p.portRange()
+		if err != nil {
+			// compiled on its own, it reports the error
+			return primitive{}, false
+		}
+		set.ports = append(set.ports, port)
+	}
+	return set, true
+}
+
+// qualifiedPortSet the port set of c, an "and" of a primitive with only a protocol and an "or" of ports,
+// in either order, with the protocol of the primitive
+func qualifiedPortSet(c composite) (primitive, bool) {
+	if len(c.filters) != 2 {
+		return primitive{}, false
+	}
+	q, ok := c.filters[0].(primitive)
+	o, isComposite := c.filters[1].(composite)
+	if !ok || !isComposite {
+		q, ok = c.filters[1].(primitive)
+		o, isComposite = c.filters[0].(composite)
+	}
+	if !ok || !isComposite || o.and || q.kind != filterKindUnset || q.id != "" || q.negator {
+		return primitive{}, false
+	}
+	set, ok := portSet(o)
+	if !ok {
+		return primitive{}, false
+	}
+	combined := q.Combine(&set)
+	if combined == nil {
+		return primitive{}, false
+	}
+	combined.ports = set.ports
+	if combined.validate() != nil {
+		return primitive{}, false
+	}
+	return *combined, true
+}
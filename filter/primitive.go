@@ -2,16 +2,15 @@ package filter
 
 import (
 	"bytes"
-	"context"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
+	"strings"
 
 	"golang.org/x/net/bpf"
 )
 
-var resolver net.Resolver
-
 // primitive implements Filter and Element
 type primitive struct {
 	kind        filterKind
@@ -20,6 +19,43 @@ type primitive struct {
 	subProtocol filterSubProtocol
 	negator     bool
 	id          string
+	// err why the expression could not be parsed, in which case there is nothing else
+	err error
+	// labels how many mpls labels come before this one, for an mpls primitive
+	labels uint32
+	// ports the other ports that a port primitive matches, when it is compiled for an "or" of them
+	ports []uint32
+	// maxAddrs the most addresses of a hostname to check, as set by LimitHostAddresses, or 0 for
+	// DefaultMaxHostAddresses
+	maxAddrs int
+	// token and pos the word of the expression that an error compiling it is about, and where it is,
+	// as in CompileError
+	token string
+	pos   int
+}
+
+func (p primitive) Kind() string {
+	return p.kind.String()
+}
+
+func (p primitive) Direction() string {
+	return p.direction.String()
+}
+
+func (p primitive) Protocol() string {
+	return p.protocol.String()
+}
+
+func (p primitive) SubProtocol() string {
+	return p.subProtocol.String()
+}
+
+func (p primitive) ID() string {
+	return p.id
+}
+
+func (p primitive) Negated() bool {
+	return p.negator
 }
 
 func (p primitive) IsPrimitive() bool {
@@ -37,12 +73,39 @@ func (p primitive) Distill() Filter {
 // without any loss of information. If they are not combinable, returns nil; if they
 // are, returns a new primitive that represents both.
 func (p primitive) Combine(o *primitive) *primitive {
+	// vlan applies to the frame as a whole, rather than qualifying another primitive,
+	// so it never can be combined; not even with another vlan, which is the next tag in.
+	// Neither can inbound or outbound, which are applied apart from the instructions.
+	if p.kind == filterKindVlan || o.kind == filterKindVlan || p.kind == filterKindIPIP || o.kind == filterKindIPIP ||
+		p.kind == filterKindMpls || o.kind == filterKindMpls || p.isPacketDirection() || o.isPacketDirection() {
+		return nil
+	}
 	if p.Equal(o) {
 		return &p
 	}
+	// "not A and not B" is "not (A or B)", which no one primitive can be
+	if p.negator || o.negator {
+		return nil
+	}
+	// tcp flags already are of tcp over ip, so it only takes those, which it need not check again
+	if p.kind == filterKindTCPFlags || o.kind == filterKindTCPFlags {
+		flags, q := p, *o
+		if o.kind == filterKindTCPFlags {
+			flags, q = *o, p
+		}
+		if q.kind != filterKindUnset || q.id != "" || (q.direction != filterDirectionUnset && q.direction != flags.direction) ||
+			(q.protocol != filterProtocolUnset && q.protocol != filterProtocolIP) ||
+			(q.subProtocol != filterSubProtocolUnset && q.subProtocol != filterSubProtocolTCP) {
+			return nil
+		}
+		return &flags
+	}
 	// our definition of "combinable" is: all of the fields that are set in one are either
-	// set to the same value in the other, or Unset
-	c := primitive{}
+	// set to the same value in the other, or Unset. Any error is about the id, if one has it.
+	c := primitive{token: p.token, pos: p.pos}
+	if p.id == "" && o.id != "" {
+		c.token, c.pos = o.token, o.pos
+	}
 	switch {
 	case p.kind == o.kind || o.kind == filterKindUnset:
 		c.kind = p.kind
@@ -52,10 +115,14 @@ func (p primitive) Combine(o *primitive) *primitive {
 		return nil
 	}
 
+	// a protocol alone, e.g. "udp", has the default direction of src or dst, which it does not use, so it
+	// takes any other, e.g. "udp and dst port 53" is "udp dst port 53"
+	pProtocolOnly := p.kind == filterKindUnset && p.id == "" && p.direction == filterDirectionSrcOrDst
+	oProtocolOnly := o.kind == filterKindUnset && o.id == "" && o.direction == filterDirectionSrcOrDst
 	switch {
-	case p.direction == o.direction || o.direction == filterDirectionUnset:
+	case p.direction == o.direction || o.direction == filterDirectionUnset || oProtocolOnly:
 		c.direction = p.direction
-	case p.direction == filterDirectionUnset:
+	case p.direction == filterDirectionUnset || pProtocolOnly:
 		c.direction = o.direction
 	default:
 		return nil
@@ -81,9 +148,9 @@ func (p primitive) Combine(o *primitive) *primitive {
 
 	switch {
 	case p.id == o.id || o.id == "":
-		c.id = p.id
+		c.id, c.maxAddrs = p.id, p.maxAddrs
 	case p.id == "":
-		c.id = o.id
+		c.id, c.maxAddrs = o.id, o.maxAddrs
 	default:
 		return nil
 	}
@@ -95,10 +162,33 @@ func (p primitive) Combine(o *primitive) *primitive {
 		return nil
 	}
 
+	// only a port, or the protocol itself, checks the protocol in ip, e.g. tcp; there is no host or net of tcp
+	if p.subProtocol != o.subProtocol && c.kind != filterKindUnset && c.kind != filterKindPort && c.kind != filterKindPortRange {
+		return nil
+	}
+
+	// the id of gre is the protocol type it carries, so it cannot take a flag of ip or ip6 too
+	if c.subProtocol == filterSubProtocolGre && (isIP4Flag(c.id) || c.id == ip6Jumbo) {
+		return nil
+	}
+
 	return &c
 }
 
 func (p primitive) Compile() ([]bpf.Instruction, error) {
+	inst, err := p.compile()
+	if err != nil {
+		if _, ok := err.(*CompileError); ok {
+			return nil, err
+		}
+		return nil, &CompileError{Token: p.token, Position: p.pos, Err: err}
+	}
+	return inst, nil
+}
+
+// compile the instructions of p, as Compile, without where in the expression an error is
+func (p primitive) compile() ([]bpf.Instruction, error) {
+	p = p.hostNet()
 	// validate it
 	if err := p.validate(); err != nil {
 		return nil, err
@@ -110,7 +200,7 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 	// there always is at least the return packet and return none
 	inst := instructions{
 		inst: make([]bpf.Instruction, 0),
-		size: p.Size(),
+		size: uint8(p.Size()),
 	}
 
 	// if there are any conditions, there is a possibility of returning 0
@@ -123,73 +213,62 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 			inst.append(compareProtocolIP6(0, inst.skipToFail()))
 			// ignore errors as it already has been validated
 			_, a6, _ := p.getAddrs()
-			inst.append(checkIP6HostAddresses(p.direction, a6[0], inst.skipToFail(), inst.skipToSucceed())...)
+			inst.appendAddressChecks(p.direction, a6, p.addressSteps(8), checkIP6HostAddresses)
 		case filterProtocolIP:
 			inst.append(loadEtherKind)
 			inst.append(compareProtocolIP4(0, inst.skipToFail()))
 			// ignore errors as it already has been validated
 			a4, _, _ := p.getAddrs()
-			inst.append(checkIP4HostAddresses(p.direction, a4[0], inst.skipToFail(), inst.skipToSucceed())...)
+			inst.appendAddressChecks(p.direction, a4, p.addressSteps(2), checkIP4HostAddresses)
 		case filterProtocolArp:
 			inst.append(loadEtherKind)
 			inst.append(compareProtocolArp(0, inst.skipToFail()))
 			// ignore errors as it already has been validated
 			a4, _, _ := p.getAddrs()
-			inst.append(checkIP4ArpAddresses(p.direction, a4[0], inst.skipToFail(), inst.skipToSucceed())...)
+			inst.appendAddressChecks(p.direction, a4, p.addressSteps(2), checkIP4ArpAddresses)
 		case filterProtocolRarp:
 			inst.append(loadEtherKind)
 			inst.append(compareProtocolRarp(0, inst.skipToFail()))
 			// ignore errors as it already has been validated
 			a4, _, _ := p.getAddrs()
-			inst.append(checkIP4ArpAddresses(p.direction, a4[0], inst.skipToFail(), inst.skipToSucceed())...)
+			inst.appendAddressChecks(p.direction, a4, p.addressSteps(2), checkIP4ArpAddresses)
 		case filterProtocolUnset:
-			// compare to the type
-
 			// ignore errors as it already has been validated
-			// we do, however, need to know if the addresses are ip6 or ip4
-			// it takes 2 steps to check the src or dst for ip4, 8 steps for ip6
+			// we do, however, need to know if the addresses are ip6 or ip4, and how many of each,
+			// as a hostname can resolve to several of both
 			a4, a6, _ := p.getAddrs()
+			ip4Steps := p.addressSteps(2) * uint8(len(a4))
 
 			inst.append(loadEtherKind)
 			if len(a4) > 0 {
-				var (
-					addressCheck uint8 = 2
-				)
-				if p.direction == filterDirectionSrcOrDst || p.direction == filterDirectionSrcAndDst {
-					addressCheck = 4
-				}
-				inst.append(compareProtocolIP4(0, addressCheck))
-				// compare IP addresses
-				inst.append(checkIP4HostAddresses(p.direction, a4[0], inst.skipToFail(), inst.skipToSucceed())...)
+				// if not ip4, skip its addresses to check for arp
+				inst.append(compareProtocolIP4(0, ip4Steps))
+				inst.appendAddressChecks(p.direction, a4, p.addressSteps(2), checkIP4HostAddresses)
 				// if Arp, go to arp addresses
 				inst.append(compareProtocolArp(1, 0))
 				// if not rarp, jump to next (if there is) or fail
 				nextStep := inst.skipToFail()
 				if len(a6) > 0 {
-					nextStep = 2
-					if p.direction == filterDirectionSrcOrDst || p.direction == filterDirectionSrcAndDst {
-						nextStep = 4
-					}
+					nextStep = ip4Steps
 				}
 				inst.append(compareProtocolRarp(0, nextStep))
-				inst.append(checkIP4ArpAddresses(p.direction, a4[0], inst.skipToFail(), inst.skipToSucceed())...)
+				inst.appendAddressChecks(p.direction, a4, p.addressSteps(2), checkIP4ArpAddresses)
 			}
 			if len(a6) > 0 {
 				inst.append(compareProtocolIP6(0, inst.skipToFail()))
-				inst.append(checkIP6HostAddresses(p.direction, a6[0], inst.skipToFail(), inst.skipToSucceed())...)
+				inst.appendAddressChecks(p.direction, a6, p.addressSteps(8), checkIP6HostAddresses)
 			}
 		}
 	}
 
-	// port
-	if p.kind == filterKindPort {
+	// port or portrange
+	if p.kind == filterKindPort || p.kind == filterKindPortRange {
 		// the port had better be valid
-		portInt, err := findPort(p.id)
+		ports, err := p.portRanges()
 		if err != nil {
 			return nil, err
 		}
 
-		port := uint32(portInt)
 		inst.append(loadEtherKind)
 		switch p.protocol {
 		case filterProtocolIP6:
@@ -200,7 +279,7 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareIPv6Protocol(ipProtocolTCP, 0, inst.skipToFail())...)
 			case filterSubProtocolUDP:
 				inst.append(compareIPv6Protocol(ipProtocolUDP, 0, inst.skipToFail())...)
-			case filterSubProtocolStp:
+			case filterSubProtocolSctp:
 				inst.append(compareSubProtocolSctp(0, inst.skipToFail()))
 			case filterSubProtocolUnset:
 				inst.append(compareSubProtocolSctp(2, 0))
@@ -208,7 +287,7 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
 			}
 			// compare IP addresses
-			inst.append(checkPorts(p.direction, port, inst.skipToFail(), inst.skipToSucceed(), true)...)
+			inst.append(checkPorts(p.direction, ports, inst.skipToFail(), inst.skipToSucceed(), true)...)
 		case filterProtocolIP:
 			inst.append(compareProtocolIP4(0, inst.skipToFail()))
 			inst.append(loadIPv4Protocol)
@@ -217,14 +296,14 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareSubProtocolTCP(0, inst.skipToFail()))
 			case filterSubProtocolUDP:
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
-			case filterSubProtocolStp:
+			case filterSubProtocolSctp:
 				inst.append(compareSubProtocolSctp(0, inst.skipToFail()))
 			case filterSubProtocolUnset:
 				inst.append(compareSubProtocolSctp(2, 0))
 				inst.append(compareSubProtocolTCP(1, 0))
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
 			}
-			inst.append(checkPorts(p.direction, port, inst.skipToFail(), inst.skipToSucceed(), false)...)
+			inst.append(checkPorts(p.direction, ports, inst.skipToFail(), inst.skipToSucceed(), false)...)
 		case filterProtocolUnset:
 			// this is a little backward, but I need to calculate how many steps in the
 			// ip6 section so I can know where the ip4 section starts
@@ -234,9 +313,10 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				steps += 2
 			}
 			// next for loading the src and/or dst port and checking it
-			steps += 2
+			portSteps := portCheckSteps(ports)
+			steps += portSteps
 			if p.direction == filterDirectionSrcOrDst || p.direction == filterDirectionSrcAndDst {
-				steps += 2
+				steps += portSteps
 			}
 			inst.append(compareProtocolIP6(0, steps))
 			inst.append(loadIPv6Protocol)
@@ -261,14 +341,14 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareSubProtocolTCP(0, inst.skipToFail()))
 			case filterSubProtocolUDP:
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
-			case filterSubProtocolStp:
+			case filterSubProtocolSctp:
 				inst.append(compareSubProtocolSctp(0, inst.skipToFail()))
 			case filterSubProtocolUnset:
 				inst.append(compareSubProtocolSctp(2, 0))
 				inst.append(compareSubProtocolTCP(1, 0))
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
 			}
-			inst.append(checkPorts(p.direction, port, inst.skipToFail(), inst.skipToSucceed(), true)...)
+			inst.append(checkPorts(p.direction, ports, inst.skipToFail(), inst.skipToSucceed(), true)...)
 			inst.append(compareProtocolIP4(0, inst.skipToFail()))
 			inst.append(loadIPv4Protocol)
 			switch p.subProtocol {
@@ -276,14 +356,14 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareSubProtocolTCP(0, inst.skipToFail()))
 			case filterSubProtocolUDP:
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
-			case filterSubProtocolStp:
+			case filterSubProtocolSctp:
 				inst.append(compareSubProtocolSctp(0, inst.skipToFail()))
 			case filterSubProtocolUnset:
 				inst.append(compareSubProtocolSctp(2, 0))
 				inst.append(compareSubProtocolTCP(1, 0))
 				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
 			}
-			inst.append(checkPorts(p.direction, port, inst.skipToFail(), inst.skipToSucceed(), false)...)
+			inst.append(checkPorts(p.direction, ports, inst.skipToFail(), inst.skipToSucceed(), false)...)
 		}
 	}
 
@@ -337,31 +417,175 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 		}
 	}
 
+	// vlan
+	if p.kind == filterKindVlan {
+		inst.append(loadEtherKind)
+		inst.append(compareProtocolVlan(0, inst.skipToFail()))
+		if p.id != "" {
+			// ignore errors as it already has been validated
+			id, _ := strconv.ParseUint(p.id, 10, 16)
+			inst.append(loadVlanTCI)
+			inst.append(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: vlanIDMask})
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipFalse: inst.skipToFail()})
+		}
+	}
+
+	// mpls, whose label is after those before it, each of which must not have been the bottom of the stack
+	if p.kind == filterKindMpls {
+		inst.append(loadEtherKind)
+		inst.append(compareProtocolMpls(0, inst.skipToFail())...)
+		offset := ethernetHeaderSize + mplsLabelSize*p.labels
+		if p.labels > 0 {
+			inst.append(bpf.LoadAbsolute{Off: offset - 2, Size: lengthByte})
+			inst.append(bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: mplsBottomOfStack, SkipTrue: inst.skipToFail()})
+		}
+		if p.id != "" {
+			// ignore errors as it already has been validated
+			label, _ := strconv.ParseUint(p.id, 10, 32)
+			inst.append(bpf.LoadAbsolute{Off: offset, Size: lengthWord})
+			inst.append(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mplsLabelMask})
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(label) << mplsLabelShift, SkipFalse: inst.skipToFail()})
+		}
+	}
+
+	// the dscp, the top 6 bits of the ToS byte of ipv4 or of the traffic class of ipv6, which spans the
+	// nibbles after the version
+	if p.kind == filterKindDscp {
+		// ignore errors as it already has been validated
+		dscp, _ := strconv.ParseUint(p.id, 0, 8)
+		inst.append(loadEtherKind)
+		switch p.protocol {
+		case filterProtocolIP:
+			inst.append(compareProtocolIP4(0, inst.skipToFail()))
+			inst.append(loadIPv4TypeOfService)
+			inst.append(maskDscp(ip4DscpMask, ip4DscpShift)...)
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(dscp), SkipFalse: inst.skipToFail()})
+		case filterProtocolIP6:
+			inst.append(compareProtocolIP6(0, inst.skipToFail()))
+			inst.append(loadIPv6VersionClass)
+			inst.append(maskDscp(ip6DscpMask, ip6DscpShift)...)
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(dscp), SkipFalse: inst.skipToFail()})
+		case filterProtocolUnset:
+			inst.append(compareProtocolIP4(0, 4)) // to the ip6 check, past the ip4 one
+			inst.append(loadIPv4TypeOfService)
+			inst.append(maskDscp(ip4DscpMask, ip4DscpShift)...)
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(dscp), SkipTrue: inst.skipToSucceed(), SkipFalse: inst.skipToFail()})
+			inst.append(compareProtocolIP6(0, inst.skipToFail()))
+			inst.append(loadIPv6VersionClass)
+			inst.append(maskDscp(ip6DscpMask, ip6DscpShift)...)
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(dscp), SkipFalse: inst.skipToFail()})
+		}
+	}
+
+	// the flags of tcp over ipv4, masked and compared, as tcpdump only has tcp[] for ipv4
+	if p.kind == filterKindTCPFlags {
+		// ignore errors as it already has been validated
+		mask, value, notEqual, _ := parseTCPFlags(p.id)
+		inst.append(loadEtherKind)
+		inst.append(compareProtocolIP4(0, inst.skipToFail()))
+		inst.append(compareIPv4Protocol(ipProtocolTCP, 0, inst.skipToFail())...)
+		inst.append(loadIPv4HeaderOffset(inst.skipToFail())...)
+		inst.append(bpf.LoadIndirect{Off: ethernetHeaderSize + tcpFlagsOffset, Size: lengthByte})
+		if mask != tcpFlagsAll {
+			inst.append(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		}
+		if notEqual {
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: value, SkipTrue: inst.skipToFail()})
+		} else {
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: value, SkipFalse: inst.skipToFail()})
+		}
+	}
+
+	// ip-in-ip, with the fixed size outer header that the filters after it look past
+	if p.kind == filterKindIPIP {
+		inst.append(loadEtherKind)
+		inst.append(compareProtocolIP4(0, inst.skipToFail()))
+		inst.append(compareIPv4Protocol(ipProtocolIPIP, 0, inst.skipToFail())...)
+		inst.append(loadIPv4VersionIHL)
+		inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: ip4VersionIHL, SkipFalse: inst.skipToFail()})
+	}
+
+	// protochain, which only looks past extension headers for ip6
+	if p.kind == filterKindProtochain {
+		// ignore errors as it already has been validated
+		proto, _ := p.protochainProtocol()
+		inst.append(loadEtherKind)
+		switch p.protocol {
+		case filterProtocolIP:
+			inst.append(compareProtocolIP4(0, inst.skipToFail()))
+			inst.append(compareIPv4Protocol(proto, 0, inst.skipToFail())...)
+		case filterProtocolIP6:
+			inst.append(compareProtocolIP6(0, inst.skipToFail()))
+			inst.append(checkIPv6Protochain(proto, ProtochainDepth, 0, inst.skipToFail())...)
+		case filterProtocolUnset:
+			inst.append(compareProtocolIP4(0, 2)) // size of compareIPv4Protocol
+			inst.append(compareIPv4Protocol(proto, inst.skipToSucceed(), inst.skipToFail())...)
+			inst.append(compareProtocolIP6(0, inst.skipToFail()))
+			inst.append(checkIPv6Protochain(proto, ProtochainDepth, 0, inst.skipToFail())...)
+		}
+	}
+
+	// gre, which only is supported over ip4
+	if p.kind == filterKindUnset && p.subProtocol == filterSubProtocolGre {
+		inst.append(loadEtherKind)
+		inst.append(compareProtocolIP4(0, inst.skipToFail()))
+		inst.append(loadIPv4Protocol)
+		inst.append(compareSubProtocolGre(0, inst.skipToFail()))
+		if p.id != "" {
+			// ignore errors as it already has been validated
+			proto, _ := strconv.ParseUint(p.id, 0, 16)
+			inst.append(loadIPv4HeaderOffset(inst.skipToFail())...)
+			inst.append(loadIPv4GreProtocolType)
+			inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(proto), SkipFalse: inst.skipToFail()})
+		}
+	}
+
 	// unset
-	if p.kind == filterKindUnset {
+	if p.kind == filterKindUnset && p.subProtocol != filterSubProtocolGre {
 		inst.append(loadEtherKind)
 		switch p.protocol {
 		case filterProtocolIP:
 			inst.append(compareProtocolIP4(0, inst.skipToFail()))
-			inst.append(loadIPv4Protocol)
-			switch p.subProtocol {
-			case filterSubProtocolTCP:
-				inst.append(compareSubProtocolTCP(0, inst.skipToFail()))
-			case filterSubProtocolUDP:
-				inst.append(compareSubProtocolUDP(0, inst.skipToFail()))
+			if ip, ok := ipSubProtocols[p.subProtocol]; ok {
+				inst.append(compareIPv4Protocol(ip.proto, 0, inst.skipToFail())...)
+			}
+			switch p.id {
+			case ip4DF:
+				inst.append(loadIPv4Flags)
+				inst.append(bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: ip4DontFragment, SkipFalse: inst.skipToFail()})
+			case ip4MF:
+				inst.append(loadIPv4Flags)
+				inst.append(bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: ip4MoreFragments, SkipFalse: inst.skipToFail()})
+			case ip4Fragment:
+				inst.append(loadIPv4FlagsAndOffset)
+				inst.append(bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: jumpMask, SkipFalse: inst.skipToFail()})
 			}
 		case filterProtocolIP6:
 			inst.append(compareProtocolIP6(0, inst.skipToFail()))
+			if ip, ok := ipSubProtocols[p.subProtocol]; ok {
+				inst.append(compareIPv6Protocol(ip.proto, 0, inst.skipToFail())...)
+			}
 			switch p.subProtocol {
-			case filterSubProtocolTCP:
-				inst.append(compareIPv6Protocol(ipProtocolTCP, 0, inst.skipToFail())...)
-			case filterSubProtocolUDP:
-				inst.append(compareIPv6Protocol(ipProtocolUDP, 0, inst.skipToFail())...)
+			case filterSubProtocolHbh:
+				// hop-by-hop options always must come first, so only the first next header matters
+				inst.append(loadIPv6Protocol)
+				inst.append(compareSubProtocolHopByHop(0, inst.skipToFail()))
+			}
+			if p.id == ip6Jumbo {
+				inst.append(loadIPv6PayloadLength)
+				inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipFalse: inst.skipToFail()})
 			}
 		case filterProtocolArp:
 			inst.append(compareProtocolArp(0, inst.skipToFail()))
 		case filterProtocolRarp:
 			inst.append(compareProtocolRarp(0, inst.skipToFail()))
+		case filterProtocolLlc:
+			inst.append(compareEther8023(0, inst.skipToFail()))
+			// "llc and stp" is combined into one, which is stp, as it already is llc
+			if p.subProtocol == filterSubProtocolStp {
+				inst.append(loadLlcDsap)
+				inst.append(compareLlcDsap(llcSapStp, 0, inst.skipToFail()))
+			}
 		case filterProtocolEther:
 			switch p.subProtocol {
 			case filterSubProtocolIP:
@@ -372,20 +596,38 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 				inst.append(compareProtocolArp(0, inst.skipToFail()))
 			case filterSubProtocolRarp:
 				inst.append(compareProtocolRarp(0, inst.skipToFail()))
+			case filterSubProtocolEtherType:
+				// ignore errors as it already has been validated
+				etherType, _ := getEtherType(p.id)
+				inst.append(bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherType, SkipFalse: inst.skipToFail()})
+			case filterSubProtocolStp:
+				inst.append(compareEther8023(0, inst.skipToFail()))
+				inst.append(loadLlcDsap)
+				inst.append(compareLlcDsap(llcSapStp, 0, inst.skipToFail()))
 			}
 		case filterProtocolUnset:
-			// kind is unset, and protocol is unset, so subprotocol must be set or it would have failed vaildation
-			switch p.subProtocol {
-			case filterSubProtocolUDP:
+			if p.subProtocol == filterSubProtocolStp {
+				// not over ip, but 802.2, the same as "ether proto stp"
+				inst.append(compareEther8023(0, inst.skipToFail()))
+				inst.append(loadLlcDsap)
+				inst.append(compareLlcDsap(llcSapStp, 0, inst.skipToFail()))
+				break
+			}
+			// kind is unset, and protocol is unset, so subprotocol must be a bare ip protocol, e.g. "tcp",
+			// or it would have failed validation
+			ip := ipSubProtocols[p.subProtocol]
+			switch {
+			case ip.ip4 && ip.ip6:
 				inst.append(compareProtocolIP6(0, 5)) // size of compareIPv6Protocol
-				inst.append(compareIPv6Protocol(ipProtocolUDP, inst.skipToSucceed(), inst.skipToFail())...)
+				inst.append(compareIPv6Protocol(ip.proto, inst.skipToSucceed(), inst.skipToFail())...)
 				inst.append(compareProtocolIP4(0, inst.skipToFail()))
-				inst.append(compareIPv4Protocol(ipProtocolUDP, 0, inst.skipToFail())...)
-			case filterSubProtocolTCP:
-				inst.append(compareProtocolIP6(0, 5)) // size of compareIPv6Protocol
-				inst.append(compareIPv6Protocol(ipProtocolTCP, inst.skipToSucceed(), inst.skipToFail())...)
+				inst.append(compareIPv4Protocol(ip.proto, 0, inst.skipToFail())...)
+			case ip.ip6:
+				inst.append(compareProtocolIP6(0, inst.skipToFail()))
+				inst.append(compareIPv6Protocol(ip.proto, 0, inst.skipToFail())...)
+			case ip.ip4:
 				inst.append(compareProtocolIP4(0, inst.skipToFail()))
-				inst.append(compareIPv4Protocol(ipProtocolTCP, 0, inst.skipToFail())...)
+				inst.append(compareIPv4Protocol(ip.proto, 0, inst.skipToFail())...)
 			}
 		}
 	}
@@ -402,6 +644,11 @@ func (p primitive) Compile() ([]bpf.Instruction, error) {
 	return inst.inst, nil
 }
 
+// isPacketDirection whether the primitive is inbound or outbound
+func (p primitive) isPacketDirection() bool {
+	return p.kind == filterKindInbound || p.kind == filterKindOutbound
+}
+
 func (p primitive) Equal(f Filter) bool {
 	if f == nil {
 		return false
@@ -423,8 +670,58 @@ func (p primitive) Equal(f Filter) bool {
 
 func (p primitive) validate() error {
 	switch {
+	case p.err != nil:
+		return p.err
 	case p.subProtocol == filterSubProtocolUnknown:
 		return fmt.Errorf("unknown protocol %s", p.id)
+	case unsupportedProtocols[p.protocol]:
+		return fmt.Errorf("unsupported protocol %s", p.protocol)
+	case unsupportedSubProtocols[p.subProtocol]:
+		return fmt.Errorf("unsupported protocol %s", p.subProtocol)
+	case p.subProtocol == filterSubProtocolStp:
+		switch {
+		case p.protocol != filterProtocolUnset && p.protocol != filterProtocolEther && p.protocol != filterProtocolLlc:
+			return fmt.Errorf("stp only is valid for ether")
+		case p.kind != filterKindUnset || p.id != "":
+			return fmt.Errorf("stp takes no qualifiers")
+		}
+	case p.kind == filterKindUnset && p.protocol == filterProtocolEther && p.subProtocol != filterSubProtocolUnset &&
+		p.subProtocol != filterSubProtocolIP && p.subProtocol != filterSubProtocolIP6 && p.subProtocol != filterSubProtocolArp &&
+		p.subProtocol != filterSubProtocolRarp && p.subProtocol != filterSubProtocolEtherType:
+		// the ethertypes that ether proto compiles; the others, e.g. tcp, are not one
+		return fmt.Errorf("unsupported protocol %s", p.subProtocol)
+	case p.subProtocol == filterSubProtocolEtherType:
+		if p.protocol != filterProtocolEther || p.kind != filterKindUnset {
+			return fmt.Errorf("an ethertype only is valid for ether proto")
+		}
+		if _, err := getEtherType(p.id); err != nil {
+			return err
+		}
+	case p.isPacketDirection():
+		// the direction is not in the packet, so is up to whoever captures it; see SplitPacketDirection
+		return fmt.Errorf("%s cannot be compiled into instructions", p.kind)
+	case p.subProtocol == filterSubProtocolHbh && p.protocol != filterProtocolIP6:
+		return fmt.Errorf("hbh only is valid for ip6")
+	case p.protocol == filterProtocolLlc && (p.kind != filterKindUnset || p.subProtocol != filterSubProtocolUnset || p.id != ""):
+		return fmt.Errorf("llc takes no qualifiers")
+	case p.kind == filterKindUnset && p.id == ip6Jumbo && p.protocol != filterProtocolIP6:
+		return fmt.Errorf("jumbo only is valid for ip6")
+	case p.kind == filterKindUnset && p.protocol == filterProtocolIP6 && p.id != "" && p.id != ip6Jumbo:
+		return fmt.Errorf("unknown ip6 qualifier: %s", p.id)
+	case p.kind == filterKindUnset && isIP4Flag(p.id) && p.protocol != filterProtocolIP:
+		return fmt.Errorf("%s only is valid for ip", p.id)
+	case p.kind == filterKindUnset && p.protocol == filterProtocolIP && p.subProtocol != filterSubProtocolGre && p.id != "" && !isIP4Flag(p.id):
+		return fmt.Errorf("unknown ip qualifier: %s", p.id)
+	case p.subProtocol == filterSubProtocolGre && p.kind == filterKindUnset:
+		if p.protocol != filterProtocolUnset && p.protocol != filterProtocolIP {
+			return fmt.Errorf("gre only is valid for ip")
+		}
+		if p.id == "" {
+			break
+		}
+		if _, err := strconv.ParseUint(p.id, 0, 16); err != nil {
+			return fmt.Errorf("invalid gre protocol type: %s", p.id)
+		}
 	case p.kind == filterKindHost:
 		switch p.protocol {
 		case filterProtocolIP, filterProtocolIP6, filterProtocolArp, filterProtocolRarp, filterProtocolUnset:
@@ -432,23 +729,17 @@ func (p primitive) validate() error {
 			if p.id == "" {
 				return fmt.Errorf("blank host")
 			}
-			// if it is in IP format, check the IP validity
-			addr, network, _ := getNetAndMask(p.id)
-			var maskFull net.IPMask
-			if addr != nil && network != nil {
-				if addr.To4() != nil {
-					maskFull = ip4MaskFull
-				} else {
-					maskFull = ip6MaskFull
-				}
-				if !bytes.Equal(network.Mask, maskFull) {
-					return fmt.Errorf("invalid host address with CIDR: %s", p.id)
-				}
-			}
+			// a CIDR already has been turned into the net it is the same as, by hostNet
+			addr := net.ParseIP(p.id)
 			// if it was not a valid IP, check if it is a valid hostname
+			var a4, a6 []net.IP
 			if addr == nil {
-				a4, a6, err := p.getAddrs()
-				if err != nil || (len(a4)+len(a6) == 0) {
+				var err error
+				a4, a6, err = p.getAddrs()
+				if err != nil {
+					return err
+				}
+				if len(a4)+len(a6) == 0 {
 					return fmt.Errorf("unknown host: %s", p.id)
 				}
 				for _, a := range a4 {
@@ -461,6 +752,19 @@ func (p primitive) validate() error {
 						return fmt.Errorf("invalid address return in lookup: %s", a)
 					}
 				}
+				// at most, each ip4 address is checked in ip and arp, and each ip6 one takes 8 steps, in
+				// both directions; the jumps of bpf only go so far
+				if steps := 2*(4*len(a4)+8*len(a6)) + 8; steps > math.MaxUint8 {
+					return fmt.Errorf("host %s has too many addresses to compile, %d; limit them with LimitHostAddresses", p.id, len(a4)+len(a6))
+				}
+			} else if addr.To4() != nil {
+				a4 = []net.IP{addr}
+			} else {
+				a6 = []net.IP{addr}
+			}
+			// arp and rarp only carry IPv4 protocol addresses
+			if (p.protocol == filterProtocolArp || p.protocol == filterProtocolRarp) && len(a4) == 0 {
+				return fmt.Errorf("arp and rarp only are valid for IPv4 addresses: %s", p.id)
 			}
 		case filterProtocolEther:
 			// check that it is a valid ether host format
@@ -470,8 +774,20 @@ func (p primitive) validate() error {
 		}
 	case p.kind == filterKindUnset && p.protocol == filterProtocolUnset && p.subProtocol == filterSubProtocolUnset:
 		return fmt.Errorf("parse error")
-	case p.kind == filterKindPort:
-		if _, err := findPort(p.id); err != nil {
+	case p.kind == filterKindUnset && (p.protocol == filterProtocolUnset || p.protocol == filterProtocolIP || p.protocol == filterProtocolIP6) &&
+		p.subProtocol != filterSubProtocolUnset && p.subProtocol != filterSubProtocolHbh:
+		// a bare ip protocol, e.g. "tcp" or "ip6 icmp6"
+		ip, ok := ipSubProtocols[p.subProtocol]
+		switch {
+		case !ok:
+			return fmt.Errorf("unsupported protocol %s", p.subProtocol)
+		case p.protocol == filterProtocolIP && !ip.ip4:
+			return fmt.Errorf("%s only is valid for ip6", p.subProtocol)
+		case p.protocol == filterProtocolIP6 && !ip.ip6:
+			return fmt.Errorf("%s only is valid for ip", p.subProtocol)
+		}
+	case p.kind == filterKindPort, p.kind == filterKindPortRange:
+		if _, _, err := p.portRange(); err != nil {
 			return err
 		}
 	case p.kind == filterKindNet:
@@ -486,28 +802,112 @@ func (p primitive) validate() error {
 		if !addr.Equal(masked) {
 			return fmt.Errorf("invalid network, network bits extend past mask bits: %s", p.id)
 		}
+		if (p.protocol == filterProtocolArp || p.protocol == filterProtocolRarp) && addr.To4() == nil {
+			return fmt.Errorf("arp and rarp only are valid for IPv4 addresses: %s", p.id)
+		}
 	case p.kind == filterKindUnset && p.protocol == filterProtocolEther && p.subProtocol == filterSubProtocolUnset:
 		return fmt.Errorf("parse error")
+	case p.kind == filterKindTCPFlags:
+		if p.protocol != filterProtocolUnset && p.protocol != filterProtocolIP {
+			return fmt.Errorf("tcp[tcpflags] only can be of ip")
+		}
+		if _, _, _, err := parseTCPFlags(p.id); err != nil {
+			return err
+		}
+	case p.kind == filterKindDscp:
+		if p.protocol != filterProtocolUnset && p.protocol != filterProtocolIP && p.protocol != filterProtocolIP6 {
+			return fmt.Errorf("dscp only is valid for ip and ip6")
+		}
+		if p.subProtocol != filterSubProtocolUnset {
+			return fmt.Errorf("dscp takes no protocol in ip")
+		}
+		if dscp, err := strconv.ParseUint(p.id, 0, 8); err != nil || uint32(dscp) > dscpMax {
+			return fmt.Errorf("invalid dscp, must be from 0 to %d: %s", dscpMax, p.id)
+		}
+	case p.kind == filterKindMpls:
+		if p.protocol != filterProtocolUnset || p.subProtocol != filterSubProtocolUnset {
+			return fmt.Errorf("mpls takes no protocol")
+		}
+		if p.id == "" {
+			break
+		}
+		if label, err := strconv.ParseUint(p.id, 10, 32); err != nil || uint32(label) > mplsMaxLabel {
+			return fmt.Errorf("invalid mpls label: %s", p.id)
+		}
+	case p.kind == filterKindIPIP:
+		if p.protocol != filterProtocolUnset || p.subProtocol != filterSubProtocolUnset || p.id != "" {
+			return fmt.Errorf("ipip takes no qualifiers")
+		}
+	case p.kind == filterKindProtochain:
+		if p.protocol != filterProtocolUnset && p.protocol != filterProtocolIP && p.protocol != filterProtocolIP6 {
+			return fmt.Errorf("protochain only is valid for ip and ip6")
+		}
+		if ProtochainDepth < 1 || ProtochainDepth > maxProtochainDepth {
+			return fmt.Errorf("invalid protochain depth %d, must be from 1 to %d", ProtochainDepth, maxProtochainDepth)
+		}
+		if _, err := p.protochainProtocol(); err != nil {
+			return err
+		}
+	case p.kind == filterKindVlan:
+		if p.id == "" {
+			break
+		}
+		if id, err := strconv.ParseUint(p.id, 10, 16); err != nil || uint32(id) > vlanIDMask {
+			return fmt.Errorf("invalid vlan id: %s", p.id)
+		}
 	}
 	return nil
 }
 
+// hostNet the net that a host with a CIDR, e.g. "host 10.100.100.100/24", is the same as, like in newer
+// tcpdump, i.e. "net 10.100.100.0/24", with the host bits cleared; otherwise p itself
+func (p primitive) hostNet() primitive {
+	if p.kind != filterKindHost || p.protocol == filterProtocolEther || !strings.Contains(p.id, "/") {
+		return p
+	}
+	_, network, err := net.ParseCIDR(p.id)
+	if err != nil {
+		return p
+	}
+	p.kind = filterKindNet
+	p.id = network.String()
+	return p
+}
+
 // Size how many instructions do we expect
-func (p primitive) Size() uint8 {
+func (p primitive) Size() uint32 {
+	p = p.hostNet()
 	var instCount uint8
 	// if there are any conditions, there is a possibility of returning 0
 	switch p.kind {
 	case filterKindHost:
 		instCount += p.calculateStepsKindHost()
-	case filterKindPort:
+	case filterKindPort, filterKindPortRange:
 		instCount += p.calculateStepsKindPort()
 	case filterKindUnset:
+		if p.subProtocol == filterSubProtocolGre {
+			instCount += p.calculateStepsGre()
+			break
+		}
 		instCount += p.calculateStepsKindUnset()
 	case filterKindNet:
 		instCount += p.calculateStepsKindNet()
+	case filterKindVlan:
+		instCount += p.calculateStepsKindVlan()
+	case filterKindProtochain:
+		instCount += p.calculateStepsKindProtochain()
+	case filterKindIPIP:
+		// 2 to load and compare the ether protocol, 2 the ip protocol, and 2 the version and header length
+		instCount += 6
+	case filterKindMpls:
+		instCount += p.calculateStepsKindMpls()
+	case filterKindTCPFlags:
+		instCount += p.calculateStepsKindTCPFlags()
+	case filterKindDscp:
+		instCount += p.calculateStepsKindDscp()
 	}
 
-	return instCount + 2
+	return uint32(instCount) + 2
 }
 
 // getAddrs get valid IP addresses for the provided string, whether ipv4, ipv6,
@@ -518,9 +918,12 @@ func (p primitive) getAddrs() ([]net.IP, []net.IP, error) {
 	if addr := net.ParseIP(p.id); addr != nil {
 		addrs = append(addrs, addr)
 	} else {
-		// look up the host; ignore error as it already should have been done
-		resolvedAddrs, _ := resolver.LookupHost(context.Background(), p.id)
-		for _, a := range resolvedAddrs {
+		// look up the host; after validation, this always comes from the cache
+		resolvedAddrs, err := lookupHost(p.id)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, a := range resolvedAddrs[:p.hostAddressLimit(len(resolvedAddrs))] {
 			addrs = append(addrs, net.ParseIP(a))
 		}
 	}
@@ -534,6 +937,15 @@ func (p primitive) getAddrs() ([]net.IP, []net.IP, error) {
 	return a4, a6, nil
 }
 
+// addressSteps how many steps it takes to check one address, at steps for each of the src or dst that
+// the direction checks
+func (p primitive) addressSteps(steps uint8) uint8 {
+	if p.direction == filterDirectionSrcOrDst || p.direction == filterDirectionSrcAndDst {
+		return 2 * steps
+	}
+	return steps
+}
+
 // calculateStepsKindHost determine the number of steps for a filter of kind host
 func (p primitive) calculateStepsKindHost() uint8 {
 	// do we need to use separate locations to check for the src and/or dst?
@@ -619,8 +1031,8 @@ func (p primitive) calculateStepsKindNet() uint8 {
 		count++
 		// compare to the type
 		count++
+		// including the bitmask, which is only needed within a word
 		dirCount += calculateIP6MaskSteps(network.Mask)
-		maskFull = ip6MaskFull
 	case filterProtocolUnset:
 		// compare to the type
 		count++
@@ -638,13 +1050,12 @@ func (p primitive) calculateStepsKindNet() uint8 {
 			dirCount += calculateIP6MaskSteps(network.Mask)
 			// compare to the one type
 			count++
-			maskFull = ip6MaskFull
 		}
 	}
 
-	// if the netmask is not "mask full" (0xffffffff for ip4, larger for ip6), then we need to add a
+	// if the ip4 netmask is not "mask full" (0xffffffff), then we need to add a
 	// step to each direction for netmask
-	if !bytes.Equal(network.Mask, maskFull) {
+	if maskFull != nil && !bytes.Equal(network.Mask, maskFull) {
 		dirCount++
 	}
 
@@ -684,13 +1095,16 @@ func (p primitive) calculateStepsKindPort() uint8 {
 		subProtocolCount += 2
 	}
 
-	// checking ports on ipv6 is 2 for each of src and/or dst
-	// checking ports on ipv4 is 2 for each of src and/or dst, plus 3 to calculate the location
+	// checking ports on ipv6 is 1 to load, and 1 (2 for a range) to compare each port, for each of src and/or dst
+	// checking ports on ipv4 is the same, plus 3 to calculate the location
+	// ignore errors as it already has been validated
+	ports, _ := p.portRanges()
+	portSteps := portCheckSteps(ports)
 	switch p.direction {
 	case filterDirectionSrc, filterDirectionDst:
-		subProtocolCount += 2
+		subProtocolCount += portSteps
 	case filterDirectionSrcOrDst, filterDirectionSrcAndDst:
-		subProtocolCount += 4
+		subProtocolCount += 2 * portSteps
 	}
 	if doubler {
 		subProtocolCount *= 2
@@ -714,19 +1128,179 @@ func (p primitive) calculateStepsKindUnset() uint8 {
 	// 2 to load and compare the ether protocol
 	// 2 more to load and compare the sub protocol, if provided
 	count += 2
+	ip, bare := ipSubProtocols[p.subProtocol]
 	switch {
+	case p.subProtocol == filterSubProtocolStp:
+		count += 2 // load and compare the DSAP
 	case p.protocol == filterProtocolUnset:
 		// protocol is unset in addition to kind, so it depends on the subprotocol
-		count++    // check ipv4 and ipv6
-		count += 2 // 2 for ipv6 protocol check
-		count += 3 // 3 for ipv6 continuation packet protocol check
-		count += 2 // 2 for ipv4 protocol check
-	case p.protocol != filterProtocolEther:
-		count += 2 // for ether, it already was covered
+		if ip.ip4 && ip.ip6 {
+			count++ // check ipv4 as well as ipv6
+		}
+		if ip.ip6 {
+			count += 5 // the size of compareIPv6Protocol
+		}
+		if ip.ip4 {
+			count += 2 // the size of compareIPv4Protocol
+		}
+	case p.protocol == filterProtocolIP6 && bare:
+		count += 5 // the size of compareIPv6Protocol
+	case p.protocol != filterProtocolEther && p.subProtocol != filterSubProtocolUnset:
+		count += 2 // for ether, it already was covered; for a bare protocol, e.g. "rarp", there is none
+	}
+	if p.protocol == filterProtocolIP6 && p.id == ip6Jumbo {
+		count += 2 // load and compare the payload length
+	}
+	if p.protocol == filterProtocolIP && isIP4Flag(p.id) {
+		count += 2 // load and test the flags or fragment offset
 	}
 	return count
 }
 
+// calculateStepsGre determine the number of steps for a gre filter
+func (p primitive) calculateStepsGre() uint8 {
+	// 2 to load and compare the ether protocol, 2 to load and compare the ip protocol
+	var count uint8 = 4
+	// 3 to find the ip header length, then 2 to load and compare the gre protocol type, if provided
+	if p.id != "" {
+		count += 5
+	}
+	return count
+}
+
+// calculateStepsKindVlan determine the number of steps for a filter of kind vlan
+func (p primitive) calculateStepsKindVlan() uint8 {
+	// 2 to load and compare the ether protocol
+	var count uint8 = 2
+	// 3 more to load, mask and compare the vlan id, if provided
+	if p.id != "" {
+		count += 3
+	}
+	return count
+}
+
+// calculateStepsKindTCPFlags determine the number of steps for a filter of kind tcpflags
+func (p primitive) calculateStepsKindTCPFlags() uint8 {
+	// 2 to load and compare the ether protocol, 2 the ip protocol, 3 to check for a fragment and find the
+	// tcp header, and 2 to load and compare the flags
+	var count uint8 = 9
+	// 1 more to mask them, unless it is all of them
+	if mask, _, _, err := parseTCPFlags(p.id); err == nil && mask != tcpFlagsAll {
+		count++
+	}
+	return count
+}
+
+// calculateStepsKindDscp determine the number of steps for a filter of kind dscp
+func (p primitive) calculateStepsKindDscp() uint8 {
+	// 1 to load the ether protocol
+	var count uint8 = 1
+	// for each of ip and ip6, 1 to compare the ether protocol, and 4 to load, mask, shift and compare the dscp
+	if p.protocol == filterProtocolIP || p.protocol == filterProtocolUnset {
+		count += 5
+	}
+	if p.protocol == filterProtocolIP6 || p.protocol == filterProtocolUnset {
+		count += 5
+	}
+	return count
+}
+
+// calculateStepsKindMpls determine the number of steps for a filter of kind mpls
+func (p primitive) calculateStepsKindMpls() uint8 {
+	// 3 to load and compare the ether protocol to both mpls types
+	var count uint8 = 3
+	// 2 more to check that the label before was not the bottom of the stack
+	if p.labels > 0 {
+		count += 2
+	}
+	// 3 more to load, mask and compare the label, if provided
+	if p.id != "" {
+		count += 3
+	}
+	return count
+}
+
+// calculateStepsKindProtochain determine the number of steps for a protochain filter
+func (p primitive) calculateStepsKindProtochain() uint8 {
+	// 1 to load the ether protocol
+	var count uint8 = 1
+	if p.protocol == filterProtocolIP || p.protocol == filterProtocolUnset {
+		count += 1 + 2 // compare the ether protocol, and the size of compareIPv4Protocol
+	}
+	if p.protocol == filterProtocolIP6 || p.protocol == filterProtocolUnset {
+		count += 1 + 3 + 19*uint8(ProtochainDepth) // compare the ether protocol, and the size of checkIPv6Protochain
+	}
+	return count
+}
+
+// protochainProtocol the ip protocol number that protochain looks for, given by name, e.g. "tcp", or number
+func (p primitive) protochainProtocol() (uint32, error) {
+	if ip, ok := ipSubProtocols[p.subProtocol]; ok {
+		return ip.proto, nil
+	}
+	if proto, ok := ipProtocolNumbers[p.subProtocol]; ok {
+		return proto, nil
+	}
+	if p.subProtocol == filterSubProtocolUnset && p.id != "" {
+		if proto, err := strconv.ParseUint(p.id, 0, 8); err == nil {
+			return uint32(proto), nil
+		}
+	}
+	if p.id == "" {
+		return 0, fmt.Errorf("unsupported protochain protocol: %s", p.subProtocol)
+	}
+	return 0, fmt.Errorf("unsupported protochain protocol: %s", p.id)
+}
+
+// portRange get the lowest and highest port to match. For a single port, both are the same.
+func (p primitive) portRange() (uint32, uint32, error) {
+	if p.kind != filterKindPortRange {
+		port, err := findPort(p.id)
+		if err != nil {
+			return 0, 0, err
+		}
+		return uint32(port), uint32(port), nil
+	}
+	lowStr, highStr, ok := strings.Cut(p.id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range: %s", p.id)
+	}
+	low, err := findPort(lowStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := findPort(highStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if low < 0 || low > 0xffff || high < 0 || high > 0xffff {
+		return 0, 0, fmt.Errorf("invalid port range: %s", p.id)
+	}
+	// like tcpdump, accept the range in either order
+	if low > high {
+		low, high = high, low
+	}
+	return uint32(low), uint32(high), nil
+}
+
+// portRanges the range of the port or portrange, followed by any other ports that it matches
+func (p primitive) portRanges() ([]portRange, error) {
+	low, high, err := p.portRange()
+	if err != nil {
+		return nil, err
+	}
+	ranges := []portRange{{low: low, high: high}}
+	for _, port := range p.ports {
+		ranges = append(ranges, portRange{low: port, high: port})
+	}
+	return ranges, nil
+}
+
+// portCheckSteps how many steps it takes to load a single src or dst port and compare it to the ports
+func portCheckSteps(ports []portRange) uint8 {
+	return 1 + portCompareSteps(ports)
+}
+
 func findPort(portStr string) (int, error) {
 	// check that it is either an integer, or a known and valid port
 	if port, err := strconv.Atoi(portStr); err == nil {
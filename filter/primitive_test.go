@@ -86,6 +86,28 @@ func TestPrimitiveCombine(t *testing.T) {
 			id:          "abc",
 		}, nil},
 
+		// "tcp and host abc", as a host does not check the protocol in ip
+		{primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+		}, primitive{
+			kind:      filterKindHost,
+			direction: filterDirectionSrcOrDst,
+			id:        "abc",
+		}, nil},
+		// "not ip and not tcp", which is not "not ip tcp"
+		{primitive{
+			kind:      filterKindUnset,
+			direction: filterDirectionSrcOrDst,
+			protocol:  filterProtocolIP,
+			negator:   true,
+		}, primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			negator:     true,
+		}, nil},
 		// COMBINABLE
 		// identical
 		{primitive{
@@ -140,6 +162,22 @@ func TestPrimitiveCombine(t *testing.T) {
 			subProtocol: filterSubProtocolUDP,
 			id:          "53",
 		}},
+		// "tcp and tcp[tcpflags] == tcp-syn" -> "tcp[tcpflags] == tcp-syn"
+		{primitive{
+			kind:        filterKindUnset,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+		}, primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			id:          "0xff==0x2",
+		}, &primitive{
+			kind:        filterKindTCPFlags,
+			direction:   filterDirectionSrcOrDst,
+			subProtocol: filterSubProtocolTCP,
+			id:          "0xff==0x2",
+		}},
 	}
 	for i, tt := range tests {
 		c := tt.a.Combine(&tt.b)
@@ -3,39 +3,23 @@ package filter
 // primitives a slice of primitive with some methods
 type primitives []primitive
 
-// combine combine multiple primitives until nothing is left to combine
+// combine combine the primitives that can be, each with the first one before it that it can be combined
+// with, e.g. "tcp and host X and port 80" is "tcp port 80 and host X". They all are joined by "and", so
+// the order in which they are checked does not matter.
 func (p *primitives) combine() *primitives {
 	// nothing to combine
 	if p == nil || len(*p) == 0 || len(*p) == 1 {
 		return p
 	}
-	// The simplest first cut is to have each one combine with its neighbour.
-	// It isn't perfect - e.g. we will miss A combining with D - but it is a good start.
-	pd := *p
-	list := make(primitives, 0)
-	var (
-		prev, elm primitive
-		lastMatch bool
-		i         int
-	)
-	for i, elm = range pd {
-		// do not bother combining with myself
-		if i == 0 {
-			prev = elm
-			continue
+	list := make(primitives, 0, len(*p))
+elements:
+	for _, elm := range *p {
+		for i, prev := range list {
+			if n := prev.Combine(&elm); n != nil {
+				list[i] = *n
+				continue elements
+			}
 		}
-		if n := prev.Combine(&elm); n != nil {
-			lastMatch = true
-			list = append(list, *n)
-			prev = *n
-		} else {
-			lastMatch = false
-			list = append(list, prev)
-			prev = elm
-		}
-	}
-	// add the last element if it was not merged with the previous
-	if !lastMatch {
 		list = append(list, elm)
 	}
 	return &list
@@ -122,6 +122,36 @@ func TestPrimitivesCombine(t *testing.T) {
 				},
 			},
 		},
+		// "udp and host abc and port 53" -> "udp port 53 and host abc"
+		{
+			primitives{
+				primitive{
+					kind:        filterKindUnset,
+					direction:   filterDirectionSrcOrDst,
+					subProtocol: filterSubProtocolUDP,
+				}, primitive{
+					kind:      filterKindHost,
+					direction: filterDirectionSrcOrDst,
+					id:        "abc",
+				}, primitive{
+					kind:      filterKindPort,
+					direction: filterDirectionSrcOrDst,
+					id:        "53",
+				},
+			},
+			primitives{
+				primitive{
+					kind:        filterKindPort,
+					direction:   filterDirectionSrcOrDst,
+					subProtocol: filterSubProtocolUDP,
+					id:          "53",
+				}, primitive{
+					kind:      filterKindHost,
+					direction: filterDirectionSrcOrDst,
+					id:        "abc",
+				},
+			},
+		},
 	}
 	for i, tt := range tests {
 		out := tt.in.combine()
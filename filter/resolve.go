@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxHostAddresses the most addresses of a hostname that a host filter checks, unless changed
+// with LimitHostAddresses, so that a name with many of them, e.g. of a CDN, compiles to a program that
+// fits the jumps of bpf.
+const DefaultMaxHostAddresses = 8
+
+const (
+	// defaultResolveTimeout how long to wait for a hostname to resolve, unless changed with SetResolveTimeout
+	defaultResolveTimeout = 5 * time.Second
+	// resolveCacheTTL how long to remember a resolved hostname
+	resolveCacheTTL = time.Minute
+)
+
+var (
+	resolver       = net.DefaultResolver
+	resolveTimeout = defaultResolveTimeout
+	resolveCache   = hostCache{entries: map[string]hostCacheEntry{}}
+)
+
+type hostCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// hostCache remember resolved hostnames, so that compiling the same filter again,
+// or calculating its size, does not go back to DNS each time
+type hostCache struct {
+	sync.Mutex
+	entries map[string]hostCacheEntry
+}
+
+// SetResolveTimeout set how long to wait for hostnames in host filters to resolve when
+// compiling. A timeout of 0 waits forever.
+func SetResolveTimeout(d time.Duration) {
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+	resolveTimeout = d
+}
+
+// lookupHost resolve the host, using the cache if we can. If the host does not
+// exist, it returns no addresses, but no error; the only error is a timeout.
+func lookupHost(host string) ([]string, error) {
+	// the lock only is held for the cache, so that one slow host does not hold up every other
+	resolveCache.Lock()
+	entry, ok := resolveCache.entries[host]
+	timeout := resolveTimeout
+	resolveCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		// the resolver may give up on its own just before the context is done
+		var dnsErr *net.DNSError
+		if ctx.Err() != nil || (errors.As(err, &dnsErr) && dnsErr.IsTimeout) {
+			return nil, fmt.Errorf("timeout resolving host: %s", host)
+		}
+		// unknown hosts are not cached, in case they show up later
+		return nil, nil
+	}
+	resolveCache.Lock()
+	resolveCache.entries[host] = hostCacheEntry{addrs: addrs, expires: time.Now().Add(resolveCacheTTL)}
+	resolveCache.Unlock()
+	return addrs, nil
+}
+
+// LimitHostAddresses check at most n of the addresses of each hostname in f, in the order they resolved,
+// rather than DefaultMaxHostAddresses; n of 0 or less is the default. It returns a warning for each hostname
+// that resolves to more addresses than that, whose others the filter does not match. More addresses make for
+// a longer program, and too many for one that cannot be compiled, as its jumps are too long.
+func LimitHostAddresses(f Filter, n int) (Filter, []string) {
+	var warnings []string
+	return limitHostAddresses(f, n, &warnings), warnings
+}
+
+// limitHostAddresses LimitHostAddresses of f, adding its warnings to warnings
+func limitHostAddresses(f Filter, n int, warnings *[]string) Filter {
+	switch v := f.(type) {
+	case primitive:
+		if !v.isHostname() {
+			return v
+		}
+		v.maxAddrs = n
+		// errors are left for compiling, as they are without a limit
+		addrs, err := lookupHost(v.id)
+		if limit := v.hostAddressLimit(len(addrs)); err == nil && limit < len(addrs) {
+			*warnings = append(*warnings, fmt.Sprintf("host %s resolves to %d addresses, of which only the first %d are matched", v.id, len(addrs), limit))
+		}
+		return v
+	case composite:
+		filters := make(Filters, 0, len(v.filters))
+		for _, m := range v.filters {
+			filters = append(filters, limitHostAddresses(m, n, warnings))
+		}
+		v.filters = filters
+		return v
+	}
+	return f
+}
+
+// isHostname whether p is a host that is a name, which is resolved to its addresses
+func (p primitive) isHostname() bool {
+	return p.kind == filterKindHost && p.protocol != filterProtocolEther && p.id != "" &&
+		net.ParseIP(p.id) == nil && !strings.Contains(p.id, "/")
+}
+
+// hostAddressLimit how many of the count addresses of the hostname of p to check
+func (p primitive) hostAddressLimit(count int) int {
+	limit := p.maxAddrs
+	if limit <= 0 {
+		limit = DefaultMaxHostAddresses
+	}
+	if count < limit {
+		return count
+	}
+	return limit
+}
@@ -0,0 +1,161 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// silentResolver a resolver whose DNS server never answers
+func silentResolver(t *testing.T) *net.Resolver {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", l.LocalAddr().String())
+		},
+	}
+}
+
+// withResolver use r and timeout for the duration of the test
+func withResolver(t *testing.T, r *net.Resolver, timeout time.Duration) {
+	oldResolver, oldTimeout := resolver, resolveTimeout
+	resolver = r
+	SetResolveTimeout(timeout)
+	t.Cleanup(func() {
+		resolver = oldResolver
+		SetResolveTimeout(oldTimeout)
+	})
+}
+
+func TestResolveTimeout(t *testing.T) {
+	withResolver(t, silentResolver(t), 100*time.Millisecond)
+	start := time.Now()
+	_, err := NewExpression("host slow.example.com").Compile().Compile()
+	expected := fmt.Errorf("timeout resolving host: %s", "slow.example.com")
+	if err == nil || err.Error() != expected.Error() {
+		t.Errorf("mismatched error, actual %v, expected %v", err, expected)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v to time out", elapsed)
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	// resolve it once from the fixture server, so that it is cached
+	expected, err := NewExpression("host www.google.com").Compile().Compile()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// now nothing answers, so it only can come from the cache
+	withResolver(t, silentResolver(t), 100*time.Millisecond)
+	inst, err := NewExpression("host www.google.com").Compile().Compile()
+	if err != nil {
+		t.Fatalf("unexpected error with cached host: %v", err)
+	}
+	if len(inst) != len(expected) {
+		t.Errorf("mismatched instructions, actual %v, expected %v", inst, expected)
+	}
+}
+
+func TestResolveSlowHostDoesNotBlock(t *testing.T) {
+	// cache a host from the fixture server, before nothing answers
+	if _, err := NewExpression("host www.google.com").Compile().Compile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	withResolver(t, silentResolver(t), 2*time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = NewExpression("host slow.example.com").Compile().Compile()
+	}()
+	defer func() { <-done }()
+	// give the slow host the time to start resolving
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if _, err := NewExpression("host www.google.com").Compile().Compile(); err != nil {
+		t.Errorf("unexpected error with cached host: %v", err)
+	}
+	SetResolveTimeout(2 * time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v while another host was resolving", elapsed)
+	}
+}
+
+// manyAddresses count addresses of format, from 1, in the form of dnsRecords
+func manyAddresses(format string, count int) string {
+	addrs := make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		addrs = append(addrs, fmt.Sprintf(format, i))
+	}
+	return strings.Join(addrs, ",")
+}
+
+func TestLimitHostAddresses(t *testing.T) {
+	// the packets from each of the addresses, whether it is checked or not
+	var packets [][]byte
+	for i := 1; i <= 20; i++ {
+		packets = append(packets,
+			udp4Packet(t, fmt.Sprintf("198.51.100.%d", i), "192.0.2.99", 1234, 53),
+			udp6Packet(t, fmt.Sprintf("2001:db8:100::%x", i), "2001:db8::99", 1234, 53, false),
+		)
+	}
+	tests := []struct {
+		limit    int
+		expected int
+	}{
+		{0, DefaultMaxHostAddresses},
+		{-1, DefaultMaxHostAddresses},
+		{3, 3},
+		{1, 1},
+	}
+	for _, tt := range tests {
+		expression := "host many.example.com"
+		f, warnings := LimitHostAddresses(NewExpression(expression).Parse(), tt.limit)
+		expectedWarning := fmt.Sprintf("host many.example.com resolves to 40 addresses, of which only the first %d are matched", tt.expected)
+		if len(warnings) != 1 || warnings[0] != expectedWarning {
+			t.Errorf("limit %d: mismatched warnings, actual %q, expected %q", tt.limit, warnings, expectedWarning)
+		}
+		var matched int
+		for _, data := range packets {
+			if matchCompiled(t, expression, f, LinkTypeEthernet, data) {
+				matched++
+			}
+		}
+		if matched != tt.expected {
+			t.Errorf("limit %d: mismatched addresses matched, actual %d, expected %d", tt.limit, matched, tt.expected)
+		}
+	}
+
+	// the default applies without LimitHostAddresses too, only without the warning
+	inst, err := NewExpression("host many.example.com").Compile().Compile()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f, _ := LimitHostAddresses(NewExpression("host many.example.com").Parse(), 0)
+	if expected, _ := f.Compile(); len(inst) != len(expected) {
+		t.Errorf("mismatched default instructions, actual %d, expected %d", len(inst), len(expected))
+	}
+
+	// a host with no more addresses than the limit, or an address, has nothing to warn about
+	for _, expression := range []string{"host multi.example.com", "host 192.0.2.1 or port 53", "ether host aa:bb:cc:dd:ee:ff"} {
+		if _, warnings := LimitHostAddresses(NewExpression(expression).Parse(), 4); len(warnings) != 0 {
+			t.Errorf("'%s': unexpected warnings %q", expression, warnings)
+		}
+	}
+
+	// a limit too high for the program is an error, rather than a program that jumps to the wrong place
+	f, _ = LimitHostAddresses(NewExpression("host many.example.com").Parse(), 40)
+	expectedErr := "host many.example.com has too many addresses to compile, 40; limit them with LimitHostAddresses"
+	if _, err := f.Compile(); err == nil || !strings.Contains(err.Error(), expectedErr) {
+		t.Errorf("mismatched error, actual %v, expected %s", err, expectedErr)
+	}
+}
@@ -0,0 +1,406 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// tcpdumpALU the ALU operations by their name in tcpdump -d output
+var tcpdumpALU = map[string]bpf.ALUOp{
+	"add": bpf.ALUOpAdd,
+	"sub": bpf.ALUOpSub,
+	"mul": bpf.ALUOpMul,
+	"div": bpf.ALUOpDiv,
+	"or":  bpf.ALUOpOr,
+	"and": bpf.ALUOpAnd,
+	"lsh": bpf.ALUOpShiftLeft,
+	"rsh": bpf.ALUOpShiftRight,
+	"mod": bpf.ALUOpMod,
+	"xor": bpf.ALUOpXor,
+}
+
+// tcpdumpJump the jump conditions by their name in tcpdump -d output
+var tcpdumpJump = map[string]bpf.JumpTest{
+	"jeq":  bpf.JumpEqual,
+	"jgt":  bpf.JumpGreaterThan,
+	"jge":  bpf.JumpGreaterOrEqual,
+	"jset": bpf.JumpBitsSet,
+}
+
+// tcpdumpLoadSize the sizes of loads by the name of the instruction in tcpdump -d output
+var tcpdumpLoadSize = map[string]int{
+	"ld":  lengthWord,
+	"ldh": lengthHalf,
+	"ldb": lengthByte,
+}
+
+// parseTcpdump parse the output of tcpdump -d, e.g. "(000) ldh [12]", into instructions.
+// Jump targets, which tcpdump gives as line numbers, become skips. As in the test cases, lines
+// starting with "//" are comments, and anything after a tab that is not between jt and jf is a note.
+func parseTcpdump(dump string) ([]bpf.Instruction, error) {
+	var inst []bpf.Instruction
+	for _, line := range strings.Split(dump, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "//") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		line = parts[0]
+		if len(parts) > 1 && strings.Contains(line, " jt ") {
+			line += " " + parts[1]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "(") || !strings.HasSuffix(fields[0], ")") {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		pc, err := strconv.Atoi(strings.Trim(fields[0], "()"))
+		if err != nil || pc != len(inst) {
+			return nil, fmt.Errorf("invalid line number in %q", line)
+		}
+		in, err := parseTcpdumpInstruction(pc, fields[1], strings.Join(fields[2:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("line %q: %v", line, err)
+		}
+		inst = append(inst, in)
+	}
+	return inst, nil
+}
+
+// parseTcpdumpInstruction parse the instruction at pc with the given name and operands
+func parseTcpdumpInstruction(pc int, name, operands string) (bpf.Instruction, error) {
+	switch {
+	case name == "ret" && operands == "":
+		return bpf.RetA{}, nil
+	case name == "ret":
+		val, err := parseTcpdumpConstant(operands)
+		return bpf.RetConstant{Val: val}, err
+	case name == "tax":
+		return bpf.TAX{}, nil
+	case name == "txa":
+		return bpf.TXA{}, nil
+	case name == "neg":
+		return bpf.NegateA{}, nil
+	case name == "ja":
+		target, err := strconv.Atoi(operands)
+		return bpf.Jump{Skip: uint32(target - pc - 1)}, err
+	case name == "ldxb":
+		// 4*([14]&0xf)
+		var off uint32
+		if _, err := fmt.Sscanf(operands, "4*([%d]&0xf)", &off); err != nil {
+			return nil, fmt.Errorf("invalid operand %q", operands)
+		}
+		return bpf.LoadMemShift{Off: off}, nil
+	case name == "ld" && operands == "#pktlen":
+		return bpf.LoadExtension{Num: bpf.ExtLen}, nil
+	case name == "ld" || name == "ldx":
+		dst := bpf.RegA
+		if name == "ldx" {
+			dst = bpf.RegX
+		}
+		if strings.HasPrefix(operands, "M[") {
+			n, err := parseTcpdumpScratch(operands)
+			return bpf.LoadScratch{Dst: dst, N: n}, err
+		}
+		if strings.HasPrefix(operands, "#") {
+			val, err := parseTcpdumpConstant(operands)
+			return bpf.LoadConstant{Dst: dst, Val: val}, err
+		}
+	case name == "st" || name == "stx":
+		src := bpf.RegA
+		if name == "stx" {
+			src = bpf.RegX
+		}
+		n, err := parseTcpdumpScratch(operands)
+		return bpf.StoreScratch{Src: src, N: n}, err
+	}
+	if size, ok := tcpdumpLoadSize[name]; ok {
+		var off uint32
+		if _, err := fmt.Sscanf(operands, "[x + %d]", &off); err == nil {
+			return bpf.LoadIndirect{Off: off, Size: size}, nil
+		}
+		if _, err := fmt.Sscanf(operands, "[%d]", &off); err == nil {
+			return bpf.LoadAbsolute{Off: off, Size: size}, nil
+		}
+		return nil, fmt.Errorf("invalid operand %q", operands)
+	}
+	if op, ok := tcpdumpALU[name]; ok {
+		if operands == "x" {
+			return bpf.ALUOpX{Op: op}, nil
+		}
+		val, err := parseTcpdumpConstant(operands)
+		return bpf.ALUOpConstant{Op: op, Val: val}, err
+	}
+	if cond, ok := tcpdumpJump[name]; ok {
+		// #0x800 jt 2 jf 7, or x jt 2 jf 7
+		var (
+			operand    string
+			jt, jf     int
+			skip       = func(target int) uint8 { return uint8(target - pc - 1) }
+			_, scanErr = fmt.Sscanf(operands, "%s jt %d jf %d", &operand, &jt, &jf)
+		)
+		if scanErr != nil {
+			return nil, fmt.Errorf("invalid operands %q", operands)
+		}
+		if operand == "x" {
+			return bpf.JumpIfX{Cond: cond, SkipTrue: skip(jt), SkipFalse: skip(jf)}, nil
+		}
+		val, err := parseTcpdumpConstant(operand)
+		return bpf.JumpIf{Cond: cond, Val: val, SkipTrue: skip(jt), SkipFalse: skip(jf)}, err
+	}
+	return nil, fmt.Errorf("unsupported instruction %s %s", name, operands)
+}
+
+// parseTcpdumpConstant parse a constant operand, e.g. #0x800 or #262144
+func parseTcpdumpConstant(s string) (uint32, error) {
+	val, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid constant %q", s)
+	}
+	return uint32(val), nil
+}
+
+// parseTcpdumpScratch parse a scratch memory operand, e.g. M[1]
+func parseTcpdumpScratch(s string) (int, error) {
+	var n int
+	if _, err := fmt.Sscanf(s, "M[%d]", &n); err != nil {
+		return 0, fmt.Errorf("invalid scratch operand %q", s)
+	}
+	return n, nil
+}
+
+// tcpdumpPath the path to tcpdump, skipping the test if it is not installed
+func tcpdumpPath(t *testing.T) string {
+	t.Helper()
+	path, err := exec.LookPath("tcpdump")
+	if err != nil {
+		t.Skip("tcpdump is not installed")
+	}
+	return path
+}
+
+// tcpdumpCompile compile the expression for Ethernet with tcpdump -d, returning an error if tcpdump rejects it
+func tcpdumpCompile(path, expression string) ([]bpf.Instruction, error) {
+	out, err := exec.Command(path, "-y", "EN10MB", "-d", expression).Output()
+	if err != nil {
+		return nil, fmt.Errorf("tcpdump -d %q failed: %v", expression, err)
+	}
+	return parseTcpdump(string(out))
+}
+
+// sameProgram whether a and b assemble to the same program, so that equivalent instructions, e.g.
+// a jeq with its skips swapped and a jne, count as the same
+func sameProgram(a, b []bpf.Instruction) bool {
+	rawA, errA := bpf.Assemble(a)
+	rawB, errB := bpf.Assemble(b)
+	if errA != nil || errB != nil || len(rawA) != len(rawB) {
+		return false
+	}
+	for i := range rawA {
+		if rawA[i] != rawB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpdumpDifferences expressions that intentionally compile differently from tcpdump, and why
+var tcpdumpDifferences = map[string]string{
+	"10.100.100.100":                  "an address needs the host keyword",
+	"2a00:1450:4001:824::2004":        "an address needs the host keyword",
+	"host www.google.com":             "tcpdump resolved the name with public DNS rather than the test DNS server",
+	"src www.google.com":              "tcpdump resolved the name with public DNS rather than the test DNS server",
+	"dst www.google.com":              "tcpdump resolved the name with public DNS rather than the test DNS server",
+	"src or dst host www.google.com":  "tcpdump resolved the name with public DNS rather than the test DNS server",
+	"src and dst host www.google.com": "tcpdump resolved the name with public DNS rather than the test DNS server",
+}
+
+func TestParseTcpdump(t *testing.T) {
+	// tcpdump -d port 22
+	dump := `(000) ldh      [12]
+(001) jeq      #0x86dd          jt 2	jf 10
+(002) ldb      [20]
+(003) jeq      #0x84            jt 6	jf 4
+(004) jeq      #0x6             jt 6	jf 5
+(005) jeq      #0x11            jt 6	jf 23
+(006) ldh      [54]
+(007) jeq      #0x16            jt 22	jf 8
+(008) ldh      [56]
+(009) jeq      #0x16            jt 22	jf 23
+(010) jeq      #0x800           jt 11	jf 23
+(011) ldb      [23]
+(012) jeq      #0x84            jt 15	jf 13
+(013) jeq      #0x6             jt 15	jf 14
+(014) jeq      #0x11            jt 15	jf 23
+(015) ldh      [20]
+(016) jset     #0x1fff          jt 23	jf 17
+(017) ldxb     4*([14]&0xf)
+(018) ldh      [x + 14]
+(019) jeq      #0x16            jt 22	jf 20
+(020) ldh      [x + 16]
+(021) jeq      #0x16            jt 22	jf 23
+(022) ret      #262144
+(023) ret      #0
+`
+	inst, err := parseTcpdump(dump)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %v", err)
+	}
+	expected, err := NewExpression("port 22").Compile().Compile()
+	if err != nil {
+		t.Fatalf("unexpected error compiling: %v", err)
+	}
+	if !sameProgram(inst, expected) {
+		t.Errorf("mismatched instructions\nActual  : %v\nExpected: %v", inst, expected)
+	}
+	// as annotated in the test cases
+	annotated := "\t\t// load the EtherType\n\t\t(000) ldh      [12]\t\t\tEtherType\n\t\t(001) jeq      #0x800           jt 2\tjf 3\tip\n" +
+		"\t\t(002) ret      #262144\t\t\treturn the entire packet\n\t\t(003) ret      #0\n"
+	if inst, err = parseTcpdump(annotated); err != nil {
+		t.Fatalf("unexpected error parsing annotated: %v", err)
+	}
+	expected = []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: 262144},
+		bpf.RetConstant{Val: 0},
+	}
+	if !sameProgram(inst, expected) {
+		t.Errorf("mismatched annotated instructions\nActual  : %v\nExpected: %v", inst, expected)
+	}
+	for _, invalid := range []string{"ldh [12]", "(000) ldh", "(001) ldh [12]", "(000) jeq #0x800", "(000) foo #1"} {
+		if _, err := parseTcpdump(invalid); err == nil {
+			t.Errorf("%q: did not error", invalid)
+		}
+	}
+}
+
+// TestFilterCompileTcpdump compare the host, port and net expressions to what tcpdump compiles them to, when it is installed.
+// Host names are left out, as they are resolved with the test DNS server rather than as tcpdump would.
+func TestFilterCompileTcpdump(t *testing.T) {
+	path := tcpdumpPath(t)
+	for _, k := range []string{"host_ip4", "host_ip6", "port", "net_ip4", "net_ip6"} {
+		t.Run(k, func(t *testing.T) {
+			for _, tt := range testCasesExpressionFilterInstructions[k] {
+				if reason, ok := tcpdumpDifferences[tt.expression]; ok {
+					t.Logf("'%s': differs from tcpdump: %s", tt.expression, reason)
+					continue
+				}
+				expected, tcpdumpErr := tcpdumpCompile(path, tt.expression)
+				inst, err := NewExpression(tt.expression).Compile().Compile()
+				switch {
+				case err != nil && tcpdumpErr != nil:
+				case err != nil || tcpdumpErr != nil:
+					t.Errorf("'%s': mismatched errors\nActual : %v\ntcpdump: %v", tt.expression, err, tcpdumpErr)
+				case !sameProgram(inst, expected):
+					t.Errorf("'%s': mismatched instructions\nActual : %v\ntcpdump: %v", tt.expression, inst, expected)
+				}
+			}
+		})
+	}
+}
+
+// tcpPacket build an Ethernet+IP+TCP packet, over ipv6 if ip6, between the given ports
+func tcpPacket(t *testing.T, ip6 bool, srcPort, dstPort uint16) []byte {
+	t.Helper()
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), SYN: true}
+	if ip6 {
+		eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6}
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		return serializePacket(t, eth, ip, tcp)
+	}
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t, eth, ip, tcp)
+}
+
+// tcpdumpCorpus the packets to run a program and what tcpdump compiled it to against, when they are not the same
+// instructions, for them to be equivalent: the hosts, ports and protocols of the test cases, and ones that are not
+func tcpdumpCorpus(t *testing.T) [][]byte {
+	t.Helper()
+	corpus := [][]byte{
+		udp4Packet(t, "10.100.100.100", "10.0.0.2", 1234, 80),
+		udp4Packet(t, "10.0.0.2", "10.100.100.100", 1234, 80),
+		udp4Packet(t, "10.100.100.100", "10.100.100.100", 23, 23),
+		rarpPacket(t, "10.100.100.100", "10.0.0.2"),
+		rarpPacket(t, "10.0.0.2", "10.100.100.100"),
+		rarpPacket(t, "10.0.0.2", "10.0.0.3"),
+		fragmentPacket(t, 100, false),
+	}
+	for _, port := range []uint16{20, 21, 22, 23, 53, 67, 80} {
+		corpus = append(corpus,
+			udp4Packet(t, "10.0.0.1", "10.0.0.2", port, 1234),
+			udp4Packet(t, "10.0.0.1", "10.0.0.2", 1234, port),
+			udp6Packet(t, "fe80::1", "fe80::2", port, 1234, false),
+			udp6Packet(t, "fe80::1", "fe80::2", 1234, port, false),
+			tcpPacket(t, false, port, 1234),
+			tcpPacket(t, false, 1234, port),
+			tcpPacket(t, true, port, 1234),
+			tcpPacket(t, true, 1234, port),
+		)
+	}
+	return corpus
+}
+
+// runProgram run the instructions against the packet, returning if it matched
+func runProgram(t *testing.T, inst []bpf.Instruction, data []byte) bool {
+	t.Helper()
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		t.Fatalf("invalid program: %v", err)
+	}
+	n, err := vm.Run(data)
+	if err != nil {
+		t.Fatalf("error running program: %v", err)
+	}
+	return n > 0
+}
+
+// TestFilterCompileTcpdumpOutput compare each test case to the tcpdump -d output recorded with it, if any, which is
+// checked without tcpdump installed. It must be the same program, or at least match the same packets of a corpus,
+// as where tcpdump optimizes further.
+func TestFilterCompileTcpdumpOutput(t *testing.T) {
+	corpus := tcpdumpCorpus(t)
+	for k, v := range testCasesExpressionFilterInstructions {
+		t.Run(k, func(t *testing.T) {
+			for i, tt := range v {
+				if tt.tcpdump == "" {
+					continue
+				}
+				if reason, ok := tcpdumpDifferences[tt.expression]; ok {
+					t.Logf("%d '%s': differs from tcpdump: %s", i, tt.expression, reason)
+					continue
+				}
+				expected, err := parseTcpdump(tt.tcpdump)
+				if err != nil {
+					t.Errorf("%d '%s': unable to parse tcpdump output: %v", i, tt.expression, err)
+					continue
+				}
+				inst, err := NewExpression(tt.expression).Compile().Compile()
+				if err != nil {
+					t.Errorf("%d '%s': unable to compile: %v", i, tt.expression, err)
+					continue
+				}
+				if sameProgram(inst, expected) {
+					continue
+				}
+				for j, data := range corpus {
+					if matched, tcpdump := runProgram(t, inst, data), runProgram(t, expected, data); matched != tcpdump {
+						t.Errorf("%d '%s': packet %d mismatched result, actual %v, tcpdump %v", i, tt.expression, j, matched, tcpdump)
+					}
+				}
+			}
+		})
+	}
+}
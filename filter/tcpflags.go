@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tcpFlagValues the tcp flags by their names in tcpdump, and combinations of them
+var tcpFlagValues = map[string]uint32{
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+	"tcp-ece":  0x40,
+	"tcp-cwr":  0x80,
+	// the reply that establishes a connection
+	"tcp-synack": 0x12,
+}
+
+const (
+	// tcpFlagsOffset where the flags are in the tcp header
+	tcpFlagsOffset uint32 = 13
+	// tcpFlagsAll the mask of all of the flags, which needs no masking
+	tcpFlagsAll uint32 = 0xff
+)
+
+// tcpFlags parse the rest of a tcp[tcpflags] comparison into p, after the "[": an optional mask, then
+// == or != and the value, e.g. "tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn". Its id is the comparison,
+// with the names and | resolved to numbers, e.g. "0x12==0x2". Anything else is the error of p.
+func (e *Expression) tcpFlags(p *primitive) {
+	p.kind = filterKindTCPFlags
+	if _, word := e.scanPastWhitespace(); word != "tcpflags" && word != strconv.Itoa(int(tcpFlagsOffset)) {
+		p.err = fmt.Errorf("only tcp[tcpflags] can be accessed, not tcp[%s]", word)
+		return
+	}
+	if tok, _ := e.scanPastWhitespace(); tok != tokenRightBracket {
+		p.err = errors.New("missing ] after tcp[tcpflags")
+		return
+	}
+	var (
+		mask    = tcpFlagsAll
+		err     error
+		tok, op = e.scanPastWhitespace()
+	)
+	if tok == tokenBitAnd {
+		if mask, err = e.tcpFlagsValue(); err != nil {
+			p.err = err
+			return
+		}
+		tok, op = e.scanPastWhitespace()
+	}
+	if tok != tokenEqual && tok != tokenNotEqual {
+		p.err = errors.New("tcp[tcpflags] must be compared with == or !=")
+		return
+	}
+	value, err := e.tcpFlagsValue()
+	if err != nil {
+		p.err = err
+		return
+	}
+	p.id = fmt.Sprintf("%#x%s%#x", mask, op, value)
+}
+
+// tcpFlagsValue the value of names or numbers of tcp flags joined by |, maybe in braces
+func (e *Expression) tcpFlagsValue() (uint32, error) {
+	var value uint32
+	tok, word := e.scanPastWhitespace()
+	braced := tok == tokenLeft
+	if braced {
+		_, word = e.scanPastWhitespace()
+	}
+	for {
+		v, ok := tcpFlagValues[word]
+		if !ok {
+			n, err := strconv.ParseUint(word, 0, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid tcp flags %q", word)
+			}
+			v = uint32(n)
+		}
+		value |= v
+		if next, _ := e.peekPastWhitespace(); next != tokenBitOr {
+			break
+		}
+		e.scanPastWhitespace()
+		_, word = e.scanPastWhitespace()
+	}
+	if braced {
+		if tok, _ := e.scanPastWhitespace(); tok != tokenRight {
+			return 0, errors.New("missing ) after tcp flags")
+		}
+	}
+	return value, nil
+}
+
+// parseTCPFlags the mask, value and whether it is != of the id of a tcp[tcpflags] comparison
+func parseTCPFlags(id string) (mask, value uint32, notEqual bool, err error) {
+	op := "=="
+	if strings.Contains(id, "!=") {
+		op, notEqual = "!=", true
+	}
+	parts := strings.SplitN(id, op, 2)
+	if len(parts) != 2 {
+		return 0, 0, false, fmt.Errorf("invalid tcp flags comparison %s", id)
+	}
+	m, err := strconv.ParseUint(parts[0], 0, 8)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid tcp flags mask %s", parts[0])
+	}
+	v, err := strconv.ParseUint(parts[1], 0, 8)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid tcp flags %s", parts[1])
+	}
+	return uint32(m), uint32(v), notEqual, nil
+}
@@ -0,0 +1,31 @@
+package filter
+
+// VlanTransparent make f match packets whether or not they have a vlan tag, the same as
+// "f or (vlan and f)", so that a filter like "ip host 10.0.0.1" also matches ip over vlan.
+// Filters that already say something about vlans are returned unchanged, as they are explicit
+// about the tags they expect.
+func VlanTransparent(f Filter) Filter {
+	if f == nil || hasVlan(f) {
+		return f
+	}
+	tagged := composite{
+		filters: Filters{primitive{kind: filterKindVlan, direction: filterDirectionSrcOrDst}, f},
+		and:     true,
+	}
+	return composite{filters: Filters{f, tagged}}
+}
+
+// hasVlan whether f, or any filter in it, is a vlan primitive, negated or not
+func hasVlan(f Filter) bool {
+	switch v := f.(type) {
+	case primitive:
+		return v.kind == filterKindVlan
+	case composite:
+		for _, m := range v.filters {
+			if hasVlan(m) {
+				return true
+			}
+		}
+	}
+	return false
+}
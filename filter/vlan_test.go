@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestVlanTransparentCompile(t *testing.T) {
+	tests := []struct {
+		expression   string
+		instructions []bpf.Instruction
+	}{
+		// the same as "ip host 10.100.100.100 or (vlan and ip host 10.100.100.100)"
+		{"ip host 10.100.100.100", []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 26, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.Jump{Skip: 11},
+			bpf.Jump{Skip: 0},
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 7},
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+			bpf.LoadAbsolute{Off: 30, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipTrue: 2},
+			bpf.LoadAbsolute{Off: 34, Size: 4},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xa646464, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+		// already explicit about vlans, so unchanged
+		{"vlan 100 and ip", []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 12, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x8100, SkipFalse: 4},
+			bpf.LoadAbsolute{Off: 14, Size: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 100, SkipFalse: 1},
+			bpf.Jump{Skip: 1},
+			bpf.Jump{Skip: 3},
+			bpf.LoadAbsolute{Off: 16, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+			bpf.RetConstant{Val: 262144},
+			bpf.RetConstant{Val: 0},
+		}},
+	}
+	for i, tt := range tests {
+		f := VlanTransparent(NewExpression(tt.expression).Compile())
+		inst, err := f.Compile()
+		if err != nil {
+			t.Fatalf("%d '%s': unexpected error compiling: %v", i, tt.expression, err)
+		}
+		if len(inst) != int(f.Size()) {
+			t.Errorf("%d '%s': mismatched size %d for %d instructions", i, tt.expression, f.Size(), len(inst))
+		}
+		if !compareInstructions(inst, tt.instructions) {
+			t.Errorf("%d '%s': mismatched instructions \nActual  : %#v\nExpected: %#v", i, tt.expression, inst, tt.instructions)
+		}
+	}
+}
+
+func TestVlanTransparentExecute(t *testing.T) {
+	untagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53)
+	tagged := udp4Packet(t, "10.100.100.100", "10.100.100.1", 1234, 53, 100)
+	other := udp4Packet(t, "10.100.100.2", "10.100.100.1", 1234, 53, 100)
+	tagged6 := udp6Packet(t, "2001:db8::1", "2001:db8::2", 1234, 53, false)
+	tests := []struct {
+		expression string
+		data       []byte
+		expected   bool
+	}{
+		{"ip host 10.100.100.100", untagged, true},
+		{"ip host 10.100.100.100", tagged, true},
+		{"ip host 10.100.100.100", other, false},
+		{"udp dst port 53", tagged, true},
+		{"udp dst port 80", tagged, false},
+		{"not ip host 10.100.100.100", other, true},
+		{"ip6", tagged6, true},
+		{"ip6", tagged, false},
+		{"vlan 100 and ip host 10.100.100.100", tagged, true},
+		{"vlan 100 and ip host 10.100.100.100", untagged, false},
+	}
+	for i, tt := range tests {
+		inst, err := VlanTransparent(NewExpression(tt.expression).Compile()).Compile()
+		if err != nil {
+			t.Fatalf("%d '%s': unable to compile: %v", i, tt.expression, err)
+		}
+		vm, err := bpf.NewVM(inst)
+		if err != nil {
+			t.Fatalf("%d '%s': invalid program: %v", i, tt.expression, err)
+		}
+		n, err := vm.Run(tt.data)
+		if err != nil {
+			t.Fatalf("%d '%s': error running program: %v", i, tt.expression, err)
+		}
+		if matched := n > 0; matched != tt.expected {
+			t.Errorf("%d '%s': mismatched result, actual %v, expected %v", i, tt.expression, matched, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pcap
+
+import (
+	"fmt"
+	"time"
+)
+
+// InactiveHandle the settings for a live capture, which Activate opens, as with pcap_create and pcap_activate
+// of libpcap. It is the same on every platform, and, unlike OpenLive, each setting is named, and can be left out.
+type InactiveHandle struct {
+	device      string
+	snaplen     int32
+	promiscuous bool
+	timeout     time.Duration
+	syscalls    bool
+	immediate   bool
+	bufferSize  int
+	opts        []Option
+}
+
+// NewInactiveHandle start the settings for a live capture on device, or all interfaces for "" or "any" on Linux.
+// Until they are changed, it captures whole packets, not promiscuously, waiting as long as it takes for them,
+// with DefaultSyscalls.
+func NewInactiveHandle(device string) *InactiveHandle {
+	return &InactiveHandle{device: device, snaplen: SnaplenMTU, syscalls: DefaultSyscalls}
+}
+
+// SetSnapLen capture up to snaplen bytes of each packet, or whole packets with SnaplenMTU
+func (p *InactiveHandle) SetSnapLen(snaplen int32) error {
+	if snaplen <= 0 && snaplen != SnaplenMTU {
+		return fmt.Errorf("invalid snaplen %d", snaplen)
+	}
+	p.snaplen = snaplen
+	return nil
+}
+
+// SetPromisc whether to capture in promiscuous mode
+func (p *InactiveHandle) SetPromisc(promiscuous bool) error {
+	p.promiscuous = promiscuous
+	return nil
+}
+
+// SetTimeout bound how long a read waits for packets, as SetBufferTimeout does once the handle is active.
+// A timeout of 0 waits until there are packets.
+func (p *InactiveHandle) SetTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("invalid timeout %v", timeout)
+	}
+	p.timeout = timeout
+	return nil
+}
+
+// SetImmediateMode whether to deliver packets as soon as they arrive, as WithImmediate does
+func (p *InactiveHandle) SetImmediateMode(immediate bool) error {
+	p.immediate = immediate
+	return nil
+}
+
+// SetBufferSize size the capture buffer, as WithBufferSize does, or leave it to the library with 0
+func (p *InactiveHandle) SetBufferSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid buffer size %d", size)
+	}
+	p.bufferSize = size
+	return nil
+}
+
+// SetSyscalls whether to read packets with syscalls, rather than an mmap ring, where there is one
+func (p *InactiveHandle) SetSyscalls(syscalls bool) error {
+	p.syscalls = syscalls
+	return nil
+}
+
+// SetOptions add opts, e.g. WithFilter or WithDeduplication, for whatever has no setter of its own.
+// They are applied after the other settings, so win over them.
+func (p *InactiveHandle) SetOptions(opts ...Option) {
+	p.opts = append(p.opts, opts...)
+}
+
+// Activate open the capture with the settings. The InactiveHandle can be activated again, for another
+// handle with the same settings.
+func (p *InactiveHandle) Activate() (*Handle, error) {
+	snaplen := p.snaplen
+	if snaplen == SnaplenMTU {
+		var err error
+		if snaplen, err = mtuSnaplen(p.device); err != nil {
+			return nil, err
+		}
+	}
+	var opts []Option
+	if p.bufferSize > 0 {
+		opts = append(opts, WithBufferSize(p.bufferSize))
+	}
+	if p.immediate {
+		opts = append(opts, WithImmediate())
+	}
+	opts = append(opts, p.opts...)
+	h, err := openLive(p.device, snaplen, p.promiscuous, p.timeout, p.syscalls, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if p.timeout > 0 {
+		if err := h.SetBufferTimeout(p.timeout); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,46 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+)
+
+// Interface a network interface that can be captured on, with what is needed to decide whether and
+// how to bind to it
+type Interface struct {
+	Name  string
+	Index int
+	MTU   int
+	Flags net.Flags
+	// Addrs the addresses of the interface, e.g. to choose the one that has a given address
+	Addrs []net.Addr
+	// LinkType the link type of the packets captured on it, as reported by Handle.LinkType
+	LinkType uint32
+}
+
+// FindAllDevs list the interfaces that can be captured on, whether or not they are up. On Linux,
+// it ends with "any", for all of them, as with libpcap. Interfaces whose link type is not supported
+// are left out.
+func FindAllDevs() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list interfaces: %v", err)
+	}
+	return findAllDevs(ifaces)
+}
+
+// newInterface the Interface of in, whose packets are of linkType
+func newInterface(in net.Interface, linkType uint32) (Interface, error) {
+	addrs, err := in.Addrs()
+	if err != nil {
+		return Interface{}, fmt.Errorf("unable to get the addresses of %s: %v", in.Name, err)
+	}
+	return Interface{
+		Name:     in.Name,
+		Index:    in.Index,
+		MTU:      in.MTU,
+		Flags:    in.Flags,
+		Addrs:    addrs,
+		LinkType: linkType,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package pcap
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+
+	"github.com/gopacket/gopacket"
+)
+
+// MergeReaders merge the packets of several offline handles, e.g. captured on different interfaces
+// or hosts, into a single timeline. The returned Handle reads the packets of all of them in ascending
+// timestamp order, with the InterfaceIndex of each packet set to the position of its handle in readers,
+// and reaches io.EOF once they all have. All readers must have the same link type, which is that of
+// the returned Handle; otherwise, reading returns an error. Closing the returned Handle closes the readers.
+func MergeReaders(readers ...*Handle) *Handle {
+	m := &merger{
+		sources: readers,
+		pending: make([]int, len(readers)),
+	}
+	o := &offlineReader{
+		merge:  m,
+		closer: m,
+	}
+	for i, r := range readers {
+		m.pending[i] = i
+		if r.LinkType() != readers[0].LinkType() {
+			m.err = fmt.Errorf("cannot merge handles of link types %d and %d", readers[0].LinkType(), r.LinkType())
+		}
+		if r.offline != nil && r.offline.snaplen > o.snaplen {
+			o.snaplen = r.offline.snaplen
+		}
+	}
+	if len(readers) > 0 {
+		o.linkType = readers[0].LinkType()
+	}
+	return &Handle{offline: o}
+}
+
+// mergedPacket the next packet of one of the merged handles
+type mergedPacket struct {
+	data   []byte
+	ci     gopacket.CaptureInfo
+	source int
+}
+
+// merger a k-way merge of the packets of several handles, keeping the next packet of each in a heap
+type merger struct {
+	sources []*Handle
+	// pending the sources whose next packet has yet to be read
+	pending []int
+	packets mergeHeap
+	err     error
+}
+
+// readPacketData read the earliest of the next packets of the sources
+func (m *merger) readPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if m.err != nil {
+		return nil, gopacket.CaptureInfo{}, m.err
+	}
+	// fill in the sources we took the last packet from; on an error, they still are pending for the next try
+	for len(m.pending) > 0 {
+		source := m.pending[0]
+		data, ci, err := m.sources[source].ReadPacketData()
+		switch {
+		case err == io.EOF:
+		case err != nil:
+			return nil, ci, fmt.Errorf("error reading merged handle %d: %w", source, err)
+		default:
+			ci.InterfaceIndex = source
+			heap.Push(&m.packets, mergedPacket{data: data, ci: ci, source: source})
+		}
+		m.pending = m.pending[1:]
+	}
+	if len(m.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	p := heap.Pop(&m.packets).(mergedPacket)
+	m.pending = append(m.pending, p.source)
+	return p.data, p.ci, nil
+}
+
+// Close close all the merged handles
+func (m *merger) Close() error {
+	for _, h := range m.sources {
+		h.Close()
+	}
+	return nil
+}
+
+// mergeHeap packets ordered by timestamp, then by source, so that ties keep the order of the sources
+type mergeHeap []mergedPacket
+
+func (p mergeHeap) Len() int { return len(p) }
+func (p mergeHeap) Less(i, j int) bool {
+	if !p[i].ci.Timestamp.Equal(p[j].ci.Timestamp) {
+		return p[i].ci.Timestamp.Before(p[j].ci.Timestamp)
+	}
+	return p[i].source < p[j].source
+}
+func (p mergeHeap) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p *mergeHeap) Push(x any)   { *p = append(*p, x.(mergedPacket)) }
+func (p *mergeHeap) Pop() any {
+	old := *p
+	x := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return x
+}
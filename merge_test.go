@@ -0,0 +1,75 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMergeReaders(t *testing.T) {
+	ts := time.Unix(1600000000, 0)
+	first := []testRecord{
+		{ts, []byte{0x01}, 1},
+		{ts.Add(2 * time.Second), []byte{0x03}, 1},
+		{ts.Add(3 * time.Second), []byte{0x04}, 1},
+		{ts.Add(6 * time.Second), []byte{0x07}, 1},
+	}
+	second := []testRecord{
+		{ts.Add(time.Second), []byte{0x02}, 1},
+		{ts.Add(3 * time.Second), []byte{0x05}, 1},
+		{ts.Add(5 * time.Second), []byte{0x06}, 1},
+	}
+	var handles []*Handle
+	for _, records := range [][]testRecord{first, second} {
+		h, err := OpenOfflineReader(bytes.NewReader(buildPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeEthernet, records)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		handles = append(handles, h)
+	}
+	h := MergeReaders(handles...)
+	defer h.Close()
+	if lt := h.LinkType(); lt != LinkTypeEthernet {
+		t.Errorf("mismatched link type, actual %d, expected %d", lt, LinkTypeEthernet)
+	}
+	// equal timestamps keep the order of the handles
+	expected := []int{0, 1, 0, 0, 1, 1, 0}
+	var last time.Time
+	for i, source := range expected {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if ci.Timestamp.Before(last) {
+			t.Errorf("%d: timestamp %v before previous %v", i, ci.Timestamp, last)
+		}
+		last = ci.Timestamp
+		if data[0] != byte(i+1) {
+			t.Errorf("%d: mismatched packet, actual %x, expected %x", i, data[0], i+1)
+		}
+		if ci.InterfaceIndex != source {
+			t.Errorf("%d: mismatched interface index, actual %d, expected %d", i, ci.InterfaceIndex, source)
+		}
+	}
+	if _, _, err := h.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected io.EOF after last packet, got %v", err)
+	}
+}
+
+func TestMergeReadersLinkTypes(t *testing.T) {
+	var handles []*Handle
+	for _, linkType := range []uint32{LinkTypeEthernet, LinkTypeLinuxSLL} {
+		h, err := OpenOfflineReader(bytes.NewReader(buildPcap(binary.LittleEndian, pcapMagicMicroseconds, linkType, testRecords)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		handles = append(handles, h)
+	}
+	h := MergeReaders(handles...)
+	defer h.Close()
+	if _, _, err := h.ReadPacketData(); err == nil {
+		t.Error("expected error merging different link types")
+	}
+}
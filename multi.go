@@ -0,0 +1,181 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	syscall "golang.org/x/sys/unix"
+)
+
+// multiMemberTimeout the buffer timeout of each of the handles of OpenLiveMulti, which only are read once
+// they are ready, so that one that was not after all does not hold up the others
+const multiMemberTimeout = time.Millisecond
+
+// OpenLiveMulti open a live capture on each of ifaces, with the same settings and options, as OpenLive does,
+// that are read as one handle. Its reads poll all of the sockets, or, on Darwin, bpf devices, together, and
+// take the packets of those that are ready in turn, so that a busy interface does not starve the others;
+// the CaptureInfo.InterfaceIndex of each packet is the index of the interface it was captured on.
+// All of the interfaces must have the same link type, which is that of the handle. Filters, the direction
+// and the other settings of the handle apply to each of them. It cannot write packets, as there is no one
+// interface to write them on. Once ctx is done, the handle is closed.
+func OpenLiveMulti(ctx context.Context, ifaces []string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, _ error) {
+	if len(ifaces) == 0 {
+		return nil, errors.New("no interfaces to capture on")
+	}
+	m := &multiReader{
+		ifaces:        ifaces,
+		bufferTimeout: int64(timeout),
+		done:          make(chan struct{}),
+		wake:          [2]int{-1, -1},
+	}
+	for _, iface := range ifaces {
+		h, err := OpenLive(iface, snaplen, promiscuous, multiMemberTimeout, syscalls, opts...)
+		if err != nil {
+			m.closeAll()
+			return nil, fmt.Errorf("unable to open %s: %w", iface, err)
+		}
+		m.members = append(m.members, h)
+		if h.LinkType() != m.members[0].LinkType() {
+			m.closeAll()
+			return nil, fmt.Errorf("cannot capture on %s of link type %d and %s of link type %d together", ifaces[0], m.members[0].LinkType(), iface, h.LinkType())
+		}
+		m.pollfd = append(m.pollfd, syscall.PollFd{Fd: int32(h.fd), Events: syscall.POLLIN})
+	}
+	if err := syscall.Pipe(m.wake[:]); err != nil {
+		m.closeAll()
+		return nil, fmt.Errorf("unable to create pipe to wake readers: %v", err)
+	}
+	m.pollfd = append(m.pollfd, syscall.PollFd{Fd: int32(m.wake[0]), Events: syscall.POLLIN})
+	h := &Handle{
+		multi:            m,
+		fd:               -1,
+		snaplen:          m.members[0].snaplen,
+		linkType:         m.members[0].LinkType(),
+		maxHostAddresses: m.members[0].maxHostAddresses,
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.Close()
+		case <-m.done:
+		}
+	}()
+	return h, nil
+}
+
+// multiReader the handles of OpenLiveMulti, one for each interface, which are polled together
+type multiReader struct {
+	// bufferTimeout how long, as a time.Duration, a read waits for packets on any of the members
+	bufferTimeout int64
+	// deadline the read deadline of SetReadDeadline, as UnixNano, or 0 for none
+	deadline int64
+	closed   uint32
+	ifaces   []string
+	members  []*Handle
+	// pollfd the sockets of the members, in order, and then the read end of wake
+	pollfd []syscall.PollFd
+	// wake a pipe, written to by close, to wake a read waiting in poll
+	wake [2]int
+	// next the member to try first in the next read, so that they take turns
+	next int
+	// mu held by a read, so that close waits for it before closing the members out from under it
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+// readPacketData read the next packet of any of the members with read, as ReadPacketData does
+func (m *multiReader) readPacketData(read func(h *Handle) ([]byte, gopacket.CaptureInfo, error)) (data []byte, ci gopacket.CaptureInfo, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadline, expired := waitDeadline(time.Duration(atomic.LoadInt64(&m.bufferTimeout)), atomic.LoadInt64(&m.deadline))
+	for atomic.LoadUint32(&m.closed) == 0 {
+		ready, err := m.nextReady(deadline)
+		if err != nil {
+			return nil, ci, err
+		}
+		if ready >= 0 {
+			m.next = (ready + 1) % len(m.members)
+			data, ci, err = read(m.members[ready])
+			if err != nil {
+				return nil, ci, fmt.Errorf("error reading %s: %w", m.ifaces[ready], err)
+			}
+			if data != nil {
+				return data, ci, nil
+			}
+		}
+		// nothing was ready, or what was did not make a packet, e.g. as it was of the wrong direction
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, ci, expired
+		}
+	}
+	return nil, ci, io.EOF
+}
+
+// nextReady the next member, in turn, that has a packet to read, waiting for one to until the deadline,
+// if any, or -1 if there is none by then, or close woke it
+func (m *multiReader) nextReady(deadline time.Time) (int, error) {
+	// packets that a member already read from the kernel come first, as its socket need not be readable for them
+	for i := range m.members {
+		if j := (m.next + i) % len(m.members); m.members[j].buffered() {
+			return j, nil
+		}
+	}
+	timeout := -1
+	if !deadline.IsZero() {
+		// round up, so that we do not wake just before the deadline, only to poll again
+		timeout = int((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	if _, err := syscall.Poll(m.pollfd, timeout); err != nil && err != syscall.EINTR {
+		return -1, fmt.Errorf("error polling sockets: %v", err)
+	}
+	// an error, or hang up, is ready too, for the read of the member to report it
+	for i := range m.members {
+		if j := (m.next + i) % len(m.members); m.pollfd[j].Revents != 0 {
+			return j, nil
+		}
+	}
+	return -1, nil
+}
+
+// each call f for each of the members, stopping at the first error
+func (m *multiReader) each(f func(h *Handle) error) error {
+	for i, h := range m.members {
+		if err := f(h); err != nil {
+			return fmt.Errorf("%s: %w", m.ifaces[i], err)
+		}
+	}
+	return nil
+}
+
+// close wake any read, and, once it is done, close the members
+func (m *multiReader) close() {
+	if !atomic.CompareAndSwapUint32(&m.closed, 0, 1) {
+		return
+	}
+	close(m.done)
+	_, _ = syscall.Write(m.wake[1], []byte{0})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeAll()
+}
+
+// closeAll close the members, and the wake pipe, if they are open
+func (m *multiReader) closeAll() {
+	for _, h := range m.members {
+		h.Close()
+	}
+	for _, fd := range m.wake {
+		if fd >= 0 {
+			_ = syscall.Close(fd)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"golang.org/x/net/bpf"
+)
+
+// magic numbers of the classic libpcap file format, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagicMicroseconds uint32 = 0xa1b2c3d4
+	pcapMagicNanoseconds  uint32 = 0xa1b23c4d
+	pcapGlobalHeaderSize         = 24
+	pcapRecordHeaderSize         = 16
+	// pcapMaxRecordSize the largest record we are willing to read, to protect against corrupt files
+	pcapMaxRecordSize = 256 * 1024
+)
+
+// offlineReader reads packets from a classic libpcap or pcapng file, or from merged handles
+type offlineReader struct {
+	r        *bufio.Reader
+	closer   io.Closer
+	order    binary.ByteOrder
+	nano     bool
+	snaplen  uint32
+	linkType uint32
+	// filter run against each packet, as the kernel would for a live handle
+	filter *bpf.VM
+	// merge the handles to read from instead of r
+	merge *merger
+	// ng whether it is a pcapng file, with the interfaces of its current section
+	ng         bool
+	interfaces []pcapngInterface
+	// iface the only interface whose packets are read, if byInterface; see FilterByInterface
+	iface       int
+	byInterface bool
+}
+
+// OpenOffline open a classic libpcap or pcapng file for reading. The returned Handle supports
+// ReadPacketData, Listen and LinkType exactly as a live one does.
+func OpenOffline(path string) (*Handle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	h, err := OpenOfflineReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	h.offline.closer = f
+	return h, nil
+}
+
+// OpenOfflineReader read classic libpcap or pcapng file data from r. The returned Handle supports
+// ReadPacketData, Listen and LinkType exactly as a live one does. Filters set with SetBPFFilter
+// are compiled for the link type of the file and applied as the packets are read. For pcapng, that is
+// the link type of its first interface, which all of the interfaces whose packets are read must have;
+// the InterfaceIndex of each packet is the id of its interface in its section of the file.
+func OpenOfflineReader(r io.Reader) (*Handle, error) {
+	o := &offlineReader{
+		r: bufio.NewReader(r),
+	}
+	// pcapng starts with a section header, whose type reads the same in either byte order
+	if magic, err := o.r.Peek(4); err == nil && binary.LittleEndian.Uint32(magic) == pcapngBlockSectionHeader {
+		if err := o.openPcapng(); err != nil {
+			return nil, err
+		}
+		return &Handle{offline: o}, nil
+	}
+	var hdr [pcapGlobalHeaderSize]byte
+	if _, err := io.ReadFull(o.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("unable to read pcap file header: %w", err)
+	}
+	// the magic number tells us both the byte order and the timestamp resolution
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicMicroseconds:
+		o.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicMicroseconds:
+		o.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicNanoseconds:
+		o.order, o.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNanoseconds:
+		o.order, o.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("unknown pcap magic number %#x", hdr[0:4])
+	}
+	o.snaplen = o.order.Uint32(hdr[16:20])
+	o.linkType = o.order.Uint32(hdr[20:24])
+	return &Handle{offline: o}, nil
+}
+
+// setFilter apply raw to every packet read from now on, or no longer filter if it is empty
+func (o *offlineReader) setFilter(raw []bpf.RawInstruction) error {
+	if len(raw) == 0 {
+		o.filter = nil
+		return nil
+	}
+	inst, ok := bpf.Disassemble(raw)
+	if !ok {
+		return errors.New("filter has instructions that cannot be applied to offline handles")
+	}
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+	o.filter = vm
+	return nil
+}
+
+// readPacketData read the next record from the file that passes the filter, truncated to the length it returns
+func (o *offlineReader) readPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		if data, ci, err = o.readRecord(); err != nil {
+			return data, ci, err
+		}
+		if o.byInterface && ci.InterfaceIndex != o.iface {
+			continue
+		}
+		if o.ng && o.interfaces[ci.InterfaceIndex].linkType != o.linkType {
+			return nil, ci, fmt.Errorf("pcapng interface %d has link type %d, not %d", ci.InterfaceIndex, o.interfaces[ci.InterfaceIndex].linkType, o.linkType)
+		}
+		if o.filter == nil {
+			return data, ci, nil
+		}
+		n, err := o.filter.Run(data)
+		if err != nil {
+			return nil, ci, fmt.Errorf("error running filter: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if n < len(data) {
+			data = data[:n]
+			ci.CaptureLength = n
+		}
+		return data, ci, nil
+	}
+}
+
+// readRecord read the next record from the file
+func (o *offlineReader) readRecord() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if o.merge != nil {
+		return o.merge.readPacketData()
+	}
+	if o.ng {
+		return o.readPcapngRecord()
+	}
+	var hdr [pcapRecordHeaderSize]byte
+	if _, err := io.ReadFull(o.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ci, fmt.Errorf("truncated pcap record header: %w", err)
+		}
+		return nil, ci, err
+	}
+	var (
+		sec     = o.order.Uint32(hdr[0:4])
+		frac    = o.order.Uint32(hdr[4:8])
+		caplen  = o.order.Uint32(hdr[8:12])
+		origlen = o.order.Uint32(hdr[12:16])
+	)
+	if caplen > pcapMaxRecordSize {
+		return nil, ci, fmt.Errorf("pcap record length %d larger than maximum %d", caplen, pcapMaxRecordSize)
+	}
+	data = make([]byte, caplen)
+	if _, err := io.ReadFull(o.r, data); err != nil {
+		return nil, ci, fmt.Errorf("truncated pcap record: %w", err)
+	}
+	ts := time.Unix(int64(sec), int64(frac)*int64(time.Microsecond))
+	if o.nano {
+		ts = time.Unix(int64(sec), int64(frac))
+	}
+	ci = gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: int(caplen),
+		Length:        int(origlen),
+	}
+	return data, ci, nil
+}
+
+// close release the underlying file, if we opened it
+func (o *offlineReader) close() {
+	if o.closer != nil {
+		_ = o.closer.Close()
+	}
+}
@@ -0,0 +1,285 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+type testRecord struct {
+	ts     time.Time
+	data   []byte
+	length int
+}
+
+var testRecords = []testRecord{
+	{time.Unix(1600000000, 123456000), []byte{0x01, 0x02, 0x03, 0x04}, 4},
+	{time.Unix(1600000001, 999999000), []byte("a somewhat longer packet"), 100},
+	{time.Unix(1600000002, 0), []byte{0xff}, 1},
+}
+
+// buildPcap build a classic libpcap file by hand
+func buildPcap(order binary.ByteOrder, magic, linkType uint32, records []testRecord) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, order, magic)
+	_ = binary.Write(&buf, order, uint16(2))
+	_ = binary.Write(&buf, order, uint16(4))
+	_ = binary.Write(&buf, order, int32(0))
+	_ = binary.Write(&buf, order, uint32(0))
+	_ = binary.Write(&buf, order, uint32(65535))
+	_ = binary.Write(&buf, order, linkType)
+	for _, r := range records {
+		frac := uint32(r.ts.Nanosecond() / 1000)
+		if magic == pcapMagicNanoseconds {
+			frac = uint32(r.ts.Nanosecond())
+		}
+		_ = binary.Write(&buf, order, uint32(r.ts.Unix()))
+		_ = binary.Write(&buf, order, frac)
+		_ = binary.Write(&buf, order, uint32(len(r.data)))
+		_ = binary.Write(&buf, order, uint32(r.length))
+		buf.Write(r.data)
+	}
+	return buf.Bytes()
+}
+
+// checkRecords read all packets from the handle and compare them to the expected records
+func checkRecords(t *testing.T, h *Handle, records []testRecord) {
+	t.Helper()
+	for i, r := range records {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(data, r.data) {
+			t.Errorf("%d: mismatched data, actual %x, expected %x", i, data, r.data)
+		}
+		if !ci.Timestamp.Equal(r.ts) {
+			t.Errorf("%d: mismatched timestamp, actual %v, expected %v", i, ci.Timestamp, r.ts)
+		}
+		if ci.CaptureLength != len(r.data) || ci.Length != r.length {
+			t.Errorf("%d: mismatched lengths, actual %d/%d, expected %d/%d", i, ci.CaptureLength, ci.Length, len(r.data), r.length)
+		}
+	}
+	if _, _, err := h.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected io.EOF after last record, got %v", err)
+	}
+}
+
+func TestOpenOfflineReader(t *testing.T) {
+	nanoRecords := append([]testRecord{{time.Unix(1600000003, 123456789), []byte{0x05}, 1}}, testRecords...)
+	tests := []struct {
+		name    string
+		order   binary.ByteOrder
+		magic   uint32
+		records []testRecord
+	}{
+		{"little endian", binary.LittleEndian, pcapMagicMicroseconds, testRecords},
+		{"big endian", binary.BigEndian, pcapMagicMicroseconds, testRecords},
+		{"nanoseconds", binary.LittleEndian, pcapMagicNanoseconds, nanoRecords},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := OpenOfflineReader(bytes.NewReader(buildPcap(tt.order, tt.magic, 113, tt.records)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer h.Close()
+			if lt := h.LinkType(); lt != 113 {
+				t.Errorf("mismatched link type, actual %d, expected %d", lt, 113)
+			}
+			checkRecords(t, h, tt.records)
+		})
+	}
+}
+
+func TestOpenOfflineInvalid(t *testing.T) {
+	if _, err := OpenOfflineReader(bytes.NewReader([]byte{0x01, 0x02})); err == nil {
+		t.Error("expected error for short header")
+	}
+	if _, err := OpenOfflineReader(bytes.NewReader(make([]byte, pcapGlobalHeaderSize))); err == nil {
+		t.Error("expected error for invalid magic number")
+	}
+}
+
+func TestOpenOffline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	if err := os.WriteFile(path, buildPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeEthernet, testRecords), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := OpenOffline(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	var count int
+	for p := range h.Listen() {
+		if p.Error != nil {
+			break
+		}
+		if !bytes.Equal(p.B, testRecords[count].data) {
+			t.Errorf("%d: mismatched data, actual %x, expected %x", count, p.B, testRecords[count].data)
+		}
+		count++
+	}
+	if count != len(testRecords) {
+		t.Errorf("mismatched count, actual %d, expected %d", count, len(testRecords))
+	}
+}
+
+// sllPacket build a Linux SLL packet, as captured with tcpdump -i any, of a UDP packet between src and dst
+func sllPacket(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, udp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	// packet type, ARPHRD_ETHER, address length, address and protocol
+	hdr := []byte{0, 0, 0, 1, 0, 6, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0, 0, 0x08, 0x00}
+	return append(hdr, buf.Bytes()...)
+}
+
+func TestOfflineSetBPFFilter(t *testing.T) {
+	ts := time.Unix(1600000000, 0)
+	var records []testRecord
+	for i, hosts := range [][2]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3", "10.0.0.2"}, {"10.0.0.2", "10.0.0.1"}, {"10.0.0.2", "10.0.0.3"}} {
+		data := sllPacket(t, hosts[0], hosts[1])
+		records = append(records, testRecord{ts.Add(time.Duration(i) * time.Second), data, len(data)})
+	}
+	matching := []testRecord{records[0], records[2]}
+	h, err := OpenOfflineReader(bytes.NewReader(buildPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeLinuxSLL, records)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	// with Ethernet offsets, the address would be read 2 bytes early, and nothing would match
+	if err := h.SetBPFFilter("host 10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	checkRecords(t, h, matching)
+}
+
+func TestOfflineSetBPFFilterUnsupported(t *testing.T) {
+	h, err := OpenOfflineReader(bytes.NewReader(buildPcap(binary.LittleEndian, pcapMagicMicroseconds, 105, testRecords)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	if err := h.SetBPFFilter("host 10.0.0.1"); err == nil {
+		t.Error("expected error for unsupported link type")
+	}
+	if err := h.SetBPFFilter("inbound"); err == nil {
+		t.Error("expected error for direction on offline handle")
+	}
+}
+
+func TestListenError(t *testing.T) {
+	data := buildPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeEthernet, testRecords)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		data    []byte
+		ctx     context.Context
+		packets int
+		err     error
+	}{
+		{"end of file", data, context.Background(), len(testRecords), nil},
+		{"truncated", data[:len(data)-1], context.Background(), len(testRecords) - 1, io.EOF},
+		{"canceled", data, canceled, 0, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := OpenOfflineReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer h.Close()
+			var count int
+			for p := range h.ListenContext(tt.ctx) {
+				if p.Error != nil {
+					t.Errorf("unexpected packet error: %v", p.Error)
+				}
+				count++
+			}
+			if count != tt.packets {
+				t.Errorf("mismatched packets, actual %d, expected %d", count, tt.packets)
+			}
+			err = h.Error()
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("mismatched error, actual %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApplyFilterToPacket(t *testing.T) {
+	frame := func(transport gopacket.SerializableLayer, port uint16) []byte {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, DstMAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+		switch l := transport.(type) {
+		case *layers.UDP:
+			ip.Protocol, l.SrcPort, l.DstPort = layers.IPProtocolUDP, 1234, layers.UDPPort(port)
+			_ = l.SetNetworkLayerForChecksum(ip)
+		case *layers.TCP:
+			ip.Protocol, l.SrcPort, l.DstPort = layers.IPProtocolTCP, 1234, layers.TCPPort(port)
+			_ = l.SetNetworkLayerForChecksum(ip)
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, transport, gopacket.Payload("payload")); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	h, err := OpenOfflineReader(bytes.NewReader(buildPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeEthernet, nil)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	dns, http, tcpDNS := frame(&layers.UDP{}, 53), frame(&layers.UDP{}, 80), frame(&layers.TCP{}, 53)
+	// with no filter, everything passes
+	if !h.ApplyFilterToPacket(http) {
+		t.Error("packet did not pass without a filter")
+	}
+	if err := h.SetBPFFilter("udp port 53"); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{"udp port 53", dns, true},
+		{"udp port 80", http, false},
+		{"tcp port 53", tcpDNS, false},
+		{"truncated", dns[:20], false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if actual := h.ApplyFilterToPacket(tt.data); actual != tt.expected {
+			t.Errorf("%s: mismatched result, actual %v, expected %v", tt.name, actual, tt.expected)
+		}
+	}
+	// a new filter replaces the one run before
+	if err := h.SetBPFFilter("udp port 80"); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	if h.ApplyFilterToPacket(dns) || !h.ApplyFilterToPacket(http) {
+		t.Error("the new filter was not applied")
+	}
+}
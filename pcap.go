@@ -1,14 +1,19 @@
 package pcap
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/gopacket/gopacket"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/bpf"
 
 	"github.com/packetcap/go-pcap/filter"
@@ -17,6 +22,12 @@ import (
 const (
 	// DefaultSyscalls whether the default is to use syscalls or not
 	DefaultSyscalls = defaultSyscalls
+	// sniffSnaplen how much of each packet Sniff captures, enough for any packet
+	sniffSnaplen = 65535
+	// SnaplenMTU a snaplen for OpenLive that captures whole packets, whatever the MTU of the interface
+	SnaplenMTU int32 = -1
+	// maxLinkHeaderLen an Ethernet header plus a vlan tag, which the Linux kernel strips, but we restore
+	maxLinkHeaderLen = 14 + 4
 )
 
 // Packet a single packet returned by a listen call
@@ -26,35 +37,417 @@ type Packet struct {
 	Error error
 }
 
+// Direction which packets to capture, relative to the interface on which they are captured
+type Direction uint8
+
+const (
+	// DirectionInOut capture packets both received and sent, the default
+	DirectionInOut Direction = iota
+	// DirectionIn capture only packets received on the interface
+	DirectionIn
+	// DirectionOut capture only packets sent from the interface
+	DirectionOut
+)
+
+// CaptureCapabilities the packet capture features supported by the running kernel
+type CaptureCapabilities struct {
+	// Mmap whether a memory-mapped receive ring is available
+	Mmap bool
+	// TpacketV1, TpacketV2, TpacketV3 which versions of the ring layout are supported
+	TpacketV1 bool
+	TpacketV2 bool
+	TpacketV3 bool
+	// Fanout whether multiple sockets can share load via PACKET_FANOUT
+	Fanout bool
+	// KernelHardwareTimestamps whether the kernel accepts requests for hardware timestamps, as every
+	// kernel since 2.6.36 does. It says nothing of the network adapters, whose drivers must support
+	// them, e.g. as reported by ethtool -T, for any packet to be stamped by the hardware.
+	KernelHardwareTimestamps bool
+}
+
 type BpfProgram struct {
 	Len    uint16
 	Filter *bpf.RawInstruction
 }
 
+// Option an optional setting for a Handle, passed to OpenLive. Options are applied
+// before the capture is set up.
+type Option func(*Handle)
+
+// WithBufferSize ask the kernel for a capture buffer of size bytes, rather than its default.
+// A larger buffer drops fewer packets on a busy interface. The kernel may round or cap the size.
+// It only has an effect on Darwin, where the bpf buffer has to be sized before the device is
+// bound to the interface; on Linux, the mmap ring is sized by the library.
+func WithBufferSize(size int) Option {
+	return func(h *Handle) {
+		h.bufferSize = size
+	}
+}
+
+// WithImmediate deliver packets as soon as they arrive, rather than in batches. On Linux, the mmap ring hands
+// over a block of packets once it is full, or it times out, so a slow trickle of packets can wait several
+// milliseconds or more; with this, the block times out after a millisecond. That trades throughput for
+// latency, as the blocks get handed over, and polled for, much more often, mostly with few packets in them.
+// It only has an effect on Linux with mmap; reads with syscalls, and Darwin, always are immediate.
+func WithImmediate() Option {
+	return func(h *Handle) {
+		h.immediate = true
+	}
+}
+
+// TimestampSource where the timestamps of captured packets come from
+type TimestampSource uint8
+
+const (
+	// TimestampSoftware the kernel stamps each packet as it receives it, the default
+	TimestampSoftware TimestampSource = iota
+	// TimestampHardware the network adapter stamps each packet, if it can, and has been set to stamp
+	// received packets, e.g. with hwstamp_ctl -r 1; the kernel stamps any packet that it did not
+	TimestampHardware
+)
+
+// WithTimestampSource take the timestamps of packets from src, which is software by default.
+// It only has an effect on Linux, where, with mmap, it is the PACKET_TIMESTAMP of the ring, and, with
+// syscalls, the timestamps the socket reports with each packet.
+func WithTimestampSource(src TimestampSource) Option {
+	return func(h *Handle) {
+		h.timestampSource = src
+	}
+}
+
+// ErrHandleDown returned by a read when a health check finds the socket in an error state or hung up,
+// e.g. because the interface went away. The handle does not recover; close it, and open a new one.
+var ErrHandleDown = errors.New("capture handle is down")
+
+// ErrNoInterface returned by Interface for a handle that is not bound to one interface, e.g. one capturing
+// on all of them, a handle of OpenLiveMulti, or an offline one.
+var ErrNoInterface = errors.New("handle is not bound to an interface")
+
+// WithHealthCheck check the health of the socket every interval while waiting for packets, so that a
+// read returns ErrHandleDown, rather than blocking forever, if the socket fails.
+// It only has an effect on Linux.
+func WithHealthCheck(interval time.Duration) Option {
+	return func(h *Handle) {
+		h.healthCheck = interval
+	}
+}
+
+// WithFilter set the filter expr, in tcpdump syntax, as SetBPFFilter does, while opening the capture.
+// On Linux, the filter is attached before the socket is bound to the interface, so that, unlike
+// with a later SetBPFFilter, no packets that do not match ever are captured. On Darwin, setting
+// the filter flushes anything captured before it.
+func WithFilter(expr string) Option {
+	return func(h *Handle) {
+		h.initialFilter = expr
+	}
+}
+
+// WithMaxHostAddresses check at most n of the addresses of each hostname in a filter, rather than
+// filter.DefaultMaxHostAddresses, as filter.LimitHostAddresses does. A hostname with more addresses
+// is logged as a warning when the filter is set, as the packets of the others do not match.
+func WithMaxHostAddresses(n int) Option {
+	return func(h *Handle) {
+		h.maxHostAddresses = n
+	}
+}
+
 // OpenLive open a live capture. Returns a Handle that implements https://godoc.org/github.com/gopacket/gopacket#PacketDataSource
-// so you can pass it there.
-func OpenLive(device string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool) (handle *Handle, _ error) {
-	return openLive(device, snaplen, promiscuous, timeout, syscalls)
+// so you can pass it there. A snaplen of SnaplenMTU captures whole packets, as much as the MTU of the
+// interface and its link header. A timeout other than 0 bounds how long a read waits, as SetBufferTimeout does.
+// It is the same as activating an InactiveHandle with these settings.
+func OpenLive(device string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, _ error) {
+	p := NewInactiveHandle(device)
+	p.snaplen, p.promiscuous, p.timeout, p.syscalls = snaplen, promiscuous, timeout, syscalls
+	p.SetOptions(opts...)
+	return p.Activate()
+}
+
+// mtuSnaplen the snaplen for whole packets on device, which is its MTU plus the largest link header,
+// or, for all interfaces, the largest MTU of any of them. Packets coalesced by receive offload
+// can be larger than the MTU, so still are cut short.
+func mtuSnaplen(device string) (int32, error) {
+	var mtu int
+	if device == "" || device == "any" {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return 0, fmt.Errorf("unable to list interfaces for their MTU: %v", err)
+		}
+		for _, in := range ifaces {
+			if in.MTU > mtu {
+				mtu = in.MTU
+			}
+		}
+	} else {
+		in, err := net.InterfaceByName(device)
+		if err != nil {
+			return 0, fmt.Errorf("unknown interface %s: %v", device, err)
+		}
+		mtu = in.MTU
+	}
+	if mtu <= 0 {
+		return 0, fmt.Errorf("unable to get the MTU of %s", device)
+	}
+	return int32(mtu + maxLinkHeaderLen), nil
+}
+
+// FanoutMode how the kernel spreads packets across the handles in a fanout group
+type FanoutMode uint16
+
+const (
+	// FanoutHash by a hash of the flow, so all packets of a flow go to the same handle
+	FanoutHash FanoutMode = 0
+	// FanoutLB round-robin
+	FanoutLB FanoutMode = 1
+	// FanoutCPU by the CPU on which the packet arrived
+	FanoutCPU FanoutMode = 2
+	// FanoutRollover all to one handle, until it is full, then the next
+	FanoutRollover FanoutMode = 3
+)
+
+// fanout the fanout group that a handle joins
+type fanout struct {
+	group uint16
+	mode  FanoutMode
+}
+
+// OpenLiveByIndex open a live capture like OpenLive, on the interface with the given index rather
+// than name, for network namespaces where interfaces are renamed, or only the index is stable. On
+// Linux, the socket is bound to the index itself; on Darwin, which binds by name, the index is
+// resolved to the name of the interface when opening.
+func OpenLiveByIndex(index int, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, _ error) {
+	if snaplen == SnaplenMTU {
+		in, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("unknown interface index %d: %v", index, err)
+		}
+		if snaplen, err = mtuSnaplen(in.Name); err != nil {
+			return nil, err
+		}
+	}
+	return openLiveByIndex(index, snaplen, promiscuous, timeout, syscalls, opts...)
 }
 
-// Listen simple one-step command to listen and send packets over a returned channel
-func (h Handle) Listen() chan Packet {
+// OpenLiveFanout open a live capture like OpenLive, that also joins the fanout group groupID.
+// Each packet goes to only one of the handles in the group, chosen according to mode, so that
+// capture can be spread across several readers. All handles in a group must use the same mode.
+// It only is supported on Linux.
+func OpenLiveFanout(device string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, groupID uint16, mode FanoutMode, opts ...Option) (handle *Handle, _ error) {
+	opts = append(opts, func(h *Handle) {
+		h.fanout = &fanout{group: groupID, mode: mode}
+	})
+	return OpenLive(device, snaplen, promiscuous, timeout, syscalls, opts...)
+}
+
+// ReadPacketData read the next packet from the handle. Implements https://godoc.org/github.com/gopacket/gopacket#PacketDataSource
+func (h *Handle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		switch {
+		case h.offline != nil:
+			data, ci, err = h.offline.readPacketData()
+		case h.multi != nil:
+			data, ci, err = h.multi.readPacketData((*Handle).ReadPacketData)
+		default:
+			data, ci, err = h.readPacketData()
+		}
+		if err != nil || data == nil {
+			return data, ci, err
+		}
+		if h.dedup != nil && h.dedup.duplicate(data, ci.Timestamp) {
+			continue
+		}
+		return data, ci, nil
+	}
+}
+
+// ZeroCopyReadPacketData read the next packet from the handle, without allocating for it. Implements
+// https://godoc.org/github.com/gopacket/gopacket#ZeroCopyPacketDataSource
+//
+// The returned data only is valid until the next call to ZeroCopyReadPacketData, ReadPacketData, ReadTo
+// or Close; it points into a buffer that the handle reuses for the next packets, which, on Linux with
+// mmap, is the ring shared with the kernel, un-mapped on Close. Copy anything that is needed for longer,
+// and do not call Close while still processing the data. ReadPacketData copies each packet out of the
+// same buffers, sized to the packet. With gopacket.NewZeroCopyPacketSource and NoCopy, only use NextPacket,
+// not Packets, whose channel holds on to packets past the next read.
+func (h *Handle) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		switch {
+		case h.offline != nil:
+			data, ci, err = h.offline.readPacketData()
+		case h.multi != nil:
+			data, ci, err = h.multi.readPacketData((*Handle).ZeroCopyReadPacketData)
+		default:
+			data, ci, err = h.zeroCopyReadPacketData()
+		}
+		if err != nil || data == nil {
+			return data, ci, err
+		}
+		if h.dedup != nil && h.dedup.duplicate(data, ci.Timestamp) {
+			continue
+		}
+		return data, ci, nil
+	}
+}
+
+// DecodeNext read the next packet, without copying it, as ZeroCopyReadPacketData does, and decode it with parser
+// into the layers it was made with, setting decoded to their types. Unlike gopacket.NewZeroCopyPacketSource,
+// which makes a new gopacket.Packet for each, it allocates nothing for a packet, once the parser's layers and
+// decoded have grown to fit, on Linux with mmap; with syscalls, the read itself allocates.
+//
+// The layers point into the packet, so, like it, they only are valid until the next read or Close; copy
+// anything that is needed for longer. If there is no packet before the buffer timeout, decoded is empty.
+// The error is that of the parser, e.g. gopacket.UnsupportedLayerType, if the read succeeded.
+func (h *Handle) DecodeNext(parser *gopacket.DecodingLayerParser, decoded *[]gopacket.LayerType) (ci gopacket.CaptureInfo, err error) {
+	data, ci, err := h.ZeroCopyReadPacketData()
+	if err != nil || data == nil {
+		*decoded = (*decoded)[:0]
+		return ci, err
+	}
+	return ci, parser.DecodeLayers(data, decoded)
+}
+
+// ReadTo read the next packet into buf, returning the number of bytes read. It is like
+// ReadPacketData, but lets callers reuse their own buffers rather than allocating for each
+// packet. If buf is shorter than the packet, the packet is truncated to fit.
+func (h *Handle) ReadTo(buf []byte) (n int, ci gopacket.CaptureInfo, err error) {
+	for {
+		switch {
+		case h.offline != nil:
+			n, ci, err = readToCopy(buf, h.offline.readPacketData)
+		case h.multi != nil:
+			n, ci, err = readToCopy(buf, func() ([]byte, gopacket.CaptureInfo, error) {
+				return h.multi.readPacketData((*Handle).ZeroCopyReadPacketData)
+			})
+		default:
+			n, ci, err = h.readTo(buf)
+		}
+		if err != nil || n == 0 {
+			return n, ci, err
+		}
+		if h.dedup != nil && h.dedup.duplicate(buf[:n], ci.Timestamp) {
+			continue
+		}
+		return n, ci, nil
+	}
+}
+
+// readToCopy read a packet using read and copy it into buf, for sources that cannot read into buf directly
+func readToCopy(buf []byte, read func() ([]byte, gopacket.CaptureInfo, error)) (int, gopacket.CaptureInfo, error) {
+	data, ci, err := read()
+	if err != nil || data == nil {
+		return 0, ci, err
+	}
+	n := copy(buf, data)
+	ci.CaptureLength = n
+	return n, ci, nil
+}
+
+// Listen simple one-step command to listen and send packets over a returned channel. The channel
+// is closed once the handle is closed, or, for an offline handle, at the end of the file.
+func (h *Handle) Listen() chan Packet {
+	return h.ListenContext(context.Background())
+}
+
+// ListenContext listen and send packets over a returned channel, like Listen, until ctx is done.
+// The channel is closed once ctx is done or the handle is closed, after which Error tells why. Reading cannot be interrupted
+// by ctx, so a read in progress when ctx is done only finishes with the next packet, or Close.
+func (h *Handle) ListenContext(ctx context.Context) chan Packet {
 	c := make(chan Packet, 50)
 	go func() {
-		for {
+		defer close(c)
+		for ctx.Err() == nil {
 			b, ci, err := h.ReadPacketData()
-			c <- Packet{
-				B:     b,
-				Info:  ci,
-				Error: err,
+			if errors.Is(err, io.EOF) {
+				// a bare io.EOF is the end of the file or Close, but one that is wrapped, e.g. a
+				// truncated record, is worth knowing about
+				if err != io.EOF {
+					h.setError(err)
+				}
+				return
+			}
+			if err != nil {
+				h.setError(err)
+			}
+			if b == nil && err == nil {
+				continue
+			}
+			select {
+			case c <- Packet{B: b, Info: ci, Error: err}:
+			case <-ctx.Done():
 			}
 		}
+		h.setError(ctx.Err())
 	}()
 	return c
 }
 
+// asyncError wraps an error for atomic.Value, which needs every value stored to be the same type
+type asyncError struct {
+	err error
+}
+
+// setError record err as the last asynchronous error
+func (h *Handle) setError(err error) {
+	h.asyncErr.Store(asyncError{err: err})
+}
+
+// Error the last error from the goroutine started by Listen or ListenContext: why the channel
+// was closed, e.g. the context error or a truncated file, or else the last error sent on it.
+// It is nil if there has been none, including when the channel was closed by Close or at the
+// end of the file.
+func (h *Handle) Error() error {
+	if e, ok := h.asyncErr.Load().(asyncError); ok {
+		return e.err
+	}
+	return nil
+}
+
+// Sniff capture packets on device that match filter, calling handler for each of them, until ctx
+// is done. It takes care of opening, filtering and closing the handle, so it is the simplest way
+// to capture. It returns nil when ctx is done, or the first error capturing.
+func Sniff(ctx context.Context, device, filter string, handler func(Packet)) error {
+	h, err := OpenLive(device, sniffSnaplen, true, 0, defaultSyscalls)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if err := h.SetBPFFilter(filter); err != nil {
+		return err
+	}
+	packets := make(chan Packet)
+	go func() {
+		for {
+			b, ci, err := h.ReadPacketData()
+			if b == nil && err == nil {
+				continue
+			}
+			select {
+			case packets <- Packet{B: b, Info: ci, Error: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case p := <-packets:
+			if p.Error != nil {
+				return p.Error
+			}
+			handler(p)
+		}
+	}
+}
+
 // set a classic BPF filter on the listener. filter must be compliant with
-// tcpdump syntax.
+// tcpdump syntax. As the direction of a packet is not in the packet, inbound or
+// outbound in the filter are applied with SetDirection, rather than in the kernel
+// filter, and only can be joined to the rest of the filter with "and". On offline handles, the
+// filter is compiled for the link type of the file and applied as the packets are read.
 func (h *Handle) SetBPFFilter(expr string) error {
 	expr2 := strings.TrimSpace(expr)
 	// empty strings are not of interest
@@ -65,27 +458,334 @@ func (h *Handle) SetBPFFilter(expr string) error {
 	if e == nil {
 		return fmt.Errorf("no expression received for filter '%s'", expr)
 	}
-	f := e.Compile()
-	instructions, err := f.Compile()
+	f, direction, err := filter.SplitPacketDirection(e.Parse())
 	if err != nil {
 		return fmt.Errorf("failed to compile filter into instructions: %v", err)
 	}
+	if f != nil {
+		var warnings []string
+		f, warnings = filter.LimitHostAddresses(f, h.maxHostAddresses)
+		for _, w := range warnings {
+			log.Warn(w)
+		}
+	}
+	// with nothing but a direction, keep everything in that direction
+	instructions := []bpf.Instruction{bpf.RetConstant{Val: 0x40000}}
+	if f != nil {
+		if instructions, err = f.Compile(); err != nil {
+			return fmt.Errorf("failed to compile filter into instructions: %w", err)
+		}
+	}
+	// the filter compiler works in Ethernet offsets, so move them to our link type
+	instructions, err = filter.ForLinkType(instructions, h.LinkType())
+	if err != nil {
+		return fmt.Errorf("failed to compile filter into instructions: %v", err)
+	}
+	if direction != filter.PacketDirectionAny && h.offline != nil {
+		return errors.New("inbound and outbound are not available for offline handles")
+	}
 	raw, err := bpf.Assemble(instructions)
 	if err != nil {
 		return fmt.Errorf("bpf assembly failed: %v", err)
 	}
+	// the direction a filter set no longer applies once another replaces it, though one set with SetDirection does
+	d, setDirection := DirectionInOut, h.filterDirection
+	switch direction {
+	case filter.PacketDirectionInbound:
+		d, setDirection = DirectionIn, true
+	case filter.PacketDirectionOutbound:
+		d, setDirection = DirectionOut, true
+	}
+	// set the direction first, so that if it cannot be, the filter is left as it was, and put it back if the filter cannot be
+	prevDirection, prevFilterDirection := h.direction, h.filterDirection
+	if setDirection {
+		if err := h.SetDirection(d); err != nil {
+			return err
+		}
+	}
+	if err := h.SetRawBPFFilter(raw); err != nil {
+		if setDirection && h.SetDirection(prevDirection) == nil {
+			h.filterDirection = prevFilterDirection
+		}
+		return err
+	}
+	h.filterDirection = direction != filter.PacketDirectionAny
+	return nil
+}
+
+// FilterByInterface only read the packets whose CaptureInfo.InterfaceIndex is index, e.g. of one of
+// the interfaces of a pcapng file, or of one of the handles merged by MergeReaders; a negative index
+// reads all of them again. Which interface a packet came from is not in the packet, so this cannot be
+// a BPF filter, and only is available on offline handles; it is applied before any BPF filter.
+func (h *Handle) FilterByInterface(index int) error {
+	if h.offline == nil {
+		return errors.New("packets only can be filtered by interface on offline handles")
+	}
+	h.offline.iface, h.offline.byInterface = index, index >= 0
+	return nil
+}
+
+// SetBPFFilterInstructions set a BPF program that was built outside of the filter compiler, e.g.
+// by hand or from tcpdump -dd, after assembling it. Unlike SetBPFFilter, the offsets are not moved
+// to the link type of the handle, so the program must be written for it.
+func (h *Handle) SetBPFFilterInstructions(inst []bpf.Instruction) error {
+	raw, err := bpf.Assemble(inst)
+	if err != nil {
+		return fmt.Errorf("bpf assembly failed: %v", err)
+	}
 	return h.SetRawBPFFilter(raw)
 }
 
 func (h *Handle) SetRawBPFFilter(raw []bpf.RawInstruction) error {
+	defer h.matcher.Store(filterMatcher{})
+	if h.offline != nil {
+		if err := h.offline.setFilter(raw); err != nil {
+			return err
+		}
+		h.filter = raw
+		return nil
+	}
+	// the kernel needs at least one instruction; offline, there is no kernel, so an empty program is no filter
+	if len(raw) == 0 {
+		return errors.New("empty BPF program")
+	}
+	if h.multi != nil {
+		if err := h.multi.each(func(m *Handle) error { return m.SetRawBPFFilter(raw) }); err != nil {
+			return err
+		}
+	} else if err := h.setFilter(raw); err != nil {
+		return err
+	}
+	// only once it is set, so that a rejected program is not reported as the filter
 	h.filter = raw
-	return h.setFilter()
+	return nil
+}
+
+// filterMatcher the filter in a bpf.VM, for ApplyFilterToPacket, or nothing until it is built
+type filterMatcher struct {
+	vm *bpf.VM
+	// err why the filter cannot be run in a bpf.VM
+	err error
+}
+
+// ApplyFilterToPacket whether data, a packet of the link type of the handle, passes the filter that is set,
+// running it in userspace, e.g. to filter packets that were captured otherwise, or to test a filter.
+// It passes every packet if no filter is set, and none if the filter cannot be run outside of the kernel,
+// e.g. as it uses extensions. inbound or outbound in the filter are not applied, as they are not in the packet.
+func (h *Handle) ApplyFilterToPacket(data []byte) bool {
+	if len(h.filter) == 0 {
+		return true
+	}
+	m := h.filterMatcher()
+	if m.err != nil {
+		return false
+	}
+	n, err := m.vm.Run(data)
+	return err == nil && n > 0
+}
+
+// WritePacketDataChecked inject a raw packet, as WritePacketData does, but only if it passes the filter
+// that is set on the handle, as ApplyFilterToPacket runs it, e.g. to catch a test injecting packets
+// that it then would not capture. It returns false, and no error, if the filter rejects the packet,
+// and an error, without sending it, if the filter cannot be run outside of the kernel.
+func (h *Handle) WritePacketDataChecked(data []byte) (sent bool, err error) {
+	if len(h.filter) != 0 {
+		m := h.filterMatcher()
+		if m.err != nil {
+			return false, fmt.Errorf("unable to check packet against filter: %v", m.err)
+		}
+		if n, err := m.vm.Run(data); err != nil || n == 0 {
+			return false, nil
+		}
+	}
+	if err := h.WritePacketData(data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// filterMatcher the filterMatcher of the filter that is set, building it if it is not yet
+func (h *Handle) filterMatcher() filterMatcher {
+	m, _ := h.matcher.Load().(filterMatcher)
+	if m.vm == nil && m.err == nil {
+		m = newFilterMatcher(h.filter)
+		h.matcher.Store(m)
+	}
+	return m
+}
+
+// newFilterMatcher put raw in a bpf.VM
+func newFilterMatcher(raw []bpf.RawInstruction) filterMatcher {
+	inst, ok := bpf.Disassemble(raw)
+	if !ok {
+		return filterMatcher{err: errors.New("filter has instructions that cannot be run in userspace")}
+	}
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		return filterMatcher{err: fmt.Errorf("invalid filter: %v", err)}
+	}
+	return filterMatcher{vm: vm}
+}
+
+// Filter the program set by the last SetBPFFilter, SetBPFFilterInstructions or SetRawBPFFilter, as assembled for the link type
+// of the handle, e.g. for logging it, or saving it with a capture. On Linux, when capturing on all
+// interfaces, the kernel runs a translation of it, as it filters before the cooked header is added.
+// It is nil if no filter has been set.
+func (h *Handle) Filter() []bpf.RawInstruction {
+	return append([]bpf.RawInstruction(nil), h.filter...)
+}
+
+// FilterProgram the program set by the last SetBPFFilter or SetRawBPFFilter, as Filter returns it,
+// disassembled. Any instruction that cannot be disassembled is left a bpf.RawInstruction.
+func (h *Handle) FilterProgram() []bpf.Instruction {
+	if len(h.filter) == 0 {
+		return nil
+	}
+	inst, _ := bpf.Disassemble(h.filter)
+	return inst
+}
+
+// SetRingBuffer size the Linux mmap ring as blockCount blocks of blockSize bytes, rather than the
+// smallest block that fits a packet. Larger blocks, and more of them, drop fewer packets on a busy
+// interface, at the cost of memory. blockSize must be a power of 2, a multiple of the page size, and
+// at least the size of a frame. It only can be called before the first read, and only has an effect
+// on Linux handles that use mmap.
+func (h *Handle) SetRingBuffer(blockSize, blockCount uint32) error {
+	if h.offline != nil {
+		return errors.New("ring buffers are not supported on offline handles")
+	}
+	if h.multi != nil {
+		return h.multi.each(func(m *Handle) error { return m.SetRingBuffer(blockSize, blockCount) })
+	}
+	return h.setRingBuffer(blockSize, blockCount)
+}
+
+// SetSnaplen capture up to snaplen bytes of each packet from now on, e.g. to switch between capturing
+// only headers and capturing whole packets. On Linux with mmap, it rebuilds the ring if its blocks are
+// too small for the new snaplen, which only can be done before the first read; otherwise, it returns
+// an error, and the handle needs to be opened again. On Linux with syscalls, it sizes the buffer read
+// into. On Darwin, the kernel buffer cannot change once the handle is open, so packets are cut to the
+// snaplen as they are read, and it cannot capture more of a packet than that buffer holds. It cannot
+// be called during a read.
+func (h *Handle) SetSnaplen(snaplen int32) error {
+	if h.offline != nil {
+		return errors.New("snaplen cannot be changed on offline handles")
+	}
+	if h.multi != nil {
+		if err := h.multi.each(func(m *Handle) error { return m.SetSnaplen(snaplen) }); err != nil {
+			return err
+		}
+		h.snaplen = snaplen
+		return nil
+	}
+	return h.setSnaplen(snaplen)
+}
+
+// SetBufferTimeout bound how long a read waits for packets to d, after which it returns no packet, i.e.
+// nil data and a nil error, if nothing has been captured. This is the latency of the capture buffer: on
+// BSD, it is BIOCSRTIMEOUT, which also delivers a partly filled buffer once it passes; on Linux, it caps
+// the wait for the socket to be readable. A d of 0, the default, waits until there are packets.
+// On Linux with mmap, the kernel only hands over a block of the ring once it is full or its retire
+// timeout passes, so packets can take longer than d to arrive unless the handle is opened WithImmediate.
+func (h *Handle) SetBufferTimeout(d time.Duration) error {
+	if h.offline != nil {
+		return errors.New("buffer timeout cannot be set on offline handles")
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid buffer timeout %v", d)
+	}
+	if h.multi != nil {
+		atomic.StoreInt64(&h.multi.bufferTimeout, int64(d))
+		return nil
+	}
+	return h.setBufferTimeout(d)
+}
+
+// Flush discard the packets that have been captured but not yet read, in the kernel and in the handle,
+// e.g. those captured before a filter was set, so that reads only return packets captured after it.
+// On BSD, it is BIOCFLUSH. On Linux with mmap, the blocks of the ring that the kernel has handed over go
+// back to it unread, and the packets already in the one it is filling are skipped once it is read; with
+// syscalls, the socket is drained. It cannot be called during a read.
+func (h *Handle) Flush() error {
+	if h.offline != nil {
+		return errors.New("offline handles cannot be flushed")
+	}
+	if h.multi != nil {
+		return h.multi.each(func(m *Handle) error { return m.Flush() })
+	}
+	return h.flush()
+}
+
+// SetReadDeadline have reads give up waiting for packets at t, returning context.DeadlineExceeded, as
+// net.Conn does, rather than no packet, as at the buffer timeout, which still applies if it passes first.
+// It is checked whenever a read waits, so packets that already have been read from the kernel still are
+// returned once it has passed. A zero t clears the deadline. It can be changed between reads, or during
+// one, when it applies from the next wait.
+func (h *Handle) SetReadDeadline(t time.Time) error {
+	if h.offline != nil {
+		return errors.New("read deadline cannot be set on offline handles")
+	}
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	if h.multi != nil {
+		atomic.StoreInt64(&h.multi.deadline, deadline)
+		return nil
+	}
+	atomic.StoreInt64(&h.deadline, deadline)
+	return nil
+}
+
+// waitDeadline when a read that starts now gives up waiting for packets, the earlier of bufferTimeout from now
+// and readDeadline, as UnixNano, either of which may be 0 for none, or zero if there is neither; and what the
+// read returns then, no error, for no packet, at the buffer timeout, or context.DeadlineExceeded at the deadline
+func waitDeadline(bufferTimeout time.Duration, readDeadline int64) (time.Time, error) {
+	var deadline time.Time
+	if bufferTimeout > 0 {
+		deadline = time.Now().Add(bufferTimeout)
+	}
+	if readDeadline != 0 {
+		if t := time.Unix(0, readDeadline); deadline.IsZero() || !deadline.Before(t) {
+			return t, context.DeadlineExceeded
+		}
+	}
+	return deadline, nil
+}
+
+// Close close sockets and release resources
+func (h *Handle) Close() {
+	if h.offline != nil {
+		h.offline.close()
+		return
+	}
+	if h.multi != nil {
+		h.multi.close()
+		return
+	}
+	h.close()
 }
 
 // LinkType return the link type, compliant with pcap-linktype(7) and http://www.tcpdump.org/linktypes.html.
-// For now, we just support Ethernet; some day we may support more
-func (h Handle) LinkType() uint8 {
-	return LinkTypeEthernet
+func (h Handle) LinkType() uint32 {
+	if h.offline != nil {
+		return h.offline.linkType
+	}
+	return h.linkType
+}
+
+// Interface the interface the handle is bound to, e.g. for its hardware address, to build frames to inject,
+// or its MTU, as it is now, rather than when the handle was opened. It returns ErrNoInterface for handles
+// that are not bound to one interface.
+func (h *Handle) Interface() (*net.Interface, error) {
+	if h.offline != nil || h.multi != nil || h.index == 0 {
+		return nil, ErrNoInterface
+	}
+	in, err := net.InterfaceByIndex(h.index)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get interface %d: %v", h.index, err)
+	}
+	return in, nil
 }
 
 // getEndianness discover the endianness of our current system
@@ -5,6 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -17,87 +21,362 @@ import (
 
 const (
 	enable = 1
+	// maxDataLinkTypes the most datalink types we expect an interface to offer
+	maxDataLinkTypes = 32
 	// defaultSyscalls default setting for using syscalls
 	defaultSyscalls = true
 )
 
 type Handle struct {
-	syscalls    bool
-	promiscuous bool //nolint: unused
-	index       int
-	snaplen     int32
-	fd          int
-	buf         []byte
-	endian      binary.ByteOrder
-	filter      []bpf.RawInstruction
+	// deadline the read deadline of SetReadDeadline, as UnixNano, or 0 for none
+	deadline      int64
+	syscalls      bool
+	promiscuous   bool
+	index         int
+	snaplen       int32
+	fd            int
+	buf           []byte
+	pending       []byte
+	linkType      uint32
+	bufferSize    int
+	healthCheck   time.Duration //nolint:unused
+	immediate     bool          //nolint:unused
+	fanout        *fanout
+	initialFilter string
+	// direction the direction of packets captured, as set with SetDirection
+	direction Direction
+	// filterDirection whether the direction was set by the inbound or outbound of the last filter
+	filterDirection bool
+	// maxHostAddresses the most addresses of each hostname in a filter to check, or 0 for filter.DefaultMaxHostAddresses
+	maxHostAddresses int
+	endian           binary.ByteOrder
+	filter           []bpf.RawInstruction
+	dedup            *deduplicator
+	offline          *offlineReader
+	// multi the handles of each interface, for a handle opened by OpenLiveMulti
+	multi *multiReader
+	// asyncErr the asyncError why Listen last stopped, or last failed reading
+	asyncErr atomic.Value
+	// subscribers the *broadcaster for Subscribe, once it has been called
+	subscribers atomic.Value
+	// matcher the filterMatcher for ApplyFilterToPacket, built when it first is needed after the filter is set
+	matcher atomic.Value
+	// timestampSource where the timestamps come from, which only can be chosen on Linux
+	timestampSource TimestampSource //nolint:unused
 }
 
-func (h *Handle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+func (h *Handle) readPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
 	if h.syscalls {
 		return h.readPacketDataSyscall()
 	}
 	return h.readPacketDataMmap()
 }
 
+func (h *Handle) zeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if h.syscalls {
+		return h.readBatch()
+	}
+	return h.readPacketDataMmap()
+}
+
+func (h *Handle) readTo(buf []byte) (n int, ci gopacket.CaptureInfo, err error) {
+	// packets are read from the bpf device in batches, so they always need to be copied out
+	return readToCopy(buf, h.zeroCopyReadPacketData)
+}
+
 func (h *Handle) readPacketDataSyscall() (data []byte, ci gopacket.CaptureInfo, err error) {
-	// must memset the buffer
-	h.buf = make([]byte, len(h.buf))
-	read, err := syscall.Read(h.fd, h.buf)
-	if err != nil {
-		return nil, ci, fmt.Errorf("error reading: %v", err)
+	// the batch buffer is reused, so copy the packet out of it, for it to stay valid
+	data, ci, err = h.readBatch()
+	if err != nil || data == nil {
+		return data, ci, err
 	}
-	if read <= 0 {
-		return nil, ci, fmt.Errorf("read no packets")
+	return append([]byte(nil), data...), ci, nil
+}
+
+// readBatch return the next packet of the batch read from the bpf device, reading another batch once
+// they all have been used up. The packet is in h.buf, so only is valid until the next read.
+func (h *Handle) readBatch() (data []byte, ci gopacket.CaptureInfo, err error) {
+	// a single read can return many packets, so only read again once we have used them all up
+	if len(h.pending) == 0 {
+		if err := h.waitReadable(); err != nil {
+			return nil, ci, err
+		}
+		// we only look at as much as was read, so there is no need to clear what was there before
+		read, err := syscall.Read(h.fd, h.buf)
+		if err == syscall.EBADF {
+			// the handle was closed
+			return nil, ci, io.EOF
+		}
+		if err != nil {
+			return nil, ci, fmt.Errorf("error reading: %v", err)
+		}
+		if read <= 0 {
+			// the buffer timeout passed with nothing captured
+			return nil, ci, nil
+		}
+		h.pending = h.buf[:read]
+	}
+	if len(h.pending) < syscall.SizeofBpfHdr {
+		h.pending = nil
+		return nil, ci, fmt.Errorf("short bpf header")
 	}
 	// separate the header and packet body
 	hdr := syscall.BpfHdr{}
-	buf := bytes.NewBuffer(h.buf[:syscall.SizeofBpfHdr])
+	buf := bytes.NewBuffer(h.pending[:syscall.SizeofBpfHdr])
 	err = binary.Read(buf, h.endian, &hdr)
 	if err != nil {
+		h.pending = nil
 		return nil, ci, fmt.Errorf("error reading bpf header: %v", err)
 	}
-	// TODO: add CaptureInfo, specifically:
-	//    capture timestamp
+	end := uint32(hdr.Hdrlen) + hdr.Caplen
+	if end > uint32(len(h.pending)) {
+		h.pending = nil
+		return nil, ci, fmt.Errorf("bpf packet of %d bytes extends past end of buffer", hdr.Caplen)
+	}
+	data = h.pending[hdr.Hdrlen:end]
+	// each packet is padded so that the next header is aligned
+	if next := bpfWordAlign(end); next < uint32(len(h.pending)) {
+		h.pending = h.pending[next:]
+	} else {
+		h.pending = nil
+	}
+	// the bpf device captures whole packets, so keep only the snaplen
+	if len(data) > int(h.snaplen) {
+		data = data[:h.snaplen]
+	}
+	// Darwin has no BIOCSTSTAMP, so the bpf device only stamps packets to the microsecond
 	ci = gopacket.CaptureInfo{
-		CaptureLength:  int(hdr.Caplen),
+		Timestamp:      time.Unix(int64(hdr.Tstamp.Sec), int64(hdr.Tstamp.Usec)*int64(time.Microsecond)),
+		CaptureLength:  len(data),
 		Length:         int(hdr.Datalen),
 		InterfaceIndex: h.index,
 	}
-	return h.buf[hdr.Hdrlen : uint32(hdr.Hdrlen)+hdr.Caplen], ci, nil
+	return data, ci, nil
+}
+
+// waitReadable wait, if there is a read deadline, for the bpf device to be readable, which it is once it has
+// packets or its buffer timeout passes, returning context.DeadlineExceeded if the deadline passes first.
+// Without one, the read itself waits.
+func (h *Handle) waitReadable() error {
+	deadline, expired := waitDeadline(0, atomic.LoadInt64(&h.deadline))
+	if deadline.IsZero() {
+		return nil
+	}
+	fds := []syscall.PollFd{{Fd: int32(h.fd), Events: syscall.POLLIN}}
+	for {
+		// round up, so that we do not wake just before the deadline, only to poll again
+		timeout := int((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+		if timeout < 0 {
+			timeout = 0
+		}
+		n, err := syscall.Poll(fds, timeout)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			return fmt.Errorf("error polling: %v", err)
+		case n > 0:
+			// readable, or closed, for the read to report
+			return nil
+		case !time.Now().Before(deadline):
+			return expired
+		}
+	}
+}
+
+// bpfWordAlign round x up to the alignment of bpf headers, like BPF_WORDALIGN
+func bpfWordAlign(x uint32) uint32 {
+	return (x + syscall.BPF_ALIGNMENT - 1) &^ (syscall.BPF_ALIGNMENT - 1)
 }
 
 func (h *Handle) readPacketDataMmap() (data []byte, ci gopacket.CaptureInfo, err error) {
 	return nil, ci, errors.New("mmap unsupported on Darwin")
 }
 
-// Close close sockets and release resources
-func (h *Handle) Close() {
+// buffered whether packets already have been read from the kernel, the rest of a batch, that the next read returns
+// without waiting for the socket
+func (h *Handle) buffered() bool {
+	return len(h.pending) > 0
+}
+
+// close close sockets and release resources
+func (h *Handle) close() {
 	// close the socket
 	_ = syscall.Close(h.fd)
 }
 
+// WritePacketData inject a raw packet, including the link layer header, on the
+// interface to which the handle is bound.
+func (h *Handle) WritePacketData(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("cannot write empty packet")
+	}
+	if h.multi != nil {
+		return errors.New("cannot write packets on a handle of several interfaces")
+	}
+	_, err := syscall.Write(h.fd, data)
+	return err
+}
+
+// SetDirection set the direction of packets to capture. Darwin only supports
+// choosing whether or not to see sent packets, via BIOCSSEESENT, so capturing only
+// sent packets is not supported.
+func (h *Handle) SetDirection(d Direction) error {
+	if h.multi != nil {
+		if err := h.multi.each(func(m *Handle) error { return m.SetDirection(d) }); err != nil {
+			return err
+		}
+		h.direction, h.filterDirection = d, false
+		return nil
+	}
+	var seeSent int
+	switch d {
+	case DirectionInOut:
+		seeSent = enable
+	case DirectionIn:
+	case DirectionOut:
+		return errors.New("capturing only sent packets is unsupported on Darwin")
+	default:
+		return fmt.Errorf("invalid direction: %d", d)
+	}
+	if err := SetBpfMonitor(h.fd, seeSent); err != nil {
+		return fmt.Errorf("unable to set BIOCSSEESENT: %v", err)
+	}
+	h.direction, h.filterDirection = d, false
+	return nil
+}
+
+// SetPromiscuous turn promiscuous mode on for the interface to which the handle is bound. BIOCPROMISC
+// only can turn it on; it stays on until the handle is closed, so turning it off is not supported.
+func (h *Handle) SetPromiscuous(promiscuous bool) error {
+	if h.offline != nil {
+		return errors.New("promiscuous mode is not supported on offline handles")
+	}
+	if h.multi != nil {
+		return h.multi.each(func(m *Handle) error { return m.SetPromiscuous(promiscuous) })
+	}
+	if promiscuous == h.promiscuous {
+		return nil
+	}
+	if !promiscuous {
+		return errors.New("turning promiscuous mode off is unsupported on Darwin")
+	}
+	if err := SetBpfPromisc(h.fd); err != nil {
+		return fmt.Errorf("failed to set promiscuous mode: %w", err)
+	}
+	h.promiscuous = true
+	return nil
+}
+
+// setSnaplen capture up to snaplen bytes of each packet from now on. h.buf is sized by the bpf
+// buffer, which cannot change once bound to the interface, so packets are cut to the snaplen as
+// they are read.
+func (h *Handle) setSnaplen(snaplen int32) error {
+	if snaplen <= 0 {
+		return fmt.Errorf("invalid snaplen %d", snaplen)
+	}
+	h.snaplen = snaplen
+	return nil
+}
+
+// flush discard the packets in the buffers of the bpf device, via BIOCFLUSH, and those already read from it
+func (h *Handle) flush() error {
+	h.pending = nil
+	if err := ioctlPtr(h.fd, syscall.BIOCFLUSH, nil); err != nil {
+		return fmt.Errorf("unable to flush with BIOCFLUSH: %v", err)
+	}
+	return nil
+}
+
+// setBufferTimeout have reads return whatever has been captured after d, via BIOCSRTIMEOUT
+func (h *Handle) setBufferTimeout(d time.Duration) error {
+	if err := SetBpfReadTimeout(h.fd, d); err != nil {
+		return fmt.Errorf("unable to set BIOCSRTIMEOUT: %v", err)
+	}
+	return nil
+}
+
+func (h *Handle) setRingBuffer(blockSize, blockCount uint32) error {
+	return errors.New("ring buffers are unsupported on Darwin")
+}
+
 // set a classic BPF filter on the listener. filter must be compliant with
 // tcpdump syntax.
-func (h *Handle) setFilter() error {
+func (h *Handle) setFilter(raw []bpf.RawInstruction) error {
 	/*
-	 * Try to install the kernel filter.
+	 * Try to install the kernel filter. If it is rejected, the kernel keeps the one it had.
 	 */
 	prog := BpfProgram{
-		Len:    uint16(len(h.filter)),
-		Filter: (*bpf.RawInstruction)(unsafe.Pointer(&h.filter[0])),
+		Len:    uint16(len(raw)),
+		Filter: (*bpf.RawInstruction)(unsafe.Pointer(&raw[0])),
 	}
 	if err := ioctlPtr(h.fd, syscall.BIOCSETF, unsafe.Pointer(&prog)); err != nil {
 		return fmt.Errorf("unable to set filter: %v", err)
 	}
+	// the kernel flushes its buffer when setting a filter, so drop what we have left over as well
+	h.pending = nil
 
 	return nil
 }
 
-func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool) (handle *Handle, _ error) {
-	var (
-		fd  int = -1
-		err error
-	)
+func openLiveByIndex(index int, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, _ error) {
+	in, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return nil, fmt.Errorf("unknown interface index %d: %v", index, err)
+	}
+	// keep the index we were given, rather than looking it up again by name
+	opts = append(opts, func(h *Handle) {
+		h.index = index
+	})
+	return openLive(in.Name, snaplen, promiscuous, timeout, syscalls, opts...)
+}
+
+// openBpfDevice open the first bpf device that is not in use
+func openBpfDevice() (int, error) {
+	for i := 0; i < 255; i++ {
+		dev := fmt.Sprintf("/dev/bpf%d", i)
+		fd, err := syscall.Open(dev, syscall.O_RDWR, 0000)
+		if fd > -1 {
+			return fd, nil
+		}
+		if err != nil && err == syscall.EBUSY {
+			continue
+		}
+		return -1, fmt.Errorf("error opening device %s: %v", dev, err)
+	}
+	return -1, errors.New("failed to get valid bpf device")
+}
+
+// findAllDevs the Interfaces of ifaces that can be captured on, with the link type that a bpf device
+// bound to each of them reports
+func findAllDevs(ifaces []net.Interface) ([]Interface, error) {
+	fd, err := openBpfDevice()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	devs := make([]Interface, 0, len(ifaces))
+	for _, in := range ifaces {
+		// binding again moves the device to the next interface
+		if err := SetBpfInterface(fd, in.Name); err != nil {
+			log.Debugf("leaving out interface %s: %v", in.Name, err)
+			continue
+		}
+		dlt, err := syscall.IoctlGetInt(fd, syscall.BIOCGDLT)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the BPF datalink type of %s: %v", in.Name, err)
+		}
+		dev, err := newInterface(in, uint32(dlt))
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, dev)
+	}
+	return devs, nil
+}
+
+func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, err error) {
+	fd := -1
 	logger := log.WithFields(log.Fields{
 		"iface":       iface,
 		"snaplen":     snaplen,
@@ -107,8 +386,23 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 	})
 	logger.Debug("started")
 	h := Handle{
-		snaplen:  snaplen,
-		syscalls: syscalls,
+		snaplen:     snaplen,
+		syscalls:    syscalls,
+		promiscuous: promiscuous,
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	if h.fanout != nil {
+		return nil, errors.New("fanout is unsupported on Darwin")
+	}
+	// the bpf device is bound by name, but packets and Interface need the index, unless OpenLiveByIndex gave it
+	if h.index == 0 {
+		in, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("unknown interface %s: %v", iface, err)
+		}
+		h.index = in.Index
 	}
 	// we need to know our endianness
 	endianness, err := getEndianness()
@@ -118,26 +412,37 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 	h.endian = endianness
 
 	// open the bpf device
-	for i := 0; i < 255; i++ {
-		dev := fmt.Sprintf("/dev/bpf%d", i)
-		fd, err = syscall.Open(dev, syscall.O_RDWR, 0000)
-		if fd > -1 {
-			break
-		}
-		if err != nil && err == syscall.EBUSY {
-			continue
-		}
-		return nil, fmt.Errorf("error opening device %s: %v", dev, err)
-	}
-	if fd <= -1 {
-		return nil, errors.New("failed to get valid bpf device")
+	if fd, err = openBpfDevice(); err != nil {
+		return nil, err
 	}
 	h.fd = fd
+	// from here on, release the bpf device, of which there are few, if opening fails
+	defer func() {
+		if err != nil {
+			h.close()
+		}
+	}()
 
 	// set the options
+	// the buffer size only can be set before binding to the interface
+	if h.bufferSize > 0 {
+		if _, err = SetBpfBuflen(fd, h.bufferSize); err != nil {
+			return nil, fmt.Errorf("failed to set the BPF buffer length to %d: %v", h.bufferSize, err)
+		}
+	}
 	if err = SetBpfInterface(fd, iface); err != nil {
 		return nil, fmt.Errorf("failed to set the BPF interface: %v", err)
 	}
+	if h.promiscuous {
+		if err = SetBpfPromisc(fd); err != nil {
+			return nil, fmt.Errorf("failed to set promiscuous mode: %w", err)
+		}
+	}
+	dlt, err := syscall.IoctlGetInt(fd, syscall.BIOCGDLT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the BPF datalink type: %v", err)
+	}
+	h.linkType = uint32(dlt)
 	if err = SetBpfHeadercmpl(fd, enable); err != nil {
 		return nil, fmt.Errorf("failed to set the BPF header complete option: %v", err)
 	}
@@ -152,10 +457,54 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 		return nil, fmt.Errorf("failed to read buffer length: %v", err)
 	}
 	h.buf = make([]byte, size)
+	// the link type only is known once bound to the interface; setting the filter then flushes the buffer
+	if err = h.SetBPFFilter(h.initialFilter); err != nil {
+		return nil, err
+	}
 
 	return &h, nil
 }
 
+// ListLinkTypes list the link types that the interface can deliver, compliant with
+// pcap-linktype(7). Pick one with SetLinkType.
+func (h *Handle) ListLinkTypes() ([]uint32, error) {
+	if h.offline != nil {
+		return nil, errors.New("link types cannot be listed on offline handles")
+	}
+	list := make([]uint32, maxDataLinkTypes)
+	// struct bpf_dltlist is packed to 4 bytes: the count, followed by a pointer to the list
+	var dl [12]byte
+	h.endian.PutUint32(dl[0:4], uint32(len(list)))
+	h.endian.PutUint64(dl[4:12], uint64(uintptr(unsafe.Pointer(&list[0]))))
+	err := ioctlPtr(h.fd, syscall.BIOCGDLTLIST, unsafe.Pointer(&dl[0]))
+	runtime.KeepAlive(list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the BPF datalink types: %v", err)
+	}
+	return list[:h.endian.Uint32(dl[0:4])], nil
+}
+
+// SetLinkType switch the interface to deliver packets with the link type lt, which
+// must be one of those returned by ListLinkTypes.
+func (h *Handle) SetLinkType(lt uint32) error {
+	if h.offline != nil {
+		return errors.New("link type cannot be set on offline handles")
+	}
+	if err := ioctlPtr(h.fd, syscall.BIOCSDLT, unsafe.Pointer(&lt)); err != nil {
+		return fmt.Errorf("failed to set the BPF datalink type %d: %v", lt, err)
+	}
+	h.linkType = lt
+	// the kernel flushes its buffer when changing the datalink type
+	h.pending = nil
+	return nil
+}
+
+// Capabilities report the supported capture features. The BPF device on Darwin
+// supports none of mmap rings, fanout or hardware timestamps.
+func Capabilities() (CaptureCapabilities, error) {
+	return CaptureCapabilities{}, nil
+}
+
 // because they deprecated all of the below from "syscall" and redirected to "golang.org/x/net/bpf" but did not
 // create a replacement. Sigh.
 
@@ -178,9 +527,32 @@ func SetBpfImmediate(fd, m int) error {
 	return ioctlPtr(fd, syscall.BIOCIMMEDIATE, unsafe.Pointer(&m))
 }
 
+// SetBpfReadTimeout have reads on fd return, with whatever has been captured, after d, or wait
+// until the buffer fills if d is 0
+func SetBpfReadTimeout(fd int, d time.Duration) error {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return ioctlPtr(fd, syscall.BIOCSRTIMEOUT, unsafe.Pointer(&tv))
+}
+
+// SetBpfPromisc put the interface attached to fd into promiscuous mode. It has to be called
+// after SetBpfInterface, and stays in effect until fd is closed.
+func SetBpfPromisc(fd int) error {
+	return ioctlPtr(fd, syscall.BIOCPROMISC, nil)
+}
+
 func SetBpfMonitor(fd, m int) error {
 	return ioctlPtr(fd, syscall.BIOCSSEESENT, unsafe.Pointer(&m))
 }
+
+// SetBpfBuflen set the buffer length for fd, returning the length the kernel accepted.
+// It has to be called before SetBpfInterface.
+func SetBpfBuflen(fd, l int) (int, error) {
+	v := uint32(l)
+	if err := ioctlPtr(fd, syscall.BIOCSBLEN, unsafe.Pointer(&v)); err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
 func BpfBuflen(fd int) (int, error) {
 	return syscall.IoctlGetInt(fd, syscall.BIOCGBLEN)
 }
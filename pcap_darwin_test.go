@@ -0,0 +1,209 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_bpfWordAlign(t *testing.T) {
+	tests := []struct {
+		in, expected uint32
+	}{
+		{0, 0}, {1, 4}, {4, 4}, {5, 8}, {62, 64},
+	}
+	for i, tt := range tests {
+		if out := bpfWordAlign(tt.in); out != tt.expected {
+			t.Errorf("%d: mismatched alignment of %d, actual %d, expected %d", i, tt.in, out, tt.expected)
+		}
+	}
+}
+
+func Test_OpenLivePromiscuous(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("opening /dev/bpf requires root")
+	}
+	handle, err := OpenLive("lo0", 1600, true, 0, true)
+	if err != nil {
+		t.Fatalf("unexpected error opening in promiscuous mode: %v", err)
+	}
+	defer handle.Close()
+	if !handle.promiscuous {
+		t.Error("expected handle to be promiscuous")
+	}
+}
+
+func Test_WithFilterInvalid(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("opening /dev/bpf requires root")
+	}
+	// more failures than there are bpf devices, which run out if any is left open
+	for i := 0; i < 300; i++ {
+		if _, err := OpenLive("lo0", 1600, false, 0, true, WithFilter("udp and port nothing")); err == nil {
+			t.Fatal("expected error opening with an invalid filter")
+		}
+	}
+	handle, err := OpenLive("lo0", 1600, false, 0, true)
+	if err != nil {
+		t.Fatalf("unexpected error opening after failing to open: %v", err)
+	}
+	handle.Close()
+}
+
+func Test_LinkTypes(t *testing.T) {
+	handle, err := OpenLive("lo0", 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	lts, err := handle.ListLinkTypes()
+	if err != nil {
+		t.Fatalf("unexpected error listing link types: %v", err)
+	}
+	if len(lts) == 0 {
+		t.Fatal("expected at least one link type for lo0")
+	}
+	lt := lts[len(lts)-1]
+	if err := handle.SetLinkType(lt); err != nil {
+		t.Fatalf("unexpected error setting link type %d: %v", lt, err)
+	}
+	if actual := handle.LinkType(); actual != lt {
+		t.Errorf("mismatched link type, actual %d, expected %d", actual, lt)
+	}
+}
+
+func Test_WithBufferSize(t *testing.T) {
+	handle, err := OpenLive("lo0", 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defaultSize := len(handle.buf)
+	handle.Close()
+
+	requested := 4 * 1024 * 1024
+	handle, err = OpenLive("lo0", 1600, false, 0, true, WithBufferSize(requested))
+	if err != nil {
+		t.Fatalf("unexpected error opening with buffer size: %v", err)
+	}
+	defer handle.Close()
+	size, err := BpfBuflen(handle.fd)
+	if err != nil {
+		t.Fatalf("unexpected error reading buffer length: %v", err)
+	}
+	// the kernel caps it at debug.bpf_maxbufsize, so we may not get all we asked for
+	if size < defaultSize || size > requested {
+		t.Errorf("buffer length %d outside of default %d and requested %d", size, defaultSize, requested)
+	}
+	if len(handle.buf) != size {
+		t.Errorf("mismatched read buffer, actual %d, expected %d", len(handle.buf), size)
+	}
+}
+
+func Test_readPacketDataSyscallFlood(t *testing.T) {
+	handle, err := OpenLive("lo0", 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// lo0 is not Ethernet, so our filters do not apply; pick out our packets by a marker instead
+	marker := []byte(fmt.Sprintf("flood-%d-", time.Now().UnixNano()))
+	// send them all at once, so that the kernel batches several into each read
+	count := 200
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write(append(marker, fmt.Sprintf("%d", i)...))
+	}
+	received := make(chan int)
+	go func() {
+		var n int
+		for n < count {
+			b, _, err := handle.ReadPacketData()
+			if err != nil {
+				break
+			}
+			if bytes.Contains(b, marker) {
+				n++
+			}
+		}
+		received <- n
+	}()
+	select {
+	case n := <-received:
+		if n != count {
+			t.Errorf("mismatched packet count, actual %d, expected %d", n, count)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("did not receive %d packets in time", count)
+	}
+}
+
+func Test_readPacketDataSyscallTimestamps(t *testing.T) {
+	handle, err := OpenLive("lo0", 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	marker := []byte(fmt.Sprintf("timestamp-%d-", time.Now().UnixNano()))
+	start := time.Now()
+	count := 10
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write(append(marker, fmt.Sprintf("%d", i)...))
+		time.Sleep(time.Millisecond)
+	}
+	received := make(chan []time.Time)
+	go func() {
+		var stamps []time.Time
+		for len(stamps) < count {
+			b, ci, err := handle.ReadPacketData()
+			if err != nil {
+				break
+			}
+			if bytes.Contains(b, marker) {
+				stamps = append(stamps, ci.Timestamp)
+			}
+		}
+		received <- stamps
+	}()
+	var stamps []time.Time
+	select {
+	case stamps = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("did not receive %d packets in time", count)
+	}
+	if len(stamps) != count {
+		t.Fatalf("mismatched packet count, actual %d, expected %d", len(stamps), count)
+	}
+	for i, ts := range stamps {
+		// the clock of the kernel and ours can be a little apart
+		if ts.Before(start.Add(-time.Second)) || ts.After(time.Now().Add(time.Second)) {
+			t.Errorf("packet %d: timestamp %v is not around when it was sent, from %v", i, ts, start)
+		}
+		if i > 0 && !ts.After(stamps[i-1]) {
+			t.Errorf("packet %d: timestamp %v is not after that of the previous packet, %v", i, ts, stamps[i-1])
+		}
+	}
+}
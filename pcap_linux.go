@@ -1,12 +1,12 @@
 package pcap
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -31,15 +31,44 @@ const (
 	// defaultSyscalls default setting for using syscalls
 	defaultSyscalls     = false
 	offsetToBlockStatus = 4 + 4
+	// offsetToNumPkts where the count of the packets in a block is, after its status
+	offsetToNumPkts = offsetToBlockStatus + 4
 
 	tpacketAuxdataSize = 20
+	// timespecSize the size of a struct timespec, which the socket timestamps are in
+	timespecSize = int(unsafe.Sizeof(syscall.Timespec{}))
+	// scmTimestampingSize the size of the three timestamps of SCM_TIMESTAMPING
+	scmTimestampingSize = 3 * timespecSize
+	// anyInterface the name of the pseudo-interface for capturing on all interfaces, as with libpcap
+	anyInterface = "any"
+	// sllHeaderLen the length of the Linux cooked header, see https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL.html
+	sllHeaderLen = 16
+	// immediateBlockTimeout how long, in milliseconds, the kernel waits for a block to fill before
+	// handing it over, when immediate; it otherwise picks its own, which can be much longer
+	immediateBlockTimeout = 1
+	// maxOffloadLen the largest packet the kernel can deliver on receive offload, regardless of the MTU
+	maxOffloadLen = 0xffff
+	// ethernetTypeOffset where the EtherType, or the TPID of a vlan tag, is in an Ethernet frame
+	ethernetTypeOffset = 12
+	// vlanTagLen the length of an 802.1Q tag, which is its TPID and TCI
+	vlanTagLen = 4
+	// etherTypeVLAN the TPID of an 802.1Q tag
+	etherTypeVLAN = 0x8100
 )
 
+// errBufferTimeout the buffer timeout passed while waiting for packets
+var errBufferTimeout = errors.New("buffer timeout")
+
+// errNoRing the ring is gone, after the kernel rejected its replacement and then the old one too
+var errNoRing = errors.New("the mmap ring is gone, after failing to replace it")
+
+// the sizes of the headers before each packet in the ring, as the syscall package does not provide them all
 var (
-	packetRALLSize           int32
-	alignedTpacketHdrSize    int32
-	alignedTpacketRALLSize   int32
-	alignedTpacketAllHdrSize int32
+	packetRALLSize           = int32(unsafe.Sizeof(syscall.RawSockaddrLinklayer{}))
+	alignedTpacketHdrSize    = tpacketAlign(syscall.SizeofTpacket3Hdr)
+	alignedTpacketRALLSize   = tpacketAlign(packetRALLSize)
+	alignedTpacketAllHdrSize = alignedTpacketHdrSize + alignedTpacketRALLSize
+	blockHeaderSize          = binary.Size(blockHeader{})
 )
 
 type blockHeader struct {
@@ -51,6 +80,8 @@ type blockHeader struct {
 type captured struct {
 	data []byte
 	ci   gopacket.CaptureInfo
+	// inRing whether data still is in the mmap ring, rather than copied out of it
+	inRing bool
 }
 
 // Handle states
@@ -77,13 +108,18 @@ const (
 const pollIntervalMs = 60 * 1000 // 1 minute
 
 type Handle struct {
-	// this must be first for atomic to behave nicely
+	// these must be first for atomic to behave nicely
+	// bufferTimeout how long, as a time.Duration, a read waits for packets before giving up, or 0 to wait until there are some
+	bufferTimeout int64
+	// deadline the read deadline of SetReadDeadline, as UnixNano, or 0 for none
+	deadline        int64
 	state           uint32
 	syscalls        bool
 	promiscuous     bool
 	index           int
 	iface           string
 	snaplen         int32
+	mtu             int
 	fd              int
 	ring            []byte
 	framePtr        int
@@ -94,38 +130,82 @@ type Handle struct {
 	blockNumbers    int
 	blockSize       int
 	pollfd          []syscall.PollFd
-	endian          binary.ByteOrder
-	filter          []bpf.RawInstruction
-	cache           []captured
+	direction       Direction
+	// filterDirection whether the direction was set by the inbound or outbound of the last filter
+	filterDirection bool
+	linkType        uint32
+	bufferSize      int //nolint:unused
+	healthCheck     time.Duration
+	immediate       bool
+	timestampSource TimestampSource
+	// started whether there has been a read, after which the ring cannot change
+	started       uint32
+	fanout        *fanout
+	initialFilter string
+	// maxHostAddresses the most addresses of each hostname in a filter to check, or 0 for filter.DefaultMaxHostAddresses
+	maxHostAddresses int
+	// wakefd an eventfd, polled along with the socket, that Close signals to wake any waiting reader
+	wakefd int
+	// poll is syscall.Poll, other than in tests
+	poll func(fds []syscall.PollFd, timeout int) (int, error)
+	// recvmsg is syscall.Recvmsg, other than in tests
+	recvmsg func(fd int, p, oob []byte, flags int) (n, oobn, recvflags int, from syscall.Sockaddr, err error)
+	endian  binary.ByteOrder
+	filter  []bpf.RawInstruction
+	// queuedFilter runs the filter on the packets in the next queuedBlocks blocks of the ring, which the
+	// kernel filled, or started to, before the filter was attached
+	queuedFilter *bpf.VM
+	queuedBlocks int
+	// flushSkip how many packets of the next block to skip, which the kernel already had put in it when
+	// Flush was called, while it still was filling it
+	flushSkip int
+	cache     []captured
+	// packets the reusable backing for cache, when reading without copying
+	packets []captured
+	// held whether the block at heldFlag still is in use by packets read without copying,
+	// and must be returned to the kernel before reading the next one
+	held     bool
+	heldFlag int
+	// losing whether the last block read was marked by the kernel as losing packets
+	losing bool
+	// readBuf the reusable buffer for syscall reads, of snaplen bytes
+	readBuf []byte
+	oob     []byte
+	dedup   *deduplicator
+	offline *offlineReader
+	// multi the handles of each interface, for a handle opened by OpenLiveMulti
+	multi *multiReader
+	// asyncErr the asyncError why Listen last stopped, or last failed reading
+	asyncErr atomic.Value
+	// subscribers the *broadcaster for Subscribe, once it has been called
+	subscribers atomic.Value
+	// matcher the filterMatcher for ApplyFilterToPacket, built when it first is needed after the filter is set
+	matcher atomic.Value
 }
 
-func (h *Handle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	if !atomic.CompareAndSwapUint32(&h.state, open, reading) {
+func (h *Handle) readPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if !h.startRead() {
 		return data, ci, io.EOF
 	}
-	defer func() {
-		if !atomic.CompareAndSwapUint32(&h.state, reading, open) {
-			if atomic.CompareAndSwapUint32(&h.state, canceling, canceled) {
-				logger := log.WithFields(log.Fields{
-					"iface": h.iface,
-				})
-				logger.Debugf("packet read was canceled")
-			}
-		}
-	}()
+	defer h.finishRead()
 	if h.syscalls {
 		return h.readPacketDataSyscall()
 	}
 	// mmap can return multiple packets, so we can cache extras, and return if there are
 
-	// if there already was one in the cache, return it
+	// if there already was one in the cache, return it, copied out of the ring if
+	// it was read by ZeroCopyReadPacketData
 	if len(h.cache) > 0 {
 		cap := h.cache[0]
 		h.cache = h.cache[1:]
+		if cap.inRing {
+			cap.data = append([]byte(nil), cap.data...)
+		}
 		return cap.data, cap.ci, nil
 	}
 	// there was not, so read a new one
-	caps, err := h.readPacketDataMmap()
+	h.releaseBlock()
+	caps, err := h.readPacketDataMmap(false)
 	if err != nil {
 		return nil, ci, err
 	}
@@ -141,54 +221,383 @@ func (h *Handle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err err
 	return cap.data, cap.ci, nil
 }
 
-func writeVLANTag(data []byte, tci, tpid uint16) ([]byte, []byte) {
-	buf := make([]byte, 4)
-	if tpid == 0 || binary.BigEndian.Uint16(data[12:14]) != 0x8100 {
-		tpid = binary.BigEndian.Uint16(data[12:14])
-		binary.BigEndian.PutUint16(data[12:14], 0x8100) // set ethernet frame type to VLAN
+func (h *Handle) zeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if !h.startRead() {
+		return data, ci, io.EOF
+	}
+	defer h.finishRead()
+	if h.syscalls {
+		return h.readSyscallBuf()
+	}
+	if len(h.cache) == 0 {
+		// the packets from the last block all have been read, so it can go back to the kernel
+		h.releaseBlock()
+		caps, err := h.readPacketDataMmap(true)
+		if err != nil || len(caps) == 0 {
+			return nil, ci, err
+		}
+		h.cache = caps
+	}
+	cap := h.cache[0]
+	h.cache = h.cache[1:]
+	return cap.data, cap.ci, nil
+}
+
+// releaseBlock return the block held by ZeroCopyReadPacketData, if any, to the kernel
+func (h *Handle) releaseBlock() {
+	if !h.held {
+		return
+	}
+	h.returnBlock(h.heldFlag)
+	h.held = false
+}
+
+// returnBlock give the block whose status is at flagIndex back to the kernel. Its count of packets is
+// cleared first, as the kernel only does so once it starts to fill it again; until then, flushRing
+// would take the count for packets that are in it.
+func (h *Handle) returnBlock(flagIndex int) {
+	h.endian.PutUint32(h.ring[flagIndex-offsetToBlockStatus+offsetToNumPkts:], 0)
+	h.ring[flagIndex] = syscall.TP_STATUS_KERNEL
+}
+
+// flush discard the packets queued on the socket, or in the ring, and those already read into the cache
+func (h *Handle) flush() error {
+	// keep reads out while the ring changes hands
+	if !atomic.CompareAndSwapUint32(&h.state, open, reading) {
+		return errors.New("packets cannot be flushed during a read")
+	}
+	defer h.finishRead()
+	h.cache = nil
+	if h.syscalls {
+		h.drainSocket()
+		return nil
+	}
+	if h.ring == nil {
+		return errNoRing
+	}
+	h.releaseBlock()
+	h.flushRing()
+	return nil
+}
+
+// flushRing give the blocks of the ring that the kernel has handed over back to it unread, and have the
+// packets that it already put in the block it is filling skipped, once it hands that over too
+func (h *Handle) flushRing() {
+	for i := 0; i < h.blockNumbers; i++ {
+		flagIndex := h.framePtr*h.blockSize + offsetToBlockStatus
+		if h.ring[flagIndex]&syscall.TP_STATUS_USER == 0 {
+			break
+		}
+		h.returnBlock(flagIndex)
+		h.framePtr = (h.framePtr + 1) % h.blockNumbers
+		// a block that the queued filter would have run on is gone
+		if h.queuedBlocks > 0 {
+			h.queuedBlocks--
+		}
+	}
+	// the kernel keeps the count up to date as it fills the block, or it was cleared by returnBlock, if
+	// the kernel has not started to fill it yet; if it handed it over in the meantime, it is all of them
+	h.flushSkip = int(h.endian.Uint32(h.ring[h.framePtr*h.blockSize+offsetToNumPkts:]))
+}
+
+func (h *Handle) readTo(buf []byte) (n int, ci gopacket.CaptureInfo, err error) {
+	// mmap packets already are copied out of the ring, so only syscalls can read straight into buf,
+	// and then only if it has room for a cooked header
+	if len(buf) > int(h.snaplen) {
+		buf = buf[:h.snaplen]
+	}
+	if !h.syscalls || (h.linkType == LinkTypeLinuxSLL && len(buf) < sllHeaderLen) {
+		return readToCopy(buf, h.readPacketData)
+	}
+	if !h.startRead() {
+		return 0, ci, io.EOF
+	}
+	defer h.finishRead()
+	return h.readSyscallTo(buf)
+}
+
+// startRead move the handle from open to reading, returning false if it is not open
+func (h *Handle) startRead() bool {
+	if !atomic.CompareAndSwapUint32(&h.state, open, reading) {
+		return false
+	}
+	atomic.StoreUint32(&h.started, 1)
+	return true
+}
+
+// finishRead move the handle back to open after a read, or to canceled if Close was called
+func (h *Handle) finishRead() {
+	if !atomic.CompareAndSwapUint32(&h.state, reading, open) {
+		if atomic.CompareAndSwapUint32(&h.state, canceling, canceled) {
+			logger := log.WithFields(log.Fields{
+				"iface": h.iface,
+			})
+			logger.Debugf("packet read was canceled")
+		}
+	}
+}
+
+// insertVLANTag put the 802.1Q tag that the kernel stripped from the Ethernet frame of n bytes in b
+// back in place, after the addresses, and return the new length. b must have room for the 4 more
+// bytes, or the frame is truncated to fit. Without a tpid, the tag is a plain 802.1Q one.
+func insertVLANTag(b []byte, n int, tci, tpid uint16) int {
+	if n < ethernetTypeOffset || len(b) < ethernetTypeOffset+vlanTagLen {
+		return n
+	}
+	if tpid == 0 {
+		tpid = etherTypeVLAN
+	}
+	end := n + vlanTagLen
+	if end > len(b) {
+		end = len(b)
+	}
+	copy(b[ethernetTypeOffset+vlanTagLen:end], b[ethernetTypeOffset:n])
+	binary.BigEndian.PutUint16(b[ethernetTypeOffset:], tpid)
+	binary.BigEndian.PutUint16(b[ethernetTypeOffset+2:], tci)
+	return end
+}
+
+// vlanTPID the TPID of a stripped VLAN tag, which older kernels do not report
+func vlanTPID(status uint32, tpid uint16) uint16 {
+	if status&syscall.TP_STATUS_VLAN_TPID_VALID == 0 {
+		return 0
+	}
+	return tpid
+}
+
+// pollTimeout how long to wait in each poll, in milliseconds, which is never past the deadline, if any
+func (h *Handle) pollTimeout(deadline time.Time) int {
+	timeout := pollIntervalMs
+	if h.healthCheck > 0 {
+		timeout = int(h.healthCheck.Milliseconds())
+		if timeout <= 0 {
+			timeout = 1
+		}
+	}
+	if !deadline.IsZero() {
+		// round up, so that we do not wake just before the deadline, only to poll again
+		if ms := int((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond); ms < timeout {
+			timeout = ms
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	return timeout
+}
+
+// readDeadline when a read that starts now gives up waiting for packets, or zero if it waits until there are some,
+// and what it returns then, as waitDeadline
+func (h *Handle) readDeadline() (time.Time, error) {
+	return waitDeadline(time.Duration(atomic.LoadInt64(&h.bufferTimeout)), atomic.LoadInt64(&h.deadline))
+}
+
+// setBufferTimeout have reads give up waiting for packets after d
+func (h *Handle) setBufferTimeout(d time.Duration) error {
+	atomic.StoreInt64(&h.bufferTimeout, int64(d))
+	return nil
+}
+
+// checkHealth check the events from the last poll for any that mean the socket no longer can
+// deliver packets. If so, the handle is gone, and it returns an error wrapping ErrHandleDown.
+func (h *Handle) checkHealth() error {
+	var reason string
+	revents := h.pollfd[0].Revents
+	switch {
+	case revents&syscall.POLLHUP != 0:
+		reason = "socket hung up"
+	case revents&syscall.POLLNVAL != 0:
+		reason = "socket closed"
+	case revents&syscall.POLLERR != 0:
+		reason = "socket error"
+		if sockErr, err := syscall.GetsockoptInt(h.fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err == nil && sockErr != 0 {
+			reason = fmt.Sprintf("socket error: %v", syscall.Errno(sockErr))
+		}
+	default:
+		return nil
+	}
+	atomic.StoreUint32(&h.state, gone)
+	return fmt.Errorf("%w: %s on interface %s", ErrHandleDown, reason, h.iface)
+}
+
+// waitReadable wait for a packet to be ready on the socket, checking its health at each health check,
+// until Close wakes it, or, if there is a deadline, it passes, when it returns errBufferTimeout
+func (h *Handle) waitReadable(deadline time.Time) error {
+	for {
+		val, err := h.poll(h.pollfd, h.pollTimeout(deadline))
+		switch {
+		case atomic.LoadUint32(&h.state) != reading:
+			// closed while we waited
+			return io.EOF
+		case err == nil && val == 0 && !deadline.IsZero() && !time.Now().Before(deadline):
+			return errBufferTimeout
+		case err == syscall.EINTR, err == nil && val == 0:
+			continue
+		case err != nil:
+			return fmt.Errorf("error polling socket: %v", err)
+		}
+		if err := h.checkHealth(); err != nil {
+			return err
+		}
+		if h.pollfd[0].Revents&syscall.POLLIN != 0 {
+			return nil
+		}
 	}
-	binary.BigEndian.PutUint16(buf[:2], tci)
-	binary.BigEndian.PutUint16(buf[2:], tpid)
-	return data, buf
 }
 
 func (h *Handle) readPacketDataSyscall() (data []byte, ci gopacket.CaptureInfo, err error) {
-	b := make([]byte, h.snaplen)
-	oob := make([]byte, syscall.CmsgSpace(tpacketAuxdataSize))
-	n, _, _, _, err := syscall.Recvmsg(h.fd, b, oob, 0)
+	// copy the packet out of the reusable buffer, so that it stays valid, without allocating all of the snaplen
+	data, ci, err = h.readSyscallBuf()
 	if err != nil {
-		return nil, ci, fmt.Errorf("error reading packets: %w", err)
+		return nil, ci, err
 	}
+	return append([]byte(nil), data...), ci, nil
+}
+
+// readSyscallBuf read a single packet into the reusable buffer, returning it. It only is valid until the next read.
+func (h *Handle) readSyscallBuf() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if h.readBuf == nil {
+		h.readBuf = make([]byte, h.snaplen)
+	}
+	n, ci, err := h.readSyscallTo(h.readBuf)
+	if err != nil || n == 0 {
+		return nil, ci, err
+	}
+	return h.readBuf[:n], ci, nil
+}
 
-	var auxData syscall.TpacketAuxdata
-	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+// readSyscallTo read a single packet into b, returning the number of bytes read
+func (h *Handle) readSyscallTo(b []byte) (n int, ci gopacket.CaptureInfo, err error) {
+	if h.oob == nil {
+		h.oob = make([]byte, syscall.CmsgSpace(tpacketAuxdataSize)+syscall.CmsgSpace(scmTimestampingSize))
+	}
+	// a cooked packet goes after the header that we build for it
+	data := b
+	if h.linkType == LinkTypeLinuxSLL {
+		data = b[sllHeaderLen:]
+	}
+	var (
+		oobn int
+		sall *syscall.SockaddrLinklayer
+	)
+	deadline, expired := h.readDeadline()
+	for {
+		var (
+			from syscall.Sockaddr
+			ok   bool
+		)
+		// only wait if there is nothing to read yet, in a poll that Close can wake
+		n, oobn, _, from, err = h.recvmsg(h.fd, data, h.oob, syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN {
+			switch err = h.waitReadable(deadline); {
+			case err == errBufferTimeout:
+				return 0, ci, expired
+			case err != nil:
+				return 0, ci, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, ci, fmt.Errorf("error reading packets: %w", err)
+		}
+		if sall, ok = from.(*syscall.SockaddrLinklayer); !ok || h.wantPacketType(sall.Pkttype) {
+			break
+		}
+	}
+	if n > len(data) {
+		n = len(data)
+	}
+	var (
+		auxData syscall.TpacketAuxdata
+		ts      time.Time
+	)
+	cmsgs, err := syscall.ParseSocketControlMessage(h.oob[:oobn])
 	if err != nil {
-		return nil, ci, fmt.Errorf("error reading socket control messages: %w", err)
+		return 0, ci, fmt.Errorf("error reading socket control messages: %w", err)
 	}
 	for _, cmsg := range cmsgs {
-		if cmsg.Header.Level == syscall.SOL_PACKET && cmsg.Header.Type == syscall.PACKET_AUXDATA && cmsg.Header.Len >= tpacketAuxdataSize {
-			auxData.Vlan_tci = binary.BigEndian.Uint16(cmsg.Data[len(cmsg.Data)-5 : len(cmsg.Data)-3])
-			auxData.Vlan_tpid = binary.BigEndian.Uint16(cmsg.Data[len(cmsg.Data)-3:])
-			break
+		switch {
+		case cmsg.Header.Level == syscall.SOL_PACKET && cmsg.Header.Type == syscall.PACKET_AUXDATA && len(cmsg.Data) >= tpacketAuxdataSize:
+			// struct tpacket_auxdata, in host byte order
+			auxData.Status = h.endian.Uint32(cmsg.Data[0:4])
+			auxData.Vlan_tci = h.endian.Uint16(cmsg.Data[16:18])
+			auxData.Vlan_tpid = h.endian.Uint16(cmsg.Data[18:20])
+		case cmsg.Header.Level == syscall.SOL_SOCKET && cmsg.Header.Type == syscall.SCM_TIMESTAMPNS:
+			ts = cmsgTimespec(cmsg.Data)
+		case cmsg.Header.Level == syscall.SOL_SOCKET && cmsg.Header.Type == syscall.SCM_TIMESTAMPING:
+			// the software timestamp, then one that no longer is used, then the raw hardware one
+			if len(cmsg.Data) >= scmTimestampingSize {
+				ts = cmsgTimespec(cmsg.Data[2*timespecSize:])
+			}
+			if ts.IsZero() {
+				ts = cmsgTimespec(cmsg.Data)
+			}
+		}
+	}
+	if h.linkType == LinkTypeLinuxSLL {
+		if sall == nil {
+			sall = &syscall.SockaddrLinklayer{}
+		}
+		writeSLLHeader(b, sall.Pkttype, sall.Hatype, sall.Halen, sall.Addr, sall.Protocol)
+		n += sllHeaderLen
+		ci = gopacket.CaptureInfo{
+			Timestamp:      ts,
+			CaptureLength:  n,
+			InterfaceIndex: sall.Ifindex,
 		}
+		return n, ci, nil
 	}
-	if auxData.Vlan_tci != 0 {
-		var aux []byte
-		b, aux = writeVLANTag(b, auxData.Vlan_tci, auxData.Vlan_tpid)
-		b = append(append(b[:14], aux...), b[14:]...)
-		n = n + 4
+	if auxData.Status&syscall.TP_STATUS_VLAN_VALID != 0 {
+		// the kernel strips the tag, so put it back in place, truncating to fit if we must
+		n = insertVLANTag(b, n, auxData.Vlan_tci, vlanTPID(auxData.Status, auxData.Vlan_tpid))
 	}
-	// TODO: add CaptureInfo, specifically:
-	//    capture timestamp
-	//    original packet length
+	// TODO: add the original packet length to the CaptureInfo
 	ci = gopacket.CaptureInfo{
+		Timestamp:      ts,
 		CaptureLength:  n,
 		InterfaceIndex: h.index,
 	}
-	return b, ci, nil
+	return n, ci, nil
+}
+
+// setTimestampSource have the socket stamp packets from h.timestampSource. With mmap, the ring carries
+// the timestamp in the header of each packet, whatever the source; with syscalls, the socket has to be
+// asked to send it along with each packet, as a control message.
+func (h *Handle) setTimestampSource() error {
+	hardware := h.timestampSource == TimestampHardware
+	switch {
+	case !h.syscalls && hardware:
+		if err := syscall.SetsockoptInt(h.fd, syscall.SOL_PACKET, syscall.PACKET_TIMESTAMP, syscall.SOF_TIMESTAMPING_RAW_HARDWARE); err != nil {
+			return fmt.Errorf("failed to request hardware timestamps: %v", err)
+		}
+	case hardware:
+		flags := syscall.SOF_TIMESTAMPING_RX_HARDWARE | syscall.SOF_TIMESTAMPING_RAW_HARDWARE | syscall.SOF_TIMESTAMPING_RX_SOFTWARE | syscall.SOF_TIMESTAMPING_SOFTWARE
+		if err := syscall.SetsockoptInt(h.fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags); err != nil {
+			return fmt.Errorf("failed to request hardware timestamps: %v", err)
+		}
+	case h.syscalls:
+		if err := syscall.SetsockoptInt(h.fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1); err != nil {
+			return fmt.Errorf("failed to request timestamps: %v", err)
+		}
+	}
+	return nil
+}
+
+// cmsgTimespec the time in the struct timespec at the start of b, or the zero time if it is not there, or is zero
+func cmsgTimespec(b []byte) time.Time {
+	if len(b) < timespecSize {
+		return time.Time{}
+	}
+	ts := *(*syscall.Timespec)(unsafe.Pointer(&b[0]))
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts.Unix())
 }
 
-func (h *Handle) readPacketDataMmap() ([]captured, error) {
+// readPacketDataMmap read the packets in the next block of the ring. With zeroCopy, the packets
+// are left in the ring, which is held from the kernel until releaseBlock.
+func (h *Handle) readPacketDataMmap(zeroCopy bool) ([]captured, error) {
 	logger := log.WithFields(log.Fields{
 		"method": "mmap",
 		"iface":  h.iface,
@@ -201,14 +610,18 @@ func (h *Handle) readPacketDataMmap() ([]captured, error) {
 		h.frameNumbers,
 		h.blockNumbers,
 	)
+	if h.ring == nil {
+		return nil, errNoRing
+	}
 	// we check the bit setting on the pointer
 	blockBase := h.framePtr * h.blockSize
 	// add a loop, so that we do not just rely on the polling, but instead the actual flag bit
 	flagIndex := blockBase + offsetToBlockStatus
+	deadline, expired := h.readDeadline()
 	for atomic.LoadUint32(&h.state) == reading {
 		logger.Debugf("checking for packet at block %d, buffer starting position %d, flagIndex %d ring pointer %p", h.framePtr, blockBase, flagIndex, h.ring)
 		if h.ring[flagIndex]&syscall.TP_STATUS_USER == syscall.TP_STATUS_USER {
-			return h.processMmapPackets(blockBase, flagIndex)
+			return h.processMmapPackets(blockBase, flagIndex, zeroCopy)
 		}
 		logger.Debugf("packet not ready at block %d position %d, polling via %#v", h.framePtr, blockBase, h.pollfd)
 		var err error
@@ -223,14 +636,24 @@ func (h *Handle) readPacketDataMmap() ([]captured, error) {
 			// We need to have some timeout to eventually detect closed socket.
 			// Listening for syscall.POLLERR and syscall.POLLNVAL events
 			// does not seem to always do the job.
-			val, err = syscall.Poll(h.pollfd, pollIntervalMs)
+			val, err = h.poll(h.pollfd, h.pollTimeout(deadline))
 			if !atomic.CompareAndSwapUint32(&h.state, polling, reading) {
 				// the state is cancelling
 				logger.Debugf("polling was canceled for ring %p", h.ring)
 				return nil, io.EOF
 			}
+			if err == nil && val == 0 && !deadline.IsZero() && !time.Now().Before(deadline) {
+				// nothing before the buffer timeout, or the read deadline
+				return nil, expired
+			}
 		}
 		logger.Debugf("poll returned val %v with pollfd %#v", val, h.pollfd)
+		if err == nil && h.healthCheck > 0 {
+			if err := h.checkHealth(); err != nil {
+				logger.Errorf("health check failed: %v", err)
+				return nil, err
+			}
+		}
 
 		switch {
 		case err != nil && err == syscall.EINTR:
@@ -270,7 +693,7 @@ func (h *Handle) readPacketDataMmap() ([]captured, error) {
 	return nil, io.EOF
 }
 
-func (h *Handle) processMmapPackets(blockBase, flagIndex int) ([]captured, error) {
+func (h *Handle) processMmapPackets(blockBase, flagIndex int, zeroCopy bool) ([]captured, error) {
 	logger := log.WithFields(log.Fields{
 		"method": "mmap-process",
 		"iface":  h.iface,
@@ -278,33 +701,69 @@ func (h *Handle) processMmapPackets(blockBase, flagIndex int) ([]captured, error
 	// read the header
 	logger.Debugf("reading block header into b slice from position %d to position %d", blockBase, blockBase+h.blockSize)
 	b := h.ring[blockBase : blockBase+h.blockSize]
-	buf := bytes.NewBuffer(b[:])
-	bHdr := blockHeader{}
-	logger.Debugf("binary parsing block header of size %d", buf.Len())
-	if err := binary.Read(buf, h.endian, &bHdr); err != nil {
+	logger.Debugf("parsing block header of size %d", len(b))
+	bHdr, err := parseBlockHeader(b, h.endian)
+	if err != nil {
 		logger.Errorf("error reading block header: %v", err)
 		return nil, fmt.Errorf("error reading block header: %v", err)
 	}
 	logger.Debugf("block header %#v", bHdr)
+	// the kernel marks the block, and the packets in it, as losing once it has had to drop packets
+	// because the ring was full, so that there is warning before the drops show up in the stats
+	losing := bHdr.H1.Block_status&syscall.TP_STATUS_LOSING != 0
 	// now we need to get the packets themselves
 	numPkts := int(bHdr.H1.Num_pkts)
-	packets := make([]captured, numPkts)
+	var packets []captured
+	if zeroCopy {
+		// the last block's packets all have been read, so their slice can be reused
+		packets = h.packets[:0]
+	} else {
+		packets = make([]captured, 0, numPkts)
+	}
+
+	// the arguments of a log call are allocated whether or not it logs, so only make the calls for each
+	// packet when they will, for reading a packet to allocate nothing
+	debug := log.IsLevelEnabled(log.DebugLevel)
+	// the packets that already were in the block when the ring was flushed
+	skip := h.flushSkip
+	h.flushSkip = 0
 
 	nextOffset := bHdr.H1.Offset_to_first_pkt
 	for i := 0; i < numPkts; i++ {
-		hdr := syscall.Tpacket3Hdr{}
-		logger.Debugf("packet number %d/%d at position %d in block", i, numPkts, nextOffset)
+		if debug {
+			logger.Debugf("packet number %d/%d at position %d in block", i, numPkts, nextOffset)
+		}
+		if nextOffset > uint32(len(b)) {
+			logger.Errorf("packet %d at offset %d is past the remaining block size %d", i, nextOffset, len(b))
+			return nil, fmt.Errorf("packet %d at offset %d is past the remaining block size %d", i, nextOffset, len(b))
+		}
 		b = b[nextOffset:]
-		buf := bytes.NewBuffer(b[:alignedTpacketHdrSize])
-		logger.Debugf("binary parsing packet header of size %d", buf.Len())
-		if err := binary.Read(buf, h.endian, &hdr); err != nil {
+		// parsed by hand, rather than with binary.Read, so that reading a packet allocates nothing
+		hdr, err := parseTpacket3Hdr(b, h.endian)
+		if err != nil {
 			msg := fmt.Sprintf("error reading tpacket3 header on byte %d: %v", i, err)
 			logger.Errorf(msg)
 			return nil, fmt.Errorf(msg)
 		}
-		logger.Debugf("tpacket3 header %#v", hdr)
+		if debug {
+			logger.Debugf("tpacket3 header %#v", hdr)
+		}
+		if hdr.Status&syscall.TP_STATUS_LOSING != 0 {
+			losing = true
+		}
 		nextOffset = hdr.Next_offset
-		logger.Debugf("setting next offset to %d", nextOffset)
+		if debug {
+			logger.Debugf("setting next offset to %d", nextOffset)
+		}
+		// everything after is sliced by the offsets and lengths of the header, so make sure they are within
+		// the block, rather than trusting the kernel, or a corrupted ring, to have them right
+		if err := checkTpacket3Hdr(hdr, len(b)); err != nil {
+			logger.Errorf("packet %d: %v", i, err)
+			return nil, fmt.Errorf("packet %d: %v", i, err)
+		}
+		if i < skip {
+			continue
+		}
 
 		// read the sockaddr_ll
 		// unfortunately, we cannot do binary.Read() because syscall.SockaddrLinklayer has an embedded slice
@@ -315,6 +774,12 @@ func (h *Handle) processMmapPackets(blockBase, flagIndex int) ([]captured, error
 			logger.Errorf("error parsing sockaddr_ll: %v", err)
 			return nil, fmt.Errorf("error parsing sockaddr_ll for packet %d: %v", i, err)
 		}
+		if !h.wantPacketType(sall.Pkttype) {
+			if debug {
+				logger.Debugf("skipping packet %d with packet type %d", i, sall.Pkttype)
+			}
+			continue
+		}
 
 		ci := gopacket.CaptureInfo{
 			Length:         int(hdr.Len),
@@ -330,24 +795,71 @@ func (h *Handle) processMmapPackets(blockBase, flagIndex int) ([]captured, error
 		// data copied here and then enable NoCopy for PacketSource, i.e.:
 		//   packetSource := gopacket.NewPacketSource(...)
 		//   packetSource.NoCopy = true
-		data := make([]byte, hdr.Snaplen)
-		copy(data, b[hdr.Mac:uint32(hdr.Mac)+hdr.Snaplen])
-		if hdr.Hv1.Vlan_tci != 0 {
-			var vlanTag []byte
-			data, vlanTag = writeVLANTag(data, uint16(hdr.Hv1.Vlan_tci), uint16(hdr.Hv1.Vlan_tpid))
-			data = append(data[:14], append(vlanTag, data[14:]...)...)
-		}
-		packets[i] = captured{
+		// hdr.Snaplen is what the kernel actually captured, which may be less than we asked for;
+		// checkTpacket3Hdr made sure it fits in the block, and the kernel captures as much as fits in the block, so keep only the snaplen, as a syscall read does
+		if h.linkType == LinkTypeLinuxSLL {
+			caplen := snapLength(hdr.Snaplen, h.snaplen, sllHeaderLen)
+			data := make([]byte, sllHeaderLen+caplen)
+			writeSLLHeader(data, sall.Pkttype, sall.Hatype, sall.Halen, sall.Addr, sall.Protocol)
+			copy(data[sllHeaderLen:], b[hdr.Mac:uint32(hdr.Mac)+caplen])
+			ci.CaptureLength = len(data)
+			ci.Length += sllHeaderLen
+			packets = append(packets, captured{
+				ci:   ci,
+				data: data,
+			})
+			continue
+		}
+		caplen := snapLength(hdr.Snaplen, h.snaplen, 0)
+		end := uint32(hdr.Mac) + caplen
+		ci.CaptureLength = int(caplen)
+		if zeroCopy && hdr.Status&syscall.TP_STATUS_VLAN_VALID == 0 {
+			// the packet needs nothing added, so it can be returned straight out of the ring;
+			// cap it so that appending to it cannot overwrite the next packet
+			packets = append(packets, captured{
+				ci:     ci,
+				data:   b[hdr.Mac:end:end],
+				inRing: true,
+			})
+			continue
+		}
+		data := make([]byte, caplen, caplen+vlanTagLen)
+		copy(data, b[hdr.Mac:end])
+		if hdr.Status&syscall.TP_STATUS_VLAN_VALID != 0 {
+			// the kernel strips the tag, so put it back in place, within the snaplen; the frame was that
+			// much longer on the wire
+			data = data[:snapLength(caplen+vlanTagLen, h.snaplen, 0)]
+			n := insertVLANTag(data, int(caplen), uint16(hdr.Hv1.Vlan_tci), vlanTPID(hdr.Status, hdr.Hv1.Vlan_tpid))
+			data = data[:n]
+			ci.Length += vlanTagLen
+			ci.CaptureLength = n
+		}
+		packets = append(packets, captured{
 			ci:   ci,
 			data: data,
+		})
+
+		if debug {
+			logger.Debugf("raw packet for packet %d: %d\n ", i, data)
 		}
+	}
+	h.warnLosing(losing, logger)
 
-		logger.Debugf("raw packet for packet %d: %d\n ", i, data)
+	if h.queuedBlocks > 0 {
+		h.queuedBlocks--
+		packets = runQueuedFilter(h.queuedFilter, packets)
 	}
 
-	// indicate we are done with this frame, send back to the kernel
-	logger.Debugf("returning block at pos %d to kernel", h.framePtr)
-	h.ring[flagIndex] = syscall.TP_STATUS_KERNEL
+	if zeroCopy {
+		// the packets still are in the block, so hold on to it until they all have been read
+		h.packets = packets
+		h.held = true
+		h.heldFlag = flagIndex
+	} else {
+		// indicate we are done with this frame, send back to the kernel
+		logger.Debugf("returning block at pos %d to kernel", h.framePtr)
+		h.returnBlock(flagIndex)
+	}
 
 	h.framePtr = (h.framePtr + 1) % h.blockNumbers
 	logger.Debugf("final block: %d", h.framePtr)
@@ -355,8 +867,23 @@ func (h *Handle) processMmapPackets(blockBase, flagIndex int) ([]captured, error
 	return packets, nil
 }
 
-// Close close sockets and release resources
-func (h *Handle) Close() {
+// warnLosing warn when the kernel starts to mark the blocks of the ring as losing packets, once until it
+// stops, rather than for every block
+func (h *Handle) warnLosing(losing bool, logger *log.Entry) {
+	if losing && !h.losing {
+		logger.Warn("the ring is full and the kernel is dropping packets; read them faster, or make the ring bigger with SetRingBuffer")
+	}
+	h.losing = losing
+}
+
+// buffered whether packets already have been read from the kernel, e.g. the rest of an mmap block, that the next read returns
+// without waiting for the socket
+func (h *Handle) buffered() bool {
+	return len(h.cache) > 0
+}
+
+// close close sockets and release resources
+func (h *Handle) close() {
 	logger := log.WithFields(log.Fields{
 		"iface": h.iface,
 	})
@@ -374,16 +901,21 @@ func (h *Handle) Close() {
 			atomic.StoreUint32(&h.state, closed)
 			break
 		}
+		// Only wake the reader once it is canceling, so that it cannot go back to reading the ring.
 		if atomic.CompareAndSwapUint32(&h.state, reading, canceling) {
 			logger.Debugf("cancelling ongoig packet read")
+			h.wake()
 		}
 		if atomic.CompareAndSwapUint32(&h.state, polling, canceling) {
 			// When polling is interrupted it is safe to go ahead and unmap the ring buffer.
 			// Reader will eventually detect canceled polling and will exit without accessing
 			// the buffer anymore.
 			logger.Debugf("cancelling ongoing socket polling; not waiting for poll to return")
+			h.wake()
 			break
 		}
+		// give the woken reader the chance to finish
+		time.Sleep(time.Millisecond)
 	}
 	if h.ring != nil {
 		if err := syscall.Munmap(h.ring); err != nil {
@@ -394,31 +926,338 @@ func (h *Handle) Close() {
 	if err := syscall.Close(h.fd); err != nil {
 		logger.Errorf("error closing file descriptor %d ; nothing to do", h.fd)
 	}
+	// a handle that failed to open may not have one yet
+	if h.wakefd < 0 {
+		return
+	}
+	if err := syscall.Close(h.wakefd); err != nil {
+		logger.Errorf("error closing file descriptor %d ; nothing to do", h.wakefd)
+	}
+}
+
+// wake wake any reader waiting for packets, so that it sees the handle is closing
+func (h *Handle) wake() {
+	var b [8]byte
+	h.endian.PutUint64(b[:], 1)
+	if _, err := syscall.Write(h.wakefd, b[:]); err != nil {
+		log.Errorf("error waking readers: %v", err)
+	}
+}
+
+// WritePacketData inject a raw packet, including the link layer header, on the
+// interface to which the handle is bound.
+func (h *Handle) WritePacketData(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("cannot write empty packet")
+	}
+	if h.multi != nil {
+		return errors.New("cannot write packets on a handle of several interfaces")
+	}
+	if h.index == 0 {
+		return errors.New("cannot write packets on a handle not bound to an interface")
+	}
+	sa := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  h.index,
+	}
+	return syscall.Sendto(h.fd, data, 0, &sa)
+}
+
+// SetDirection set the direction of packets to capture. Received-only capture
+// is done in the kernel via PACKET_IGNORE_OUTGOING, which requires Linux 4.20 or later;
+// sent-only capture is done in userspace based on the packet type, so it, and capturing
+// both, work on older kernels too.
+func (h *Handle) SetDirection(d Direction) error {
+	if h.multi != nil {
+		if err := h.multi.each(func(m *Handle) error { return m.SetDirection(d) }); err != nil {
+			return err
+		}
+		h.direction, h.filterDirection = d, false
+		return nil
+	}
+	var ignoreOutgoing int
+	switch d {
+	case DirectionInOut, DirectionOut:
+	case DirectionIn:
+		ignoreOutgoing = 1
+	default:
+		return fmt.Errorf("invalid direction: %d", d)
+	}
+	err := syscall.SetsockoptInt(h.fd, syscall.SOL_PACKET, syscall.PACKET_IGNORE_OUTGOING, ignoreOutgoing)
+	switch {
+	case err == nil:
+	case ignoreOutgoing == 0 && h.direction != DirectionIn && errors.Is(err, syscall.ENOPROTOOPT):
+		// a kernel older than 4.20 does not have the option, but then it never was set, so there is nothing to undo
+	default:
+		return fmt.Errorf("unable to set PACKET_IGNORE_OUTGOING: %w", err)
+	}
+	h.direction, h.filterDirection = d, false
+	return nil
+}
+
+// SetPromiscuous turn promiscuous mode on or off for the interface to which the handle is bound,
+// without closing it. The kernel counts promiscuous requests across sockets, so turning it off only
+// leaves promiscuous mode if no other socket asked for it.
+func (h *Handle) SetPromiscuous(promiscuous bool) error {
+	if h.offline != nil {
+		return errors.New("promiscuous mode is not supported on offline handles")
+	}
+	if h.multi != nil {
+		return h.multi.each(func(m *Handle) error { return m.SetPromiscuous(promiscuous) })
+	}
+	if h.index == 0 {
+		return errors.New("cannot set promiscuous mode on a handle not bound to an interface")
+	}
+	// the membership is counted on the socket too, so only add or drop it once
+	if promiscuous == h.promiscuous {
+		return nil
+	}
+	if err := setPromiscuous(h.fd, h.index, promiscuous); err != nil {
+		return fmt.Errorf("failed to set promiscuous to %v: %v", promiscuous, err)
+	}
+	h.promiscuous = promiscuous
+	return nil
+}
+
+// setPromiscuous add or drop the PACKET_MR_PROMISC membership of fd on the interface with the given index
+func setPromiscuous(fd, index int, promiscuous bool) error {
+	opt := syscall.PACKET_DROP_MEMBERSHIP
+	if promiscuous {
+		opt = syscall.PACKET_ADD_MEMBERSHIP
+	}
+	mreq := syscall.PacketMreq{
+		Ifindex: int32(index),
+		Type:    syscall.PACKET_MR_PROMISC,
+	}
+	return syscall.SetsockoptPacketMreq(fd, syscall.SOL_PACKET, opt, &mreq)
+}
+
+// wantPacketType whether a packet of the given sockaddr_ll packet type
+// should be returned, based on the direction set on the handle
+func (h *Handle) wantPacketType(pkttype uint8) bool {
+	switch h.direction {
+	case DirectionIn:
+		return pkttype != syscall.PACKET_OUTGOING
+	case DirectionOut:
+		return pkttype == syscall.PACKET_OUTGOING
+	}
+	return true
 }
 
 // set a classic BPF filter on the listener. filter must be compliant with
 // tcpdump syntax.
-func (h *Handle) setFilter() error {
-
-	/*
-	 * Try to install the kernel filter.
-	 */
-	prog := syscall.SockFprog{
-		Len:    uint16(len(h.filter)),
-		Filter: (*syscall.SockFilter)(unsafe.Pointer(&h.filter[0])),
+func (h *Handle) setFilter(filter []bpf.RawInstruction) error {
+	raw := filter
+	if h.linkType == LinkTypeLinuxSLL {
+		var err error
+		if raw, err = cookedKernelFilter(raw); err != nil {
+			return fmt.Errorf("unable to set filter: %v", err)
+		}
 	}
 
-	if err := syscall.SetsockoptSockFprog(h.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, &prog); err != nil {
+	// packets that arrived before the filter was attached would still be read, so, as libpcap does,
+	// drop everything while the socket is drained, or have the packets in the ring filtered as they are read
+	if h.syscalls {
+		if err := h.attachFilter(rejectAll); err != nil {
+			return fmt.Errorf("unable to set filter: %v", err)
+		}
+		h.drainSocket()
+	} else if h.ring != nil {
+		h.filterQueuedBlocks(filter)
+	}
+	if err := h.attachFilter(raw); err != nil {
+		// the kernel keeps the filter it had, which, with syscalls, is the one that rejects all
+		h.queuedFilter, h.queuedBlocks = nil, 0
+		if h.syscalls {
+			h.restoreFilter()
+		}
 		return fmt.Errorf("unable to set filter: %v", err)
 	}
 	return nil
 }
 
+// restoreFilter attach the filter that was set before again, or none if there was none
+func (h *Handle) restoreFilter() {
+	if len(h.filter) == 0 {
+		if err := syscall.SetsockoptInt(h.fd, syscall.SOL_SOCKET, syscall.SO_DETACH_FILTER, 0); err != nil {
+			log.Errorf("failed to detach the filter: %v", err)
+		}
+		return
+	}
+	raw := h.filter
+	if h.linkType == LinkTypeLinuxSLL {
+		// it was translated when it was set, so it can be again
+		raw, _ = cookedKernelFilter(raw)
+	}
+	if err := h.attachFilter(raw); err != nil {
+		log.Errorf("failed to restore the previous filter: %v", err)
+	}
+}
+
+// rejectAll a program that keeps no packets
+var rejectAll = []bpf.RawInstruction{{Op: 0x06, K: 0}} // ret #0
+
+// attachFilter install raw as the kernel filter of the socket, replacing any other
+func (h *Handle) attachFilter(raw []bpf.RawInstruction) error {
+	prog := syscall.SockFprog{
+		Len:    uint16(len(raw)),
+		Filter: (*syscall.SockFilter)(unsafe.Pointer(&raw[0])),
+	}
+	return syscall.SetsockoptSockFprog(h.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, &prog)
+}
+
+// drainSocket discard the packets queued on the socket, until there are none
+func (h *Handle) drainSocket() {
+	b := make([]byte, 1)
+	for {
+		if _, _, err := syscall.Recvfrom(h.fd, b, syscall.MSG_DONTWAIT|syscall.MSG_TRUNC); err != nil {
+			return
+		}
+	}
+}
+
+// filterQueuedBlocks have the packets that the kernel already put in the ring, and those already read
+// into the cache, run through filter as they are read. Those are the blocks that it handed over to us,
+// and the one it is filling. If the filter cannot be run in a bpf.VM, they are left as they are.
+func (h *Handle) filterQueuedBlocks(filter []bpf.RawInstruction) {
+	h.queuedFilter, h.queuedBlocks = nil, 0
+	inst, ok := bpf.Disassemble(filter)
+	if !ok {
+		return
+	}
+	vm, err := bpf.NewVM(inst)
+	if err != nil {
+		return
+	}
+	blocks := 1
+	for ; blocks < h.blockNumbers; blocks++ {
+		flagIndex := ((h.framePtr+blocks-1)%h.blockNumbers)*h.blockSize + offsetToBlockStatus
+		if h.ring[flagIndex]&syscall.TP_STATUS_USER == 0 {
+			break
+		}
+	}
+	h.queuedFilter, h.queuedBlocks = vm, blocks
+	h.cache = runQueuedFilter(vm, h.cache)
+}
+
+// runQueuedFilter keep the packets that vm accepts
+func runQueuedFilter(vm *bpf.VM, packets []captured) []captured {
+	kept := packets[:0]
+	for _, p := range packets {
+		if n, err := vm.Run(p.data); err == nil && n > 0 {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// cookedKernelFilter translate a filter for packets with a cooked header into one the kernel can run.
+// We only add the cooked header after the kernel runs the filter, on the packet starting at its network
+// header, so packet offsets move back by the header, and the header fields the kernel knows are loaded
+// as ancillary data instead.
+func cookedKernelFilter(raw []bpf.RawInstruction) ([]bpf.RawInstruction, error) {
+	out := make([]bpf.RawInstruction, 0, len(raw))
+	for _, r := range raw {
+		in := r.Disassemble()
+		switch i := in.(type) {
+		case bpf.LoadAbsolute:
+			switch {
+			case i.Off >= sllHeaderLen:
+				i.Off -= sllHeaderLen
+				in = i
+			case i.Off == 0 && i.Size == 2:
+				in = bpf.LoadExtension{Num: bpf.ExtType}
+			case i.Off == 14 && i.Size == 2:
+				in = bpf.LoadExtension{Num: bpf.ExtProto}
+			default:
+				return nil, fmt.Errorf("cannot load %d bytes at offset %d of the cooked header in the kernel", i.Size, i.Off)
+			}
+		case bpf.LoadIndirect:
+			if i.Off < sllHeaderLen {
+				return nil, fmt.Errorf("cannot load %d bytes at offset %d of the cooked header in the kernel", i.Size, i.Off)
+			}
+			i.Off -= sllHeaderLen
+			in = i
+		case bpf.LoadMemShift:
+			if i.Off < sllHeaderLen {
+				return nil, fmt.Errorf("cannot load offset %d of the cooked header in the kernel", i.Off)
+			}
+			i.Off -= sllHeaderLen
+			in = i
+		}
+		ri, err := in.Assemble()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ri)
+	}
+	return out, nil
+}
+
+// snapLength how much of a packet of n bytes to keep, within snaplen, after a header of hdrLen bytes that we add
+func snapLength(n uint32, snaplen int32, hdrLen int) uint32 {
+	limit := int64(snaplen) - int64(hdrLen)
+	switch {
+	case limit < 0:
+		return 0
+	case int64(n) > limit:
+		return uint32(limit)
+	}
+	return n
+}
+
+// ringFrameSize the size of a ring frame for a packet of snaplen bytes, on an interface with mtu
+func ringFrameSize(snaplen int32, mtu int) uint32 {
+	return uint32(tpacketAlign(syscall.SizeofTpacket3Hdr+EthHlen) + tpacketAlign(ringSnaplen(snaplen, mtu)))
+}
+
+// ringBlockSize the smallest block, in pages, that fits a frame of frameSize
+func ringBlockSize(frameSize uint32) uint32 {
+	blockSize := uint32(syscall.Getpagesize())
+	for {
+		if blockSize > frameSize {
+			break
+		}
+		blockSize = blockSize << 1
+	}
+	return blockSize
+}
+
+// ringSnaplen the most packet data a ring frame needs to hold. A snaplen beyond anything the
+// interface can deliver, i.e. its MTU plus link header, only wastes ring space. Receive offload
+// can coalesce packets beyond the MTU, so it never goes below the largest IP packet.
+// If the mtu is unknown, it is the snaplen.
+func ringSnaplen(snaplen int32, mtu int) int32 {
+	if mtu <= 0 {
+		return snaplen
+	}
+	limit := int32(mtu + maxLinkHeaderLen)
+	if limit < maxOffloadLen {
+		limit = maxOffloadLen
+	}
+	if snaplen > limit {
+		return limit
+	}
+	return snaplen
+}
+
 func tpacketAlign(base int32) int32 {
 	return (base + syscall.TPACKET_ALIGNMENT - 1) &^ (syscall.TPACKET_ALIGNMENT - 1)
 }
 
-func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool) (handle *Handle, _ error) {
+func openLiveByIndex(index int, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, _ error) {
+	in, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return nil, fmt.Errorf("unknown interface index %d: %v", index, err)
+	}
+	// bind to the index itself, which stays the same even if the interface is renamed
+	opts = append(opts, func(h *Handle) {
+		h.index = index
+	})
+	return openLive(in.Name, snaplen, promiscuous, timeout, syscalls, opts...)
+}
+
+func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Duration, syscalls bool, opts ...Option) (handle *Handle, err error) {
 	logger := log.WithFields(log.Fields{
 		"iface":       iface,
 		"snaplen":     snaplen,
@@ -433,6 +1272,18 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 		snaplen:  snaplen,
 		syscalls: syscalls,
 		iface:    iface,
+		linkType: LinkTypeEthernet,
+		poll:     syscall.Poll,
+		recvmsg:  syscall.Recvmsg,
+	}
+	// all interfaces can have different link headers, so, like libpcap, we have the kernel remove
+	// them, and give each packet a cooked header of our own
+	cooked := iface == "" || iface == anyInterface
+	if cooked {
+		h.linkType = LinkTypeLinuxSLL
+	}
+	for _, opt := range opts {
+		opt(&h)
 	}
 	// we need to know our endianness
 	endianness, err := getEndianness()
@@ -441,62 +1292,73 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 	}
 	h.endian = endianness
 
-	// because syscall package does not provide this
-	rall := syscall.RawSockaddrLinklayer{}
-	packetRALLSize = int32(unsafe.Sizeof(rall))
-	alignedTpacketHdrSize = tpacketAlign(syscall.SizeofTpacket3Hdr)
-	alignedTpacketRALLSize = tpacketAlign(packetRALLSize)
-	alignedTpacketAllHdrSize = alignedTpacketHdrSize + alignedTpacketRALLSize
+	if !cooked {
+		// get our interface, by index if opened that way, before the socket, whose type depends on its link type
+		in, err := lookupInterface(h.index, iface)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		// check the interface is up
+		if in.Flags&net.FlagUp != net.FlagUp {
+			logger.Errorf("interface %s is not up", iface)
+			return nil, fmt.Errorf("interface %s is not up", iface)
+		}
+		h.index = in.Index
+		// the mtu, if known, sizes the ring
+		h.mtu = in.MTU
+		h.linkType = in.LinkType
+		// like libpcap, an interface whose link headers we do not know is captured with cooked headers
+		cooked = in.LinkType == LinkTypeLinuxSLL
+	}
+	sockType := syscall.SOCK_RAW
+	if cooked {
+		sockType = syscall.SOCK_DGRAM
+	}
 
-	// set up the socket - remember to switch to network socket order for the protocol int
-	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	// set up the socket. With no protocol, it does not receive anything until we bind it, so that
+	// nothing is captured before the ring and filter are ready.
+	fd, err := syscall.Socket(syscall.AF_PACKET, sockType, 0)
 	if err != nil {
 		logger.Errorf("failed opening raw socket: %v", err)
 		return nil, fmt.Errorf("failed opening raw socket: %v", err)
 	}
 	h.fd = fd
+	h.wakefd = -1
+	// from here on, release the socket, and whatever else was set up, if opening fails
+	defer func() {
+		if err != nil {
+			atomic.StoreUint32(&h.state, open)
+			h.close()
+		}
+	}()
+	// closing the socket does not wake a reader waiting on it, so Close signals this too
+	wakefd, err := syscall.Eventfd(0, syscall.EFD_CLOEXEC|syscall.EFD_NONBLOCK)
+	if err != nil {
+		logger.Errorf("failed to create wake eventfd: %v", err)
+		return nil, fmt.Errorf("failed to create wake eventfd: %v", err)
+	}
+	h.wakefd = wakefd
 	h.pollfd = []syscall.PollFd{{
 		Fd:     int32(h.fd),
-		Events: syscall.POLLIN | syscall.POLLERR | syscall.POLLNVAL}}
+		Events: syscall.POLLIN | syscall.POLLERR | syscall.POLLNVAL}, {
+		Fd:     int32(h.wakefd),
+		Events: syscall.POLLIN}}
 	if err := syscall.SetNonblock(fd, false); err != nil {
 		return nil, fmt.Errorf("failed to set socket as blocking: %v", err)
 	}
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_AUXDATA, 1); err != nil {
 		return nil, fmt.Errorf("failed to set packet auxilary data: %w", err)
 	}
-	if iface != "" {
-		// get our interface
-		in, err := net.InterfaceByName(iface)
-		if err != nil {
-			logger.Errorf("unknown interface %s: %v", iface, err)
-			return nil, fmt.Errorf("unknown interface %s: %v", iface, err)
-		}
-		// check the interface is up
-		if in.Flags&net.FlagUp != net.FlagUp {
-			logger.Errorf("interface %s is not up", iface)
-			return nil, fmt.Errorf("interface %s is not up", iface)
-		}
-		h.index = in.Index
-
-		// create the sockaddr_ll
-		sa := syscall.SockaddrLinklayer{
-			Protocol: htons(syscall.ETH_P_ALL),
-			Ifindex:  in.Index,
-		}
-		// bind to it
-		if err = syscall.Bind(fd, &sa); err != nil {
-			return nil, fmt.Errorf("failed to bind")
-		}
-		if promiscuous {
-			h.promiscuous = true
-			mreq := syscall.PacketMreq{
-				Ifindex: int32(in.Index),
-				Type:    syscall.PACKET_MR_PROMISC,
-			}
-			if err = syscall.SetsockoptPacketMreq(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
-				logger.Errorf("failed to set promiscuous for %s: %v", iface, err)
-				return nil, fmt.Errorf("failed to set promiscuous for %s: %v", iface, err)
-			}
+	if err = h.setTimestampSource(); err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	if h.index != 0 && promiscuous {
+		h.promiscuous = true
+		if err = setPromiscuous(fd, h.index, true); err != nil {
+			logger.Errorf("failed to set promiscuous for %s: %v", iface, err)
+			return nil, fmt.Errorf("failed to set promiscuous for %s: %v", iface, err)
 		}
 	}
 	if !syscalls {
@@ -504,61 +1366,353 @@ func openLive(iface string, snaplen int32, promiscuous bool, timeout time.Durati
 			logger.Errorf("failed to set TPACKET_V3: %v", err)
 			return nil, fmt.Errorf("failed to set TPACKET_V3: %v", err)
 		}
-		// set up the ring
-		var (
-			frameSize           = uint32(tpacketAlign(syscall.SizeofTpacket3Hdr+EthHlen) + tpacketAlign(snaplen))
-			pageSize            = syscall.Getpagesize()
-			blockSize           = uint32(pageSize)
-			blockNumbers uint32 = defaultBlockNumbers
-		)
-		for {
-			if blockSize > frameSize {
-				break
+		// set up the ring, with the smallest block that fits a frame, until SetRingBuffer changes it
+		frameSize := ringFrameSize(snaplen, h.mtu)
+		if err = h.setupRing(ringBlockSize(frameSize), defaultBlockNumbers, frameSize); err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+	}
+	if err = h.SetBPFFilter(h.initialFilter); err != nil {
+		return nil, err
+	}
+	// create the sockaddr_ll; an index of 0, when cooked, is all interfaces. Remember to switch to
+	// network byte order for the protocol.
+	sa := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  h.index,
+	}
+	// bind to it, which starts capturing
+	if err = syscall.Bind(fd, &sa); err != nil {
+		return nil, fmt.Errorf("failed to bind: %v", err)
+	}
+	if h.fanout != nil {
+		// the group id is in the low 16 bits, the mode in the high
+		arg := int(h.fanout.group) | int(h.fanout.mode)<<16
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_FANOUT, arg); err != nil {
+			logger.Errorf("failed to join fanout group %d: %v", h.fanout.group, err)
+			return nil, fmt.Errorf("failed to join fanout group %d: %v", h.fanout.group, err)
+		}
+	}
+	atomic.StoreUint32(&h.state, open)
+	return &h, nil
+}
+
+// setRingBuffer replace the ring with one of blockCount blocks of blockSize bytes
+func (h *Handle) setRingBuffer(blockSize, blockCount uint32) error {
+	if h.syscalls {
+		return errors.New("the ring buffer only is used with mmap, not syscalls")
+	}
+	pageSize := uint32(syscall.Getpagesize())
+	switch {
+	case blockSize&(blockSize-1) != 0 || blockSize%pageSize != 0:
+		return fmt.Errorf("block size %d is not a power of 2 and a multiple of the page size %d", blockSize, pageSize)
+	case blockSize < h.frameSize:
+		return fmt.Errorf("block size %d is smaller than the frame size %d", blockSize, h.frameSize)
+	case blockCount == 0:
+		return errors.New("block count must be at least 1")
+	}
+	// keep reads out until the new ring is ready
+	if atomic.LoadUint32(&h.started) != 0 || !atomic.CompareAndSwapUint32(&h.state, open, reading) {
+		return errors.New("the ring buffer only can be set before capture has started")
+	}
+	defer h.finishRead()
+	return h.setupRing(blockSize, blockCount, h.frameSize)
+}
+
+// setSnaplen capture up to snaplen bytes of each packet from now on. The ring only is rebuilt if
+// its blocks are too small for the new snaplen, which cannot happen once capture has started.
+func (h *Handle) setSnaplen(snaplen int32) error {
+	if snaplen <= 0 {
+		return fmt.Errorf("invalid snaplen %d", snaplen)
+	}
+	// keep reads out while the snaplen, and maybe the ring, change
+	if !atomic.CompareAndSwapUint32(&h.state, open, reading) {
+		return errors.New("the snaplen cannot be changed during a read")
+	}
+	defer h.finishRead()
+	if !h.syscalls {
+		frameSize := ringFrameSize(snaplen, h.mtu)
+		if frameSize > uint32(h.blockSize) && atomic.LoadUint32(&h.started) != 0 {
+			return fmt.Errorf("the ring blocks of %d bytes cannot hold a snaplen of %d once capture has started", h.blockSize, snaplen)
+		}
+		// the kernel fills blocks with as many packets as fit, so the frame size only matters for sizing blocks
+		if frameSize > uint32(h.blockSize) {
+			if err := h.setupRing(ringBlockSize(frameSize), uint32(h.blockNumbers), frameSize); err != nil {
+				return err
 			}
-			blockSize = blockSize << 1
 		}
-		// we use the default - for now
+		h.frameSize = frameSize
+	}
+	h.snaplen = snaplen
+	h.readBuf = nil
+	return nil
+}
+
+// setupRing create the mmap ring, of blockCount blocks of blockSize bytes, each with frames of
+// frameSize, replacing any that there already is. If the kernel rejects the new ring, the old one
+// is put back, so that the handle still can be read.
+func (h *Handle) setupRing(blockSize, blockCount, frameSize uint32) error {
+	if h.ring == nil {
+		return h.mapRing(blockSize, blockCount, frameSize)
+	}
+	oldBlockSize, oldBlockCount, oldFrameSize := uint32(h.blockSize), uint32(h.blockNumbers), h.frameSize
+	// the kernel only releases the old ring once it no longer is mapped
+	if err := syscall.Munmap(h.ring); err != nil {
+		return fmt.Errorf("error unmapping the old ring: %v", err)
+	}
+	h.ring = nil
+	if err := releaseRing(h.fd); err != nil {
+		return fmt.Errorf("failed to release the old ring: %v", err)
+	}
+	err := h.mapRing(blockSize, blockCount, frameSize)
+	if err == nil {
+		return nil
+	}
+	if oldErr := h.mapRing(oldBlockSize, oldBlockCount, oldFrameSize); oldErr != nil {
+		return fmt.Errorf("%v, and failed to restore the old ring: %v", err, oldErr)
+	}
+	return err
+}
+
+// releaseRing have the kernel release the ring of the socket fd, which must no longer be mapped
+func releaseRing(fd int) error {
+	return syscall.SetsockoptTpacketReq3(fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, &syscall.TpacketReq3{})
+}
 
-		framesPerBuffer := blockSize / frameSize
-		frameNumbers := blockNumbers * framesPerBuffer
+// mapRing have the kernel create a ring of blockCount blocks of blockSize bytes, each with frames of
+// frameSize, and map it, when there is none
+func (h *Handle) mapRing(blockSize, blockCount, frameSize uint32) error {
+	framesPerBuffer := blockSize / frameSize
+	frameNumbers := blockCount * framesPerBuffer
+
+	tpreq := syscall.TpacketReq3{
+		Block_size: blockSize,
+		Block_nr:   blockCount,
+		Frame_size: frameSize,
+		Frame_nr:   frameNumbers,
+	}
+	if h.immediate {
+		tpreq.Retire_blk_tov = immediateBlockTimeout
+	}
+	log.Debugf("creating mmap buffer with tpreq %#v", tpreq)
+	if err := syscall.SetsockoptTpacketReq3(h.fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, &tpreq); err != nil {
+		return fmt.Errorf("failed to set tpacket req: %v", err)
+	}
+	totalSize := int(tpreq.Block_size * tpreq.Block_nr)
+	data, err := syscall.Mmap(h.fd, 0, totalSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		// the kernel refuses another ring until this one is released
+		_ = releaseRing(h.fd)
+		return fmt.Errorf("error mmapping: %v", err)
+	}
+	log.Infof("mmap buffer created at %p with size %d", data, len(data))
+	h.frameSize = frameSize
+	h.framesPerBuffer = framesPerBuffer
+	h.blockSize = int(blockSize)
+	h.frameNumbers = frameNumbers
+	h.blockNumbers = int(blockCount)
+	h.framePtr = 0
+	h.flushSkip = 0
+	h.ring = data
+	h.cache = make([]captured, 0, framesPerBuffer)
+	return nil
+}
 
-		tpreq := syscall.TpacketReq3{
-			Block_size: blockSize,
-			Block_nr:   blockNumbers,
+// Capabilities probe the kernel for supported capture features, using throwaway sockets
+func Capabilities() (CaptureCapabilities, error) {
+	var c CaptureCapabilities
+	// a socket with protocol 0 receives no packets, which is ideal for probing options
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return c, fmt.Errorf("failed opening raw socket: %v", err)
+	}
+	defer func() { _ = syscall.Close(fd) }()
+
+	c.TpacketV3 = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_VERSION, syscall.TPACKET_V3) == nil
+	c.TpacketV2 = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_VERSION, syscall.TPACKET_V2) == nil
+	c.TpacketV1 = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_VERSION, syscall.TPACKET_V1) == nil
+	c.KernelHardwareTimestamps = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, syscall.PACKET_TIMESTAMP, syscall.SOF_TIMESTAMPING_RAW_HARDWARE) == nil
+
+	// the smallest possible ring: a single page-sized block
+	if c.TpacketV1 {
+		pageSize := uint32(syscall.Getpagesize())
+		frameSize := uint32(syscall.TPACKET_ALIGNMENT << 7)
+		tpreq := syscall.TpacketReq{
+			Block_size: pageSize,
+			Block_nr:   1,
 			Frame_size: frameSize,
-			Frame_nr:   frameNumbers,
+			Frame_nr:   pageSize / frameSize,
 		}
-		logger.Debugf("creating mmap buffer with tpreq %#v", tpreq)
-		if err = syscall.SetsockoptTpacketReq3(fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, &tpreq); err != nil {
-			logger.Errorf("failed to set tpacket req: %v", err)
-			return nil, fmt.Errorf("failed to set tpacket req: %v", err)
+		if err := syscall.SetsockoptTpacketReq(fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, &tpreq); err == nil {
+			if ring, err := syscall.Mmap(fd, 0, int(pageSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err == nil {
+				c.Mmap = true
+				_ = syscall.Munmap(ring)
+			}
 		}
-		totalSize := int(tpreq.Block_size * tpreq.Block_nr)
-		data, err := syscall.Mmap(fd, 0, totalSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	}
+
+	// fanout only can be joined by a running socket, i.e. one with a protocol
+	fanoutFd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return c, fmt.Errorf("failed opening raw socket: %v", err)
+	}
+	defer func() { _ = syscall.Close(fanoutFd) }()
+	fanoutArg := (os.Getpid() & 0xffff) | syscall.PACKET_FANOUT_HASH<<16
+	c.Fanout = syscall.SetsockoptInt(fanoutFd, syscall.SOL_PACKET, syscall.PACKET_FANOUT, fanoutArg) == nil
+
+	return c, nil
+}
+
+// writeSLLHeader write a Linux cooked header for a packet received from the given sockaddr_ll
+// into the first sllHeaderLen bytes of b. protocol is in network byte order, as in the sockaddr_ll.
+func writeSLLHeader(b []byte, pktType uint8, haType uint16, haLen uint8, addr [8]byte, protocol uint16) {
+	binary.BigEndian.PutUint16(b[0:2], uint16(pktType))
+	binary.BigEndian.PutUint16(b[2:4], haType)
+	binary.BigEndian.PutUint16(b[4:6], uint16(haLen))
+	copy(b[6:14], addr[:])
+	binary.BigEndian.PutUint16(b[14:16], htons(protocol))
+}
+
+// lookupInterface returns the Interface with the given index or, if it is 0, name
+func lookupInterface(index int, name string) (Interface, error) {
+	var (
+		in  *net.Interface
+		err error
+	)
+	if index != 0 {
+		in, err = net.InterfaceByIndex(index)
+	} else {
+		in, err = net.InterfaceByName(name)
+	}
+	if err != nil {
+		return Interface{}, fmt.Errorf("unknown interface %s: %v", name, err)
+	}
+	// any socket will do to get the link type
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return Interface{}, fmt.Errorf("failed opening socket to get link type: %v", err)
+	}
+	defer syscall.Close(fd)
+	linkType, err := interfaceLinkType(fd, in.Name)
+	if err != nil {
+		return Interface{}, fmt.Errorf("unable to get link type for %s: %v", name, err)
+	}
+	return newInterface(*in, linkType)
+}
+
+// findAllDevs the Interfaces of ifaces that can be captured on, then "any"
+func findAllDevs(ifaces []net.Interface) ([]Interface, error) {
+	// any socket will do to get the link types
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening socket to get link types: %v", err)
+	}
+	defer syscall.Close(fd)
+	devs := make([]Interface, 0, len(ifaces)+1)
+	for _, in := range ifaces {
+		linkType, err := interfaceLinkType(fd, in.Name)
 		if err != nil {
-			logger.Errorf("error mmapping: %v", err)
-			return nil, fmt.Errorf("error mmapping: %v", err)
+			log.Debugf("leaving out interface %s: %v", in.Name, err)
+			continue
 		}
-		logger.Infof("mmap buffer created at %p with size %d", data, len(data))
-		h.framesPerBuffer = framesPerBuffer
-		h.blockSize = int(blockSize)
-		h.frameSize = frameSize
-		h.frameNumbers = frameNumbers
-		h.blockNumbers = int(blockNumbers)
-		h.ring = data
-		h.cache = make([]captured, 0, blockSize/frameSize)
+		dev, err := newInterface(in, linkType)
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, dev)
 	}
-	atomic.StoreUint32(&h.state, open)
-	return &h, nil
+	return append(devs, Interface{Name: anyInterface, Flags: net.FlagUp, LinkType: LinkTypeLinuxSLL}), nil
+}
+
+// interfaceLinkType get the link type of the named interface, from its ARPHRD_* hardware type.
+// Loopback on Linux has a fake Ethernet header, so it is reported as Ethernet. Any other type, e.g.
+// PPP or CAN, is captured with cooked headers, so it is reported as Linux SLL.
+func interfaceLinkType(fd int, iface string) (uint32, error) {
+	ifr, err := syscall.NewIfreq(iface)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interface name %s: %v", iface, err)
+	}
+	if err := syscall.IoctlIfreq(fd, syscall.SIOCGIFHWADDR, ifr); err != nil {
+		return 0, fmt.Errorf("failed to get hardware type of %s: %v", iface, err)
+	}
+	// the hardware address is a sockaddr, whose family is the ARPHRD_* type
+	switch ifr.Uint16() {
+	case syscall.ARPHRD_ETHER, syscall.ARPHRD_LOOPBACK:
+		return LinkTypeEthernet, nil
+	case syscall.ARPHRD_NONE:
+		return LinkTypeRaw, nil
+	default:
+		return LinkTypeLinuxSLL, nil
+	}
+}
+
+// parseBlockHeader parse byte data to get the header of a block of the ring
+func parseBlockHeader(b []byte, endian binary.ByteOrder) (blockHeader, error) {
+	if len(b) < blockHeaderSize {
+		return blockHeader{}, fmt.Errorf("bytes of length %d shorter than mandated %d", len(b), blockHeaderSize)
+	}
+	return blockHeader{
+		Version:      endian.Uint32(b[0:4]),
+		OffsetToPriv: endian.Uint32(b[4:8]),
+		H1: syscall.TpacketHdrV1{
+			Block_status:        endian.Uint32(b[8:12]),
+			Num_pkts:            endian.Uint32(b[12:16]),
+			Offset_to_first_pkt: endian.Uint32(b[16:20]),
+			Blk_len:             endian.Uint32(b[20:24]),
+			Seq_num:             endian.Uint64(b[24:32]),
+			Ts_first_pkt:        syscall.TpacketBDTS{Sec: endian.Uint32(b[32:36]), Usec: endian.Uint32(b[36:40])},
+			Ts_last_pkt:         syscall.TpacketBDTS{Sec: endian.Uint32(b[40:44]), Usec: endian.Uint32(b[44:48])},
+		},
+	}, nil
+}
+
+// parseTpacket3Hdr parse byte data to get the tpacket3 header of a packet in a block
+func parseTpacket3Hdr(b []byte, endian binary.ByteOrder) (syscall.Tpacket3Hdr, error) {
+	if len(b) < syscall.SizeofTpacket3Hdr {
+		return syscall.Tpacket3Hdr{}, fmt.Errorf("bytes of length %d shorter than mandated %d", len(b), syscall.SizeofTpacket3Hdr)
+	}
+	return syscall.Tpacket3Hdr{
+		Next_offset: endian.Uint32(b[0:4]),
+		Sec:         endian.Uint32(b[4:8]),
+		Nsec:        endian.Uint32(b[8:12]),
+		Snaplen:     endian.Uint32(b[12:16]),
+		Len:         endian.Uint32(b[16:20]),
+		Status:      endian.Uint32(b[20:24]),
+		Mac:         endian.Uint16(b[24:26]),
+		Net:         endian.Uint16(b[26:28]),
+		Hv1: syscall.TpacketHdrVariant1{
+			Rxhash:    endian.Uint32(b[28:32]),
+			Vlan_tci:  endian.Uint32(b[32:36]),
+			Vlan_tpid: endian.Uint16(b[36:38]),
+		},
+	}, nil
+}
+
+// checkTpacket3Hdr check that the packet of hdr, and the sockaddr_ll before it, are within the remaining
+// bytes of its block, and that its lengths are consistent, before they are used to slice the block
+func checkTpacket3Hdr(hdr syscall.Tpacket3Hdr, remaining int) error {
+	switch {
+	case int32(hdr.Mac) < alignedTpacketAllHdrSize:
+		return fmt.Errorf("packet at offset %d overlaps its headers of size %d", hdr.Mac, alignedTpacketAllHdrSize)
+	case int(hdr.Mac) > remaining:
+		return fmt.Errorf("packet at offset %d is past the remaining block size %d", hdr.Mac, remaining)
+	case hdr.Snaplen > hdr.Len:
+		return fmt.Errorf("packet captured length %d exceeds its length %d", hdr.Snaplen, hdr.Len)
+	case uint64(hdr.Mac)+uint64(hdr.Snaplen) > uint64(remaining):
+		// compared as uint64, so that a huge snaplen cannot wrap around to fit
+		return fmt.Errorf("packet with length %d at offset %d exceeds the remaining block size %d", hdr.Snaplen, hdr.Mac, remaining)
+	}
+	return nil
 }
 
 // parseSocketAddrLinkLayer parse byte data to get a RawSockAddrLinkLayer
-func parseSocketAddrLinkLayer(b []byte, endian binary.ByteOrder) (*syscall.RawSockaddrLinklayer, error) {
+func parseSocketAddrLinkLayer(b []byte, endian binary.ByteOrder) (syscall.RawSockaddrLinklayer, error) {
 	if len(b) < int(packetRALLSize) {
-		return nil, fmt.Errorf("bytes of length %d shorter than mandated %d", len(b), packetRALLSize)
+		return syscall.RawSockaddrLinklayer{}, fmt.Errorf("bytes of length %d shorter than mandated %d", len(b), packetRALLSize)
 	}
 	var addr [8]byte
-	copy(addr[:], b[11:19])
+	copy(addr[:], b[12:20])
 	sall := syscall.RawSockaddrLinklayer{
 		Family:   endian.Uint16(b[0:2]),
 		Protocol: endian.Uint16(b[2:4]),
@@ -568,5 +1722,5 @@ func parseSocketAddrLinkLayer(b []byte, endian binary.ByteOrder) (*syscall.RawSo
 		Halen:    b[11],
 		Addr:     addr,
 	}
-	return &sall, nil
+	return sall, nil
 }
@@ -0,0 +1,1810 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+	syscall "golang.org/x/sys/unix"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// openLoopback open a handle on the loopback interface, skipping the test if
+// we do not have the privileges to capture
+func openLoopback(t testing.TB, syscalls bool) *Handle {
+	handle, err := OpenLive("lo", 1600, false, 0, syscalls)
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	return handle
+}
+
+// udpSender returns a connected UDP socket on localhost, along with the port to which it sends
+func udpSender(t testing.TB) (*net.UDPConn, uint16) {
+	// listen so that we do not get ICMP port unreachable noise
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	conn, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, uint16(l.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// udpFrame build an Ethernet+IPv4+UDP frame from and to localhost
+func udpFrame(t *testing.T, port uint16, payload string) []byte {
+	localhost := net.ParseIP("127.0.0.1")
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: localhost, DstIP: localhost}
+	udp := &layers.UDP{SrcPort: 12345, DstPort: layers.UDPPort(port)}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("unable to serialize frame: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readPackets read count packets from the handle, failing if they do not arrive within timeout
+func readPackets(t *testing.T, h *Handle, count int, timeout time.Duration) []Packet {
+	c := make(chan Packet, count)
+	go func() {
+		for i := 0; i < count; {
+			b, ci, err := h.ReadPacketData()
+			if err != nil {
+				c <- Packet{Error: err}
+				return
+			}
+			if b == nil {
+				continue
+			}
+			c <- Packet{B: b, Info: ci}
+			i++
+		}
+	}()
+	packets := make([]Packet, 0, count)
+	deadline := time.After(timeout)
+	for len(packets) < count {
+		select {
+		case p := <-c:
+			if p.Error != nil {
+				t.Fatalf("unexpected error reading packets: %v", p.Error)
+			}
+			packets = append(packets, p)
+		case <-deadline:
+			t.Fatalf("received %d packets instead of %d within %v", len(packets), count, timeout)
+		}
+	}
+	return packets
+}
+
+func Test_mmapTimestamps(t *testing.T) {
+	handle := openLoopback(t, false)
+	defer handle.Close()
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	gap := 20 * time.Millisecond
+	go func() {
+		_, _ = conn.Write([]byte(tstMsg))
+		time.Sleep(gap)
+		_, _ = conn.Write([]byte(tstMsg))
+	}()
+	// loopback shows every packet twice: once outgoing, once incoming
+	packets := readPackets(t, handle, 4, 10*time.Second)
+	now := time.Now()
+	for i, p := range packets {
+		if now.Sub(p.Info.Timestamp) > time.Minute || p.Info.Timestamp.After(now) {
+			t.Errorf("%d: implausible timestamp %v", i, p.Info.Timestamp)
+		}
+	}
+	delta := packets[len(packets)-1].Info.Timestamp.Sub(packets[0].Info.Timestamp)
+	if delta < gap/2 || delta > time.Second {
+		t.Errorf("implausible delta %v between packets sent %v apart", delta, gap)
+	}
+}
+
+func Test_WithTimestampSource(t *testing.T) {
+	for _, src := range []TimestampSource{TimestampSoftware, TimestampHardware} {
+		for _, syscalls := range []bool{true, false} {
+			t.Run(fmt.Sprintf("source=%d/syscalls=%v", src, syscalls), func(t *testing.T) {
+				handle, err := OpenLive("lo", 1600, false, 0, syscalls, WithTimestampSource(src))
+				if err != nil {
+					t.Skipf("unable to open loopback for capture with timestamp source %d: %v", src, err)
+				}
+				defer handle.Close()
+				conn, port := udpSender(t)
+				if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+					t.Fatalf("unexpected error setting filter: %v", err)
+				}
+				before := time.Now()
+				_, _ = conn.Write([]byte(tstMsg))
+				// loopback has no hardware timestamps, so the kernel stamps them either way
+				for i, p := range readPackets(t, handle, 2, 10*time.Second) {
+					if ts := p.Info.Timestamp; ts.Before(before.Add(-time.Second)) || ts.After(time.Now()) {
+						t.Errorf("%d: implausible timestamp %v", i, ts)
+					}
+				}
+			})
+		}
+	}
+}
+
+func Test_SetDirectionIn(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	if err := handle.SetDirection(DirectionIn); err != nil {
+		t.Skipf("kernel does not support PACKET_IGNORE_OUTGOING: %v", err)
+	}
+	count := 5
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+	}
+	// with both directions, loopback would deliver each packet twice, once outgoing and once incoming
+	seen := map[string]bool{}
+	for _, p := range readPackets(t, handle, count, 10*time.Second) {
+		payload := string(p.B[42:p.Info.CaptureLength])
+		if seen[payload] {
+			t.Errorf("packet %s captured more than once", payload)
+		}
+		seen[payload] = true
+	}
+}
+
+func Test_SetPromiscuous(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	for _, promiscuous := range []bool{true, false, true, false} {
+		if err := handle.SetPromiscuous(promiscuous); err != nil {
+			t.Fatalf("unexpected error setting promiscuous to %v: %v", promiscuous, err)
+		}
+		if handle.promiscuous != promiscuous {
+			t.Errorf("promiscuous is %v, expected %v", handle.promiscuous, promiscuous)
+		}
+	}
+}
+
+func Test_Filter(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	if handle.Filter() != nil || handle.FilterProgram() != nil {
+		t.Errorf("unexpected filter before setting one: %v", handle.Filter())
+	}
+	if err := handle.SetBPFFilter("udp and dst port 53"); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	raw, inst := handle.Filter(), handle.FilterProgram()
+	if len(raw) == 0 || len(raw) != len(inst) {
+		t.Fatalf("mismatched filter of %d instructions and program of %d", len(raw), len(inst))
+	}
+	disassembled, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatal("unable to disassemble filter")
+	}
+	for i := range inst {
+		if _, isRaw := inst[i].(bpf.RawInstruction); isRaw || inst[i] != disassembled[i] {
+			t.Errorf("%d: mismatched instruction %#v, expected %#v", i, inst[i], disassembled[i])
+		}
+	}
+	reassembled, err := bpf.Assemble(inst)
+	if err != nil {
+		t.Fatalf("unable to assemble program: %v", err)
+	}
+	for i := range raw {
+		if reassembled[i] != raw[i] {
+			t.Errorf("%d: mismatched raw instruction %v, expected %v", i, reassembled[i], raw[i])
+		}
+	}
+}
+
+func Test_SetBPFFilterOutbound(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("outbound and udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			count := 5
+			for i := 0; i < count; i++ {
+				_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+			}
+			// loopback delivers each packet twice, once outgoing and once incoming; only the first is outbound
+			seen := map[string]bool{}
+			for _, p := range readPackets(t, handle, count, 10*time.Second) {
+				payload := string(p.B[42:p.Info.CaptureLength])
+				if seen[payload] {
+					t.Errorf("packet %s captured more than once", payload)
+				}
+				seen[payload] = true
+			}
+		})
+	}
+}
+
+func Test_SetBPFFilterRejected(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			expected := handle.Filter()
+			// longer than the kernel takes
+			tooLong := make([]bpf.RawInstruction, 5000)
+			for i := range tooLong {
+				tooLong[i] = bpf.RawInstruction{Op: 0x06, K: 0x40000} // ret #262144
+			}
+			if err := handle.SetRawBPFFilter(tooLong); err == nil {
+				t.Fatal("expected error setting a program the kernel rejects")
+			}
+			if actual := handle.Filter(); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("mismatched filter after a rejected one, actual %d instructions, expected %v", len(actual), expected)
+			}
+			// the filter we had still captures
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.Write([]byte(tstMsg))
+			}()
+			readPackets(t, handle, 1, 5*time.Second)
+		})
+	}
+}
+
+func Test_SetBPFFilterDirection(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	steps := []struct {
+		set      func() error
+		expected Direction
+	}{
+		{func() error { return handle.SetBPFFilter("inbound and udp") }, DirectionIn},
+		// the next filter, without a direction, captures both again
+		{func() error { return handle.SetBPFFilter("udp") }, DirectionInOut},
+		{func() error { return handle.SetBPFFilter("outbound and udp") }, DirectionOut},
+		{func() error { return handle.SetBPFFilter("") }, DirectionOut},
+		{func() error { return handle.SetBPFFilter("tcp") }, DirectionInOut},
+		// but one set apart from the filter stays
+		{func() error { return handle.SetDirection(DirectionIn) }, DirectionIn},
+		{func() error { return handle.SetBPFFilter("udp") }, DirectionIn},
+	}
+	for i, step := range steps {
+		if err := step.set(); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if handle.direction != step.expected {
+			t.Errorf("%d: mismatched direction, actual %d, expected %d", i, handle.direction, step.expected)
+		}
+	}
+}
+
+func Test_ZeroCopyReadPacketData(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			count := 3
+			for i := 0; i < count; i++ {
+				_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+			}
+			// loopback delivers each packet twice; read some without copying, then the rest with
+			// ReadPacketData, which must not hand out data still in the ring
+			var payloads []string
+			for len(payloads) < 2*count {
+				read := handle.ReadPacketData
+				if len(payloads) < count {
+					read = handle.ZeroCopyReadPacketData
+				}
+				b, ci, err := read()
+				if err != nil {
+					t.Fatalf("unexpected error reading packet: %v", err)
+				}
+				if b == nil {
+					continue
+				}
+				if len(b) != ci.CaptureLength {
+					t.Errorf("mismatched data length %d and capture length %d", len(b), ci.CaptureLength)
+				}
+				payloads = append(payloads, string(b[42:]))
+			}
+			for i, payload := range payloads {
+				if expected := fmt.Sprintf("msg-%d", i/2); payload != expected {
+					t.Errorf("%d: mismatched payload, actual %s, expected %s", i, payload, expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_WithDeduplication(t *testing.T) {
+	handle, err := OpenLive("lo", 1600, false, 0, true, WithDeduplication(100*time.Millisecond))
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	count := 5
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+	}
+	// loopback delivers identical outgoing and incoming copies of each packet, which should be deduplicated
+	for i, p := range readPackets(t, handle, count, 10*time.Second) {
+		if payload, expected := string(p.B[42:p.Info.CaptureLength]), fmt.Sprintf("msg-%d", i); payload != expected {
+			t.Errorf("%d: mismatched payload, actual %s, expected %s", i, payload, expected)
+		}
+	}
+}
+
+func Test_WritePacketData(t *testing.T) {
+	writer := openLoopback(t, true)
+	defer writer.Close()
+	reader := openLoopback(t, true)
+	defer reader.Close()
+	_, port := udpSender(t)
+	if err := reader.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	if err := writer.WritePacketData(nil); err == nil {
+		t.Error("expected error writing empty packet")
+	}
+	frame := udpFrame(t, port, tstMsg)
+	if err := writer.WritePacketData(frame); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	packets := readPackets(t, reader, 1, 10*time.Second)
+	if captured := packets[0].B[:packets[0].Info.CaptureLength]; string(captured) != string(frame) {
+		t.Errorf("mismatched packet\nactual   %x\nexpected %x", captured, frame)
+	}
+}
+
+func Test_WritePacketDataChecked(t *testing.T) {
+	writer := openLoopback(t, true)
+	defer writer.Close()
+	reader := openLoopback(t, true)
+	defer reader.Close()
+	_, port := udpSender(t)
+	_, other := udpSender(t)
+	filter := fmt.Sprintf("udp and dst port %d", port)
+	if err := writer.SetBPFFilter(filter); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	// the reader sees both ports, so that it would see the packet that should not be sent
+	if err := reader.SetBPFFilter(fmt.Sprintf("udp and (dst port %d or dst port %d)", port, other)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	sent, err := writer.WritePacketDataChecked(udpFrame(t, other, tstMsg))
+	if err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	if sent {
+		t.Errorf("sent packet that does not pass filter %s", filter)
+	}
+	frame := udpFrame(t, port, tstMsg)
+	sent, err = writer.WritePacketDataChecked(frame)
+	if err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	if !sent {
+		t.Errorf("did not send packet that passes filter %s", filter)
+	}
+	// only the packet that passes is captured, as the other was not sent before it
+	packets := readPackets(t, reader, 1, 10*time.Second)
+	if captured := packets[0].B[:packets[0].Info.CaptureLength]; string(captured) != string(frame) {
+		t.Errorf("mismatched packet\nactual   %x\nexpected %x", captured, frame)
+	}
+}
+
+func Test_ReadTo(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			_, _ = conn.Write([]byte(tstMsg))
+			buf := make([]byte, 1600)
+			// mmap reads can time out without a packet, so keep going until we get one
+			var (
+				n   int
+				ci  gopacket.CaptureInfo
+				err error
+			)
+			for n == 0 && err == nil {
+				n, ci, err = handle.ReadTo(buf)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading packet: %v", err)
+			}
+			if ci.CaptureLength != n {
+				t.Errorf("mismatched capture length, actual %d, expected %d", ci.CaptureLength, n)
+			}
+			if payload := string(buf[42:n]); payload != tstMsg {
+				t.Errorf("mismatched payload, actual %s, expected %s", payload, tstMsg)
+			}
+			// a short buffer truncates the packet
+			_, _ = conn.Write([]byte(tstMsg))
+			short := make([]byte, 20)
+			n, err = 0, nil
+			for n == 0 && err == nil {
+				n, _, err = handle.ReadTo(short)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading packet: %v", err)
+			}
+			if n != len(short) {
+				t.Errorf("mismatched truncated length, actual %d, expected %d", n, len(short))
+			}
+		})
+	}
+}
+
+func Test_DecodeNext(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			var (
+				eth     layers.Ethernet
+				ip4     layers.IPv4
+				udp     layers.UDP
+				decoded []gopacket.LayerType
+			)
+			parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &udp)
+			// the payload is whatever the udp port says it is, so stop at the udp
+			parser.IgnoreUnsupported = true
+			_, _ = conn.Write([]byte(tstMsg))
+			// mmap reads can time out without a packet, so keep going until we get one
+			var err error
+			for len(decoded) == 0 && err == nil {
+				_, err = handle.DecodeNext(parser, &decoded)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error decoding packet: %v", err)
+			}
+			expected := []gopacket.LayerType{layers.LayerTypeEthernet, layers.LayerTypeIPv4, layers.LayerTypeUDP}
+			if fmt.Sprint(decoded) != fmt.Sprint(expected) {
+				t.Errorf("mismatched layers, actual %v, expected %v", decoded, expected)
+			}
+			if uint16(udp.DstPort) != port {
+				t.Errorf("mismatched port, actual %d, expected %d", udp.DstPort, port)
+			}
+			if payload := string(udp.Payload); payload != tstMsg {
+				t.Errorf("mismatched payload, actual %s, expected %s", payload, tstMsg)
+			}
+		})
+	}
+}
+
+func Test_ZeroCopyPacketSource(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			source := gopacket.NewZeroCopyPacketSource(handle, layers.LinkType(handle.LinkType()), gopacket.WithNoCopy(true))
+			_, _ = conn.Write([]byte(tstMsg))
+			// mmap reads can time out without a packet, which decodes to nothing
+			var udp *layers.UDP
+			for udp == nil {
+				packet, err := source.NextPacket()
+				if err != nil {
+					t.Fatalf("unexpected error reading packet: %v", err)
+				}
+				udp, _ = packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			}
+			if payload := string(udp.Payload); payload != tstMsg {
+				t.Errorf("mismatched payload, actual %s, expected %s", payload, tstMsg)
+			}
+		})
+	}
+}
+
+// floodLoopback open a handle on loopback that captures only the packets that are sent to it in the
+// background, as fast as they can be, until the benchmark is over
+func floodLoopback(b *testing.B, syscalls bool, snaplen int32) *Handle {
+	handle := openLoopback(b, syscalls)
+	b.Cleanup(handle.Close)
+	if err := handle.SetSnaplen(snaplen); err != nil {
+		b.Fatalf("unexpected error setting snaplen: %v", err)
+	}
+	conn, port := udpSender(b)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		b.Fatalf("unexpected error setting filter: %v", err)
+	}
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = conn.Write([]byte(tstMsg))
+			}
+		}
+	}()
+	return handle
+}
+
+// benchmarkRead read b.N packets from loopback with read, while sending packets in the background
+func benchmarkRead(b *testing.B, syscalls bool, snaplen int32, read func(h *Handle) error) {
+	handle := floodLoopback(b, syscalls, snaplen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(handle); err != nil {
+			b.Fatalf("unexpected error reading packet: %v", err)
+		}
+	}
+}
+
+// benchmarkCapture read b.N packets from loopback with ReadPacketData, reporting the packets read a
+// second and how many syscalls it took to read each, which for mmap only are the polls
+func benchmarkCapture(b *testing.B, syscalls bool) {
+	handle := floodLoopback(b, syscalls, 1600)
+	var calls int
+	poll, recvmsg := handle.poll, handle.recvmsg
+	handle.poll = func(fds []syscall.PollFd, timeout int) (int, error) {
+		calls++
+		return poll(fds, timeout)
+	}
+	handle.recvmsg = func(fd int, p, oob []byte, flags int) (int, int, int, syscall.Sockaddr, error) {
+		calls++
+		return recvmsg(fd, p, oob, flags)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := handle.ReadPacketData(); err != nil {
+			b.Fatalf("unexpected error reading packet: %v", err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+	b.ReportMetric(float64(calls)/float64(b.N), "syscalls/packet")
+}
+
+func BenchmarkCaptureSyscall(b *testing.B) {
+	benchmarkCapture(b, true)
+}
+
+func BenchmarkCaptureMmap(b *testing.B) {
+	benchmarkCapture(b, false)
+}
+
+func BenchmarkReadPacketData(b *testing.B) {
+	for _, syscalls := range []bool{true, false} {
+		b.Run(fmt.Sprintf("syscalls=%v", syscalls), func(b *testing.B) {
+			benchmarkRead(b, syscalls, 1600, func(h *Handle) error {
+				_, _, err := h.ReadPacketData()
+				return err
+			})
+		})
+	}
+}
+
+// BenchmarkReadPacketDataSnaplen reads small packets with a large snaplen, where a buffer of snaplen
+// bytes for every packet would dominate the allocations
+func BenchmarkReadPacketDataSnaplen(b *testing.B) {
+	for _, snaplen := range []int32{1600, 65535} {
+		b.Run(fmt.Sprintf("snaplen=%d", snaplen), func(b *testing.B) {
+			benchmarkRead(b, true, snaplen, func(h *Handle) error {
+				_, _, err := h.ReadPacketData()
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkReadTo(b *testing.B) {
+	buf := make([]byte, 1600)
+	benchmarkRead(b, true, 1600, func(h *Handle) error {
+		_, _, err := h.ReadTo(buf)
+		return err
+	})
+}
+
+// BenchmarkDecodeNext decodes each packet into the same layers, which with mmap allocates nothing
+func BenchmarkDecodeNext(b *testing.B) {
+	for _, syscalls := range []bool{true, false} {
+		b.Run(fmt.Sprintf("syscalls=%v", syscalls), func(b *testing.B) {
+			var (
+				eth     layers.Ethernet
+				ip4     layers.IPv4
+				udp     layers.UDP
+				decoded = make([]gopacket.LayerType, 0, 4)
+			)
+			parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &udp)
+			parser.IgnoreUnsupported = true
+			benchmarkRead(b, syscalls, 1600, func(h *Handle) error {
+				_, err := h.DecodeNext(parser, &decoded)
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkZeroCopyReadPacketData(b *testing.B) {
+	for _, syscalls := range []bool{true, false} {
+		b.Run(fmt.Sprintf("syscalls=%v", syscalls), func(b *testing.B) {
+			benchmarkRead(b, syscalls, 1600, func(h *Handle) error {
+				_, _, err := h.ZeroCopyReadPacketData()
+				return err
+			})
+		})
+	}
+}
+
+// waitClosed wait for c to be closed, discarding any packets still in it
+func waitClosed(t *testing.T, c chan Packet, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("channel was not closed within %v", timeout)
+		}
+	}
+}
+
+// waitGoroutines wait for the number of goroutines to go back down to n
+func waitGoroutines(t *testing.T, n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, expected %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Listen(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			goroutines := runtime.NumGoroutine()
+			c := handle.Listen()
+			_, _ = conn.Write([]byte(tstMsg))
+			select {
+			case p := <-c:
+				if p.Error != nil {
+					t.Fatalf("unexpected error reading packet: %v", p.Error)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("packet was not received")
+			}
+			// give the reader time to wait for the next packet, which Close has to interrupt
+			time.Sleep(100 * time.Millisecond)
+			handle.Close()
+			waitClosed(t, c, 5*time.Second)
+			waitGoroutines(t, goroutines, 5*time.Second)
+		})
+	}
+}
+
+func Test_ListenContext(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := handle.ListenContext(ctx)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	// the read in progress only finishes with the next packet
+	_, _ = conn.Write([]byte(tstMsg))
+	waitClosed(t, c, 5*time.Second)
+	waitGoroutines(t, goroutines, 5*time.Second)
+	// the handle still is open for reading
+	_, _ = conn.Write([]byte(tstMsg))
+	if packets := readPackets(t, handle, 1, 5*time.Second); len(packets[0].B) == 0 {
+		t.Error("no packet read after the listener stopped")
+	}
+}
+
+func Test_Sniff(t *testing.T) {
+	conn, port := udpSender(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	count := 5
+	// loopback shows every packet twice: once outgoing, once incoming
+	expected := 2 * count
+	var received int32
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Sniff(ctx, "lo", fmt.Sprintf("udp and dst port %d", port), func(p Packet) {
+			if atomic.AddInt32(&received, 1) == int32(expected) {
+				cancel()
+			}
+		})
+	}()
+	// give the capture time to start before sending
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Skipf("unable to sniff on loopback: %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("Sniff did not return after the context was done")
+	}
+	if n := atomic.LoadInt32(&received); n != int32(expected) {
+		t.Errorf("mismatched packet count, actual %d, expected %d", n, expected)
+	}
+}
+
+func Test_Capabilities(t *testing.T) {
+	c, err := Capabilities()
+	if err != nil {
+		t.Skipf("unable to probe capabilities: %v", err)
+	}
+	// every kernel that can run this library supports these
+	if !c.TpacketV1 || !c.TpacketV3 {
+		t.Errorf("expected TPACKET_V1 and TPACKET_V3 support, got %#v", c)
+	}
+	// the kernel accepts the request whether or not any adapter can stamp packets
+	if !c.KernelHardwareTimestamps {
+		t.Errorf("expected kernel hardware timestamp support, got %#v", c)
+	}
+	if !c.Mmap {
+		t.Errorf("expected mmap support, got %#v", c)
+	}
+	if !c.Fanout {
+		t.Errorf("expected fanout support, got %#v", c)
+	}
+}
+
+func Test_LinkTypeCooked(t *testing.T) {
+	// a gre tunnel has no link headers we know, so like libpcap it is captured with cooked headers
+	name := fmt.Sprintf("gopcapgre%d", syscall.Getpid()%10000)
+	if out, err := exec.Command("ip", "link", "add", name, "type", "gre", "local", "127.0.0.1", "remote", "127.0.0.2").CombinedOutput(); err != nil {
+		t.Skipf("unable to create gre tunnel: %v: %s", err, out)
+	}
+	t.Cleanup(func() { _ = exec.Command("ip", "link", "del", name).Run() })
+	if out, err := exec.Command("ip", "link", "set", name, "up").CombinedOutput(); err != nil {
+		t.Fatalf("unable to set %s up: %v: %s", name, err, out)
+	}
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive(name, 1600, false, 0, syscalls)
+			if err != nil {
+				t.Fatalf("unexpected error opening %s: %v", name, err)
+			}
+			defer handle.Close()
+			if lt := handle.LinkType(); lt != LinkTypeLinuxSLL {
+				t.Errorf("mismatched link type for gre tunnel, actual %d, expected %d", lt, LinkTypeLinuxSLL)
+			}
+		})
+	}
+}
+
+func Test_LinkType(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle := openLoopback(t, syscalls)
+			defer handle.Close()
+			if lt := handle.LinkType(); lt != LinkTypeEthernet {
+				t.Errorf("mismatched link type for loopback, actual %d, expected %d", lt, LinkTypeEthernet)
+			}
+		})
+	}
+}
+
+func Test_Interface(t *testing.T) {
+	handle := openLoopback(t, true)
+	defer handle.Close()
+	in, err := handle.Interface()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if in.Name != "lo" || in.Flags&net.FlagLoopback == 0 {
+		t.Errorf("mismatched interface, actual %s %v, expected lo", in.Name, in.Flags)
+	}
+
+	all, err := OpenLive("any", 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open all interfaces for capture: %v", err)
+	}
+	defer all.Close()
+	if _, err := all.Interface(); !errors.Is(err, ErrNoInterface) {
+		t.Errorf("mismatched error for all interfaces, actual %v, expected %v", err, ErrNoInterface)
+	}
+	if _, err := MergeReaders().Interface(); !errors.Is(err, ErrNoInterface) {
+		t.Errorf("mismatched error for offline handle, actual %v, expected %v", err, ErrNoInterface)
+	}
+}
+
+func Test_FindAllDevs(t *testing.T) {
+	devs, err := FindAllDevs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := map[string]Interface{}
+	for _, dev := range devs {
+		found[dev.Name] = dev
+	}
+	lo, ok := found["lo"]
+	if !ok {
+		t.Fatalf("no loopback in %v", devs)
+	}
+	in, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lo.Index != in.Index || lo.MTU != in.MTU || lo.Flags != in.Flags {
+		t.Errorf("mismatched loopback %+v, expected %+v", lo, in)
+	}
+	var localhost bool
+	for _, addr := range lo.Addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			localhost = true
+		}
+	}
+	if !localhost {
+		t.Errorf("loopback addresses %v are missing 127.0.0.1", lo.Addrs)
+	}
+	// the same as the handles report, by name or index
+	handle := openLoopback(t, false)
+	defer handle.Close()
+	if lt := handle.LinkType(); lt != lo.LinkType {
+		t.Errorf("mismatched link type of loopback, handle %d, FindAllDevs %d", lt, lo.LinkType)
+	}
+	byIndex, err := OpenLiveByIndex(lo.Index, 1600, false, 0, true)
+	if err != nil {
+		t.Fatalf("unable to open loopback by index: %v", err)
+	}
+	defer byIndex.Close()
+	if lt := byIndex.LinkType(); lt != lo.LinkType {
+		t.Errorf("mismatched link type of loopback by index, handle %d, FindAllDevs %d", lt, lo.LinkType)
+	}
+	anyDev, ok := found[anyInterface]
+	if !ok {
+		t.Fatalf("no %s in %v", anyInterface, devs)
+	}
+	all, err := OpenLive(anyDev.Name, 1600, false, 0, true)
+	if err != nil {
+		t.Fatalf("unable to open all interfaces: %v", err)
+	}
+	defer all.Close()
+	if lt := all.LinkType(); lt != anyDev.LinkType {
+		t.Errorf("mismatched link type of %s, handle %d, FindAllDevs %d", anyInterface, lt, anyDev.LinkType)
+	}
+}
+
+func Test_SnaplenLargerThanMTU(t *testing.T) {
+	in, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	snaplen := int32(in.MTU * 4)
+	// as big as a UDP datagram on loopback can go
+	msg := bytes.Repeat([]byte{0xab}, 65000)
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive("lo", snaplen, false, 0, syscalls)
+			if err != nil {
+				t.Skipf("unable to open loopback for capture: %v", err)
+			}
+			defer handle.Close()
+			if !syscalls && int32(handle.frameSize) >= snaplen {
+				t.Errorf("frame size %d reserved for the full snaplen %d, beyond mtu %d", handle.frameSize, snaplen, in.MTU)
+			}
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+			var (
+				data []byte
+				ci   gopacket.CaptureInfo
+			)
+			for data == nil && err == nil {
+				data, ci, err = handle.ReadPacketData()
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading packet: %v", err)
+			}
+			expected := 42 + len(msg)
+			if ci.CaptureLength != expected || len(data) != expected {
+				t.Errorf("truncated capture, capture length %d, data %d, expected %d", ci.CaptureLength, len(data), expected)
+			}
+			// the syscall path does not report the original length
+			if !syscalls && ci.Length != expected {
+				t.Errorf("mismatched length, actual %d, expected %d", ci.Length, expected)
+			}
+			if len(data) == expected && !bytes.Equal(data[42:], msg) {
+				t.Error("mismatched payload")
+			}
+		})
+	}
+}
+
+func Test_AnyInterface(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive("any", 1600, false, 0, syscalls)
+			if err != nil {
+				t.Skipf("unable to open all interfaces for capture: %v", err)
+			}
+			defer handle.Close()
+			if lt := handle.LinkType(); lt != LinkTypeLinuxSLL {
+				t.Fatalf("mismatched link type, actual %d, expected %d", lt, LinkTypeLinuxSLL)
+			}
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("ip and udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			_, _ = conn.Write([]byte(tstMsg))
+			var (
+				data []byte
+				ci   gopacket.CaptureInfo
+			)
+			for data == nil && err == nil {
+				data, ci, err = handle.ReadPacketData()
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading packet: %v", err)
+			}
+			if ci.CaptureLength != len(data) {
+				t.Errorf("mismatched capture length, actual %d, expected %d", ci.CaptureLength, len(data))
+			}
+			packet := gopacket.NewPacket(data, layers.LinkTypeLinuxSLL, gopacket.Default)
+			sll, ok := packet.LinkLayer().(*layers.LinuxSLL)
+			if !ok {
+				t.Fatalf("packet has no cooked header: %v", packet)
+			}
+			if sll.EthernetType != layers.EthernetTypeIPv4 || sll.AddrType != syscall.ARPHRD_LOOPBACK {
+				t.Errorf("mismatched cooked header, protocol %v, hardware type %d", sll.EthernetType, sll.AddrType)
+			}
+			if app := packet.ApplicationLayer(); app == nil || string(app.Payload()) != tstMsg {
+				t.Errorf("mismatched payload, actual %v, expected %s", app, tstMsg)
+			}
+		})
+	}
+}
+
+func Test_cookedKernelFilter(t *testing.T) {
+	tests := []struct {
+		in, out bpf.Instruction
+		err     bool
+	}{
+		{bpf.LoadAbsolute{Off: 14, Size: 2}, bpf.LoadExtension{Num: bpf.ExtProto}, false},
+		{bpf.LoadAbsolute{Off: 0, Size: 2}, bpf.LoadExtension{Num: bpf.ExtType}, false},
+		{bpf.LoadAbsolute{Off: 28, Size: 4}, bpf.LoadAbsolute{Off: 12, Size: 4}, false},
+		{bpf.LoadMemShift{Off: 16}, bpf.LoadMemShift{Off: 0}, false},
+		{bpf.LoadIndirect{Off: 18, Size: 2}, bpf.LoadIndirect{Off: 2, Size: 2}, false},
+		{bpf.RetConstant{Val: 0x40000}, bpf.RetConstant{Val: 0x40000}, false},
+		{bpf.LoadAbsolute{Off: 6, Size: 4}, nil, true},
+	}
+	for i, tt := range tests {
+		raw, err := bpf.Assemble([]bpf.Instruction{tt.in})
+		if err != nil {
+			t.Fatalf("%d: unable to assemble: %v", i, err)
+		}
+		out, err := cookedKernelFilter(raw)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error, actual %v, expected error %v", i, err, tt.err)
+		}
+		if tt.err {
+			continue
+		}
+		if actual := out[0].Disassemble(); actual != tt.out {
+			t.Errorf("%d: mismatched instruction, actual %#v, expected %#v", i, actual, tt.out)
+		}
+	}
+}
+
+func Test_WithHealthCheck(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive("lo", 1600, false, 0, syscalls, WithHealthCheck(10*time.Millisecond))
+			if err != nil {
+				t.Skipf("unable to open loopback for capture: %v", err)
+			}
+			defer handle.Close()
+			// keep any real traffic from getting in the way
+			if err := handle.SetBPFFilter("udp and port 9"); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			// the interface goes away after a few quiet polls
+			var polls int
+			handle.poll = func(fds []syscall.PollFd, timeout int) (int, error) {
+				if timeout != 10 {
+					t.Errorf("mismatched poll timeout, actual %d, expected %d", timeout, 10)
+				}
+				if polls++; polls < 3 {
+					return 0, nil
+				}
+				fds[0].Revents = syscall.POLLHUP
+				return 1, nil
+			}
+			_, _, err = handle.ReadPacketData()
+			if !errors.Is(err, ErrHandleDown) {
+				t.Fatalf("mismatched error, actual %v, expected %v", err, ErrHandleDown)
+			}
+			if polls != 3 {
+				t.Errorf("mismatched polls, actual %d, expected %d", polls, 3)
+			}
+			// the handle stays down
+			if _, _, err = handle.ReadPacketData(); err != io.EOF {
+				t.Errorf("mismatched error after down, actual %v, expected %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func Test_OpenLiveByIndex(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLiveByIndex(lo.Index, 1600, false, 0, syscalls)
+			if err != nil {
+				t.Fatalf("unexpected error opening loopback by index %d: %v", lo.Index, err)
+			}
+			defer handle.Close()
+			if handle.index != lo.Index || handle.iface != lo.Name {
+				t.Errorf("mismatched interface, actual %s/%d, expected %s/%d", handle.iface, handle.index, lo.Name, lo.Index)
+			}
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			_, _ = conn.Write([]byte(tstMsg))
+			readPackets(t, handle, 1, 10*time.Second)
+		})
+	}
+	if _, err := OpenLiveByIndex(math.MaxInt32, 1600, false, 0, true); err == nil {
+		t.Error("expected error opening unknown interface index")
+	}
+}
+
+func Test_OpenLiveSnaplenMTU(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive("lo", SnaplenMTU, false, 0, syscalls)
+			if err != nil {
+				t.Fatalf("unexpected error opening loopback: %v", err)
+			}
+			defer handle.Close()
+			// a full loopback packet has an Ethernet header
+			if int(handle.snaplen) < lo.MTU+14 {
+				t.Errorf("snaplen %d does not cover the loopback MTU %d", handle.snaplen, lo.MTU)
+			}
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			payload := strings.Repeat("x", 60000)
+			_, _ = conn.Write([]byte(payload))
+			for _, p := range readPackets(t, handle, 2, 10*time.Second) {
+				if full := 42 + len(payload); p.Info.CaptureLength != full {
+					t.Errorf("mismatched capture length %d, expected whole packet of %d", p.Info.CaptureLength, full)
+				}
+			}
+		})
+	}
+	if _, err := OpenLive("nosuchinterface", SnaplenMTU, false, 0, true); err == nil {
+		t.Error("expected error deriving snaplen of unknown interface")
+	}
+}
+
+// fanoutGroups how many fanout groups the tests have used
+var fanoutGroups uint32
+
+func Test_OpenLiveFanout(t *testing.T) {
+	conn, port := udpSender(t)
+	// a group of our own, so that we do not join that of anything else on the host,
+	// or that of an earlier run whose sockets have not gone away yet
+	group := uint16(syscall.Getpid()) + uint16(atomic.AddUint32(&fanoutGroups, 1))
+	handles := make([]*Handle, 2)
+	for i := range handles {
+		handle, err := OpenLiveFanout("lo", 1600, false, 0, true, group, FanoutLB)
+		if err != nil {
+			t.Skipf("unable to open loopback for fanout capture: %v", err)
+		}
+		defer handle.Close()
+		if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+			t.Fatalf("unexpected error setting filter: %v", err)
+		}
+		handles[i] = handle
+	}
+	count := 10
+	// loopback shows every packet twice: once outgoing, once incoming
+	expected := 2 * count
+	received := make(chan int, 2*expected)
+	for i, handle := range handles {
+		go func(i int, h *Handle) {
+			for {
+				b, _, err := h.ReadPacketData()
+				if err != nil {
+					return
+				}
+				if b != nil {
+					received <- i
+				}
+			}
+		}(i, handle)
+	}
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+	}
+	counts := make([]int, len(handles))
+	deadline := time.After(5 * time.Second)
+	for total := 0; total < expected; total++ {
+		select {
+		case i := <-received:
+			counts[i]++
+		case <-deadline:
+			t.Fatalf("received %v packets instead of %d in total", counts, expected)
+		}
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Errorf("handle %d received no packets, counts %v", i, counts)
+		}
+	}
+	// nothing is delivered to more than one handle in the group
+	select {
+	case i := <-received:
+		t.Errorf("handle %d received a packet beyond the %d sent", i, expected)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_OpenLiveFanoutMismatch(t *testing.T) {
+	group := uint16(syscall.Getpid()) + uint16(atomic.AddUint32(&fanoutGroups, 1))
+	handle, err := OpenLiveFanout("lo", 1600, false, 0, true, group, FanoutLB)
+	if err != nil {
+		t.Skipf("unable to open loopback for fanout capture: %v", err)
+	}
+	defer handle.Close()
+	// the kernel refuses to join a group with a mode other than its own
+	fds := openFds(t)
+	if _, err := OpenLiveFanout("lo", 1600, false, 0, false, group, FanoutCPU); err == nil {
+		t.Fatal("expected error joining a fanout group with another mode")
+	}
+	if n := openFds(t); n != fds {
+		t.Errorf("%d file descriptors open after failing to open, instead of %d", n, fds)
+	}
+}
+
+func Test_WithFilter(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			// keep the loopback busy with traffic the filter does not match, while we open
+			noise, _ := udpSender(t)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_, _ = noise.Write([]byte("noise"))
+					}
+				}
+			}()
+			conn, port := udpSender(t)
+			handle, err := OpenLive("lo", 1600, false, 0, syscalls, WithFilter(fmt.Sprintf("udp and dst port %d", port)))
+			if err != nil {
+				t.Skipf("unable to open loopback for capture: %v", err)
+			}
+			defer handle.Close()
+			count := 5
+			for i := 0; i < count; i++ {
+				_, _ = conn.Write([]byte(fmt.Sprintf("msg-%d", i)))
+			}
+			// loopback shows every packet twice: once outgoing, once incoming
+			for i, p := range readPackets(t, handle, 2*count, 5*time.Second) {
+				packet := gopacket.NewPacket(p.B, layers.LayerTypeEthernet, gopacket.Default)
+				udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+				if !ok || uint16(udp.DstPort) != port {
+					t.Errorf("%d: captured a packet that does not match the filter: %v", i, packet)
+				}
+			}
+		})
+	}
+}
+
+func Test_WithFilterInvalid(t *testing.T) {
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls %v", syscalls), func(t *testing.T) {
+			fds := openFds(t)
+			if _, err := OpenLive("lo", 1600, false, 0, syscalls, WithFilter("udp and port nothing")); err == nil {
+				t.Fatal("expected error opening with an invalid filter")
+			}
+			if n := openFds(t); n != fds {
+				t.Errorf("%d file descriptors open after failing to open, instead of %d", n, fds)
+			}
+		})
+	}
+}
+
+func Test_OpenLiveUnknownInterface(t *testing.T) {
+	// the interface is looked up before the socket is set up, so nothing is left open
+	fds := openFds(t)
+	if _, err := OpenLive("go-pcap-none", 1600, false, 0, true, WithTimestampSource(TimestampHardware)); err == nil {
+		t.Fatal("expected error opening unknown interface")
+	}
+	if n := openFds(t); n != fds {
+		t.Errorf("%d file descriptors open after failing to open, instead of %d", n, fds)
+	}
+}
+
+// openFds how many file descriptors the process has open
+func openFds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// mmapBlock build a block of the TPACKET_V3 ring holding frame, as the kernel would, with the given
+// status on the block and on the packet in it
+func mmapBlock(t *testing.T, endian binary.ByteOrder, blockStatus, status uint32, frame []byte) []byte {
+	block := make([]byte, 4096)
+	first := uint32(tpacketAlign(int32(binary.Size(blockHeader{}))))
+	bHdr := blockHeader{
+		Version: syscall.TPACKET_V3,
+		H1: syscall.TpacketHdrV1{
+			Block_status:        blockStatus | syscall.TP_STATUS_USER,
+			Num_pkts:            1,
+			Offset_to_first_pkt: first,
+			Blk_len:             uint32(len(block)),
+		},
+	}
+	hdr := syscall.Tpacket3Hdr{
+		Snaplen: uint32(len(frame)),
+		Len:     uint32(len(frame)),
+		Status:  status | syscall.TP_STATUS_USER,
+		Mac:     uint16(alignedTpacketAllHdrSize),
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, endian, bHdr); err != nil {
+		t.Fatalf("unable to write block header: %v", err)
+	}
+	copy(block, buf.Bytes())
+	buf.Reset()
+	if err := binary.Write(&buf, endian, hdr); err != nil {
+		t.Fatalf("unable to write packet header: %v", err)
+	}
+	copy(block[first:], buf.Bytes())
+	// the sockaddr_ll, of a packet to this host
+	endian.PutUint16(block[first+uint32(alignedTpacketHdrSize):], syscall.AF_PACKET)
+	copy(block[first+uint32(hdr.Mac):], frame)
+	return block
+}
+
+func Test_mmapLosing(t *testing.T) {
+	endian, err := getEndianness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	frame := udpFrame(t, 53, "losing")
+	tests := []struct {
+		blockStatus, status uint32
+		warn                bool
+	}{
+		{0, 0, false},
+		// the block is marked as soon as the kernel drops
+		{syscall.TP_STATUS_LOSING, 0, true},
+		// only once, while it still is
+		{syscall.TP_STATUS_LOSING, syscall.TP_STATUS_LOSING, false},
+		{0, 0, false},
+		// and again, once it starts again, with only the packet marked
+		{0, syscall.TP_STATUS_LOSING, true},
+	}
+	h := &Handle{iface: "test", endian: endian, linkType: LinkTypeEthernet, snaplen: 1600, blockNumbers: 1}
+	for i, tt := range tests {
+		hook.Reset()
+		h.ring = mmapBlock(t, endian, tt.blockStatus, tt.status, frame)
+		h.blockSize = len(h.ring)
+		packets, err := h.processMmapPackets(0, offsetToBlockStatus, false)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(packets) != 1 || !bytes.Equal(packets[0].data, frame) {
+			t.Errorf("%d: mismatched packets %v", i, packets)
+		}
+		var warned bool
+		for _, entry := range hook.AllEntries() {
+			warned = warned || (entry.Level == log.WarnLevel && strings.Contains(entry.Message, "dropping packets"))
+		}
+		if warned != tt.warn {
+			t.Errorf("%d: mismatched warning, actual %v, expected %v", i, warned, tt.warn)
+		}
+	}
+}
+
+func Test_mmapMalformed(t *testing.T) {
+	endian, err := getEndianness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := udpFrame(t, 53, "malformed")
+	first := uint32(tpacketAlign(int32(binary.Size(blockHeader{}))))
+	// the offsets, in the block, of the fields of its header and that of its packet
+	const (
+		offsetToNumPkts          = 12
+		offsetToOffsetToFirstPkt = 16
+		offsetToNextOffset       = 0
+		offsetToSnaplen          = 12
+		offsetToLen              = 16
+		offsetToMac              = 24
+	)
+	tests := []struct {
+		name    string
+		corrupt func(block []byte)
+	}{
+		{"snaplen wrapping around", func(block []byte) {
+			endian.PutUint32(block[first+offsetToSnaplen:], 0xfffffff0)
+			endian.PutUint32(block[first+offsetToLen:], 0xfffffff0)
+		}},
+		{"snaplen past the block", func(block []byte) {
+			endian.PutUint32(block[first+offsetToSnaplen:], uint32(len(block)))
+			endian.PutUint32(block[first+offsetToLen:], uint32(len(block)))
+		}},
+		{"snaplen exceeding the length", func(block []byte) {
+			endian.PutUint32(block[first+offsetToSnaplen:], uint32(len(frame)+1))
+		}},
+		{"mac within the headers", func(block []byte) {
+			endian.PutUint16(block[first+offsetToMac:], 0)
+		}},
+		{"mac past the block", func(block []byte) {
+			endian.PutUint16(block[first+offsetToMac:], 0xffff)
+		}},
+		{"first packet past the block", func(block []byte) {
+			endian.PutUint32(block[offsetToOffsetToFirstPkt:], uint32(len(block))+1)
+		}},
+		{"next packet past the block", func(block []byte) {
+			endian.PutUint32(block[offsetToNumPkts:], 2)
+			endian.PutUint32(block[first+offsetToNextOffset:], uint32(len(block)))
+		}},
+	}
+	for _, tt := range tests {
+		for _, zeroCopy := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s zero copy %v", tt.name, zeroCopy), func(t *testing.T) {
+				h := &Handle{iface: "test", endian: endian, linkType: LinkTypeEthernet, snaplen: 65535, blockNumbers: 1}
+				h.ring = mmapBlock(t, endian, 0, 0, frame)
+				h.blockSize = len(h.ring)
+				tt.corrupt(h.ring)
+				packets, err := h.processMmapPackets(0, offsetToBlockStatus, zeroCopy)
+				if err == nil {
+					t.Errorf("unexpected packets %v, expected an error", packets)
+				}
+			})
+		}
+	}
+}
+
+func Test_insertVLANTag(t *testing.T) {
+	frame := []byte{
+		0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, // addresses
+		0x08, 0x00, // ip4
+		0x45, 0x00, // start of the ip4 header
+	}
+	tagged := func(tpid, tci uint16) []byte {
+		b := append([]byte{}, frame[:12]...)
+		b = append(b, byte(tpid>>8), byte(tpid), byte(tci>>8), byte(tci))
+		return append(b, frame[12:]...)
+	}
+	tests := []struct {
+		room      int
+		tci, tpid uint16
+		expected  []byte
+	}{
+		// room for the tag
+		{vlanTagLen, 100, 0, tagged(0x8100, 100)},
+		{vlanTagLen, 100, 0x8100, tagged(0x8100, 100)},
+		// 802.1ad
+		{vlanTagLen, 0x2064, 0x88a8, tagged(0x88a8, 0x2064)},
+		// priority tagged, with vlan id 0
+		{vlanTagLen, 0x6000, 0, tagged(0x8100, 0x6000)},
+		// truncated to the buffer
+		{1, 100, 0, tagged(0x8100, 100)[:len(frame)+1]},
+	}
+	for i, tt := range tests {
+		b := make([]byte, len(frame)+tt.room)
+		copy(b, frame)
+		n := insertVLANTag(b, len(frame), tt.tci, tt.tpid)
+		if !bytes.Equal(b[:n], tt.expected) {
+			t.Errorf("%d: mismatched frame, actual % x, expected % x", i, b[:n], tt.expected)
+		}
+	}
+}
+
+// vethPair create a veth pair, returning the names of its ends
+func vethPair(t *testing.T) (string, string) {
+	// names of our own, so that we do not touch anything else on the host
+	veth0, veth1 := fmt.Sprintf("gopcap%d", syscall.Getpid()%10000), fmt.Sprintf("gopcap%db", syscall.Getpid()%10000)
+	commands := [][]string{
+		{"link", "add", veth0, "type", "veth", "peer", "name", veth1},
+		{"link", "set", veth0, "up"},
+		{"link", "set", veth1, "up"},
+	}
+	for i, args := range commands {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			if i > 0 {
+				_ = exec.Command("ip", "link", "del", veth0).Run()
+			}
+			t.Skipf("unable to create veth pair: %v: %s", err, out)
+		}
+	}
+	// deleting either end deletes both
+	t.Cleanup(func() { _ = exec.Command("ip", "link", "del", veth0).Run() })
+	return veth0, veth1
+}
+
+func Test_VLANTag(t *testing.T) {
+	veth0, veth1 := vethPair(t)
+	sender, err := OpenLive(veth0, 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open %s for sending: %v", veth0, err)
+	}
+	defer sender.Close()
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive(veth1, 1600, false, 0, syscalls)
+			if err != nil {
+				t.Skipf("unable to open %s for capture: %v", veth1, err)
+			}
+			defer handle.Close()
+			payload := fmt.Sprintf("vlan-%v", syscalls)
+			eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0}, EthernetType: layers.EthernetTypeDot1Q}
+			dot1q := &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+			udp := &layers.UDP{SrcPort: 12345, DstPort: 9}
+			_ = udp.SetNetworkLayerForChecksum(ip)
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, dot1q, ip, udp, gopacket.Payload(payload)); err != nil {
+				t.Fatalf("unable to serialize frame: %v", err)
+			}
+			// the peer strips the tag on receipt, and delivers it out of band
+			if err := sender.WritePacketData(buf.Bytes()); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+			// other traffic, such as ip6 neighbor discovery, may come first
+			for {
+				p := readPackets(t, handle, 1, 5*time.Second)[0]
+				packet := gopacket.NewPacket(p.B, layers.LayerTypeEthernet, gopacket.Default)
+				if app := packet.ApplicationLayer(); app == nil || string(app.Payload()) != payload {
+					continue
+				}
+				if !bytes.Equal(p.B, buf.Bytes()) {
+					t.Errorf("mismatched frame, actual % x, expected % x", p.B, buf.Bytes())
+				}
+				if tag, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); !ok || tag.VLANIdentifier != 100 {
+					t.Errorf("captured frame is missing the tag for vlan %d: %v", 100, packet)
+				}
+				if p.Info.CaptureLength != len(p.B) {
+					t.Errorf("mismatched capture length, actual %d, expected %d", p.Info.CaptureLength, len(p.B))
+				}
+				return
+			}
+		})
+	}
+}
+
+func Test_OpenLiveMulti(t *testing.T) {
+	veth0, veth1 := vethPair(t)
+	sender, err := OpenLive(veth0, 1600, false, 0, true)
+	if err != nil {
+		t.Skipf("unable to open %s for capture: %v", veth0, err)
+	}
+	defer sender.Close()
+	expected := map[int]string{}
+	for _, name := range []string{"lo", veth1} {
+		in, err := net.InterfaceByName(name)
+		if err != nil {
+			t.Fatalf("unable to get interface %s: %v", name, err)
+		}
+		expected[in.Index] = name
+	}
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			handle, err := OpenLiveMulti(ctx, []string{"lo", veth1}, 1600, false, 100*time.Millisecond, syscalls)
+			if err != nil {
+				t.Fatalf("unable to open lo and %s for capture: %v", veth1, err)
+			}
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			if err := handle.WritePacketData(udpFrame(t, port, tstMsg)); err == nil {
+				t.Error("expected error writing on a handle of several interfaces")
+			}
+			// one packet on each: sent on lo, and received on veth1, from its peer
+			_, _ = conn.Write([]byte(tstMsg))
+			if err := sender.WritePacketData(udpFrame(t, port, tstMsg)); err != nil {
+				t.Fatalf("unable to send: %v", err)
+			}
+			seen := map[int]bool{}
+			deadline := time.Now().Add(10 * time.Second)
+			for len(seen) < len(expected) && time.Now().Before(deadline) {
+				data, ci, err := handle.ReadPacketData()
+				if err != nil {
+					t.Fatalf("unexpected error reading packet: %v", err)
+				}
+				if data == nil {
+					continue
+				}
+				if _, ok := expected[ci.InterfaceIndex]; !ok {
+					t.Fatalf("packet of unexpected interface index %d", ci.InterfaceIndex)
+				}
+				if payload := string(data[42:]); payload != tstMsg {
+					t.Errorf("%s: mismatched payload, actual %s, expected %s", expected[ci.InterfaceIndex], payload, tstMsg)
+				}
+				seen[ci.InterfaceIndex] = true
+			}
+			for index, name := range expected {
+				if !seen[index] {
+					t.Errorf("no packet captured on %s, index %d", name, index)
+				}
+			}
+			// once the context is done, the handle is closed, and reads end
+			cancel()
+			deadline = time.Now().Add(5 * time.Second)
+			for {
+				_, _, err := handle.ReadPacketData()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error reading after cancel: %v", err)
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("reads did not end after the context was done")
+				}
+			}
+		})
+	}
+}
+
+func Test_WithImmediate(t *testing.T) {
+	handle, err := OpenLive("lo", 1600, false, 0, false, WithImmediate())
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	// let the reader wait on an idle ring before the packet arrives
+	read := make(chan time.Time, 1)
+	go func() {
+		if _, _, err := handle.ReadPacketData(); err == nil {
+			read <- time.Now()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sent := time.Now()
+	_, _ = conn.Write([]byte("msg"))
+	// the block times out after a millisecond; leave plenty of room for scheduling
+	bound := 50 * time.Millisecond
+	select {
+	case at := <-read:
+		if latency := at.Sub(sent); latency > bound {
+			t.Errorf("packet took %v to be read, more than %v", latency, bound)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet was not read")
+	}
+}
+
+func Test_SetRingBuffer(t *testing.T) {
+	handle, err := OpenLive("lo", 1600, false, 0, false, WithImmediate())
+	if err != nil {
+		t.Skipf("unable to open loopback for capture: %v", err)
+	}
+	defer handle.Close()
+	pageSize := uint32(syscall.Getpagesize())
+	invalid := []struct {
+		name       string
+		blockSize  uint32
+		blockCount uint32
+	}{
+		{"not a power of 2", 3 * pageSize, 4},
+		{"not a multiple of the page size", pageSize / 2, 4},
+		{"smaller than a frame", pageSize, 4},
+		{"no blocks", 1 << 18, 0},
+	}
+	for _, tt := range invalid {
+		if tt.name == "smaller than a frame" && pageSize >= handle.frameSize {
+			continue
+		}
+		if err := handle.SetRingBuffer(tt.blockSize, tt.blockCount); err == nil {
+			t.Errorf("%s: expected error for block size %d, count %d", tt.name, tt.blockSize, tt.blockCount)
+		}
+	}
+
+	var blockSize, blockCount uint32 = 1 << 18, 16
+	if err := handle.SetRingBuffer(blockSize, blockCount); err != nil {
+		t.Fatalf("unexpected error setting ring buffer: %v", err)
+	}
+	if len(handle.ring) != int(blockSize*blockCount) {
+		t.Errorf("mismatched ring size, actual %d, expected %d", len(handle.ring), blockSize*blockCount)
+	}
+	if handle.blockSize != int(blockSize) || handle.blockNumbers != int(blockCount) {
+		t.Errorf("mismatched blocks, actual %d of %d, expected %d of %d", handle.blockNumbers, handle.blockSize, blockCount, blockSize)
+	}
+	// a ring that the kernel rejects, as it is far too big, leaves the one we had
+	if err := handle.SetRingBuffer(1<<22, 1<<22); err == nil {
+		t.Error("expected error setting a ring buffer too big for the kernel")
+	}
+	if len(handle.ring) != int(blockSize*blockCount) {
+		t.Errorf("mismatched ring size after a rejected ring, actual %d, expected %d", len(handle.ring), blockSize*blockCount)
+	}
+
+	// the new ring still captures
+	conn, port := udpSender(t)
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := handle.ReadPacketData()
+		read <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, _ = conn.Write([]byte("msg"))
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatalf("unexpected error reading packet: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet was not read")
+	}
+
+	if err := handle.SetRingBuffer(blockSize, blockCount); err == nil {
+		t.Error("expected error setting ring buffer after capture has started")
+	}
+}
+
+func Test_SetSnaplen(t *testing.T) {
+	payload := strings.Repeat("x", 200)
+	for _, syscalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive("lo", 64, false, 0, syscalls)
+			if err != nil {
+				t.Skipf("unable to open loopback for capture: %v", err)
+			}
+			defer handle.Close()
+			conn, port := udpSender(t)
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			if !syscalls {
+				// before capture has started, the ring grows to hold the bigger snaplen
+				blockSize := handle.blockSize
+				if err := handle.SetSnaplen(65535); err != nil {
+					t.Fatalf("unexpected error setting snaplen: %v", err)
+				}
+				if handle.blockSize <= blockSize || len(handle.ring) != handle.blockSize*handle.blockNumbers {
+					t.Errorf("ring was not rebuilt, block size %d, was %d, ring size %d", handle.blockSize, blockSize, len(handle.ring))
+				}
+			}
+			full := 42 + len(payload)
+			for _, snaplen := range []int32{1600, 64, 1600} {
+				if err := handle.SetSnaplen(snaplen); err != nil {
+					t.Fatalf("unexpected error setting snaplen %d: %v", snaplen, err)
+				}
+				expected := full
+				if int(snaplen) < full {
+					expected = int(snaplen)
+				}
+				_, _ = conn.Write([]byte(payload))
+				// loopback shows every packet twice
+				for _, p := range readPackets(t, handle, 2, 10*time.Second) {
+					if p.Info.CaptureLength != expected || len(p.B) != expected {
+						t.Errorf("snaplen %d: mismatched capture length %d and data length %d, expected %d", snaplen, p.Info.CaptureLength, len(p.B), expected)
+					}
+					// syscall reads do not report the original length yet
+					if !syscalls && p.Info.Length != full {
+						t.Errorf("snaplen %d: mismatched length %d, expected %d", snaplen, p.Info.Length, full)
+					}
+				}
+			}
+			if err := handle.SetSnaplen(0); err == nil {
+				t.Error("expected error for snaplen 0")
+			}
+		})
+	}
+	t.Run("grow after start", func(t *testing.T) {
+		handle, err := OpenLive("lo", 64, false, 0, false)
+		if err != nil {
+			t.Skipf("unable to open loopback for capture: %v", err)
+		}
+		defer handle.Close()
+		conn, port := udpSender(t)
+		if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", port)); err != nil {
+			t.Fatalf("unexpected error setting filter: %v", err)
+		}
+		_, _ = conn.Write([]byte(payload))
+		readPackets(t, handle, 1, 10*time.Second)
+		if err := handle.SetSnaplen(65535); err == nil {
+			t.Error("expected error growing the ring after capture has started")
+		}
+	})
+}
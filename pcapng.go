@@ -0,0 +1,362 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket"
+)
+
+// block types and options of the pcapng file format, see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngBlockSectionHeader        uint32 = 0x0a0d0d0a
+	pcapngBlockInterfaceDescription uint32 = 0x00000001
+	pcapngBlockSimplePacket         uint32 = 0x00000003
+	pcapngBlockNameResolution       uint32 = 0x00000004
+	pcapngBlockEnhancedPacket       uint32 = 0x00000006
+	pcapngByteOrderMagic            uint32 = 0x1a2b3c4d
+	pcapngVersionMajor              uint16 = 1
+	pcapngVersionMinor              uint16 = 0
+
+	pcapngOptionEnd              uint16 = 0
+	pcapngOptionInterfaceName    uint16 = 2
+	pcapngOptionInterfaceTsresol uint16 = 9
+	// pcapngTsresolNanoseconds timestamps are in units of 10^-9 seconds
+	pcapngTsresolNanoseconds uint8 = 9
+
+	pcapngRecordEnd  uint16 = 0
+	pcapngRecordIPv4 uint16 = 1
+	pcapngRecordIPv6 uint16 = 2
+
+	// pcapngMaxBlockSize the largest block we are willing to read, which is a record with room for its options
+	pcapngMaxBlockSize = 2 * pcapMaxRecordSize
+)
+
+// PcapngWriter writes packets to a pcapng file, which, unlike a classic libpcap file,
+// records which interface, and thus link type, each packet came from.
+type PcapngWriter struct {
+	w          io.Writer
+	order      binary.ByteOrder
+	interfaces int
+}
+
+// NewPcapngWriter create a PcapngWriter that emits a pcapng file to w. The section header
+// is written immediately; register interfaces with AddInterface before writing packets.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	endian, err := getEndianness()
+	if err != nil {
+		return nil, err
+	}
+	pw := &PcapngWriter{
+		w:     w,
+		order: endian,
+	}
+	body := make([]byte, 16)
+	pw.order.PutUint32(body[0:4], pcapngByteOrderMagic)
+	pw.order.PutUint16(body[4:6], pcapngVersionMajor)
+	pw.order.PutUint16(body[6:8], pcapngVersionMinor)
+	// the section length is unknown, since we are streaming
+	pw.order.PutUint64(body[8:16], 0xffffffffffffffff)
+	if err := pw.writeBlock(pcapngBlockSectionHeader, body); err != nil {
+		return nil, fmt.Errorf("unable to write pcapng section header: %w", err)
+	}
+	return pw, nil
+}
+
+// AddInterface register an interface with the given link type and name, returning the id
+// to use as CaptureInfo.InterfaceIndex for packets captured on it. Ids are assigned
+// in order, starting at 0.
+func (w *PcapngWriter) AddInterface(linkType uint32, name string) (ifaceID int, err error) {
+	if linkType > 0xffff {
+		return 0, fmt.Errorf("invalid link type for pcapng: %d", linkType)
+	}
+	// link type, reserved and snaplen, where a snaplen of 0 means no limit
+	body := make([]byte, 8)
+	w.order.PutUint16(body[0:2], uint16(linkType))
+	if name != "" {
+		body = w.appendOption(body, pcapngOptionInterfaceName, []byte(name))
+	}
+	body = w.appendOption(body, pcapngOptionInterfaceTsresol, []byte{pcapngTsresolNanoseconds})
+	body = w.appendOption(body, pcapngOptionEnd, nil)
+	if err := w.writeBlock(pcapngBlockInterfaceDescription, body); err != nil {
+		return 0, fmt.Errorf("unable to write pcapng interface description: %w", err)
+	}
+	ifaceID = w.interfaces
+	w.interfaces++
+	return ifaceID, nil
+}
+
+// AddNameResolution record that ip resolves to the given names, so that readers can show
+// names without looking them up again.
+func (w *PcapngWriter) AddNameResolution(ip net.IP, names ...string) error {
+	if len(names) == 0 {
+		return errors.New("no names to record")
+	}
+	recordType, addr := pcapngRecordIPv4, ip.To4()
+	if addr == nil {
+		recordType, addr = pcapngRecordIPv6, ip.To16()
+	}
+	if addr == nil {
+		return fmt.Errorf("invalid address: %v", ip)
+	}
+	value := append([]byte{}, addr...)
+	for _, name := range names {
+		value = append(append(value, name...), 0)
+	}
+	body := w.appendOption(nil, recordType, value)
+	body = w.appendOption(body, pcapngRecordEnd, nil)
+	if err := w.writeBlock(pcapngBlockNameResolution, body); err != nil {
+		return fmt.Errorf("unable to write pcapng name resolution: %w", err)
+	}
+	return nil
+}
+
+// WritePacket write a single packet as an enhanced packet block. ci.InterfaceIndex must
+// be an id returned by AddInterface.
+func (w *PcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.InterfaceIndex < 0 || ci.InterfaceIndex >= w.interfaces {
+		return fmt.Errorf("unknown interface id %d", ci.InterfaceIndex)
+	}
+	origlen := ci.Length
+	if origlen < len(data) {
+		origlen = len(data)
+	}
+	ts := uint64(ci.Timestamp.UnixNano())
+	body := make([]byte, 20, 20+len(data)+4)
+	w.order.PutUint32(body[0:4], uint32(ci.InterfaceIndex))
+	w.order.PutUint32(body[4:8], uint32(ts>>32))
+	w.order.PutUint32(body[8:12], uint32(ts))
+	w.order.PutUint32(body[12:16], uint32(len(data)))
+	w.order.PutUint32(body[16:20], uint32(origlen))
+	body = append(body, pcapngPad(data)...)
+	if err := w.writeBlock(pcapngBlockEnhancedPacket, body); err != nil {
+		return fmt.Errorf("unable to write pcapng packet: %w", err)
+	}
+	return nil
+}
+
+// appendOption append an option, or a name resolution record, which share the same layout:
+// 2 bytes of code, 2 bytes of length, and the value padded to 32 bits
+func (w *PcapngWriter) appendOption(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	w.order.PutUint16(hdr[0:2], code)
+	w.order.PutUint16(hdr[2:4], uint16(len(value)))
+	return append(append(b, hdr[:]...), pcapngPad(value)...)
+}
+
+// writeBlock write a block, which wraps the body in its type and total length
+func (w *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := make([]byte, total)
+	w.order.PutUint32(b[0:4], blockType)
+	w.order.PutUint32(b[4:8], total)
+	copy(b[8:], body)
+	w.order.PutUint32(b[total-4:], total)
+	_, err := w.w.Write(b)
+	return err
+}
+
+// pcapngPad pad b with zeroes to a multiple of 32 bits
+func pcapngPad(b []byte) []byte {
+	if pad := (4 - len(b)%4) % 4; pad > 0 {
+		return append(append([]byte{}, b...), make([]byte, pad)...)
+	}
+	return b
+}
+
+// pcapngInterface an interface of the section of a pcapng file that is being read
+type pcapngInterface struct {
+	linkType uint32
+	snaplen  uint32
+	// units how many units of its timestamps there are in a second
+	units uint64
+}
+
+// timestamp the time of a timestamp of the interface
+func (i pcapngInterface) timestamp(ts uint64) time.Time {
+	// the fraction of a second is less than units, so in nanoseconds it fits in 64 bits
+	hi, lo := bits.Mul64(ts%i.units, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, i.units)
+	return time.Unix(int64(ts/i.units), int64(nsec))
+}
+
+// openPcapng read the start of a pcapng file, up to its first interface, whose link type is that of the handle
+func (o *offlineReader) openPcapng() error {
+	o.ng = true
+	for len(o.interfaces) == 0 {
+		blockType, body, err := o.readPcapngBlock()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("pcapng file has no interfaces")
+			}
+			return fmt.Errorf("unable to read pcapng file header: %w", err)
+		}
+		switch blockType {
+		case pcapngBlockInterfaceDescription:
+			if err := o.addPcapngInterface(body); err != nil {
+				return err
+			}
+		case pcapngBlockEnhancedPacket, pcapngBlockSimplePacket:
+			return errors.New("pcapng packet before any interface")
+		}
+	}
+	o.linkType = o.interfaces[0].linkType
+	o.snaplen = o.interfaces[0].snaplen
+	return nil
+}
+
+// readPcapngRecord read the blocks of a pcapng file up to the next packet, keeping track of the interfaces
+func (o *offlineReader) readPcapngRecord() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		blockType, body, err := o.readPcapngBlock()
+		if err != nil {
+			return nil, ci, err
+		}
+		switch blockType {
+		case pcapngBlockInterfaceDescription:
+			if err := o.addPcapngInterface(body); err != nil {
+				return nil, ci, err
+			}
+		case pcapngBlockEnhancedPacket:
+			return o.pcapngEnhancedPacket(body)
+		case pcapngBlockSimplePacket:
+			return o.pcapngSimplePacket(body)
+		}
+		// anything else, e.g. name resolution or statistics, is not a packet
+	}
+}
+
+// readPcapngBlock read the type and body of the next block. A section header sets the byte order of
+// the blocks of its section, which has interfaces of its own.
+func (o *offlineReader) readPcapngBlock() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(o.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated pcapng block header: %w", err)
+		}
+		return 0, nil, err
+	}
+	// the type of the section header reads the same in either byte order, so it can come first
+	if binary.LittleEndian.Uint32(hdr[0:4]) == pcapngBlockSectionHeader {
+		magic, err := o.r.Peek(4)
+		if err != nil {
+			return 0, nil, fmt.Errorf("truncated pcapng section header: %w", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+			o.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+			o.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("unknown pcapng byte order magic %#x", magic)
+		}
+		o.interfaces = nil
+	}
+	blockType, total := o.order.Uint32(hdr[0:4]), o.order.Uint32(hdr[4:8])
+	if total < 12 || total%4 != 0 || total > pcapngMaxBlockSize {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", total)
+	}
+	// the body, then the length again
+	body := make([]byte, total-8)
+	if _, err := io.ReadFull(o.r, body); err != nil {
+		return 0, nil, fmt.Errorf("truncated pcapng block: %w", err)
+	}
+	return blockType, body[:len(body)-4], nil
+}
+
+// addPcapngInterface add the interface of an interface description block, whose id is the next one
+func (o *offlineReader) addPcapngInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("truncated pcapng interface description")
+	}
+	iface := pcapngInterface{
+		linkType: uint32(o.order.Uint16(body[0:2])),
+		snaplen:  o.order.Uint32(body[4:8]),
+		// microseconds, unless it says otherwise
+		units: 1e6,
+	}
+	for options := body[8:]; len(options) >= 4; {
+		code, length := o.order.Uint16(options[0:2]), int(o.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			break
+		}
+		if code == pcapngOptionInterfaceTsresol && length == 1 {
+			// a power of 10, or, with the top bit set, of 2
+			resolution := options[4]
+			switch {
+			case resolution&0x80 != 0 && resolution&0x7f < 64:
+				iface.units = 1 << (resolution & 0x7f)
+			case resolution&0x80 == 0 && resolution < 20:
+				iface.units = 1
+				for ; resolution > 0; resolution-- {
+					iface.units *= 10
+				}
+			default:
+				return fmt.Errorf("invalid pcapng timestamp resolution %#x", resolution)
+			}
+		}
+		// the value is padded to 32 bits
+		if padded := 4 + (length+3)&^3; padded < len(options) {
+			options = options[padded:]
+		} else {
+			break
+		}
+	}
+	o.interfaces = append(o.interfaces, iface)
+	return nil
+}
+
+// pcapngEnhancedPacket the packet of an enhanced packet block, which says which interface it came from
+func (o *offlineReader) pcapngEnhancedPacket(body []byte) ([]byte, gopacket.CaptureInfo, error) {
+	if len(body) < 20 {
+		return nil, gopacket.CaptureInfo{}, errors.New("truncated pcapng packet")
+	}
+	var (
+		id      = o.order.Uint32(body[0:4])
+		ts      = uint64(o.order.Uint32(body[4:8]))<<32 | uint64(o.order.Uint32(body[8:12]))
+		caplen  = o.order.Uint32(body[12:16])
+		origlen = o.order.Uint32(body[16:20])
+	)
+	if id >= uint32(len(o.interfaces)) {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("pcapng packet of unknown interface %d", id)
+	}
+	if caplen > uint32(len(body)-20) {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("pcapng packet length %d longer than its block", caplen)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:      o.interfaces[id].timestamp(ts),
+		CaptureLength:  int(caplen),
+		Length:         int(origlen),
+		InterfaceIndex: int(id),
+	}
+	return body[20 : 20+caplen], ci, nil
+}
+
+// pcapngSimplePacket the packet of a simple packet block, which is of the first interface, and has no timestamp
+func (o *offlineReader) pcapngSimplePacket(body []byte) ([]byte, gopacket.CaptureInfo, error) {
+	if len(body) < 4 {
+		return nil, gopacket.CaptureInfo{}, errors.New("truncated pcapng packet")
+	}
+	if len(o.interfaces) == 0 {
+		return nil, gopacket.CaptureInfo{}, errors.New("pcapng packet before any interface")
+	}
+	origlen := o.order.Uint32(body[0:4])
+	// the captured length is what is left of the block, but no more than the snaplen or the packet
+	caplen := uint32(len(body) - 4)
+	if snaplen := o.interfaces[0].snaplen; snaplen > 0 && snaplen < caplen {
+		caplen = snaplen
+	}
+	if origlen < caplen {
+		caplen = origlen
+	}
+	ci := gopacket.CaptureInfo{
+		CaptureLength: int(caplen),
+		Length:        int(origlen),
+	}
+	return body[4 : 4+caplen], ci, nil
+}
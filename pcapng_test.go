@@ -0,0 +1,229 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	interfaces := []struct {
+		linkType uint32
+		name     string
+	}{
+		{LinkTypeEthernet, "eth0"},
+		{113, "any"},
+	}
+	for i, iface := range interfaces {
+		id, err := w.AddInterface(iface.linkType, iface.name)
+		if err != nil {
+			t.Fatalf("%d: unexpected error adding interface: %v", i, err)
+		}
+		if id != i {
+			t.Errorf("%d: mismatched interface id, actual %d, expected %d", i, id, i)
+		}
+	}
+	if err := w.AddNameResolution(net.ParseIP("10.100.100.100"), "host.example.com"); err != nil {
+		t.Fatalf("unexpected error adding name resolution: %v", err)
+	}
+	for i, r := range testRecords {
+		ci := gopacket.CaptureInfo{Timestamp: r.ts, CaptureLength: len(r.data), Length: r.length, InterfaceIndex: i % len(interfaces)}
+		if err := w.WritePacket(ci, r.data); err != nil {
+			t.Fatalf("%d: unexpected error writing packet: %v", i, err)
+		}
+	}
+	if err := w.WritePacket(gopacket.CaptureInfo{InterfaceIndex: len(interfaces)}, []byte{0x01}); err == nil {
+		t.Error("expected error writing packet for unknown interface")
+	}
+
+	// gopacket has its own independent pcapng reader, so use that to check our output
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		t.Fatalf("unexpected error reading pcapng: %v", err)
+	}
+	for i, r2 := range testRecords {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%d: unexpected error reading packet: %v", i, err)
+		}
+		if !bytes.Equal(data, r2.data) {
+			t.Errorf("%d: mismatched data, actual %x, expected %x", i, data, r2.data)
+		}
+		if !ci.Timestamp.Equal(r2.ts) {
+			t.Errorf("%d: mismatched timestamp, actual %v, expected %v", i, ci.Timestamp, r2.ts)
+		}
+		if ci.Length != r2.length {
+			t.Errorf("%d: mismatched length, actual %d, expected %d", i, ci.Length, r2.length)
+		}
+		if ci.InterfaceIndex != i%len(interfaces) {
+			t.Errorf("%d: mismatched interface, actual %d, expected %d", i, ci.InterfaceIndex, i%len(interfaces))
+		}
+	}
+	if n := r.NInterfaces(); n != len(interfaces) {
+		t.Fatalf("mismatched interface count, actual %d, expected %d", n, len(interfaces))
+	}
+	for i, iface := range interfaces {
+		ngIface, err := r.Interface(i)
+		if err != nil {
+			t.Fatalf("%d: unexpected error getting interface: %v", i, err)
+		}
+		if ngIface.Name != iface.name {
+			t.Errorf("%d: mismatched name, actual %s, expected %s", i, ngIface.Name, iface.name)
+		}
+		if ngIface.LinkType != layers.LinkType(iface.linkType) {
+			t.Errorf("%d: mismatched link type, actual %d, expected %d", i, ngIface.LinkType, iface.linkType)
+		}
+		if ngIface.TimestampResolution != 9 {
+			t.Errorf("%d: mismatched timestamp resolution, actual %d, expected 9", i, ngIface.TimestampResolution)
+		}
+	}
+}
+
+// buildPcapng build a pcapng file of the records with our writer, alternating between interfaces of the link types
+func buildPcapng(t *testing.T, records []testRecord, linkTypes ...uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	for i, linkType := range linkTypes {
+		if _, err := w.AddInterface(linkType, fmt.Sprintf("eth%d", i)); err != nil {
+			t.Fatalf("%d: unexpected error adding interface: %v", i, err)
+		}
+	}
+	for i, r := range records {
+		ci := gopacket.CaptureInfo{Timestamp: r.ts, CaptureLength: len(r.data), Length: r.length, InterfaceIndex: i % len(linkTypes)}
+		if err := w.WritePacket(ci, r.data); err != nil {
+			t.Fatalf("%d: unexpected error writing packet: %v", i, err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestOpenOfflinePcapng(t *testing.T) {
+	h, err := OpenOfflineReader(bytes.NewReader(buildPcapng(t, testRecords, LinkTypeEthernet, LinkTypeEthernet)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	if lt := h.LinkType(); lt != LinkTypeEthernet {
+		t.Errorf("mismatched link type, actual %d, expected %d", lt, LinkTypeEthernet)
+	}
+	for i, r := range testRecords {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(data, r.data) {
+			t.Errorf("%d: mismatched data, actual %x, expected %x", i, data, r.data)
+		}
+		if !ci.Timestamp.Equal(r.ts) {
+			t.Errorf("%d: mismatched timestamp, actual %v, expected %v", i, ci.Timestamp, r.ts)
+		}
+		if ci.CaptureLength != len(r.data) || ci.Length != r.length {
+			t.Errorf("%d: mismatched lengths, actual %d/%d, expected %d/%d", i, ci.CaptureLength, ci.Length, len(r.data), r.length)
+		}
+		if ci.InterfaceIndex != i%2 {
+			t.Errorf("%d: mismatched interface, actual %d, expected %d", i, ci.InterfaceIndex, i%2)
+		}
+	}
+	if _, _, err := h.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected io.EOF after last packet, got %v", err)
+	}
+}
+
+// TestOpenOfflinePcapngGopacket read a file of the independent pcapng writer of gopacket, in microseconds
+func TestOpenOfflinePcapngGopacket(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriterInterface(&buf, pcapgo.NgInterface{LinkType: layers.LinkTypeEthernet, TimestampResolution: 6}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	for i, r := range testRecords {
+		if err := w.WritePacket(gopacket.CaptureInfo{Timestamp: r.ts, CaptureLength: len(r.data), Length: r.length}, r.data); err != nil {
+			t.Fatalf("%d: unexpected error writing packet: %v", i, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := OpenOfflineReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	checkRecords(t, h, testRecords)
+}
+
+func TestFilterByInterface(t *testing.T) {
+	var records []testRecord
+	for i := 0; i < 6; i++ {
+		records = append(records, testRecord{time.Unix(1600000000+int64(i), 0), []byte{byte(i)}, 1})
+	}
+	tests := []struct {
+		name      string
+		linkTypes []uint32
+		index     int
+		expected  []byte
+	}{
+		{"first", []uint32{LinkTypeEthernet, LinkTypeEthernet}, 0, []byte{0, 2, 4}},
+		{"second", []uint32{LinkTypeEthernet, LinkTypeEthernet}, 1, []byte{1, 3, 5}},
+		{"all", []uint32{LinkTypeEthernet, LinkTypeEthernet}, -1, []byte{0, 1, 2, 3, 4, 5}},
+		{"none", []uint32{LinkTypeEthernet, LinkTypeEthernet}, 2, nil},
+		// the packets of the other link type are not read, so they do not fail
+		{"other link type", []uint32{LinkTypeEthernet, 113}, 0, []byte{0, 2, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := OpenOfflineReader(bytes.NewReader(buildPcapng(t, records, tt.linkTypes...)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer h.Close()
+			if err := h.FilterByInterface(tt.index); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual []byte
+			for {
+				data, ci, err := h.ReadPacketData()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tt.index >= 0 && ci.InterfaceIndex != tt.index {
+					t.Errorf("mismatched interface, actual %d, expected %d", ci.InterfaceIndex, tt.index)
+				}
+				actual = append(actual, data...)
+			}
+			if !bytes.Equal(actual, tt.expected) {
+				t.Errorf("mismatched packets, actual %v, expected %v", actual, tt.expected)
+			}
+		})
+	}
+	h, err := OpenOfflineReader(bytes.NewReader(buildPcapng(t, records, LinkTypeEthernet, 113)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Close()
+	if _, _, err := h.ReadPacketData(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := h.ReadPacketData(); err == nil {
+		t.Error("expected error reading a packet of another link type")
+	}
+}
@@ -1,11 +1,17 @@
 package pcap
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
 	"net"
 	"path"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -109,3 +115,560 @@ func runPublisher(t *testing.T, dstAddr net.IP, wg *sync.WaitGroup, keepGoing *a
 
 	return port
 }
+
+// loopbackInterface the name of the loopback interface, skipping the test if there is none
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("unable to list interfaces: %v", err)
+	}
+	for _, in := range ifaces {
+		if in.Flags&net.FlagLoopback != 0 {
+			return in.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func Test_SetBufferTimeout(t *testing.T) {
+	iface := loopbackInterface(t)
+	// mmap only is on linux
+	modes := []bool{true}
+	if runtime.GOOS == "linux" {
+		modes = append(modes, false)
+	}
+	const timeout = 100 * time.Millisecond
+	for _, syscalls := range modes {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive(iface, 1600, false, 0, syscalls)
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", iface, err)
+			}
+			defer handle.Close()
+			// nothing is sent to the discard port, so the interface is idle as far as the handle sees
+			if err := handle.SetBPFFilter("udp and port 9"); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			if err := handle.SetBufferTimeout(-time.Second); err == nil {
+				t.Error("negative buffer timeout did not error")
+			}
+			if err := handle.SetBufferTimeout(timeout); err != nil {
+				t.Fatalf("unexpected error setting buffer timeout: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				start := time.Now()
+				data, _, err := handle.ReadPacketData()
+				elapsed := time.Since(start)
+				if err != nil {
+					t.Fatalf("unexpected error reading: %v", err)
+				}
+				if data != nil {
+					t.Fatalf("read %d bytes on an idle interface", len(data))
+				}
+				if elapsed > 10*timeout {
+					t.Errorf("read took %v, more than the buffer timeout of %v", elapsed, timeout)
+				}
+			}
+		})
+	}
+}
+
+func Test_InterfaceLoopback(t *testing.T) {
+	iface := loopbackInterface(t)
+	expected, err := net.InterfaceByName(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := map[string]func() (*Handle, error){
+		"by name": func() (*Handle, error) {
+			return OpenLive(iface, 1600, false, 0, true)
+		},
+		"by index": func() (*Handle, error) {
+			return OpenLiveByIndex(expected.Index, 1600, false, 0, true)
+		},
+	}
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			handle, err := open()
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", iface, err)
+			}
+			defer handle.Close()
+			in, err := handle.Interface()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if in.Name != iface || in.Index != expected.Index {
+				t.Errorf("mismatched interface, actual %s %d, expected %s %d", in.Name, in.Index, iface, expected.Index)
+			}
+		})
+	}
+}
+
+func Test_OpenLiveMultiInterfaceIndex(t *testing.T) {
+	iface := loopbackInterface(t)
+	in, err := net.InterfaceByName(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handle, err := OpenLiveMulti(context.Background(), []string{iface}, 1600, false, 100*time.Millisecond, true)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", iface, err)
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", l.LocalAddr().(*net.UDPAddr).Port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	if _, err := conn.Write([]byte(tstMsg)); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if data == nil {
+			continue
+		}
+		// each packet is tagged with the interface it was captured on
+		if ci.InterfaceIndex != in.Index {
+			t.Errorf("mismatched interface index, actual %d, expected %d", ci.InterfaceIndex, in.Index)
+		}
+		return
+	}
+	t.Error("no packet read")
+}
+
+func Test_SetReadDeadline(t *testing.T) {
+	iface := loopbackInterface(t)
+	// mmap only is on linux
+	modes := []bool{true}
+	if runtime.GOOS == "linux" {
+		modes = append(modes, false)
+	}
+	const timeout = 100 * time.Millisecond
+	open := map[string]func(syscalls bool) (*Handle, error){
+		"single": func(syscalls bool) (*Handle, error) {
+			return OpenLive(iface, 1600, false, 0, syscalls)
+		},
+		"multi": func(syscalls bool) (*Handle, error) {
+			return OpenLiveMulti(context.Background(), []string{iface}, 1600, false, 0, syscalls)
+		},
+	}
+	for name, open := range open {
+		for _, syscalls := range modes {
+			t.Run(fmt.Sprintf("%s syscalls=%v", name, syscalls), func(t *testing.T) {
+				handle, err := open(syscalls)
+				if err != nil {
+					t.Fatalf("unable to open %s: %v", iface, err)
+				}
+				defer handle.Close()
+				// nothing is sent to the discard port, so the interface is idle as far as the handle sees
+				if err := handle.SetBPFFilter("udp and port 9"); err != nil {
+					t.Fatalf("unexpected error setting filter: %v", err)
+				}
+				if err := handle.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+					t.Fatalf("unexpected error setting read deadline: %v", err)
+				}
+				start := time.Now()
+				data, _, err := handle.ReadPacketData()
+				elapsed := time.Since(start)
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("mismatched error, actual %v, expected %v", err, context.DeadlineExceeded)
+				}
+				if data != nil {
+					t.Errorf("read %d bytes on an idle interface", len(data))
+				}
+				if elapsed < timeout/2 || elapsed > 10*timeout {
+					t.Errorf("read took %v, rather than the read deadline of %v", elapsed, timeout)
+				}
+				// once it has passed, reads fail straight away
+				start = time.Now()
+				if _, _, err := handle.ReadPacketData(); !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("mismatched error after the deadline, actual %v, expected %v", err, context.DeadlineExceeded)
+				}
+				if elapsed := time.Since(start); elapsed > timeout {
+					t.Errorf("read after the deadline took %v", elapsed)
+				}
+				// clearing it leaves the buffer timeout, which returns no packet rather than an error
+				if err := handle.SetReadDeadline(time.Time{}); err != nil {
+					t.Fatalf("unexpected error clearing read deadline: %v", err)
+				}
+				if err := handle.SetBufferTimeout(timeout); err != nil {
+					t.Fatalf("unexpected error setting buffer timeout: %v", err)
+				}
+				if data, _, err := handle.ReadPacketData(); err != nil || data != nil {
+					t.Errorf("mismatched read without a deadline, data %v error %v, expected neither", data, err)
+				}
+			})
+		}
+	}
+}
+
+func Test_Flush(t *testing.T) {
+	iface := loopbackInterface(t)
+	// mmap only is on linux
+	modes := []bool{true}
+	if runtime.GOOS == "linux" {
+		modes = append(modes, false)
+	}
+	for _, syscalls := range modes {
+		// right away, the packets still are in what the kernel is filling, and after a while, it has handed them over
+		for _, wait := range []time.Duration{0, 100 * time.Millisecond} {
+			t.Run(fmt.Sprintf("syscalls=%v wait=%v", syscalls, wait), func(t *testing.T) {
+				l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				conn, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				handle, err := OpenLive(iface, 1600, false, 0, syscalls)
+				if err != nil {
+					t.Fatalf("unable to open %s: %v", iface, err)
+				}
+				defer handle.Close()
+				if err := handle.SetBPFFilter(fmt.Sprintf("udp and dst port %d", l.LocalAddr().(*net.UDPAddr).Port)); err != nil {
+					t.Fatalf("unexpected error setting filter: %v", err)
+				}
+				if err := handle.SetBufferTimeout(100 * time.Millisecond); err != nil {
+					t.Fatalf("unexpected error setting buffer timeout: %v", err)
+				}
+				send := func(payload string, count int) {
+					for i := 0; i < count; i++ {
+						if _, err := conn.Write([]byte(payload)); err != nil {
+							t.Fatalf("unable to send: %v", err)
+						}
+					}
+				}
+				send("before flush", 5)
+				time.Sleep(wait)
+				if err := handle.Flush(); err != nil {
+					t.Fatalf("unexpected error flushing: %v", err)
+				}
+				send("after flush", 3)
+				var after int
+				for deadline := time.Now().Add(2 * time.Second); after < 3 && time.Now().Before(deadline); {
+					data, _, err := handle.ReadPacketData()
+					if err != nil {
+						t.Fatalf("unexpected error reading: %v", err)
+					}
+					switch {
+					case bytes.HasSuffix(data, []byte("before flush")):
+						t.Error("read a packet captured before the flush")
+					case bytes.HasSuffix(data, []byte("after flush")):
+						after++
+					}
+				}
+				if after != 3 {
+					t.Errorf("mismatched packets after the flush, actual %d, expected %d", after, 3)
+				}
+			})
+		}
+	}
+}
+
+func Test_SetBPFFilterInstructions(t *testing.T) {
+	iface := loopbackInterface(t)
+	handle, err := OpenLive(iface, 1600, false, 0, true)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", iface, err)
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilterInstructions([]bpf.Instruction{bpf.LoadAbsolute{Off: 0, Size: 3}}); err == nil {
+		t.Error("invalid program did not error")
+	}
+	if err := handle.SetBPFFilterInstructions(nil); err == nil {
+		t.Error("empty program did not error")
+	}
+	accept := []bpf.Instruction{bpf.RetConstant{Val: 0x40000}}
+	if err := handle.SetBPFFilterInstructions(accept); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	if program := handle.FilterProgram(); !reflect.DeepEqual(program, accept) {
+		t.Errorf("mismatched filter program, actual %v, expected %v", program, accept)
+	}
+	if err := handle.SetBufferTimeout(100 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error setting buffer timeout: %v", err)
+	}
+	keepGoing := atomic.Bool{}
+	keepGoing.Store(true)
+	wg := &sync.WaitGroup{}
+	runPublisher(t, net.ParseIP("127.0.0.1"), wg, &keepGoing)
+	defer func() {
+		keepGoing.Store(false)
+		wg.Wait()
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		data, _, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if bytes.Contains(data, []byte(tstMsg)) {
+			return
+		}
+	}
+	t.Error("did not capture any of the packets sent")
+}
+
+func Test_SetBPFFilterQueued(t *testing.T) {
+	iface := loopbackInterface(t)
+	// mmap only is on linux
+	modes := []bool{true}
+	if runtime.GOOS == "linux" {
+		modes = append(modes, false)
+	}
+	for _, syscalls := range modes {
+		t.Run(fmt.Sprintf("syscalls=%v", syscalls), func(t *testing.T) {
+			handle, err := OpenLive(iface, 1600, false, 0, syscalls)
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", iface, err)
+			}
+			defer handle.Close()
+			if err := handle.SetBufferTimeout(100 * time.Millisecond); err != nil {
+				t.Fatalf("unexpected error setting buffer timeout: %v", err)
+			}
+			var ports []int
+			for i := 0; i < 2; i++ {
+				conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatalf("unable to listen: %v", err)
+				}
+				defer conn.Close()
+				ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+			}
+			send := func() {
+				for _, port := range ports {
+					conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+					if err != nil {
+						t.Fatalf("unable to dial: %v", err)
+					}
+					_, _ = conn.Write([]byte(tstMsg))
+					conn.Close()
+				}
+			}
+			// packets to both ports are queued before the filter is set, and must not be read after it
+			send()
+			if err := handle.SetBPFFilter(fmt.Sprintf("udp port %d", ports[0])); err != nil {
+				t.Fatalf("unexpected error setting filter: %v", err)
+			}
+			send()
+			var matched int
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+				data, _, err := handle.ReadPacketData()
+				if err != nil {
+					t.Fatalf("unexpected error reading: %v", err)
+				}
+				if data == nil {
+					continue
+				}
+				packet := gopacket.NewPacket(data, layers.LinkType(handle.LinkType()), gopacket.Default)
+				udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+				if !ok || (int(udp.SrcPort) != ports[0] && int(udp.DstPort) != ports[0]) {
+					t.Fatalf("read a packet that does not match the filter: %v", packet)
+				}
+				matched++
+			}
+			if matched == 0 {
+				t.Error("did not capture any of the matching packets")
+			}
+		})
+	}
+}
+
+func Test_Subscribe(t *testing.T) {
+	iface := loopbackInterface(t)
+	handle, err := OpenLive(iface, 1600, false, 0, true)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", iface, err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			handle.Close()
+		}
+	}()
+	if err := handle.SetBufferTimeout(100 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error setting buffer timeout: %v", err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if err := handle.SetBPFFilter(fmt.Sprintf("udp port %d", port)); err != nil {
+		t.Fatalf("unexpected error setting filter: %v", err)
+	}
+	subscribers := []<-chan Packet{handle.Subscribe(), handle.Subscribe()}
+
+	const count = 5
+	send, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer send.Close()
+	for i := 0; i < count; i++ {
+		_, _ = send.Write([]byte(fmt.Sprintf("%s %d", tstMsg, i)))
+	}
+
+	// each subscriber gets every packet, in the same order, up to the last one sent
+	received := make([][][]byte, len(subscribers))
+	for i, c := range subscribers {
+		timeout := time.After(5 * time.Second)
+	packets:
+		for {
+			select {
+			case p, ok := <-c:
+				if !ok {
+					t.Fatalf("subscriber %d: closed early", i)
+				}
+				received[i] = append(received[i], p.B)
+				if bytes.Contains(p.B, []byte(fmt.Sprintf("%s %d", tstMsg, count-1))) {
+					break packets
+				}
+			case <-timeout:
+				t.Fatalf("subscriber %d: did not receive all of the packets, only %d", i, len(received[i]))
+			}
+		}
+	}
+	if !reflect.DeepEqual(received[0], received[1]) {
+		t.Fatalf("subscribers received different packets\nfirst : %v\nsecond: %v", received[0], received[1])
+	}
+	for i := 0; i < count; i++ {
+		msg := []byte(fmt.Sprintf("%s %d", tstMsg, i))
+		if !bytes.Contains(bytes.Join(received[0], nil), msg) {
+			t.Errorf("packet %d was not received", i)
+		}
+	}
+	// each has its own copy
+	received[0][0][0] ^= 0xff
+	if received[0][0][0] == received[1][0][0] {
+		t.Error("subscribers share the packet data")
+	}
+
+	// both are closed with the handle
+	handle.Close()
+	closed = true
+	for _, c := range subscribers {
+		for range c {
+		}
+	}
+	if _, ok := <-handle.Subscribe(); ok {
+		t.Error("subscribing after close did not return a closed channel")
+	}
+}
+
+func Test_InactiveHandle(t *testing.T) {
+	iface := loopbackInterface(t)
+	invalid := NewInactiveHandle(iface)
+	if invalid.SetSnapLen(0) == nil || invalid.SetTimeout(-time.Second) == nil || invalid.SetBufferSize(-1) == nil {
+		t.Error("invalid setting did not error")
+	}
+	if _, err := NewInactiveHandle("nosuchinterface0").Activate(); err == nil {
+		t.Error("activating on an unknown interface did not error")
+	}
+	// mmap only is on linux
+	modes := []bool{true}
+	if runtime.GOOS == "linux" {
+		modes = append(modes, false)
+	}
+	tests := []struct {
+		name      string
+		snaplen   int32
+		promisc   bool
+		timeout   time.Duration
+		immediate bool
+		size      int
+	}{
+		{name: "defaults"},
+		{name: "snaplen", snaplen: 64},
+		{name: "promiscuous", promisc: true, timeout: 100 * time.Millisecond},
+		{name: "immediate", immediate: true, size: 1 << 20},
+		{name: "all", snaplen: 1600, promisc: true, timeout: 100 * time.Millisecond, immediate: true, size: 1 << 20},
+	}
+	for _, syscalls := range modes {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/syscalls=%v", tt.name, syscalls), func(t *testing.T) {
+				conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatalf("unable to listen: %v", err)
+				}
+				defer conn.Close()
+				p := NewInactiveHandle(iface)
+				if tt.snaplen != 0 {
+					if err := p.SetSnapLen(tt.snaplen); err != nil {
+						t.Fatalf("unexpected error setting snaplen: %v", err)
+					}
+				}
+				if err := p.SetTimeout(tt.timeout); err != nil {
+					t.Fatalf("unexpected error setting timeout: %v", err)
+				}
+				if err := p.SetBufferSize(tt.size); err != nil {
+					t.Fatalf("unexpected error setting buffer size: %v", err)
+				}
+				_ = p.SetPromisc(tt.promisc)
+				_ = p.SetImmediateMode(tt.immediate)
+				_ = p.SetSyscalls(syscalls)
+				p.SetOptions(WithFilter(fmt.Sprintf("udp port %d", conn.LocalAddr().(*net.UDPAddr).Port)))
+				handle, err := p.Activate()
+				if err != nil {
+					t.Fatalf("unable to activate: %v", err)
+				}
+				defer handle.Close()
+				if tt.timeout > 0 {
+					// nothing has been sent yet, so the read gives up
+					start := time.Now()
+					data, _, err := handle.ReadPacketData()
+					if data != nil || err != nil {
+						t.Fatalf("read before sending returned %d bytes, error %v", len(data), err)
+					}
+					if elapsed := time.Since(start); elapsed > tt.timeout+time.Second {
+						t.Errorf("read took %v, with a timeout of %v", elapsed, tt.timeout)
+					}
+				}
+				keepGoing := atomic.Bool{}
+				keepGoing.Store(true)
+				defer keepGoing.Store(false)
+				go func() {
+					send, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+					if err != nil {
+						return
+					}
+					defer send.Close()
+					for keepGoing.Load() {
+						_, _ = send.Write([]byte(tstMsg))
+						time.Sleep(time.Millisecond)
+					}
+				}()
+				var data []byte
+				for data == nil {
+					if data, _, err = handle.ReadPacketData(); err != nil {
+						t.Fatalf("unexpected error reading: %v", err)
+					}
+				}
+				switch {
+				case tt.snaplen != 0 && len(data) > int(tt.snaplen):
+					t.Errorf("read %d bytes, more than the snaplen of %d", len(data), tt.snaplen)
+				case tt.snaplen == 0 && !bytes.Contains(data, []byte(tstMsg)):
+					t.Errorf("whole packet was not captured: %x", data)
+				}
+			})
+		}
+	}
+}
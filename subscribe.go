@@ -0,0 +1,58 @@
+package pcap
+
+import "sync"
+
+// Subscribe return a new channel that gets every packet captured from now on, like Listen, so that
+// independent consumers, e.g. a logger and an analyzer, each can have them. The first call starts
+// listening, and each packet is sent, as its own copy, to every subscriber, so a slow one holds up
+// the rest. The channels are closed once the handle is closed, or at the end of the file, after which
+// Error tells why, and any later Subscribe returns one that is closed already. Do not also call Listen
+// or read from the handle directly.
+func (h *Handle) Subscribe() <-chan Packet {
+	h.subscribers.CompareAndSwap(nil, &broadcaster{})
+	b := h.subscribers.Load().(*broadcaster)
+
+	c := make(chan Packet, 50)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.done:
+		close(c)
+	case b.channels == nil:
+		b.channels = []chan Packet{c}
+		go b.broadcast(h.Listen())
+	default:
+		b.channels = append(b.channels, c)
+	}
+	return c
+}
+
+// broadcaster sends the packets of one Listen to all of the subscribers
+type broadcaster struct {
+	mu       sync.Mutex
+	channels []chan Packet
+	// done whether the Listen channel was closed, and so too all of the subscribers
+	done bool
+}
+
+// broadcast send each packet from in to every subscriber, until in is closed, and then close them
+func (b *broadcaster) broadcast(in <-chan Packet) {
+	for p := range in {
+		b.mu.Lock()
+		channels := b.channels
+		b.mu.Unlock()
+		for _, c := range channels {
+			sent := p
+			if p.B != nil {
+				sent.B = append([]byte(nil), p.B...)
+			}
+			c <- sent
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+	for _, c := range b.channels {
+		close(c)
+	}
+}
@@ -0,0 +1,72 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gopacket/gopacket"
+)
+
+const (
+	pcapVersionMajor uint16 = 2
+	pcapVersionMinor uint16 = 4
+)
+
+// Writer writes packets to a classic libpcap file, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+type Writer struct {
+	w       io.Writer
+	order   binary.ByteOrder
+	snaplen uint32
+}
+
+// NewWriter create a Writer that emits a classic libpcap file to w, with microsecond
+// timestamps. The global header is written immediately.
+func NewWriter(w io.Writer, linkType uint32, snaplen uint32) (*Writer, error) {
+	// like libpcap, we write in our native byte order; readers use the magic number to tell
+	endian, err := getEndianness()
+	if err != nil {
+		return nil, err
+	}
+	pw := &Writer{
+		w:       w,
+		order:   endian,
+		snaplen: snaplen,
+	}
+	var hdr [pcapGlobalHeaderSize]byte
+	pw.order.PutUint32(hdr[0:4], pcapMagicMicroseconds)
+	pw.order.PutUint16(hdr[4:6], pcapVersionMajor)
+	pw.order.PutUint16(hdr[6:8], pcapVersionMinor)
+	// thiszone and sigfigs always are 0
+	pw.order.PutUint32(hdr[16:20], snaplen)
+	pw.order.PutUint32(hdr[20:24], linkType)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("unable to write pcap file header: %w", err)
+	}
+	return pw, nil
+}
+
+// WritePacket write a single packet record. ci and data can be passed straight from
+// Handle.ReadPacketData. Data longer than the snaplen is truncated.
+func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	caplen := uint32(len(data))
+	if w.snaplen > 0 && caplen > w.snaplen {
+		caplen = w.snaplen
+	}
+	origlen := uint32(ci.Length)
+	if origlen < caplen {
+		origlen = caplen
+	}
+	var hdr [pcapRecordHeaderSize]byte
+	w.order.PutUint32(hdr[0:4], uint32(ci.Timestamp.Unix()))
+	w.order.PutUint32(hdr[4:8], uint32(ci.Timestamp.Nanosecond()/1000))
+	w.order.PutUint32(hdr[8:12], caplen)
+	w.order.PutUint32(hdr[12:16], origlen)
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("unable to write pcap record header: %w", err)
+	}
+	if _, err := w.w.Write(data[:caplen]); err != nil {
+		return fmt.Errorf("unable to write pcap record: %w", err)
+	}
+	return nil
+}
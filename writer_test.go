@@ -0,0 +1,40 @@
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(f, LinkTypeEthernet, 65535)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	for i, r := range testRecords {
+		ci := gopacket.CaptureInfo{Timestamp: r.ts, CaptureLength: len(r.data), Length: r.length}
+		if err := w.WritePacket(ci, r.data); err != nil {
+			t.Fatalf("%d: unexpected error writing packet: %v", i, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := OpenOffline(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening file: %v", err)
+	}
+	defer h.Close()
+	if lt := h.LinkType(); lt != LinkTypeEthernet {
+		t.Errorf("mismatched link type, actual %d, expected %d", lt, LinkTypeEthernet)
+	}
+	checkRecords(t, h, testRecords)
+}